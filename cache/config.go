@@ -23,12 +23,13 @@ type coordsCacheOptions struct {
 	BunchCacheCapacity int
 }
 type osmCacheOptions struct {
-	Coords      coordsCacheOptions
-	Ways        cacheOptions
-	Nodes       cacheOptions
-	Relations   cacheOptions
-	CoordsIndex cacheOptions
-	WaysIndex   cacheOptions
+	Coords         coordsCacheOptions
+	Ways           cacheOptions
+	Nodes          cacheOptions
+	Relations      cacheOptions
+	CoordsIndex    cacheOptions
+	WaysIndex      cacheOptions
+	RelationsIndex cacheOptions
 }
 
 const defaultConfig = `
@@ -82,6 +83,14 @@ const defaultConfig = `
         "MaxOpenFiles": 64,
         "MaxFileSizeM": 8,
         "BlockRestartInterval": 128
+    },
+    "RelationsIndex": {
+        "CacheSizeM": 8,
+        "WriteBufferSizeM": 32,
+        "BlockSizeK": 0,
+        "MaxOpenFiles": 64,
+        "MaxFileSizeM": 8,
+        "BlockRestartInterval": 128
     }
 }
 `
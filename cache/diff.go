@@ -20,6 +20,7 @@ type DiffCache struct {
 	Coords    *CoordsRefIndex    // Stores which ways a coord references
 	CoordsRel *CoordsRelRefIndex // Stores which relations a coord references
 	Ways      *WaysRefIndex      // Stores which relations a way references
+	Relations *RelationsRefIndex // Stores which relations a relation references
 	opened    bool
 }
 
@@ -41,6 +42,10 @@ func (c *DiffCache) Close() {
 		c.Ways.Close()
 		c.Ways = nil
 	}
+	if c.Relations != nil {
+		c.Relations.Close()
+		c.Relations = nil
+	}
 }
 
 func (c *DiffCache) Flush() {
@@ -53,6 +58,9 @@ func (c *DiffCache) Flush() {
 	if c.Ways != nil {
 		c.Ways.Flush()
 	}
+	if c.Relations != nil {
+		c.Relations.Flush()
+	}
 }
 
 func (c *DiffCache) Open() error {
@@ -72,6 +80,11 @@ func (c *DiffCache) Open() error {
 		c.Close()
 		return err
 	}
+	c.Relations, err = newRelationsRefIndex(filepath.Join(c.Dir, "relations_index"))
+	if err != nil {
+		c.Close()
+		return err
+	}
 	c.opened = true
 	return nil
 }
@@ -89,6 +102,9 @@ func (c *DiffCache) Exists() bool {
 	if _, err := os.Stat(filepath.Join(c.Dir, "ways_index")); !os.IsNotExist(err) {
 		return true
 	}
+	if _, err := os.Stat(filepath.Join(c.Dir, "relations_index")); !os.IsNotExist(err) {
+		return true
+	}
 	return false
 }
 
@@ -105,6 +121,9 @@ func (c *DiffCache) Remove() error {
 	if err := os.RemoveAll(filepath.Join(c.Dir, "ways_index")); err != nil {
 		return err
 	}
+	if err := os.RemoveAll(filepath.Join(c.Dir, "relations_index")); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -217,6 +236,10 @@ type WaysRefIndex struct {
 	*bunchRefCache
 }
 
+type RelationsRefIndex struct {
+	*bunchRefCache
+}
+
 func newCoordsRefIndex(dir string) (*CoordsRefIndex, error) {
 	cache, err := newRefIndex(dir, &globalCacheOptions.CoordsIndex)
 	if err != nil {
@@ -241,6 +264,14 @@ func newWaysRefIndex(dir string) (*WaysRefIndex, error) {
 	return &WaysRefIndex{cache}, nil
 }
 
+func newRelationsRefIndex(dir string) (*RelationsRefIndex, error) {
+	cache, err := newRefIndex(dir, &globalCacheOptions.RelationsIndex)
+	if err != nil {
+		return nil, err
+	}
+	return &RelationsRefIndex{cache}, nil
+}
+
 func (index *bunchRefCache) getBunchID(id int64) int64 {
 	return id / 64
 }
@@ -412,6 +443,18 @@ func (index *WaysRefIndex) AddFromMembers(relID int64, members []osm.Member) {
 	}
 }
 
+func (index *RelationsRefIndex) AddFromMembers(relID int64, members []osm.Member) {
+	for _, member := range members {
+		if member.Type == osm.RelationMember {
+			if index.linearImport {
+				index.addc <- idRef{id: member.ID, ref: relID}
+			} else {
+				index.Add(member.ID, relID)
+			}
+		}
+	}
+}
+
 // SetLinearImport optimizes the cache for write operations.
 // Get/Delete operations will panic during linear import.
 func (index *bunchRefCache) SetLinearImport(val bool) {
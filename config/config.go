@@ -12,20 +12,25 @@ import (
 )
 
 type Config struct {
-	CacheDir            string          `json:"cachedir"`
-	DiffDir             string          `json:"diffdir"`
-	Connection          string          `json:"connection"`
-	MappingFile         string          `json:"mapping"`
-	LimitTo             string          `json:"limitto"`
-	LimitToCacheBuffer  float64         `json:"limitto_cache_buffer"`
-	Srid                int             `json:"srid"`
-	Schemas             Schemas         `json:"schemas"`
-	ExpireTilesDir      string          `json:"expiretiles_dir"`
-	ExpireTilesZoom     int             `json:"expiretiles_zoom"`
-	CommitLatest        bool            `json:"commit_latest"`
-	ReplicationURL      string          `json:"replication_url"`
-	ReplicationInterval MinutesInterval `json:"replication_interval"`
-	DiffStateBefore     MinutesInterval `json:"diff_state_before"`
+	CacheDir             string          `json:"cachedir"`
+	DiffDir              string          `json:"diffdir"`
+	Connection           string          `json:"connection"`
+	MappingFile          string          `json:"mapping"`
+	LimitTo              string          `json:"limitto"`
+	LimitToCacheBuffer   float64         `json:"limitto_cache_buffer"`
+	Srid                 int             `json:"srid"`
+	Schemas              Schemas         `json:"schemas"`
+	ExpireTilesDir       string          `json:"expiretiles_dir"`
+	ExpireTilesZoom      int             `json:"expiretiles_zoom"`
+	CommitLatest         bool            `json:"commit_latest"`
+	DiffUpsert           bool            `json:"diff_upsert"`
+	DiffChanges          bool            `json:"diff_changes"`
+	DiffChangesRetention MinutesInterval `json:"diff_changes_retention"`
+	DiffNotify           bool            `json:"diff_notify"`
+	DiffStateDB          bool            `json:"diff_state_db"`
+	ReplicationURL       string          `json:"replication_url"`
+	ReplicationInterval  MinutesInterval `json:"replication_interval"`
+	DiffStateBefore      MinutesInterval `json:"diff_state_before"`
 }
 
 type Schemas struct {
@@ -41,24 +46,29 @@ const defaultSchemaProduction = "public"
 const defaultSchemaBackup = "backup"
 
 type Base struct {
-	Connection          string
-	CacheDir            string
-	DiffDir             string
-	MappingFile         string
-	Srid                int
-	LimitTo             string
-	LimitToCacheBuffer  float64
-	ConfigFile          string
-	HTTPProfile         string
-	Quiet               bool
-	Schemas             Schemas
-	ExpireTilesDir      string
-	ExpireTilesZoom     int
-	CommitLatest        bool
-	ReplicationURL      string
-	ReplicationInterval time.Duration
-	DiffStateBefore     time.Duration
-	ForceDiffImport     bool
+	Connection           string
+	CacheDir             string
+	DiffDir              string
+	MappingFile          string
+	Srid                 int
+	LimitTo              string
+	LimitToCacheBuffer   float64
+	ConfigFile           string
+	HTTPProfile          string
+	Quiet                bool
+	Schemas              Schemas
+	ExpireTilesDir       string
+	ExpireTilesZoom      int
+	CommitLatest         bool
+	DiffUpsert           bool
+	DiffChanges          bool
+	DiffChangesRetention time.Duration
+	DiffNotify           bool
+	DiffStateDB          bool
+	ReplicationURL       string
+	ReplicationInterval  time.Duration
+	DiffStateBefore      time.Duration
+	ForceDiffImport      bool
 }
 
 func (o *Base) updateFromConfig() error {
@@ -129,6 +139,21 @@ func (o *Base) updateFromConfig() error {
 	if !o.CommitLatest {
 		o.CommitLatest = conf.CommitLatest
 	}
+	if !o.DiffUpsert {
+		o.DiffUpsert = conf.DiffUpsert
+	}
+	if !o.DiffChanges {
+		o.DiffChanges = conf.DiffChanges
+	}
+	if conf.DiffChangesRetention.Duration != 0 && o.DiffChangesRetention == 0 {
+		o.DiffChangesRetention = conf.DiffChangesRetention.Duration
+	}
+	if !o.DiffNotify {
+		o.DiffNotify = conf.DiffNotify
+	}
+	if !o.DiffStateDB {
+		o.DiffStateDB = conf.DiffStateDB
+	}
 
 	if conf.ReplicationInterval.Duration != 0 && o.ReplicationInterval == time.Minute {
 		o.ReplicationInterval = conf.ReplicationInterval.Duration
@@ -175,6 +200,9 @@ type Import struct {
 	DeployProduction bool
 	RevertDeploy     bool
 	RemoveBackup     bool
+	SortOrder        string
+	BrinIndex        bool
+	CopyFormat       string
 }
 
 func addBaseFlags(opts *Base, flags *flag.FlagSet) {
@@ -217,6 +245,9 @@ func ParseImport(args []string) Import {
 	flags.BoolVar(&opts.DeployProduction, "deployproduction", false, "deploy production")
 	flags.BoolVar(&opts.RevertDeploy, "revertdeploy", false, "revert deploy to production")
 	flags.BoolVar(&opts.RemoveBackup, "removebackup", false, "remove backups from deploy")
+	flags.StringVar(&opts.SortOrder, "sort", "", "sort rows by geometry before writing (hilbert or geohash)")
+	flags.BoolVar(&opts.BrinIndex, "brin", false, "create BRIN geometry indices for sorted tables")
+	flags.StringVar(&opts.CopyFormat, "copy-format", "text", "format for COPY into the database (text or binary)")
 	flags.DurationVar(&opts.Base.DiffStateBefore, "diff-state-before", 0, "set initial diff sequence before")
 	flags.DurationVar(&opts.Base.ReplicationInterval, "replication-interval", time.Minute, "replication interval as duration (1m, 1h, 24h)")
 
@@ -239,6 +270,7 @@ func ParseImport(args []string) Import {
 		log.Fatal(err)
 	}
 	errs := opts.Base.check()
+	errs = append(errs, opts.check()...)
 	if len(errs) != 0 {
 		reportErrors(errs)
 		flags.Usage()
@@ -246,6 +278,20 @@ func ParseImport(args []string) Import {
 	return opts
 }
 
+func (o *Import) check() []error {
+	errs := []error{}
+	if o.SortOrder != "" && o.SortOrder != "hilbert" && o.SortOrder != "geohash" {
+		errs = append(errs, errors.New("only -sort=hilbert or -sort=geohash are supported"))
+	}
+	if o.BrinIndex && o.SortOrder == "" {
+		errs = append(errs, errors.New("-brin requires -sort"))
+	}
+	if o.CopyFormat != "text" && o.CopyFormat != "binary" {
+		errs = append(errs, errors.New("only -copy-format=text or -copy-format=binary are supported"))
+	}
+	return errs
+}
+
 func ParseDiffImport(args []string) (Base, []string) {
 	flags := flag.NewFlagSet("diff", flag.ExitOnError)
 	opts := Base{}
@@ -255,6 +301,11 @@ func ParseDiffImport(args []string) (Base, []string) {
 	flags.IntVar(&opts.ExpireTilesZoom, "expiretiles-zoom", 14, "write expire tiles in this zoom level")
 	flags.BoolVar(&opts.ForceDiffImport, "force", false, "force import of diff if sequence was already imported")
 	flags.BoolVar(&opts.CommitLatest, "commit-latest", false, "commit after last diff, instead after each diff")
+	flags.BoolVar(&opts.DiffUpsert, "diff-upsert", false, "update changed rows instead of deleting and inserting all modified rows")
+	flags.BoolVar(&opts.DiffChanges, "diff-changes", false, "record all changes in the imposm_changes table")
+	flags.DurationVar(&opts.DiffChangesRetention, "diff-changes-retention", 0, "remove recorded changes after this duration (24h, 168h)")
+	flags.BoolVar(&opts.DiffNotify, "diff-notify", false, "send NOTIFY imposm_update after each commit")
+	flags.BoolVar(&opts.DiffStateDB, "diff-state-db", false, "store the replication state in the imposm_state table")
 
 	flags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s %s [args] [.osc.gz, ...]\n\n", os.Args[0], os.Args[1])
@@ -298,6 +349,11 @@ func ParseRunImport(args []string) Base {
 	flags.StringVar(&opts.ExpireTilesDir, "expiretiles-dir", "", "write expire tiles into dir")
 	flags.IntVar(&opts.ExpireTilesZoom, "expiretiles-zoom", 14, "write expire tiles in this zoom level")
 	flags.BoolVar(&opts.CommitLatest, "commit-latest", false, "commit after last diff, instead after each diff")
+	flags.BoolVar(&opts.DiffUpsert, "diff-upsert", false, "update changed rows instead of deleting and inserting all modified rows")
+	flags.BoolVar(&opts.DiffChanges, "diff-changes", false, "record all changes in the imposm_changes table")
+	flags.DurationVar(&opts.DiffChangesRetention, "diff-changes-retention", 0, "remove recorded changes after this duration (24h, 168h)")
+	flags.BoolVar(&opts.DiffNotify, "diff-notify", false, "send NOTIFY imposm_update after each commit")
+	flags.BoolVar(&opts.DiffStateDB, "diff-state-db", false, "store the replication state in the imposm_state table")
 	flags.DurationVar(&opts.ReplicationInterval, "replication-interval", time.Minute, "replication interval as duration (1m, 1h, 24h)")
 
 	flags.Usage = func() {
@@ -3,8 +3,11 @@ package database
 import (
 	"errors"
 	"strings"
+	"time"
 
+	"github.com/lib/pq/hstore"
 	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/go-osm/state"
 	"github.com/omniscale/imposm3/geom"
 	"github.com/omniscale/imposm3/mapping"
 	"github.com/omniscale/imposm3/mapping/config"
@@ -16,6 +19,25 @@ type Config struct {
 	ImportSchema     string
 	ProductionSchema string
 	BackupSchema     string
+	// SortOrder sorts all rows of bulk imports by a spatial key of their
+	// geometry (hilbert or geohash). Rows are not sorted if empty.
+	SortOrder string
+	// SortDir is the directory for temporary sort files.
+	SortDir string
+	// BrinIndex creates BRIN instead of GiST indices for geometries of
+	// sorted tables.
+	BrinIndex bool
+	// CopyFormat is the format for COPY during bulk imports (text or
+	// binary). Text is used if empty.
+	CopyFormat string
+	// Upsert applies diff imports with UPDATE of changed rows, instead
+	// of DELETE and INSERT of all rows of modified elements.
+	Upsert bool
+	// Changes records all changes of diff imports in a changes table.
+	Changes bool
+	// ChangesRetention removes recorded changes after this duration.
+	// Changes are kept if 0.
+	ChangesRetention time.Duration
 }
 
 type DB interface {
@@ -37,7 +59,9 @@ type Inserter interface {
 	InsertPoint(osm.Element, geom.Geometry, []mapping.Match) error
 	InsertLineString(osm.Element, geom.Geometry, []mapping.Match) error
 	InsertPolygon(osm.Element, geom.Geometry, []mapping.Match) error
-	InsertRelationMember(osm.Relation, osm.Member, int, geom.Geometry, []mapping.Match) error
+	// InsertRelationMember inserts a member with its index and the IDs of
+	// all parent relations (starting with the matched relation).
+	InsertRelationMember(osm.Relation, osm.Member, int, []int64, geom.Geometry, []mapping.Match) error
 }
 
 type Deployer interface {
@@ -60,6 +84,49 @@ type Deleter interface {
 	Delete(int64, []mapping.Match) error
 }
 
+// ChangeRecorder records the changes of diff imports for each replication
+// sequence.
+type ChangeRecorder interface {
+	// SetChangeSequence sets the sequence of all following changes.
+	SetChangeSequence(seq int) error
+}
+
+// HistoryRecorder keeps previous versions of changed rows.
+type HistoryRecorder interface {
+	// SetVersionTime sets the start of all following versions, usually
+	// the timestamp of the replication sequence.
+	SetVersionTime(t time.Time) error
+}
+
+// Notification describes a committed diff import.
+type Notification struct {
+	Sequence  int       `json:"sequence"`
+	Timestamp time.Time `json:"timestamp"`
+	// Changes is the number of inserted, updated and deleted rows for each
+	// table. It is set by the Notifier.
+	Changes map[string]int `json:"changes"`
+	// BBox of all changed elements in EPSG:4326 (minx, miny, maxx, maxy),
+	// nil if unknown.
+	BBox []float64 `json:"bbox,omitempty"`
+}
+
+// Notifier announces committed diff imports to other clients of the
+// database.
+type Notifier interface {
+	// Notify sends n with the changes of the last End.
+	Notify(n Notification) error
+}
+
+// StateStore stores the replication state in the database, in the same
+// transaction as the diff import.
+type StateStore interface {
+	// ReadState returns the state of the last committed diff import, or
+	// nil if no state was written.
+	ReadState() (*state.DiffState, error)
+	// WriteState stores s with the current transaction.
+	WriteState(s *state.DiffState) error
+}
+
 type Optimizer interface {
 	Optimize() error
 }
@@ -72,6 +139,21 @@ type FullDB interface {
 	Finisher
 }
 
+// DecodeHstore decodes the value of an hstore_tags column, which is
+// created in the text format of hstore. NULL values of single tags are
+// returned as empty strings.
+func DecodeHstore(s string) (map[string]string, error) {
+	var h hstore.Hstore
+	if err := h.Scan([]byte(s)); err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(h.Map))
+	for k, v := range h.Map {
+		tags[k] = v.String
+	}
+	return tags, nil
+}
+
 var databases map[string]func(Config, *config.Mapping) (DB, error)
 
 func init() {
@@ -109,7 +191,7 @@ func (n *nullDb) Abort() error
 func (n *nullDb) InsertPoint(osm.Element, geom.Geometry, []mapping.Match) error      { return nil }
 func (n *nullDb) InsertLineString(osm.Element, geom.Geometry, []mapping.Match) error { return nil }
 func (n *nullDb) InsertPolygon(osm.Element, geom.Geometry, []mapping.Match) error    { return nil }
-func (n *nullDb) InsertRelationMember(osm.Relation, osm.Member, int, geom.Geometry, []mapping.Match) error {
+func (n *nullDb) InsertRelationMember(osm.Relation, osm.Member, int, []int64, geom.Geometry, []mapping.Match) error {
 	return nil
 }
 
@@ -0,0 +1,5 @@
+/*
+Package flatgeobuf implements the database interfaces for FlatGeobuf files
+with a packed Hilbert R-tree index.
+*/
+package flatgeobuf
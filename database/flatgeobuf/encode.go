@@ -0,0 +1,298 @@
+package flatgeobuf
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/geom"
+)
+
+// magic bytes of FlatGeobuf version 3
+var magic = []byte{'f', 'g', 'b', 3, 'f', 'g', 'b', 0}
+
+// FlatGeobuf geometry types are identical to the WKB types.
+const geometryTypeUnknown = 0
+
+// FlatGeobuf column types
+const (
+	columnTypeBool   = 2
+	columnTypeShort  = 3
+	columnTypeInt    = 5
+	columnTypeLong   = 7
+	columnTypeFloat  = 9
+	columnTypeString = 11
+	columnTypeJSON   = 12
+)
+
+// columnTypes maps the GoType of mapping.ColumnType to the FlatGeobuf type.
+var columnTypes = map[string]byte{
+	"bool":          columnTypeBool,
+	"int8":          columnTypeShort,
+	"int32":         columnTypeInt,
+	"int64":         columnTypeLong,
+	"float32":       columnTypeFloat,
+	"string":        columnTypeString,
+	"hstore_string": columnTypeJSON,
+}
+
+// column is a property column of a FlatGeobuf file.
+type column struct {
+	name string
+	typ  byte
+	// rowIdx is the index of the value in the rows of the mapping
+	rowIdx int
+}
+
+type header struct {
+	name          string
+	envelope      [4]float64
+	geometryType  byte
+	columns       []column
+	featuresCount uint64
+	indexNodeSize uint16
+	srid          int
+}
+
+// encodeHeader returns the size prefixed Header table.
+func encodeHeader(h *header) []byte {
+	fields := make([]*fbField, 11)
+	fields[0] = stringField(h.name)
+	if h.featuresCount > 0 {
+		env := h.envelope
+		fields[1] = &fbField{child: func(w *fbWriter) int { return w.float64s(env[:]) }}
+	}
+	fields[2] = uint8Field(h.geometryType)
+	if len(h.columns) > 0 {
+		cols := make([][]*fbField, len(h.columns))
+		for i, c := range h.columns {
+			cols[i] = []*fbField{stringField(c.name), uint8Field(c.typ)}
+		}
+		fields[7] = &fbField{child: func(w *fbWriter) int { return w.tables(cols) }}
+	}
+	fields[8] = uint64Field(h.featuresCount)
+	// index_node_size defaults to 16, 0 disables the index
+	fields[9] = uint16Field(h.indexNodeSize)
+	if h.srid != 0 {
+		crs := []*fbField{nil, int32Field(int32(h.srid))}
+		fields[10] = &fbField{child: func(w *fbWriter) int { return w.table(crs) }}
+	}
+	return sizePrefixed(fields)
+}
+
+// encodeFeature returns the size prefixed Feature table. g is nil for
+// features without geometry.
+func encodeFeature(g *geom.WKBGeometry, properties []byte) []byte {
+	fields := make([]*fbField, 2)
+	if g != nil {
+		gf := geometryFields(g)
+		fields[0] = &fbField{child: func(w *fbWriter) int { return w.table(gf) }}
+	}
+	if len(properties) > 0 {
+		fields[1] = &fbField{child: func(w *fbWriter) int { return w.bytes(properties) }}
+	}
+	return sizePrefixed(fields)
+}
+
+func sizePrefixed(fields []*fbField) []byte {
+	w := fbWriter{}
+	buf := w.root(fields)
+	return append(binary.LittleEndian.AppendUint32(make([]byte, 0, len(buf)+4), uint32(len(buf))), buf...)
+}
+
+// geometryFields returns the fields of the Geometry table. Multi
+// polygons and collections are stored as parts, all other types as flat
+// coordinates with the end index of each ring or line.
+func geometryFields(g *geom.WKBGeometry) []*fbField {
+	fields := make([]*fbField, 8)
+	fields[6] = uint8Field(byte(g.Type))
+
+	var xy []float64
+	var ends []uint32
+	appendCoords := func(coords []geom.Coord) {
+		for _, c := range coords {
+			xy = append(xy, c.X, c.Y)
+		}
+		ends = append(ends, uint32(len(xy)/2))
+	}
+
+	switch g.Type {
+	case geom.WKBPoint, geom.WKBLineString:
+		appendCoords(g.Coords)
+		ends = nil
+	case geom.WKBPolygon:
+		for _, ring := range g.Rings {
+			appendCoords(ring)
+		}
+	case geom.WKBMultiPoint:
+		for _, p := range g.Geometries {
+			xy = append(xy, coordsXY(p.Coords)...)
+		}
+	case geom.WKBMultiLineString:
+		for _, l := range g.Geometries {
+			appendCoords(l.Coords)
+		}
+	case geom.WKBMultiPolygon, geom.WKBGeometryCollection:
+		parts := make([][]*fbField, len(g.Geometries))
+		for i, p := range g.Geometries {
+			parts[i] = geometryFields(p)
+		}
+		fields[7] = &fbField{child: func(w *fbWriter) int { return w.tables(parts) }}
+	}
+
+	// ends are only required for more than one ring/line
+	if len(ends) > 1 {
+		fields[0] = &fbField{child: func(w *fbWriter) int { return w.uint32s(ends) }}
+	}
+	if len(xy) > 0 {
+		fields[1] = &fbField{child: func(w *fbWriter) int { return w.float64s(xy) }}
+	}
+	return fields
+}
+
+func coordsXY(coords []geom.Coord) []float64 {
+	xy := make([]float64, 0, len(coords)*2)
+	for _, c := range coords {
+		xy = append(xy, c.X, c.Y)
+	}
+	return xy
+}
+
+// bounds returns the envelope (minx, miny, maxx, maxy) of g. ok is false
+// for empty geometries.
+func bounds(g *geom.WKBGeometry) (b [4]float64, ok bool) {
+	b = [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	var extend func(g *geom.WKBGeometry)
+	add := func(coords []geom.Coord) {
+		for _, c := range coords {
+			b[0] = math.Min(b[0], c.X)
+			b[1] = math.Min(b[1], c.Y)
+			b[2] = math.Max(b[2], c.X)
+			b[3] = math.Max(b[3], c.Y)
+			ok = true
+		}
+	}
+	extend = func(g *geom.WKBGeometry) {
+		add(g.Coords)
+		for _, r := range g.Rings {
+			add(r)
+		}
+		for _, p := range g.Geometries {
+			extend(p)
+		}
+	}
+	extend(g)
+	return b, ok
+}
+
+// appendProperties appends the values of row for columns. Each value is
+// prefixed with the index of the column. NULL values and values that
+// can not be converted to the column type are omitted.
+func appendProperties(buf []byte, columns []column, row []interface{}) []byte {
+	for i, c := range columns {
+		if c.rowIdx >= len(row) || row[c.rowIdx] == nil {
+			continue
+		}
+		v := row[c.rowIdx]
+		start := len(buf)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(i))
+		var ok bool
+		buf, ok = appendValue(buf, c.typ, v)
+		if !ok {
+			buf = buf[:start]
+		}
+	}
+	return buf
+}
+
+func appendValue(buf []byte, typ byte, v interface{}) ([]byte, bool) {
+	switch typ {
+	case columnTypeString:
+		s, ok := v.(string)
+		if !ok {
+			return buf, false
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s)))
+		return append(buf, s...), true
+	case columnTypeJSON:
+		// hstore values are written as JSON objects
+		s, ok := v.(string)
+		if !ok {
+			return buf, false
+		}
+		tags, err := database.DecodeHstore(s)
+		if err != nil {
+			return buf, false
+		}
+		b, err := json.Marshal(tags)
+		if err != nil {
+			return buf, false
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(b)))
+		return append(buf, b...), true
+	case columnTypeBool:
+		b, ok := v.(bool)
+		if !ok {
+			return buf, false
+		}
+		if b {
+			return append(buf, 1), true
+		}
+		return append(buf, 0), true
+	case columnTypeShort:
+		i, ok := toInt(v)
+		if !ok || i < math.MinInt16 || i > math.MaxInt16 {
+			return buf, false
+		}
+		return binary.LittleEndian.AppendUint16(buf, uint16(int16(i))), true
+	case columnTypeInt:
+		i, ok := toInt(v)
+		if !ok || i < math.MinInt32 || i > math.MaxInt32 {
+			return buf, false
+		}
+		return binary.LittleEndian.AppendUint32(buf, uint32(int32(i))), true
+	case columnTypeLong:
+		i, ok := toInt(v)
+		if !ok {
+			return buf, false
+		}
+		return binary.LittleEndian.AppendUint64(buf, uint64(i)), true
+	case columnTypeFloat:
+		var f float64
+		switch v := v.(type) {
+		case float32:
+			f = float64(v)
+		case float64:
+			f = v
+		default:
+			i, ok := toInt(v)
+			if !ok {
+				return buf, false
+			}
+			f = float64(i)
+		}
+		return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(f))), true
+	}
+	return buf, false
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
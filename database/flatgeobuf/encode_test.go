@@ -0,0 +1,283 @@
+package flatgeobuf
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/omniscale/imposm3/geom"
+)
+
+// fbTable reads tables written by fbWriter.
+type fbTable struct {
+	buf []byte
+	pos int
+}
+
+func rootTable(buf []byte) fbTable {
+	return fbTable{buf: buf, pos: int(binary.LittleEndian.Uint32(buf))}
+}
+
+// sizePrefixedTable returns the root table of a size prefixed buffer and
+// the remaining buffer.
+func sizePrefixedTable(t *testing.T, buf []byte) (fbTable, []byte) {
+	t.Helper()
+	size := int(binary.LittleEndian.Uint32(buf))
+	if size+4 > len(buf) {
+		t.Fatalf("invalid size %d for buffer of %d bytes", size, len(buf))
+	}
+	return rootTable(buf[4 : 4+size]), buf[4+size:]
+}
+
+// field returns the position of the field, or 0 if the field is not set.
+func (t fbTable) field(id int) int {
+	vtable := t.pos - int(int32(binary.LittleEndian.Uint32(t.buf[t.pos:])))
+	vtableSize := int(binary.LittleEndian.Uint16(t.buf[vtable:]))
+	if 4+2*id >= vtableSize {
+		return 0
+	}
+	offset := int(binary.LittleEndian.Uint16(t.buf[vtable+4+2*id:]))
+	if offset == 0 {
+		return 0
+	}
+	return t.pos + offset
+}
+
+func (t fbTable) uint8(id int) uint8 {
+	if pos := t.field(id); pos != 0 {
+		return t.buf[pos]
+	}
+	return 0
+}
+
+func (t fbTable) uint16(id int) uint16 {
+	if pos := t.field(id); pos != 0 {
+		return binary.LittleEndian.Uint16(t.buf[pos:])
+	}
+	return 0
+}
+
+func (t fbTable) int32(id int) int32 {
+	if pos := t.field(id); pos != 0 {
+		return int32(binary.LittleEndian.Uint32(t.buf[pos:]))
+	}
+	return 0
+}
+
+func (t fbTable) uint64(id int) uint64 {
+	if pos := t.field(id); pos != 0 {
+		return binary.LittleEndian.Uint64(t.buf[pos:])
+	}
+	return 0
+}
+
+// vector returns the position of the first element and the length.
+func (t fbTable) vector(id int) (int, int) {
+	pos := t.field(id)
+	if pos == 0 {
+		return 0, 0
+	}
+	pos += int(binary.LittleEndian.Uint32(t.buf[pos:]))
+	return pos + 4, int(binary.LittleEndian.Uint32(t.buf[pos:]))
+}
+
+func (t fbTable) string(id int) string {
+	pos, n := t.vector(id)
+	return string(t.buf[pos : pos+n])
+}
+
+func (t fbTable) bytes(id int) []byte {
+	pos, n := t.vector(id)
+	return t.buf[pos : pos+n]
+}
+
+func (t fbTable) float64s(id int) []float64 {
+	pos, n := t.vector(id)
+	if pos%8 != 0 {
+		panic("unaligned float64 vector")
+	}
+	v := make([]float64, n)
+	for i := range v {
+		v[i] = math.Float64frombits(binary.LittleEndian.Uint64(t.buf[pos+8*i:]))
+	}
+	return v
+}
+
+func (t fbTable) uint32s(id int) []uint32 {
+	pos, n := t.vector(id)
+	v := make([]uint32, n)
+	for i := range v {
+		v[i] = binary.LittleEndian.Uint32(t.buf[pos+4*i:])
+	}
+	return v
+}
+
+func (t fbTable) table(id int) fbTable {
+	pos := t.field(id)
+	return fbTable{buf: t.buf, pos: pos + int(binary.LittleEndian.Uint32(t.buf[pos:]))}
+}
+
+func (t fbTable) tables(id int) []fbTable {
+	pos, n := t.vector(id)
+	tables := make([]fbTable, n)
+	for i := range tables {
+		p := pos + 4*i
+		tables[i] = fbTable{buf: t.buf, pos: p + int(binary.LittleEndian.Uint32(t.buf[p:]))}
+	}
+	return tables
+}
+
+func TestEncodeHeader(t *testing.T) {
+	h := header{
+		name:         "pois",
+		envelope:     [4]float64{1, 2, 3, 4},
+		geometryType: geom.WKBPoint,
+		columns: []column{
+			{name: "osm_id", typ: columnTypeLong},
+			{name: "name", typ: columnTypeString},
+		},
+		featuresCount: 2,
+		indexNodeSize: 16,
+		srid:          3857,
+	}
+	tbl, rest := sizePrefixedTable(t, encodeHeader(&h))
+	if len(rest) != 0 {
+		t.Errorf("unexpected trailing bytes %v", rest)
+	}
+	if tbl.string(0) != "pois" {
+		t.Errorf("unexpected name %q", tbl.string(0))
+	}
+	if env := tbl.float64s(1); !reflect.DeepEqual(env, []float64{1, 2, 3, 4}) {
+		t.Errorf("unexpected envelope %v", env)
+	}
+	if tbl.uint8(2) != geom.WKBPoint {
+		t.Errorf("unexpected geometry type %d", tbl.uint8(2))
+	}
+	cols := tbl.tables(7)
+	if len(cols) != 2 || cols[0].string(0) != "osm_id" || cols[0].uint8(1) != columnTypeLong ||
+		cols[1].string(0) != "name" || cols[1].uint8(1) != columnTypeString {
+		t.Errorf("unexpected columns")
+	}
+	if tbl.uint64(8) != 2 {
+		t.Errorf("unexpected features count %d", tbl.uint64(8))
+	}
+	if tbl.uint16(9) != 16 {
+		t.Errorf("unexpected index node size %d", tbl.uint16(9))
+	}
+	if code := tbl.table(10).int32(1); code != 3857 {
+		t.Errorf("unexpected crs code %d", code)
+	}
+}
+
+func TestEncodeFeature(t *testing.T) {
+	square := func(x, y, size float64) []geom.Coord {
+		return []geom.Coord{{X: x, Y: y}, {X: x + size, Y: y}, {X: x + size, Y: y + size}, {X: x, Y: y}}
+	}
+	for _, tc := range []struct {
+		name string
+		geom *geom.WKBGeometry
+		xy   []float64
+		ends []uint32
+	}{
+		{
+			name: "point",
+			geom: &geom.WKBGeometry{Type: geom.WKBPoint, Coords: []geom.Coord{{X: 1, Y: 2}}},
+			xy:   []float64{1, 2},
+		},
+		{
+			name: "linestring",
+			geom: &geom.WKBGeometry{Type: geom.WKBLineString, Coords: []geom.Coord{{X: 1, Y: 2}, {X: 3, Y: 4}}},
+			xy:   []float64{1, 2, 3, 4},
+		},
+		{
+			name: "polygon",
+			geom: &geom.WKBGeometry{Type: geom.WKBPolygon, Rings: [][]geom.Coord{square(0, 0, 10)}},
+			xy:   []float64{0, 0, 10, 0, 10, 10, 0, 0},
+		},
+		{
+			name: "polygon with hole",
+			geom: &geom.WKBGeometry{Type: geom.WKBPolygon, Rings: [][]geom.Coord{square(0, 0, 10), square(1, 1, 1)}},
+			xy:   []float64{0, 0, 10, 0, 10, 10, 0, 0, 1, 1, 2, 1, 2, 2, 1, 1},
+			ends: []uint32{4, 8},
+		},
+		{
+			name: "multilinestring",
+			geom: &geom.WKBGeometry{Type: geom.WKBMultiLineString, Geometries: []*geom.WKBGeometry{
+				{Type: geom.WKBLineString, Coords: []geom.Coord{{X: 1, Y: 2}, {X: 3, Y: 4}}},
+				{Type: geom.WKBLineString, Coords: []geom.Coord{{X: 5, Y: 6}, {X: 7, Y: 8}, {X: 9, Y: 10}}},
+			}},
+			xy:   []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			ends: []uint32{2, 5},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, _ := sizePrefixedTable(t, encodeFeature(tc.geom, nil))
+			g := f.table(0)
+			if int(g.uint8(6)) != tc.geom.Type {
+				t.Errorf("unexpected type %d", g.uint8(6))
+			}
+			if xy := g.float64s(1); !reflect.DeepEqual(xy, tc.xy) {
+				t.Errorf("unexpected xy %v", xy)
+			}
+			if ends := g.uint32s(0); len(ends) != len(tc.ends) || (len(ends) > 0 && !reflect.DeepEqual(ends, tc.ends)) {
+				t.Errorf("unexpected ends %v", ends)
+			}
+			if f.field(1) != 0 {
+				t.Error("unexpected properties")
+			}
+		})
+	}
+
+	t.Run("multipolygon", func(t *testing.T) {
+		mp := &geom.WKBGeometry{Type: geom.WKBMultiPolygon, Geometries: []*geom.WKBGeometry{
+			{Type: geom.WKBPolygon, Rings: [][]geom.Coord{square(0, 0, 1)}},
+			{Type: geom.WKBPolygon, Rings: [][]geom.Coord{square(5, 5, 1), square(5.2, 5.2, 0.5)}},
+		}}
+		f, _ := sizePrefixedTable(t, encodeFeature(mp, nil))
+		g := f.table(0)
+		if g.uint8(6) != geom.WKBMultiPolygon || g.field(1) != 0 {
+			t.Fatal("unexpected multipolygon")
+		}
+		parts := g.tables(7)
+		if len(parts) != 2 {
+			t.Fatalf("unexpected parts %d", len(parts))
+		}
+		if parts[0].uint8(6) != geom.WKBPolygon || len(parts[0].float64s(1)) != 8 || parts[0].field(0) != 0 {
+			t.Error("unexpected first part")
+		}
+		if ends := parts[1].uint32s(0); !reflect.DeepEqual(ends, []uint32{4, 8}) {
+			t.Errorf("unexpected ends of second part %v", ends)
+		}
+	})
+}
+
+func TestAppendProperties(t *testing.T) {
+	columns := []column{
+		{name: "osm_id", typ: columnTypeLong, rowIdx: 0},
+		{name: "name", typ: columnTypeString, rowIdx: 2},
+		{name: "population", typ: columnTypeInt, rowIdx: 3},
+		{name: "area", typ: columnTypeFloat, rowIdx: 4},
+		{name: "oneway", typ: columnTypeBool, rowIdx: 5},
+		{name: "direction", typ: columnTypeShort, rowIdx: 6},
+		{name: "tags", typ: columnTypeJSON, rowIdx: 7},
+	}
+	// geometry in row[1] is not a column, population is invalid
+	row := []interface{}{int64(42), "0101000000", "Hamburg", "many", float32(1.5), true, int8(-1), `"name"=>"HH"`}
+
+	expected := []byte{
+		0, 0, 42, 0, 0, 0, 0, 0, 0, 0,
+		1, 0, 7, 0, 0, 0, 'H', 'a', 'm', 'b', 'u', 'r', 'g',
+		3, 0, 0, 0, 0xc0, 0x3f,
+		4, 0, 1,
+		5, 0, 0xff, 0xff,
+		6, 0, 13, 0, 0, 0, '{', '"', 'n', 'a', 'm', 'e', '"', ':', '"', 'H', 'H', '"', '}',
+	}
+	if buf := appendProperties(nil, columns, row); !reflect.DeepEqual(buf, expected) {
+		t.Errorf("unexpected properties\n%v\n%v", buf, expected)
+	}
+
+	if buf := appendProperties(nil, columns, []interface{}{nil, nil, nil}); len(buf) != 0 {
+		t.Errorf("unexpected properties for NULL values %v", buf)
+	}
+}
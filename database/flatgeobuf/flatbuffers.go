@@ -0,0 +1,181 @@
+package flatgeobuf
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// fbWriter writes FlatBuffers in forward order. Tables are written before
+// their strings, vectors and sub-tables, so that all offsets point forward.
+// The vtable of each table is written directly before the table.
+//
+// All values are aligned relative to the start of the buffer, like the
+// official FlatBuffers builders.
+type fbWriter struct {
+	buf []byte
+}
+
+// fbField is a single field of a table. Either data (for scalars) or
+// child (for strings, vectors and tables) is set. child writes the value
+// and returns its position.
+type fbField struct {
+	data  []byte
+	align int
+	child func(w *fbWriter) int
+}
+
+func (w *fbWriter) pad(align int) {
+	for len(w.buf)%align != 0 {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+// root writes the root table and returns the buffer.
+func (w *fbWriter) root(fields []*fbField) []byte {
+	w.buf = append(w.buf, 0, 0, 0, 0)
+	pos := w.table(fields)
+	binary.LittleEndian.PutUint32(w.buf[0:], uint32(pos))
+	return w.buf
+}
+
+// table writes a table with fields and returns the position of the table.
+// The index of each field is its field ID, nil fields are not written.
+func (w *fbWriter) table(fields []*fbField) int {
+	numFields := 0
+	for i, f := range fields {
+		if f != nil {
+			numFields = i + 1
+		}
+	}
+
+	w.pad(2)
+	vtablePos := len(w.buf)
+	vtableSize := 4 + 2*numFields
+	w.buf = append(w.buf, make([]byte, vtableSize)...)
+
+	w.pad(4)
+	tablePos := len(w.buf)
+	w.buf = append(w.buf, 0, 0, 0, 0) // soffset to vtable
+
+	fieldPos := make([]int, numFields)
+	for i := 0; i < numFields; i++ {
+		f := fields[i]
+		if f == nil {
+			continue
+		}
+		if f.child != nil {
+			w.pad(4)
+			fieldPos[i] = len(w.buf)
+			w.buf = append(w.buf, 0, 0, 0, 0)
+		} else {
+			w.pad(f.align)
+			fieldPos[i] = len(w.buf)
+			w.buf = append(w.buf, f.data...)
+		}
+	}
+	tableSize := len(w.buf) - tablePos
+
+	binary.LittleEndian.PutUint16(w.buf[vtablePos:], uint16(vtableSize))
+	binary.LittleEndian.PutUint16(w.buf[vtablePos+2:], uint16(tableSize))
+	for i, pos := range fieldPos {
+		if pos != 0 {
+			binary.LittleEndian.PutUint16(w.buf[vtablePos+4+2*i:], uint16(pos-tablePos))
+		}
+	}
+	binary.LittleEndian.PutUint32(w.buf[tablePos:], uint32(int32(tablePos-vtablePos)))
+
+	for i := 0; i < numFields; i++ {
+		f := fields[i]
+		if f == nil || f.child == nil {
+			continue
+		}
+		childPos := f.child(w)
+		binary.LittleEndian.PutUint32(w.buf[fieldPos[i]:], uint32(childPos-fieldPos[i]))
+	}
+	return tablePos
+}
+
+// vectorStart writes the length of a vector with elements of elemSize
+// bytes and returns the position of the vector.
+func (w *fbWriter) vectorStart(elemSize, length int) int {
+	align := elemSize
+	if align < 4 {
+		align = 4
+	}
+	// the elements after the length need to be aligned
+	for (len(w.buf)+4)%align != 0 {
+		w.buf = append(w.buf, 0)
+	}
+	pos := len(w.buf)
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, uint32(length))
+	return pos
+}
+
+func (w *fbWriter) string(s string) int {
+	pos := w.vectorStart(1, len(s))
+	w.buf = append(w.buf, s...)
+	w.buf = append(w.buf, 0)
+	return pos
+}
+
+func (w *fbWriter) bytes(b []byte) int {
+	pos := w.vectorStart(1, len(b))
+	w.buf = append(w.buf, b...)
+	return pos
+}
+
+func (w *fbWriter) float64s(v []float64) int {
+	pos := w.vectorStart(8, len(v))
+	for _, f := range v {
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(f))
+	}
+	return pos
+}
+
+func (w *fbWriter) uint32s(v []uint32) int {
+	pos := w.vectorStart(4, len(v))
+	for _, u := range v {
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, u)
+	}
+	return pos
+}
+
+// tables writes a vector of tables.
+func (w *fbWriter) tables(tables [][]*fbField) int {
+	pos := w.vectorStart(4, len(tables))
+	elemPos := len(w.buf)
+	w.buf = append(w.buf, make([]byte, 4*len(tables))...)
+	for i, fields := range tables {
+		tablePos := w.table(fields)
+		p := elemPos + 4*i
+		binary.LittleEndian.PutUint32(w.buf[p:], uint32(tablePos-p))
+	}
+	return pos
+}
+
+func stringField(s string) *fbField {
+	return &fbField{child: func(w *fbWriter) int { return w.string(s) }}
+}
+
+func uint8Field(v uint8) *fbField {
+	return &fbField{data: []byte{v}, align: 1}
+}
+
+func boolField(v bool) *fbField {
+	if v {
+		return uint8Field(1)
+	}
+	return uint8Field(0)
+}
+
+func uint16Field(v uint16) *fbField {
+	return &fbField{data: binary.LittleEndian.AppendUint16(nil, v), align: 2}
+}
+
+func int32Field(v int32) *fbField {
+	return &fbField{data: binary.LittleEndian.AppendUint32(nil, uint32(v)), align: 4}
+}
+
+func uint64Field(v uint64) *fbField {
+	return &fbField{data: binary.LittleEndian.AppendUint64(nil, v), align: 8}
+}
@@ -0,0 +1,465 @@
+package flatgeobuf
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/geom/geos"
+	"github.com/omniscale/imposm3/log"
+	"github.com/omniscale/imposm3/mapping"
+	"github.com/omniscale/imposm3/mapping/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	fileSuffix = ".fgb"
+	// features are collected in a temporary file per table and written
+	// in index order on Finish
+	tmpSuffix = ".fgb.tmp"
+)
+
+// FlatGeobuf writes each table into a FlatGeobuf file. Features are
+// written in insertion order into temporary files and the final files are
+// created with the spatial index on Finish. Diff imports are not
+// supported.
+type FlatGeobuf struct {
+	dir    string
+	srid   int
+	tables map[string]*table
+	// initialized is true after Init
+	initialized bool
+}
+
+type table struct {
+	name     string
+	columns  []column
+	geomIdx  int
+	geomType byte
+	// tolerance of generalized tables
+	tolerance float64
+	// generalized are the tables that are generalized from this table
+	generalized []*table
+
+	mu       sync.Mutex
+	tmp      *os.File
+	w        *bufio.Writer
+	size     int64
+	features []feature
+}
+
+// geosPool contains the GEOS handles for the simplification of generalized
+// tables. Rows are written concurrently by all writer goroutines.
+var geosPool = sync.Pool{
+	New: func() interface{} {
+		return geos.NewGeos()
+	},
+}
+
+// feature is the location of an encoded feature in the temporary file.
+type feature struct {
+	bounds [4]float64
+	offset int64
+	size   uint32
+}
+
+func New(conf database.Config, m *config.Mapping) (database.DB, error) {
+	dir := strings.TrimSpace(strings.TrimPrefix(conf.ConnectionParams, "flatgeobuf:"))
+	if dir == "" {
+		return nil, errors.New("missing directory for flatgeobuf, e.g. flatgeobuf:/path/to/dir")
+	}
+	db := &FlatGeobuf{
+		dir:    dir,
+		srid:   conf.Srid,
+		tables: make(map[string]*table),
+	}
+	for name, t := range m.Tables {
+		tbl := &table{name: name, geomIdx: -1}
+		for i, col := range t.Columns {
+			colType, err := mapping.MakeColumnType(col)
+			if err != nil {
+				return nil, errors.Wrapf(err, "creating column %q of table %q", col.Name, name)
+			}
+			if colType.GoType == "geometry" || colType.GoType == "validated_geometry" {
+				if tbl.geomIdx == -1 {
+					tbl.geomIdx = i
+				}
+				continue
+			}
+			typ, ok := columnTypes[colType.GoType]
+			if !ok {
+				return nil, errors.Errorf("unsupported type %q of column %q in table %q", colType.GoType, col.Name, name)
+			}
+			tbl.columns = append(tbl.columns, column{name: col.Name, typ: typ, rowIdx: i})
+		}
+		if mapping.TableType(t.Type) == mapping.PointTable {
+			tbl.geomType = geom.WKBPoint
+		}
+		db.tables[name] = tbl
+	}
+
+	for name, t := range m.GeneralizedTables {
+		if t.SQLFilter != "" {
+			log.Printf("[warn] sql_filter of generalized table %q is ignored by flatgeobuf", name)
+		}
+		db.tables[name] = &table{name: name, tolerance: t.Tolerance}
+	}
+	for name, t := range m.GeneralizedTables {
+		source, ok := db.tables[t.SourceTableName]
+		if !ok {
+			return nil, errors.Errorf("missing source table %q for generalized table %q", t.SourceTableName, name)
+		}
+		source.generalized = append(source.generalized, db.tables[name])
+	}
+	// generalized tables have the schema of their source table
+	for name := range m.Tables {
+		tbl := db.tables[name]
+		for _, gen := range tbl.generalized {
+			gen.inheritSchema(tbl)
+		}
+	}
+
+	if len(m.MergedTables) > 0 {
+		log.Println("[warn] merged tables are not supported by flatgeobuf")
+	}
+	return db, nil
+}
+
+func (tbl *table) inheritSchema(source *table) {
+	tbl.columns = source.columns
+	tbl.geomIdx = source.geomIdx
+	tbl.geomType = source.geomType
+	for _, gen := range tbl.generalized {
+		gen.inheritSchema(tbl)
+	}
+}
+
+// Init creates the directory and the temporary files for all tables.
+func (db *FlatGeobuf) Init() error {
+	if err := os.MkdirAll(db.dir, 0755); err != nil {
+		return errors.Wrap(err, "creating flatgeobuf dir")
+	}
+	for _, tbl := range db.tables {
+		f, err := os.Create(filepath.Join(db.dir, tbl.name+tmpSuffix))
+		if err != nil {
+			db.removeTmp()
+			return errors.Wrapf(err, "creating temporary file for table %q", tbl.name)
+		}
+		tbl.tmp = f
+		tbl.w = bufio.NewWriterSize(f, 256*1024)
+		tbl.size = 0
+		tbl.features = nil
+	}
+	db.initialized = true
+	return nil
+}
+
+func (db *FlatGeobuf) Begin() error {
+	if !db.initialized {
+		return errors.New("flatgeobuf does not support diff imports")
+	}
+	return nil
+}
+
+// End writes all buffered features into the temporary files.
+func (db *FlatGeobuf) End() error {
+	for _, tbl := range db.tables {
+		if err := tbl.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *FlatGeobuf) Abort() error {
+	db.removeTmp()
+	return nil
+}
+
+func (db *FlatGeobuf) Close() error {
+	db.removeTmp()
+	return nil
+}
+
+func (db *FlatGeobuf) removeTmp() {
+	for _, tbl := range db.tables {
+		if tbl.tmp == nil {
+			continue
+		}
+		tbl.tmp.Close()
+		os.Remove(tbl.tmp.Name())
+		tbl.tmp = nil
+		tbl.w = nil
+		tbl.features = nil
+	}
+	db.initialized = false
+}
+
+func (db *FlatGeobuf) InsertPoint(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	return db.insert(elem, &geom, matches)
+}
+
+func (db *FlatGeobuf) InsertLineString(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	return db.insert(elem, &geom, matches)
+}
+
+func (db *FlatGeobuf) InsertPolygon(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	return db.insert(elem, &geom, matches)
+}
+
+func (db *FlatGeobuf) insert(elem osm.Element, geom *geom.Geometry, matches []mapping.Match) error {
+	for _, match := range matches {
+		if err := db.write(match.Table.Name, match.Row(&elem, geom)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *FlatGeobuf) InsertRelationMember(rel osm.Relation, m osm.Member, mi int, parents []int64, geom geom.Geometry, matches []mapping.Match) error {
+	for _, match := range matches {
+		if err := db.write(match.Table.Name, match.MemberRow(&rel, &m, mi, parents, &geom)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes row into the table and the simplified geometry into all
+// generalized tables of the table.
+func (db *FlatGeobuf) write(tableName string, row []interface{}) error {
+	tbl, ok := db.tables[tableName]
+	if !ok {
+		return errors.Errorf("unknown table %q", tableName)
+	}
+	if tbl.geomIdx < 0 {
+		return tbl.write(nil, row)
+	}
+	if tbl.geomIdx >= len(row) {
+		return nil
+	}
+	wkbHex, ok := row[tbl.geomIdx].(string)
+	if !ok || wkbHex == "" {
+		return nil
+	}
+	g, err := geom.DecodeEWKBHex([]byte(wkbHex))
+	if err != nil {
+		return errors.Wrapf(err, "decoding geometry for table %q", tableName)
+	}
+	if err := tbl.write(g, row); err != nil {
+		return err
+	}
+	if len(tbl.generalized) == 0 {
+		return nil
+	}
+
+	wkb, err := hex.DecodeString(wkbHex)
+	if err != nil {
+		return errors.Wrapf(err, "decoding geometry for table %q", tableName)
+	}
+	gg := geosPool.Get().(*geos.Geos)
+	defer geosPool.Put(gg)
+	geosGeom := gg.FromWkb(wkb)
+	if geosGeom == nil {
+		return errors.Errorf("invalid geometry for table %q", tableName)
+	}
+	defer gg.Destroy(geosGeom)
+	return tbl.writeGeneralized(gg, geosGeom, row)
+}
+
+// writeGeneralized simplifies g for each generalized table. Generalized
+// tables of generalized tables are simplified from the already simplified
+// geometry, like the generalized tables in PostGIS.
+func (tbl *table) writeGeneralized(gg *geos.Geos, g *geos.Geom, row []interface{}) error {
+	for _, gen := range tbl.generalized {
+		simplified := gg.SimplifyPreserveTopology(g, gen.tolerance)
+		if simplified == nil {
+			log.Printf("[warn] unable to simplify geometry for table %q", gen.name)
+			continue
+		}
+		err := gen.writeGeos(gg, simplified, row)
+		gg.Destroy(simplified)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tbl *table) writeGeos(gg *geos.Geos, g *geos.Geom, row []interface{}) error {
+	decoded, err := geom.DecodeEWKB(gg.AsWkb(g))
+	if err != nil {
+		return errors.Wrapf(err, "encoding simplified geometry for table %q", tbl.name)
+	}
+	if err := tbl.write(decoded, row); err != nil {
+		return err
+	}
+	return tbl.writeGeneralized(gg, g, row)
+}
+
+// write encodes the feature into the temporary file. Features with empty
+// geometries are skipped for tables with geometries, as they can not be
+// indexed.
+func (tbl *table) write(g *geom.WKBGeometry, row []interface{}) error {
+	var b [4]float64
+	if tbl.geomIdx >= 0 {
+		var ok bool
+		if b, ok = bounds(g); !ok {
+			return nil
+		}
+	}
+	buf := encodeFeature(g, appendProperties(nil, tbl.columns, row))
+
+	tbl.mu.Lock()
+	defer tbl.mu.Unlock()
+	if tbl.w == nil {
+		return errors.New("flatgeobuf: write outside of import")
+	}
+	if _, err := tbl.w.Write(buf); err != nil {
+		return errors.Wrapf(err, "writing features of table %q", tbl.name)
+	}
+	tbl.features = append(tbl.features, feature{bounds: b, offset: tbl.size, size: uint32(len(buf))})
+	tbl.size += int64(len(buf))
+	return nil
+}
+
+func (tbl *table) flush() error {
+	tbl.mu.Lock()
+	defer tbl.mu.Unlock()
+	if tbl.w == nil {
+		return nil
+	}
+	if err := tbl.w.Flush(); err != nil {
+		return errors.Wrapf(err, "writing features of table %q", tbl.name)
+	}
+	return nil
+}
+
+// Generalize is a no-op, generalized tables are written during the
+// import.
+func (db *FlatGeobuf) Generalize() error { return nil }
+
+func (db *FlatGeobuf) EnableGeneralizeUpdates() {}
+func (db *FlatGeobuf) GeneralizeUpdates() error { return nil }
+
+// Optimize is a no-op, the files are always sorted by the index.
+func (db *FlatGeobuf) Optimize() error { return nil }
+
+// Finish writes the FlatGeobuf file with the spatial index for each table
+// and removes the temporary files.
+func (db *FlatGeobuf) Finish() error {
+	defer log.Step("Writing FlatGeobuf files")()
+	for _, tbl := range db.tables {
+		if err := tbl.flush(); err != nil {
+			return err
+		}
+		if tbl.tmp == nil {
+			continue
+		}
+		if err := tbl.writeFile(filepath.Join(db.dir, tbl.name+fileSuffix), db.srid); err != nil {
+			return err
+		}
+	}
+	db.removeTmp()
+	return nil
+}
+
+func (tbl *table) writeFile(path string, srid int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrapf(err, "creating file for table %q", tbl.name)
+	}
+	w := bufio.NewWriterSize(f, 256*1024)
+	if err := tbl.writeTo(w, srid); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "writing file for table %q", tbl.name)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "writing file for table %q", tbl.name)
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "closing file for table %q", tbl.name)
+	}
+	return nil
+}
+
+// writeTo writes the header, the index and all features from the
+// temporary file in index order.
+func (tbl *table) writeTo(w io.Writer, srid int) error {
+	h := header{
+		name:          tbl.name,
+		geometryType:  tbl.geomType,
+		columns:       tbl.columns,
+		featuresCount: uint64(len(tbl.features)),
+		srid:          srid,
+	}
+	indexed := tbl.geomIdx >= 0 && len(tbl.features) > 0
+	if indexed {
+		h.envelope = [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+		for _, f := range tbl.features {
+			h.envelope[0] = math.Min(h.envelope[0], f.bounds[0])
+			h.envelope[1] = math.Min(h.envelope[1], f.bounds[1])
+			h.envelope[2] = math.Max(h.envelope[2], f.bounds[2])
+			h.envelope[3] = math.Max(h.envelope[3], f.bounds[3])
+		}
+		h.indexNodeSize = defaultNodeSize
+		hilbertSort(tbl.features, h.envelope)
+	}
+
+	if _, err := w.Write(magic); err != nil {
+		return err
+	}
+	if _, err := w.Write(encodeHeader(&h)); err != nil {
+		return err
+	}
+
+	if indexed {
+		leaves := make([]node, len(tbl.features))
+		var offset uint64
+		for i, f := range tbl.features {
+			leaves[i] = node{bounds: f.bounds, offset: offset}
+			offset += uint64(f.size)
+		}
+		buf := make([]byte, 0, 64*nodeBytes)
+		for _, n := range packedRTree(leaves, defaultNodeSize) {
+			buf = appendNode(buf, n)
+			if len(buf) == cap(buf) {
+				if _, err := w.Write(buf); err != nil {
+					return err
+				}
+				buf = buf[:0]
+			}
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	var buf []byte
+	for _, f := range tbl.features {
+		if cap(buf) < int(f.size) {
+			buf = make([]byte, f.size)
+		}
+		buf = buf[:f.size]
+		if _, err := tbl.tmp.ReadAt(buf, f.offset); err != nil {
+			return errors.Wrap(err, "reading temporary file")
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	database.Register("flatgeobuf", New)
+}
@@ -0,0 +1,129 @@
+package flatgeobuf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/mapping"
+)
+
+const testMapping = `
+tables:
+  pois:
+    type: point
+    columns:
+    - {name: osm_id, type: id}
+    - {name: geometry, type: geometry}
+    - {name: name, type: string, key: name}
+    - {name: type, type: mapping_value}
+    mapping:
+      amenity: [__any__]
+`
+
+func TestImport(t *testing.T) {
+	m, err := mapping.New([]byte(testMapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "out")
+	conf := database.Config{ConnectionParams: "flatgeobuf:" + dir, Srid: 3857}
+
+	db, err := database.Open(conf, &m.Conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Begin(); err == nil {
+		t.Error("expected error for diff import")
+	}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	const numNodes = 40
+	for i := 0; i < numNodes; i++ {
+		node := osm.Node{Long: float64(i % 8), Lat: float64(i / 8)}
+		node.ID = int64(i + 1)
+		node.Tags = osm.Tags{"amenity": "cafe", "name": "Cafe"}
+		g := geom.Geometry{Wkb: geom.NodeAsEWKBHexPoint(node, 3857)}
+		if err := db.InsertPoint(node.Element, g, m.PointMatcher.MatchNode(&node)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.End(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.(database.Generalizer).Generalize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.(database.Finisher).Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "pois"+tmpSuffix)); !os.IsNotExist(err) {
+		t.Error("temporary file was not removed")
+	}
+	buf, err := os.ReadFile(filepath.Join(dir, "pois.fgb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf, magic) {
+		t.Fatal("missing magic bytes")
+	}
+	h, buf := sizePrefixedTable(t, buf[len(magic):])
+	if h.uint64(8) != numNodes || h.uint16(9) != defaultNodeSize {
+		t.Fatalf("unexpected header %d %d", h.uint64(8), h.uint16(9))
+	}
+	if env := h.float64s(1); env[0] != 0 || env[1] != 0 || env[2] != 7 || env[3] != 4 {
+		t.Errorf("unexpected envelope %v", env)
+	}
+	if cols := h.tables(7); len(cols) != 3 || cols[2].string(0) != "type" {
+		t.Errorf("unexpected columns")
+	}
+
+	numIndexNodes := levelBounds(numNodes, defaultNodeSize)[0][1]
+	index := buf[:numIndexNodes*nodeBytes]
+	features := buf[len(index):]
+
+	readNode := func(i int) node {
+		var n node
+		for j := range n.bounds {
+			n.bounds[j] = math.Float64frombits(binary.LittleEndian.Uint64(index[i*nodeBytes+8*j:]))
+		}
+		n.offset = binary.LittleEndian.Uint64(index[i*nodeBytes+32:])
+		return n
+	}
+	// the root contains the envelope
+	if root := readNode(0); root.bounds != [4]float64{0, 0, 7, 4} {
+		t.Errorf("unexpected root %v", root)
+	}
+
+	// each leaf points to the feature with the same point
+	seen := map[uint64]bool{}
+	for i := numIndexNodes - numNodes; i < numIndexNodes; i++ {
+		leaf := readNode(i)
+		f, _ := sizePrefixedTable(t, features[leaf.offset:])
+		xy := f.table(0).float64s(1)
+		if xy[0] != leaf.bounds[0] || xy[1] != leaf.bounds[1] {
+			t.Errorf("leaf %v does not match feature %v", leaf, xy)
+		}
+		props := f.bytes(1)
+		osmID := binary.LittleEndian.Uint64(props[2:])
+		if seen[osmID] {
+			t.Errorf("duplicate feature %d", osmID)
+		}
+		seen[osmID] = true
+	}
+	if len(seen) != numNodes {
+		t.Errorf("unexpected number of features %d", len(seen))
+	}
+}
@@ -0,0 +1,178 @@
+package flatgeobuf
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// defaultNodeSize is the number of children of each index node.
+const defaultNodeSize = 16
+
+// node is an entry of the packed R-tree. offset is the byte offset of the
+// feature for leaf nodes, and the index of the first child node otherwise.
+type node struct {
+	bounds [4]float64
+	offset uint64
+}
+
+const nodeBytes = 4*8 + 8
+
+// hilbertMax is the maximum value of the 16 bit Hilbert curve coordinates.
+const hilbertMax = (1 << 16) - 1
+
+// hilbert returns the position of x/y on a 16 bit Hilbert curve. This is
+// the same curve as used by the FlatGeobuf reference implementation.
+func hilbert(x, y uint32) uint32 {
+	a := x ^ y
+	b := 0xFFFF ^ a
+	c := 0xFFFF ^ (x | y)
+	d := x & (y ^ 0xFFFF)
+
+	A := a | (b >> 1)
+	B := (a >> 1) ^ a
+	C := ((c >> 1) ^ (b & (d >> 1))) ^ c
+	D := ((a & (c >> 1)) ^ (d >> 1)) ^ d
+
+	a = A
+	b = B
+	c = C
+	d = D
+	A = (a & (a >> 2)) ^ (b & (b >> 2))
+	B = (a & (b >> 2)) ^ (b & ((a ^ b) >> 2))
+	C ^= (a & (c >> 2)) ^ (b & (d >> 2))
+	D ^= (b & (c >> 2)) ^ ((a ^ b) & (d >> 2))
+
+	a = A
+	b = B
+	c = C
+	d = D
+	A = (a & (a >> 4)) ^ (b & (b >> 4))
+	B = (a & (b >> 4)) ^ (b & ((a ^ b) >> 4))
+	C ^= (a & (c >> 4)) ^ (b & (d >> 4))
+	D ^= (b & (c >> 4)) ^ ((a ^ b) & (d >> 4))
+
+	a = A
+	b = B
+	c = C
+	d = D
+	C ^= (a & (c >> 8)) ^ (b & (d >> 8))
+	D ^= (b & (c >> 8)) ^ ((a ^ b) & (d >> 8))
+
+	a = C ^ (C >> 1)
+	b = D ^ (D >> 1)
+
+	i0 := x ^ y
+	i1 := b | (0xFFFF ^ (i0 | a))
+
+	i0 = (i0 | (i0 << 8)) & 0x00FF00FF
+	i0 = (i0 | (i0 << 4)) & 0x0F0F0F0F
+	i0 = (i0 | (i0 << 2)) & 0x33333333
+	i0 = (i0 | (i0 << 1)) & 0x55555555
+
+	i1 = (i1 | (i1 << 8)) & 0x00FF00FF
+	i1 = (i1 | (i1 << 4)) & 0x0F0F0F0F
+	i1 = (i1 | (i1 << 2)) & 0x33333333
+	i1 = (i1 | (i1 << 1)) & 0x55555555
+
+	return (i1 << 1) | i0
+}
+
+// hilbertSort sorts features by the Hilbert value of the center of
+// their bounds within extent.
+func hilbertSort(features []feature, extent [4]float64) {
+	width := extent[2] - extent[0]
+	height := extent[3] - extent[1]
+	values := make([]uint32, len(features))
+	for i, f := range features {
+		var x, y uint32
+		if width > 0 {
+			x = uint32(math.Floor(hilbertMax * ((f.bounds[0]+f.bounds[2])/2 - extent[0]) / width))
+		}
+		if height > 0 {
+			y = uint32(math.Floor(hilbertMax * ((f.bounds[1]+f.bounds[3])/2 - extent[1]) / height))
+		}
+		values[i] = hilbert(x, y)
+	}
+	sort.Sort(byHilbert{features, values})
+}
+
+type byHilbert struct {
+	features []feature
+	values   []uint32
+}
+
+func (s byHilbert) Len() int { return len(s.features) }
+func (s byHilbert) Less(i, j int) bool {
+	// larger values first, like the reference implementation
+	return s.values[i] > s.values[j]
+}
+func (s byHilbert) Swap(i, j int) {
+	s.features[i], s.features[j] = s.features[j], s.features[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+
+// levelBounds returns the start and end node index of each level of the
+// tree, starting with the leaves.
+func levelBounds(numItems int, nodeSize int) [][2]int {
+	// number of nodes per level in bottom-up order
+	n := numItems
+	numNodes := n
+	levelNumNodes := []int{n}
+	for {
+		n = (n + nodeSize - 1) / nodeSize
+		numNodes += n
+		levelNumNodes = append(levelNumNodes, n)
+		if n == 1 {
+			break
+		}
+	}
+	// offsets per level in reversed storage order (top-down)
+	levelOffsets := make([]int, len(levelNumNodes))
+	n = numNodes
+	for i, size := range levelNumNodes {
+		levelOffsets[i] = n - size
+		n -= size
+	}
+	bounds := make([][2]int, len(levelNumNodes))
+	for i := range levelNumNodes {
+		bounds[i] = [2]int{levelOffsets[i], levelOffsets[i] + levelNumNodes[i]}
+	}
+	return bounds
+}
+
+// packedRTree builds the tree from the leaves in storage order. The root
+// node is the first node.
+func packedRTree(leaves []node, nodeSize int) []node {
+	levels := levelBounds(len(leaves), nodeSize)
+	// leaves are the last level
+	nodes := make([]node, levels[0][1])
+	copy(nodes[levels[0][0]:], leaves)
+
+	for i := 0; i < len(levels)-1; i++ {
+		pos := levels[i+1][0]
+		for child := levels[i][0]; child < levels[i][1]; child += nodeSize {
+			n := node{
+				bounds: [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)},
+				offset: uint64(child),
+			}
+			for j := child; j < child+nodeSize && j < levels[i][1]; j++ {
+				b := nodes[j].bounds
+				n.bounds[0] = math.Min(n.bounds[0], b[0])
+				n.bounds[1] = math.Min(n.bounds[1], b[1])
+				n.bounds[2] = math.Max(n.bounds[2], b[2])
+				n.bounds[3] = math.Max(n.bounds[3], b[3])
+			}
+			nodes[pos] = n
+			pos++
+		}
+	}
+	return nodes
+}
+
+func appendNode(buf []byte, n node) []byte {
+	for _, v := range n.bounds {
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+	}
+	return binary.LittleEndian.AppendUint64(buf, n.offset)
+}
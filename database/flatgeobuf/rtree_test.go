@@ -0,0 +1,73 @@
+package flatgeobuf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLevelBounds(t *testing.T) {
+	for _, tc := range []struct {
+		numItems int
+		expected [][2]int
+	}{
+		{1, [][2]int{{1, 2}, {0, 1}}},
+		{16, [][2]int{{1, 17}, {0, 1}}},
+		{17, [][2]int{{3, 20}, {1, 3}, {0, 1}}},
+		{300, [][2]int{{22, 322}, {3, 22}, {1, 3}, {0, 1}}},
+	} {
+		if b := levelBounds(tc.numItems, 16); !reflect.DeepEqual(b, tc.expected) {
+			t.Errorf("unexpected level bounds for %d items: %v", tc.numItems, b)
+		}
+	}
+}
+
+func TestPackedRTree(t *testing.T) {
+	leaves := make([]node, 20)
+	for i := range leaves {
+		f := float64(i)
+		leaves[i] = node{bounds: [4]float64{f, f, f + 1, f + 1}, offset: uint64(i * 100)}
+	}
+	nodes := packedRTree(leaves, 16)
+	if len(nodes) != 23 {
+		t.Fatalf("unexpected number of nodes %d", len(nodes))
+	}
+	if nodes[0].bounds != [4]float64{0, 0, 20, 20} || nodes[0].offset != 1 {
+		t.Errorf("unexpected root %v", nodes[0])
+	}
+	if nodes[1].bounds != [4]float64{0, 0, 16, 16} || nodes[1].offset != 3 {
+		t.Errorf("unexpected first node %v", nodes[1])
+	}
+	if nodes[2].bounds != [4]float64{16, 16, 20, 20} || nodes[2].offset != 19 {
+		t.Errorf("unexpected second node %v", nodes[2])
+	}
+	if !reflect.DeepEqual(nodes[3:], leaves) {
+		t.Error("unexpected leaves")
+	}
+}
+
+func TestHilbert(t *testing.T) {
+	if h := hilbert(0, 0); h != 0 {
+		t.Errorf("unexpected value for origin %d", h)
+	}
+	// each cell has a unique position on the curve
+	seen := map[uint32]bool{}
+	for x := uint32(0); x < 4; x++ {
+		for y := uint32(0); y < 4; y++ {
+			seen[hilbert(x, y)] = true
+		}
+	}
+	if len(seen) != 16 {
+		t.Errorf("hilbert values are not unique: %v", seen)
+	}
+
+	features := []feature{
+		{bounds: [4]float64{9, 9, 10, 10}},
+		{bounds: [4]float64{0, 0, 1, 1}},
+		{bounds: [4]float64{9, 0, 10, 1}},
+	}
+	hilbertSort(features, [4]float64{0, 0, 10, 10})
+	// descending order, the origin is last
+	if features[2].bounds[0] != 0 {
+		t.Errorf("unexpected order %v", features)
+	}
+}
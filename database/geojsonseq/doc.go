@@ -0,0 +1,5 @@
+/*
+Package geojsonseq implements the database interfaces for files with
+newline-delimited GeoJSON features.
+*/
+package geojsonseq
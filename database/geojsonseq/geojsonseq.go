@@ -0,0 +1,417 @@
+package geojsonseq
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/geom/geojson"
+	"github.com/omniscale/imposm3/log"
+	"github.com/omniscale/imposm3/mapping"
+	"github.com/omniscale/imposm3/mapping/config"
+	"github.com/omniscale/imposm3/proj"
+	"github.com/pkg/errors"
+)
+
+const (
+	fileSuffix = ".geojsonseq"
+	// changesFile contains all deletes and upserts of diff imports.
+	changesFile = "_changes" + fileSuffix
+	// coordPrecision is the number of decimal places of the coordinates
+	// (about 1cm).
+	coordPrecision = 7
+)
+
+// GeoJSONSeq writes each table into a file with one GeoJSON feature per
+// line. Diff imports append delete and upsert records to a single changes
+// file.
+type GeoJSONSeq struct {
+	dir    string
+	srid   int
+	tables map[string]*table
+	// importing is true after Init. Rows are written into the table files
+	// and not into the changes file.
+	importing bool
+	files     []*seqFile
+	changes   *seqFile
+}
+
+type table struct {
+	name string
+	// columns are the property names of all columns, empty for geometry
+	// columns
+	columns []string
+	// hstore is true for hstore_tags columns, which are written as JSON
+	// objects
+	hstore  []bool
+	geomIdx int
+	file    *seqFile
+}
+
+func New(conf database.Config, m *config.Mapping) (database.DB, error) {
+	dir := strings.TrimSpace(strings.TrimPrefix(conf.ConnectionParams, "geojsonseq:"))
+	if dir == "" {
+		return nil, errors.New("missing directory for geojsonseq, e.g. geojsonseq:/path/to/dir")
+	}
+	db := &GeoJSONSeq{
+		dir:    dir,
+		srid:   conf.Srid,
+		tables: make(map[string]*table),
+	}
+	for name, t := range m.Tables {
+		tbl := &table{name: name, geomIdx: -1}
+		for _, col := range t.Columns {
+			colType, err := mapping.MakeColumnType(col)
+			if err != nil {
+				return nil, errors.Wrapf(err, "creating column %q of table %q", col.Name, name)
+			}
+			if colType.GoType == "geometry" || colType.GoType == "validated_geometry" {
+				if tbl.geomIdx == -1 {
+					tbl.geomIdx = len(tbl.columns)
+				}
+				tbl.columns = append(tbl.columns, "")
+				tbl.hstore = append(tbl.hstore, false)
+				continue
+			}
+			tbl.columns = append(tbl.columns, col.Name)
+			tbl.hstore = append(tbl.hstore, colType.GoType == "hstore_string")
+		}
+		db.tables[name] = tbl
+	}
+	if len(m.GeneralizedTables) > 0 {
+		log.Println("[warn] generalized tables are not supported by geojsonseq")
+	}
+	return db, nil
+}
+
+// Init creates the directory and empty files for all tables.
+func (db *GeoJSONSeq) Init() error {
+	if err := os.MkdirAll(db.dir, 0755); err != nil {
+		return errors.Wrap(err, "creating geojsonseq dir")
+	}
+	for _, tbl := range db.tables {
+		f, err := os.Create(db.tablePath(tbl.name))
+		if err != nil {
+			return errors.Wrapf(err, "creating file for table %q", tbl.name)
+		}
+		f.Close()
+	}
+	db.importing = true
+	return nil
+}
+
+func (db *GeoJSONSeq) tablePath(name string) string {
+	return filepath.Join(db.dir, name+fileSuffix)
+}
+
+// Begin opens the table files after Init, or the changes file for diff
+// imports.
+func (db *GeoJSONSeq) Begin() error {
+	if !db.importing {
+		f, err := openSeqFile(filepath.Join(db.dir, changesFile))
+		if err != nil {
+			return err
+		}
+		db.changes = f
+		db.files = []*seqFile{f}
+		return nil
+	}
+	for _, tbl := range db.tables {
+		f, err := openSeqFile(db.tablePath(tbl.name))
+		if err != nil {
+			db.Abort()
+			return err
+		}
+		tbl.file = f
+		db.files = append(db.files, f)
+	}
+	return nil
+}
+
+// End writes all buffered features and closes the files.
+func (db *GeoJSONSeq) End() error {
+	var firstErr error
+	for _, f := range db.files {
+		if err := f.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	db.reset()
+	return firstErr
+}
+
+// Abort removes all features that were written since Begin.
+func (db *GeoJSONSeq) Abort() error {
+	var firstErr error
+	for _, f := range db.files {
+		if err := f.abort(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	db.reset()
+	return firstErr
+}
+
+func (db *GeoJSONSeq) reset() {
+	db.files = nil
+	db.changes = nil
+	for _, tbl := range db.tables {
+		tbl.file = nil
+	}
+}
+
+func (db *GeoJSONSeq) Close() error {
+	return nil
+}
+
+func (db *GeoJSONSeq) InsertPoint(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	return db.insert(elem, &geom, matches)
+}
+
+func (db *GeoJSONSeq) InsertLineString(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	return db.insert(elem, &geom, matches)
+}
+
+func (db *GeoJSONSeq) InsertPolygon(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	return db.insert(elem, &geom, matches)
+}
+
+func (db *GeoJSONSeq) insert(elem osm.Element, geom *geom.Geometry, matches []mapping.Match) error {
+	for _, match := range matches {
+		if err := db.write(match.Table.Name, elem.ID, match.Row(&elem, geom)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *GeoJSONSeq) InsertRelationMember(rel osm.Relation, m osm.Member, mi int, parents []int64, geom geom.Geometry, matches []mapping.Match) error {
+	for _, match := range matches {
+		if err := db.write(match.Table.Name, rel.ID, match.MemberRow(&rel, &m, mi, parents, &geom)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes row as feature into the table file, or as upsert into the
+// changes file.
+func (db *GeoJSONSeq) write(tableName string, id int64, row []interface{}) error {
+	tbl, ok := db.tables[tableName]
+	if !ok {
+		return errors.Errorf("unknown table %q", tableName)
+	}
+	f := tbl.file
+	op := ""
+	if db.changes != nil {
+		f = db.changes
+		op = "upsert"
+	}
+	if f == nil {
+		return errors.New("geojsonseq: write outside of transaction")
+	}
+	buf, err := tbl.appendFeature(nil, op, id, row, db.srid)
+	if err != nil {
+		return errors.Wrapf(err, "encoding feature %d for table %q", id, tableName)
+	}
+	return f.write(buf)
+}
+
+// Delete appends a delete record for each matched table to the changes
+// file.
+func (db *GeoJSONSeq) Delete(id int64, matches []mapping.Match) error {
+	if db.changes == nil {
+		return errors.New("geojsonseq: delete is only supported for diff imports")
+	}
+	for _, match := range matches {
+		if err := db.changes.write(appendDelete(nil, match.Table.Name, id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GeoJSONSeq implements the remaining methods of database.FullDB for diff
+// imports. There are no generalized tables or indices to update.
+
+func (db *GeoJSONSeq) Generalize() error        { return nil }
+func (db *GeoJSONSeq) EnableGeneralizeUpdates() {}
+func (db *GeoJSONSeq) GeneralizeUpdates() error { return nil }
+func (db *GeoJSONSeq) Optimize() error          { return nil }
+func (db *GeoJSONSeq) Finish() error            { return nil }
+
+// appendFeature appends row as GeoJSON feature with a trailing newline.
+// op and the table name are added as foreign members, if op is set.
+func (tbl *table) appendFeature(buf []byte, op string, id int64, row []interface{}, srid int) ([]byte, error) {
+	buf = append(buf, `{"type":"Feature",`...)
+	if op != "" {
+		buf = appendOp(buf, op, tbl.name)
+	}
+	buf = append(buf, `"id":`...)
+	buf = strconv.AppendInt(buf, id, 10)
+
+	buf = append(buf, `,"geometry":`...)
+	var err error
+	buf, err = appendGeometry(buf, row, tbl.geomIdx, srid)
+	if err != nil {
+		return nil, err
+	}
+
+	buf = append(buf, `,"properties":{`...)
+	first := true
+	for i, name := range tbl.columns {
+		if name == "" || i >= len(row) {
+			continue
+		}
+		if !first {
+			buf = append(buf, ',')
+		}
+		first = false
+		buf = appendJSON(buf, name)
+		buf = append(buf, ':')
+		if s, ok := row[i].(string); ok && tbl.hstore[i] {
+			tags, err := database.DecodeHstore(s)
+			if err != nil {
+				return nil, errors.Wrapf(err, "decoding hstore of column %q", name)
+			}
+			buf = appendJSON(buf, tags)
+			continue
+		}
+		buf = appendJSON(buf, row[i])
+	}
+	buf = append(buf, "}}\n"...)
+	return buf, nil
+}
+
+func appendDelete(buf []byte, tableName string, id int64) []byte {
+	buf = append(buf, `{"type":"Feature",`...)
+	buf = appendOp(buf, "delete", tableName)
+	buf = append(buf, `"id":`...)
+	buf = strconv.AppendInt(buf, id, 10)
+	buf = append(buf, `,"geometry":null,"properties":null}`+"\n"...)
+	return buf
+}
+
+func appendOp(buf []byte, op, tableName string) []byte {
+	buf = append(buf, `"op":`...)
+	buf = appendJSON(buf, op)
+	buf = append(buf, `,"table":`...)
+	buf = appendJSON(buf, tableName)
+	return append(buf, ',')
+}
+
+// appendGeometry appends the geometry of the row in EPSG:4326, or null if
+// the table has no geometry.
+func appendGeometry(buf []byte, row []interface{}, geomIdx int, srid int) ([]byte, error) {
+	if geomIdx < 0 || geomIdx >= len(row) {
+		return append(buf, "null"...), nil
+	}
+	wkb, ok := row[geomIdx].(string)
+	if !ok || wkb == "" {
+		return append(buf, "null"...), nil
+	}
+	g, err := geom.DecodeEWKBHex([]byte(wkb))
+	if err != nil {
+		return nil, err
+	}
+	if g.SRID != 0 {
+		srid = g.SRID
+	}
+	var transform geojson.Transform
+	if srid == 3857 {
+		transform = proj.MercToWgs
+	}
+	return geojson.AppendGeometry(buf, g, transform, coordPrecision), nil
+}
+
+func appendJSON(buf []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case float32:
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return append(buf, "null"...)
+		}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return append(buf, "null"...)
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return append(buf, "null"...)
+	}
+	return append(buf, b...)
+}
+
+// seqFile appends features to a file.
+type seqFile struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	// size of the file before Begin
+	size int64
+}
+
+func openSeqFile(path string) (*seqFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening geojsonseq file")
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "opening geojsonseq file")
+	}
+	return &seqFile{
+		path: path,
+		f:    f,
+		w:    bufio.NewWriterSize(f, 256*1024),
+		size: fi.Size(),
+	}, nil
+}
+
+func (s *seqFile) write(record []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(record); err != nil {
+		return errors.Wrapf(err, "writing %s", s.path)
+	}
+	return nil
+}
+
+func (s *seqFile) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		s.f.Close()
+		return errors.Wrapf(err, "writing %s", s.path)
+	}
+	if err := s.f.Close(); err != nil {
+		return errors.Wrapf(err, "closing %s", s.path)
+	}
+	return nil
+}
+
+// abort closes the file and removes everything that was written since
+// the file was opened.
+func (s *seqFile) abort() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.f.Close()
+	if err := os.Truncate(s.path, s.size); err != nil {
+		return errors.Wrapf(err, "truncating %s", s.path)
+	}
+	return nil
+}
+
+func init() {
+	database.Register("geojsonseq", New)
+}
@@ -0,0 +1,143 @@
+package geojsonseq
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/mapping"
+	"github.com/omniscale/imposm3/proj"
+)
+
+const testMapping = `
+tables:
+  pois:
+    type: point
+    columns:
+    - {name: osm_id, type: id}
+    - {name: geometry, type: geometry}
+    - {name: name, type: string, key: name}
+    - {name: type, type: mapping_value}
+    - {name: population, type: integer, key: population}
+    - {name: tags, type: hstore_tags, args: {include: [name, population]}}
+    mapping:
+      amenity: [__any__]
+      place: [city]
+`
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+}
+
+func TestImportAndDiff(t *testing.T) {
+	m, err := mapping.New([]byte(testMapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "out")
+	conf := database.Config{ConnectionParams: "geojsonseq:" + dir, Srid: 3857}
+
+	db, err := database.Open(conf, &m.Conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	x, y := proj.WgsToMerc(10, 53.5)
+	node := osm.Node{Long: x, Lat: y}
+	node.ID = 42
+	node.Tags = osm.Tags{"place": "city", "name": "Hamburg", "population": "1800000"}
+	g := geom.Geometry{Wkb: geom.NodeAsEWKBHexPoint(node, 3857)}
+	matches := m.PointMatcher.MatchNode(&node)
+	if len(matches) != 1 {
+		t.Fatal(matches)
+	}
+	if err := db.InsertPoint(node.Element, g, matches); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := readLines(t, filepath.Join(dir, "pois.geojsonseq"))
+	expected := `{"type":"Feature","id":42,"geometry":{"type":"Point","coordinates":[10,53.5]},` +
+		`"properties":{"osm_id":42,"name":"Hamburg","type":"city","population":1800000,` +
+		`"tags":{"name":"Hamburg","population":"1800000"}}}`
+	if len(lines) != 1 || lines[0] != expected {
+		t.Errorf("unexpected features %q", lines)
+	}
+
+	// diff import with a new DB without Init
+	db, err = database.Open(conf, &m.Conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fulldb := db.(database.FullDB)
+	if err := fulldb.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fulldb.Delete(42, matches); err != nil {
+		t.Fatal(err)
+	}
+	if err := fulldb.InsertPoint(node.Element, g, matches); err != nil {
+		t.Fatal(err)
+	}
+	if err := fulldb.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	// aborted changes are removed
+	if err := fulldb.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fulldb.Delete(42, matches); err != nil {
+		t.Fatal(err)
+	}
+	if err := fulldb.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines = readLines(t, filepath.Join(dir, "_changes.geojsonseq"))
+	if len(lines) != 2 {
+		t.Fatalf("unexpected changes %q", lines)
+	}
+	if lines[0] != `{"type":"Feature","op":"delete","table":"pois","id":42,"geometry":null,"properties":null}` {
+		t.Errorf("unexpected delete %s", lines[0])
+	}
+	var upsert map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &upsert); err != nil {
+		t.Fatal(err)
+	}
+	if upsert["op"] != "upsert" || upsert["table"] != "pois" || upsert["properties"].(map[string]interface{})["name"] != "Hamburg" {
+		t.Errorf("unexpected upsert %s", lines[1])
+	}
+
+	// the table file is not modified by diff imports
+	if lines := readLines(t, filepath.Join(dir, "pois.geojsonseq")); len(lines) != 1 {
+		t.Errorf("unexpected features %q", lines)
+	}
+}
+
+func TestMissingDir(t *testing.T) {
+	m, err := mapping.New([]byte(testMapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(database.Config{ConnectionParams: "geojsonseq:"}, &m.Conf); err == nil {
+		t.Error("expected error for missing dir")
+	}
+}
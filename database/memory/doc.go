@@ -0,0 +1,8 @@
+/*
+Package memory implements the database interfaces with tables in memory.
+
+The tables can be queried by OSM ID, by bounding box or with simple SQL
+conditions. Imports, deployments and diff imports behave like with PostGIS,
+so that the system tests can run without a database server.
+*/
+package memory
@@ -0,0 +1,1018 @@
+package memory
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/geom/geos"
+	"github.com/omniscale/imposm3/log"
+	"github.com/omniscale/imposm3/mapping"
+	"github.com/omniscale/imposm3/mapping/config"
+	"github.com/pkg/errors"
+)
+
+type tableSpec struct {
+	Name            string
+	FullName        string
+	Columns         []Column
+	GeometryType    string
+	Generalizations []*generalizedTableSpec
+	Merges          []*mergedTableSpec
+}
+
+type generalizedTableSpec struct {
+	Name              string
+	FullName          string
+	SourceName        string
+	Source            *tableSpec
+	SourceGeneralized *generalizedTableSpec
+	Tolerance         float64
+	Where             string
+	Generalizations   []*generalizedTableSpec
+}
+
+// sourceFullName returns the name of the table the rows are generalized
+// from, this is either the source table or a generalized table.
+func (spec *generalizedTableSpec) sourceFullName() string {
+	if spec.SourceGeneralized != nil {
+		return spec.SourceGeneralized.FullName
+	}
+	return spec.Source.FullName
+}
+
+type mergedTableSpec struct {
+	Name       string
+	FullName   string
+	SourceName string
+	Source     *tableSpec
+	GroupBy    []string
+	Tolerance  float64
+	Where      string
+	// Columns are the GroupBy columns and the geometry column of the source.
+	Columns []Column
+}
+
+// Memory stores all tables in memory. Tables are kept in a Store that
+// outlives the Memory, so that tables of an import can be deployed and
+// updated by later imports in the same process.
+type Memory struct {
+	Config            database.Config
+	Prefix            string
+	Tables            map[string]*tableSpec
+	GeneralizedTables map[string]*generalizedTableSpec
+	MergedTables      map[string]*mergedTableSpec
+	store             *Store
+
+	// journal contains all changes of the current transaction, it is nil
+	// for bulk imports and outside of transactions
+	journalMu sync.Mutex
+	journal   []change
+
+	updateGeneralizedTables bool
+	updateIDsMu             sync.Mutex
+	updatedIDs              map[string][]int64
+	// dirtyGroups contains the group values of modified merged tables
+	dirtyGroups map[string]map[string][]interface{}
+
+	pendingMu sync.Mutex
+	// pendingUpserts contains the new rows of all deleted OSM IDs for
+	// each table, if Config.Upsert is enabled
+	pendingUpserts map[string]map[int64][][]interface{}
+}
+
+// change is an inserted, updated or removed row that is reverted by Abort.
+type change struct {
+	table    *Table
+	row      *Row
+	inserted bool
+	// values are the previous values of an updated row
+	values []interface{}
+}
+
+// New returns a Memory for connections like memory:name?prefix=osm_.
+// All connections with the same name share the same tables.
+func New(conf database.Config, m *config.Mapping) (database.DB, error) {
+	name := strings.TrimSpace(strings.TrimPrefix(conf.ConnectionParams, "memory:"))
+	var query string
+	if i := strings.IndexByte(name, '?'); i >= 0 {
+		name, query = name[:i], name[i+1:]
+	}
+	opts, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing memory options")
+	}
+
+	db := &Memory{
+		Config:            conf,
+		Tables:            make(map[string]*tableSpec),
+		GeneralizedTables: make(map[string]*generalizedTableSpec),
+		MergedTables:      make(map[string]*mergedTableSpec),
+		store:             Lookup(name),
+	}
+	db.Prefix = opts.Get("prefix")
+	if db.Prefix == "NONE" {
+		db.Prefix = ""
+	} else {
+		if db.Prefix == "" {
+			db.Prefix = "osm_"
+		}
+		if !strings.HasSuffix(db.Prefix, "_") {
+			db.Prefix += "_"
+		}
+	}
+
+	if err := db.prepareTables(m); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// prepareTables creates the specs of all tables, generalized tables and
+// merged tables of the mapping.
+func (db *Memory) prepareTables(m *config.Mapping) error {
+	for name, t := range m.Tables {
+		spec := &tableSpec{
+			Name:         name,
+			FullName:     db.Prefix + name,
+			GeometryType: string(t.Type),
+		}
+		for _, col := range t.Columns {
+			colType, err := mapping.MakeColumnType(col)
+			if err != nil {
+				return errors.Wrapf(err, "creating table spec for %q", name)
+			}
+			spec.Columns = append(spec.Columns, Column{Name: col.Name, Type: colType.Name, goType: colType.GoType})
+		}
+		db.Tables[name] = spec
+	}
+
+	for name, t := range m.GeneralizedTables {
+		db.GeneralizedTables[name] = &generalizedTableSpec{
+			Name:       name,
+			FullName:   db.Prefix + name,
+			SourceName: t.SourceTableName,
+			Tolerance:  t.Tolerance,
+			Where:      t.SQLFilter,
+		}
+	}
+	for name, table := range db.GeneralizedTables {
+		if source, ok := db.Tables[table.SourceName]; ok {
+			table.Source = source
+		} else if source, ok := db.GeneralizedTables[table.SourceName]; ok {
+			table.SourceGeneralized = source
+		} else {
+			return errors.Errorf("missing source %q for generalized table %q", table.SourceName, name)
+		}
+	}
+	for _, name := range db.sortedGeneralizedTables() {
+		table := db.GeneralizedTables[name]
+		if table.SourceGeneralized != nil {
+			table.Source = table.SourceGeneralized.Source
+			table.SourceGeneralized.Generalizations = append(table.SourceGeneralized.Generalizations, table)
+		}
+		table.Source.Generalizations = append(table.Source.Generalizations, table)
+	}
+
+	for name, t := range m.MergedTables {
+		source, ok := db.Tables[t.SourceTableName]
+		if !ok {
+			return errors.Errorf("missing source %q for merged table %q", t.SourceTableName, name)
+		}
+		if source.GeometryType != "linestring" {
+			return errors.Errorf("merged table %q: source %q is not a linestring table", name, t.SourceTableName)
+		}
+		spec := &mergedTableSpec{
+			Name:       name,
+			FullName:   db.Prefix + name,
+			SourceName: t.SourceTableName,
+			Source:     source,
+			GroupBy:    t.GroupBy,
+			Tolerance:  t.Tolerance,
+			Where:      t.SQLFilter,
+		}
+		for _, groupBy := range t.GroupBy {
+			found := false
+			for _, col := range source.Columns {
+				if col.Name == groupBy && !isGeometry(col) {
+					spec.Columns = append(spec.Columns, col)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return errors.Errorf("merged table %q: group_by column %q not found in source %q", name, groupBy, t.SourceTableName)
+			}
+		}
+		found := false
+		for _, col := range source.Columns {
+			if isGeometry(col) {
+				spec.Columns = append(spec.Columns, col)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("merged table %q: source %q has no geometry column", name, t.SourceTableName)
+		}
+		source.Merges = append(source.Merges, spec)
+		db.MergedTables[name] = spec
+	}
+	return nil
+}
+
+func isGeometry(col Column) bool {
+	return col.goType == "geometry" || col.goType == "validated_geometry"
+}
+
+// sortedGeneralizedTables returns the names of all generalized tables,
+// sources before the tables that are generalized from them.
+func (db *Memory) sortedGeneralizedTables() []string {
+	added := map[string]bool{}
+	sorted := []string{}
+
+	for len(db.GeneralizedTables) > len(sorted) {
+		for _, tbl := range db.GeneralizedTables {
+			if _, ok := added[tbl.Name]; !ok {
+				if tbl.SourceGeneralized == nil || added[tbl.SourceGeneralized.Name] {
+					added[tbl.Name] = true
+					sorted = append(sorted, tbl.Name)
+				}
+			}
+		}
+	}
+	return sorted
+}
+
+// Init creates all tables and drops existing data.
+func (db *Memory) Init() error {
+	for _, spec := range db.Tables {
+		t := newTable(spec.FullName, spec.Columns)
+		if t.column("id") == -1 {
+			// PostGIS tables have a PRIMARY KEY of the serial and the OSM
+			// ID if the mapping has no id column
+			t.Indices = append(t.Indices, spec.FullName+"_pkey")
+		}
+		db.store.putTable(db.Config.ImportSchema, t)
+	}
+	return nil
+}
+
+// table returns the table from the import schema.
+func (db *Memory) table(fullName string) (*Table, error) {
+	t := db.store.Table(db.Config.ImportSchema, fullName)
+	if t == nil {
+		return nil, errors.Errorf("table %q does not exist in %q", fullName, db.Config.ImportSchema)
+	}
+	return t, nil
+}
+
+func (db *Memory) Begin() error {
+	db.journalMu.Lock()
+	db.journal = []change{}
+	db.journalMu.Unlock()
+	if db.Config.Upsert {
+		db.pendingUpserts = make(map[string]map[int64][][]interface{})
+	}
+	return nil
+}
+
+// BeginBulk starts an import without journal, Abort can not revert bulk
+// imports.
+func (db *Memory) BeginBulk() error {
+	db.journalMu.Lock()
+	db.journal = nil
+	db.journalMu.Unlock()
+	return nil
+}
+
+func (db *Memory) End() error {
+	if err := db.flushUpserts(); err != nil {
+		return err
+	}
+	db.pendingUpserts = nil
+	db.journalMu.Lock()
+	db.journal = nil
+	db.journalMu.Unlock()
+	return nil
+}
+
+// Abort reverts all changes since Begin.
+func (db *Memory) Abort() error {
+	db.pendingUpserts = nil
+	db.journalMu.Lock()
+	defer db.journalMu.Unlock()
+	for i := len(db.journal) - 1; i >= 0; i-- {
+		c := db.journal[i]
+		if c.values != nil {
+			c.table.replace(c.row, c.values)
+		} else if c.inserted {
+			c.table.remove(c.row)
+		} else {
+			c.table.restore(c.row)
+		}
+	}
+	db.journal = nil
+	return nil
+}
+
+// Close keeps all tables in the store, see Remove.
+func (db *Memory) Close() error {
+	return nil
+}
+
+func (db *Memory) record(c change) {
+	db.journalMu.Lock()
+	if db.journal != nil {
+		db.journal = append(db.journal, c)
+	}
+	db.journalMu.Unlock()
+}
+
+// insertRow inserts the row into the table of the mapping. The row is
+// collected for flushUpserts if the OSM ID of the row was deleted in upsert
+// mode.
+func (db *Memory) insertRow(table string, values []interface{}) error {
+	spec := db.Tables[table]
+	if db.pendingUpserts != nil {
+		t, err := db.table(spec.FullName)
+		if err != nil {
+			return err
+		}
+		db.pendingMu.Lock()
+		if pending, ok := db.pendingUpserts[table]; ok && t.idIdx != -1 && t.idIdx < len(values) {
+			if id, ok := values[t.idIdx].(int64); ok {
+				if rows, ok := pending[id]; ok {
+					pending[id] = append(rows, values)
+					db.pendingMu.Unlock()
+					return nil
+				}
+			}
+		}
+		db.pendingMu.Unlock()
+	}
+	return db.insert(spec.FullName, values)
+}
+
+// flushUpserts updates the existing rows of all deleted OSM IDs with the
+// collected rows. Rows are updated in place if any value changed,
+// additional rows are inserted and remaining rows are removed.
+func (db *Memory) flushUpserts() error {
+	db.pendingMu.Lock()
+	defer db.pendingMu.Unlock()
+	for table, pending := range db.pendingUpserts {
+		fullName := db.Tables[table].FullName
+		t, err := db.table(fullName)
+		if err != nil {
+			return err
+		}
+		for id, rows := range pending {
+			existing := t.ByID(id)
+			for i, values := range rows {
+				if i >= len(existing) {
+					if err := db.insert(fullName, values); err != nil {
+						return err
+					}
+					continue
+				}
+				prev, changed, err := t.update(existing[i], values)
+				if err != nil {
+					return errors.Wrapf(err, "updating %d in %q", id, fullName)
+				}
+				if changed {
+					db.record(change{table: t, row: existing[i], values: prev})
+				}
+			}
+			for _, row := range existing[min(len(rows), len(existing)):] {
+				t.remove(row)
+				db.record(change{table: t, row: row})
+			}
+		}
+		delete(db.pendingUpserts, table)
+	}
+	return nil
+}
+
+func (db *Memory) insert(fullName string, values []interface{}) error {
+	t, err := db.table(fullName)
+	if err != nil {
+		return err
+	}
+	row, err := t.insert(values)
+	if err != nil {
+		return errors.Wrapf(err, "inserting into %q", fullName)
+	}
+	db.record(change{table: t, row: row, inserted: true})
+	return nil
+}
+
+// deleteID removes all rows with the OSM ID from the table.
+func (db *Memory) deleteID(fullName string, id int64) error {
+	t, err := db.table(fullName)
+	if err != nil {
+		return err
+	}
+	for _, row := range t.ByID(id) {
+		t.remove(row)
+		db.record(change{table: t, row: row})
+	}
+	return nil
+}
+
+func (db *Memory) InsertPoint(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	for _, match := range matches {
+		row := match.Row(&elem, &geom)
+		if err := db.insertRow(match.Table.Name, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Memory) InsertLineString(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	for _, match := range matches {
+		row := match.Row(&elem, &geom)
+		if err := db.insertRow(match.Table.Name, row); err != nil {
+			return err
+		}
+	}
+	if db.updateGeneralizedTables {
+		db.updateIDsMu.Lock()
+		for _, generalizedTable := range db.generalizedFromMatches(matches) {
+			db.updatedIDs[generalizedTable.Name] = append(db.updatedIDs[generalizedTable.Name], elem.ID)
+		}
+		for _, match := range matches {
+			for _, mergedTable := range db.Tables[match.Table.Name].Merges {
+				db.updatedIDs[mergedTable.Name] = append(db.updatedIDs[mergedTable.Name], elem.ID)
+			}
+		}
+		db.updateIDsMu.Unlock()
+	}
+	return nil
+}
+
+// subdividePool contains the GEOS handles for subdivided polygons. Rows
+// are inserted concurrently by all writer goroutines.
+var subdividePool = sync.Pool{
+	New: func() interface{} {
+		return geos.NewGeos()
+	},
+}
+
+func (db *Memory) InsertPolygon(elem osm.Element, geometry geom.Geometry, matches []mapping.Match) error {
+	var g *geos.Geos
+	for _, match := range matches {
+		if maxVertices := match.Subdivide(); maxVertices > 0 {
+			if g == nil {
+				g = subdividePool.Get().(*geos.Geos)
+				defer subdividePool.Put(g)
+				// parts are encoded as EWKB with the SRID of the columns
+				g.SetHandleSrid(db.Config.Srid)
+			}
+			parts, err := geom.SubdivideGeometry(g, geometry, maxVertices)
+			if err != nil {
+				return errors.Wrapf(err, "subdividing %d for %q", elem.ID, match.Table.Name)
+			}
+			for _, part := range parts {
+				row := match.Row(&elem, &part)
+				if err := db.insertRow(match.Table.Name, row); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		row := match.Row(&elem, &geometry)
+		if err := db.insertRow(match.Table.Name, row); err != nil {
+			return err
+		}
+	}
+	if db.updateGeneralizedTables {
+		db.updateIDsMu.Lock()
+		for _, generalizedTable := range db.generalizedFromMatches(matches) {
+			db.updatedIDs[generalizedTable.Name] = append(db.updatedIDs[generalizedTable.Name], elem.ID)
+		}
+		db.updateIDsMu.Unlock()
+	}
+	return nil
+}
+
+func (db *Memory) InsertRelationMember(rel osm.Relation, m osm.Member, mi int, parents []int64, geom geom.Geometry, matches []mapping.Match) error {
+	for _, match := range matches {
+		row := match.MemberRow(&rel, &m, mi, parents, &geom)
+		if err := db.insertRow(match.Table.Name, row); err != nil {
+			return err
+		}
+	}
+	if db.updateGeneralizedTables && mi == 0 {
+		db.updateIDsMu.Lock()
+		for _, generalizedTable := range db.generalizedFromMatches(matches) {
+			db.updatedIDs[generalizedTable.Name] = append(db.updatedIDs[generalizedTable.Name], rel.ID)
+		}
+		db.updateIDsMu.Unlock()
+	}
+	return nil
+}
+
+func (db *Memory) Delete(id int64, matches []mapping.Match) error {
+	if db.updateGeneralizedTables {
+		// remember groups of merged tables before the source row is removed
+		for _, match := range matches {
+			for _, mergedTable := range db.Tables[match.Table.Name].Merges {
+				if err := db.markDirtyGroup(mergedTable, id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, match := range matches {
+		if db.pendingUpserts != nil {
+			// keep rows until flushUpserts
+			db.pendingMu.Lock()
+			if db.pendingUpserts[match.Table.Name] == nil {
+				db.pendingUpserts[match.Table.Name] = make(map[int64][][]interface{})
+			}
+			db.pendingUpserts[match.Table.Name][id] = [][]interface{}{}
+			db.pendingMu.Unlock()
+			continue
+		}
+		if err := db.deleteID(db.Tables[match.Table.Name].FullName, id); err != nil {
+			return errors.Wrapf(err, "deleting %d from %q", id, match.Table.Name)
+		}
+	}
+	if db.updateGeneralizedTables {
+		for _, generalizedTable := range db.generalizedFromMatches(matches) {
+			if err := db.deleteID(generalizedTable.FullName, id); err != nil {
+				return errors.Wrapf(err, "deleting %d from %q", id, generalizedTable.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (db *Memory) generalizedFromMatches(matches []mapping.Match) []*generalizedTableSpec {
+	generalizedTables := []*generalizedTableSpec{}
+	for _, match := range matches {
+		tbl := db.Tables[match.Table.Name]
+		generalizedTables = append(generalizedTables, tbl.Generalizations...)
+	}
+	return generalizedTables
+}
+
+func (db *Memory) EnableGeneralizeUpdates() {
+	db.updateGeneralizedTables = true
+	db.updatedIDs = make(map[string][]int64)
+	db.dirtyGroups = make(map[string]map[string][]interface{})
+}
+
+// Generalize creates all generalized and merged tables.
+func (db *Memory) Generalize() error {
+	if len(db.GeneralizedTables) == 0 && len(db.MergedTables) == 0 {
+		return nil
+	}
+	defer log.Step("Creating generalized tables")()
+
+	g := geos.NewGeos()
+	defer g.Finish()
+	g.SetHandleSrid(db.Config.Srid)
+
+	for _, name := range db.sortedGeneralizedTables() {
+		if err := db.generalizeTable(g, db.GeneralizedTables[name]); err != nil {
+			return err
+		}
+	}
+	for _, table := range db.MergedTables {
+		if err := db.mergeTable(g, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Memory) generalizeTable(g *geos.Geos, spec *generalizedTableSpec) error {
+	defer log.Step(fmt.Sprintf("Generalizing %s into %s", spec.sourceFullName(), spec.FullName))()
+
+	source, err := db.table(spec.sourceFullName())
+	if err != nil {
+		return err
+	}
+	t := newTable(spec.FullName, spec.Source.Columns)
+	rows, err := db.generalizedRows(g, spec, source, source.Rows())
+	if err != nil {
+		return err
+	}
+	for _, values := range rows {
+		if _, err := t.insert(values); err != nil {
+			return errors.Wrapf(err, "inserting into %q", spec.FullName)
+		}
+	}
+	db.store.putTable(db.Config.ImportSchema, t)
+	return nil
+}
+
+// generalizedRows returns the values of all rows that match the filter of
+// the generalized table, with simplified geometries.
+func (db *Memory) generalizedRows(g *geos.Geos, spec *generalizedTableSpec, source *Table, rows []*Row) ([][]interface{}, error) {
+	var f *filter
+	if spec.Where != "" {
+		var err error
+		f, err = compileFilter(spec.Where, source.Columns)
+		if err != nil {
+			return nil, errors.Wrapf(err, "sql_filter of %q", spec.Name)
+		}
+	}
+	var result [][]interface{}
+	for _, row := range rows {
+		if f != nil && !f.match(row) {
+			continue
+		}
+		values := append([]interface{}(nil), row.Values...)
+		for i, col := range source.Columns {
+			wkb, ok := values[i].(string)
+			if !isGeometry(col) || !ok {
+				continue
+			}
+			simplified, err := simplify(g, wkb, spec.Tolerance, col.goType == "validated_geometry")
+			if err != nil {
+				return nil, errors.Wrapf(err, "generalizing %d for %q", row.ID, spec.Name)
+			}
+			values[i] = simplified
+		}
+		result = append(result, values)
+	}
+	return result, nil
+}
+
+// simplify returns the hex EWKB geometry simplified with
+// SimplifyPreserveTopology, and made valid if validate is true.
+func simplify(g *geos.Geos, wkbHex string, tolerance float64, validate bool) (string, error) {
+	wkb, err := hex.DecodeString(wkbHex)
+	if err != nil {
+		return "", err
+	}
+	geom := g.FromWkb(wkb)
+	if geom == nil {
+		return "", errors.New("invalid geometry")
+	}
+	defer g.Destroy(geom)
+	simplified := g.SimplifyPreserveTopology(geom, tolerance)
+	if simplified == nil {
+		return "", errors.New("simplifying geometry")
+	}
+	if validate {
+		if t := g.Type(simplified); t == "Polygon" || t == "MultiPolygon" {
+			simplified, err = g.MakeValid(simplified)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	defer g.Destroy(simplified)
+	return string(g.AsEwkbHex(simplified)), nil
+}
+
+func (db *Memory) mergeTable(g *geos.Geos, spec *mergedTableSpec) error {
+	defer log.Step(fmt.Sprintf("Merging %s into %s", spec.Source.FullName, spec.FullName))()
+
+	source, err := db.table(spec.Source.FullName)
+	if err != nil {
+		return err
+	}
+	t := newTable(spec.FullName, spec.Columns)
+	if err := db.mergeRows(g, spec, source, t, nil); err != nil {
+		return err
+	}
+	db.store.putTable(db.Config.ImportSchema, t)
+	return nil
+}
+
+// mergeRows merges the linestrings of all groups of source into t. Only
+// the group is merged if group is not nil.
+func (db *Memory) mergeRows(g *geos.Geos, spec *mergedTableSpec, source, t *Table, group []interface{}) error {
+	var f *filter
+	if spec.Where != "" {
+		var err error
+		f, err = compileFilter(spec.Where, source.Columns)
+		if err != nil {
+			return errors.Wrapf(err, "sql_filter of %q", spec.Name)
+		}
+	}
+
+	groupIdx := make([]int, len(spec.GroupBy))
+	for i, name := range spec.GroupBy {
+		groupIdx[i] = source.column(name)
+	}
+	geomIdx := source.column(spec.Columns[len(spec.Columns)-1].Name)
+
+	var keys []string
+	groups := make(map[string][]interface{})
+	lines := make(map[string][]*geos.Geom)
+	defer func() {
+		for _, geoms := range lines {
+			for _, geom := range geoms {
+				g.Destroy(geom)
+			}
+		}
+	}()
+	for _, row := range source.Rows() {
+		if f != nil && !f.match(row) {
+			continue
+		}
+		values := make([]interface{}, len(groupIdx))
+		for i, idx := range groupIdx {
+			values[i] = row.Values[idx]
+		}
+		if group != nil && !equalGroup(group, values) {
+			continue
+		}
+		wkbHex, ok := row.Values[geomIdx].(string)
+		if !ok {
+			continue
+		}
+		wkb, err := hex.DecodeString(wkbHex)
+		if err != nil {
+			return errors.Wrapf(err, "decoding geometry of %d from %q", row.ID, source.Name)
+		}
+		geom := g.FromWkb(wkb)
+		if geom == nil {
+			return errors.Errorf("invalid geometry of %d from %q", row.ID, source.Name)
+		}
+		key := fmt.Sprintf("%#v", values)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+			groups[key] = values
+		}
+		lines[key] = append(lines[key], geom)
+	}
+
+	for _, key := range keys {
+		merged := g.LineMerge(lines[key])
+		// LineMerge takes ownership of the lines
+		delete(lines, key)
+		for _, line := range merged {
+			if spec.Tolerance > 0 {
+				simplified := g.SimplifyPreserveTopology(line, spec.Tolerance)
+				g.Destroy(line)
+				if simplified == nil {
+					return errors.Errorf("simplifying merged geometry for %q", spec.Name)
+				}
+				line = simplified
+			}
+			values := append(append([]interface{}(nil), groups[key]...), string(g.AsEwkbHex(line)))
+			g.Destroy(line)
+			row, err := t.insert(values)
+			if err != nil {
+				return errors.Wrapf(err, "inserting into %q", spec.FullName)
+			}
+			db.record(change{table: t, row: row, inserted: true})
+		}
+	}
+	return nil
+}
+
+// equalGroup compares the group values, NULL values are equal like IS NOT
+// DISTINCT FROM.
+func equalGroup(a, b []interface{}) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// GeneralizeUpdates updates all generalized and merged tables with the
+// modified rows of a diff import.
+func (db *Memory) GeneralizeUpdates() error {
+	if err := db.flushUpserts(); err != nil {
+		return err
+	}
+	if len(db.GeneralizedTables) == 0 && len(db.MergedTables) == 0 {
+		return nil
+	}
+	defer log.Step("Updating generalized tables")()
+
+	g := geos.NewGeos()
+	defer g.Finish()
+	g.SetHandleSrid(db.Config.Srid)
+
+	for _, name := range db.sortedGeneralizedTables() {
+		spec := db.GeneralizedTables[name]
+		ids, ok := db.updatedIDs[name]
+		if !ok {
+			continue
+		}
+		source, err := db.table(spec.sourceFullName())
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			rows, err := db.generalizedRows(g, spec, source, source.ByID(id))
+			if err != nil {
+				return err
+			}
+			for _, values := range rows {
+				if err := db.insert(spec.FullName, values); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := db.mergeUpdates(g); err != nil {
+		return err
+	}
+	db.updatedIDs = make(map[string][]int64) // reset for multiple diff imports in same tx
+	db.dirtyGroups = make(map[string]map[string][]interface{})
+	return nil
+}
+
+// mergeUpdates recreates the merged linestrings of all groups that were
+// modified since the last update.
+func (db *Memory) mergeUpdates(g *geos.Geos) error {
+	for name, spec := range db.MergedTables {
+		for _, id := range db.updatedIDs[name] {
+			if err := db.markDirtyGroup(spec, id); err != nil {
+				return err
+			}
+		}
+		if len(db.dirtyGroups[name]) == 0 {
+			continue
+		}
+		source, err := db.table(spec.Source.FullName)
+		if err != nil {
+			return err
+		}
+		t, err := db.table(spec.FullName)
+		if err != nil {
+			return err
+		}
+		for _, group := range db.dirtyGroups[name] {
+			for _, row := range t.Rows() {
+				if equalGroup(group, row.Values[:len(group)]) {
+					t.remove(row)
+					db.record(change{table: t, row: row})
+				}
+			}
+			if err := db.mergeRows(g, spec, source, t, group); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// markDirtyGroup marks the groups of the source rows with id for update
+// of the merged table.
+func (db *Memory) markDirtyGroup(spec *mergedTableSpec, id int64) error {
+	source, err := db.table(spec.Source.FullName)
+	if err != nil {
+		return err
+	}
+	for _, row := range source.ByID(id) {
+		group := make([]interface{}, len(spec.GroupBy))
+		for i, name := range spec.GroupBy {
+			group[i] = row.Value(name)
+		}
+		key := fmt.Sprintf("%#v", group)
+		db.updateIDsMu.Lock()
+		if db.dirtyGroups[spec.Name] == nil {
+			db.dirtyGroups[spec.Name] = make(map[string][]interface{})
+		}
+		db.dirtyGroups[spec.Name][key] = group
+		db.updateIDsMu.Unlock()
+	}
+	return nil
+}
+
+// Optimize does nothing, rows are not clustered in memory.
+func (db *Memory) Optimize() error {
+	return nil
+}
+
+// Finish adds the names of the indices that PostGIS creates to all tables.
+func (db *Memory) Finish() error {
+	for _, spec := range db.Tables {
+		if err := db.addIndices(spec.FullName, spec.Columns, false); err != nil {
+			return err
+		}
+	}
+	for _, spec := range db.GeneralizedTables {
+		if err := db.addIndices(spec.FullName, spec.Source.Columns, true); err != nil {
+			return err
+		}
+	}
+	for _, spec := range db.MergedTables {
+		if err := db.addIndices(spec.FullName, spec.Columns, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Memory) addIndices(fullName string, columns []Column, generalizedTable bool) error {
+	t, err := db.table(fullName)
+	if err != nil {
+		return err
+	}
+	for _, name := range indexNames(fullName, columns, generalizedTable) {
+		t.addIndex(name)
+	}
+	return nil
+}
+
+// indexNames returns the names of the geometry, OSM ID and member indices
+// that PostGIS creates in Finish.
+func indexNames(tableName string, columns []Column, generalizedTable bool) []string {
+	var names []string
+	foundIDCol := false
+	for _, col := range columns {
+		if col.Name == "id" {
+			foundIDCol = true
+		}
+	}
+	for _, col := range columns {
+		if isGeometry(col) {
+			names = append(names, tableName+"_geom")
+		}
+		if col.Type == "id" && (foundIDCol || generalizedTable) {
+			names = append(names, tableName+"_"+col.Name+"_idx")
+		}
+	}
+	var memberCols int
+	for _, name := range []string{"member_parent_id", "member_id"} {
+		for _, col := range columns {
+			if col.Type == name {
+				memberCols++
+				break
+			}
+		}
+	}
+	if memberCols == 2 {
+		names = append(names, tableName+"_member_idx")
+	}
+	return names
+}
+
+func (db *Memory) Deploy() error {
+	return db.rotate(db.Config.ImportSchema, db.Config.ProductionSchema, db.Config.BackupSchema)
+}
+
+func (db *Memory) RevertDeploy() error {
+	return db.rotate(db.Config.BackupSchema, db.Config.ProductionSchema, db.Config.ImportSchema)
+}
+
+func (db *Memory) rotate(source, dest, backup string) error {
+	defer log.Step("Rotating tables")()
+
+	for _, tableName := range db.tableNames() {
+		tableName = db.Prefix + tableName
+
+		log.Printf("[info] Rotating %s from %s -> %s -> %s", tableName, source, dest, backup)
+
+		if db.store.Table(source, tableName) == nil {
+			log.Printf("[warn] skipping rotate of %s, table does not exists in %s", tableName, source)
+			continue
+		}
+		if db.store.Table(dest, tableName) != nil {
+			log.Printf("[info] backup of %s, to %s", tableName, backup)
+			db.store.dropTable(backup, tableName)
+			db.store.moveTable(tableName, dest, backup)
+		}
+		db.store.moveTable(tableName, source, dest)
+	}
+	return nil
+}
+
+func (db *Memory) RemoveBackup() error {
+	backup := db.Config.BackupSchema
+	for _, tableName := range db.tableNames() {
+		tableName = db.Prefix + tableName
+		if db.store.dropTable(backup, tableName) != nil {
+			log.Printf("[info] removing backup of %s from %s", tableName, backup)
+		}
+	}
+	return nil
+}
+
+// tableNames returns a list of all tables (without prefix).
+func (db *Memory) tableNames() []string {
+	var names []string
+	for name := range db.Tables {
+		names = append(names, name)
+	}
+	for name := range db.GeneralizedTables {
+		names = append(names, name)
+	}
+	for name := range db.MergedTables {
+		names = append(names, name)
+	}
+	return names
+}
+
+func init() {
+	database.Register("memory", New)
+}
@@ -0,0 +1,287 @@
+package memory
+
+import (
+	"testing"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/geom/geos"
+	"github.com/omniscale/imposm3/mapping"
+)
+
+const testMapping = `
+tables:
+  pois:
+    type: point
+    columns:
+    - {name: osm_id, type: id}
+    - {name: geometry, type: geometry}
+    - {name: name, type: string, key: name}
+    - {name: type, type: mapping_value}
+    - {name: tags, type: hstore_tags}
+    mapping:
+      amenity: [__any__]
+`
+
+func openTestDB(t *testing.T, name string) (database.FullDB, *mapping.Mapping) {
+	t.Helper()
+	return openTestDBConfig(t, name, false)
+}
+
+func openTestDBConfig(t *testing.T, name string, upsert bool) (database.FullDB, *mapping.Mapping) {
+	t.Helper()
+	m, err := mapping.New([]byte(testMapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Remove(name) })
+	conf := database.Config{
+		ConnectionParams: "memory:" + name,
+		Srid:             3857,
+		ImportSchema:     "import",
+		ProductionSchema: "production",
+		BackupSchema:     "backup",
+		Upsert:           upsert,
+	}
+	db, err := database.Open(conf, &m.Conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db.(database.FullDB), m
+}
+
+func insertNodes(t *testing.T, db database.FullDB, m *mapping.Mapping, ids ...int64) {
+	t.Helper()
+	for _, id := range ids {
+		node := osm.Node{Long: float64(id), Lat: float64(id) / 2}
+		node.ID = id
+		node.Tags = osm.Tags{"amenity": "cafe", "name": "Cafe"}
+		g := geom.Geometry{Wkb: geom.NodeAsEWKBHexPoint(node, 3857)}
+		if err := db.InsertPoint(node.Element, g, m.PointMatcher.MatchNode(&node)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	db, m := openTestDB(t, "test_import")
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.(database.BulkBeginner).BeginBulk(); err != nil {
+		t.Fatal(err)
+	}
+	insertNodes(t, db, m, 1, 2, 3)
+	for _, f := range []func() error{db.End, db.Generalize, db.Finish} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := Lookup("test_import")
+	pois := s.Table("import", "osm_pois")
+	if pois == nil || pois.Len() != 3 {
+		t.Fatalf("unexpected table %v", pois)
+	}
+	if idx := pois.Indices; len(idx) != 2 || idx[0] != "osm_pois_pkey" || idx[1] != "osm_pois_geom" {
+		t.Errorf("unexpected indices %v", idx)
+	}
+	rows := pois.ByID(2)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+	if name, _ := rows[0].String("name"); name != "Cafe" {
+		t.Errorf("unexpected name %q", name)
+	}
+	if wkt := rows[0].WKT(); wkt != "POINT(2 1)" {
+		t.Errorf("unexpected geometry %q", wkt)
+	}
+	if tags, err := rows[0].Tags("tags"); err != nil || tags["amenity"] != "cafe" {
+		t.Errorf("unexpected tags %v %v", tags, err)
+	}
+	if rows := pois.InBBox(1.5, 0, 10, 10); len(rows) != 2 {
+		t.Errorf("unexpected rows in bbox %v", rows)
+	}
+
+	if err := db.(database.Deployer).Deploy(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Table("import", "osm_pois") != nil || s.Table("production", "osm_pois") != pois {
+		t.Error("table not deployed")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	db, m := openTestDB(t, "test_diff")
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	insertNodes(t, db, m, 1, 2)
+	pois := Lookup("test_diff").Table("import", "osm_pois")
+
+	db.EnableGeneralizeUpdates()
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	node := osm.Node{}
+	node.ID = 1
+	node.Tags = osm.Tags{"amenity": "cafe"}
+	if err := db.Delete(1, m.PointMatcher.MatchNode(&node)); err != nil {
+		t.Fatal(err)
+	}
+	insertNodes(t, db, m, 3)
+	if rows := pois.Rows(); len(rows) != 2 || rows[0].Value("osm_id") != int64(2) || rows[1].Value("osm_id") != int64(3) {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+
+	if err := db.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	rows := pois.Rows()
+	if len(rows) != 2 || rows[0].Value("osm_id") != int64(1) || rows[1].Value("osm_id") != int64(2) {
+		t.Fatalf("unexpected rows after abort %v", rows)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	db, m := openTestDBConfig(t, "test_upsert", true)
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	insertNodes(t, db, m, 1, 2, 3)
+	pois := Lookup("test_upsert").Table("import", "osm_pois")
+	before := pois.Rows()
+
+	db.EnableGeneralizeUpdates()
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{1, 2, 3} {
+		node := osm.Node{}
+		node.ID = id
+		node.Tags = osm.Tags{"amenity": "cafe"}
+		if err := db.Delete(id, m.PointMatcher.MatchNode(&node)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 1 is unchanged, 2 is modified and 3 is removed
+	insertNodes(t, db, m, 1)
+	node := osm.Node{Long: 2, Lat: 1}
+	node.ID = 2
+	node.Tags = osm.Tags{"amenity": "cafe", "name": "Bar"}
+	g := geom.Geometry{Wkb: geom.NodeAsEWKBHexPoint(node, 3857)}
+	if err := db.InsertPoint(node.Element, g, m.PointMatcher.MatchNode(&node)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.GeneralizeUpdates(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := pois.Rows()
+	if len(rows) != 2 || rows[0] != before[0] || rows[1] != before[1] {
+		t.Fatalf("rows not updated in place %v", rows)
+	}
+	if name, _ := rows[1].String("name"); name != "Bar" {
+		t.Errorf("unexpected name %q", name)
+	}
+	if len(db.(*Memory).journal) != 2 {
+		t.Errorf("unexpected changes %v", db.(*Memory).journal)
+	}
+
+	if err := db.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	rows = pois.Rows()
+	if len(rows) != 3 {
+		t.Fatalf("unexpected rows after abort %v", rows)
+	}
+	if name, _ := rows[1].String("name"); name != "Cafe" {
+		t.Errorf("unexpected name after abort %q", name)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	db, _ := openTestDB(t, "test_rotate")
+	s := Lookup("test_rotate")
+	deployer := db.(database.Deployer)
+
+	db.Init()
+	first := s.Table("import", "osm_pois")
+	deployer.Deploy()
+	db.Init()
+	second := s.Table("import", "osm_pois")
+	deployer.Deploy()
+	if s.Table("production", "osm_pois") != second || s.Table("backup", "osm_pois") != first {
+		t.Fatal("unexpected tables after deploy")
+	}
+	deployer.RevertDeploy()
+	if s.Table("production", "osm_pois") != first || s.Table("import", "osm_pois") != second || s.Table("backup", "osm_pois") != nil {
+		t.Fatal("unexpected tables after revert")
+	}
+	deployer.Deploy()
+	deployer.RemoveBackup()
+	if names := s.TableNames("backup"); len(names) != 0 {
+		t.Errorf("unexpected backup tables %v", names)
+	}
+}
+
+func TestSubdivideSRID(t *testing.T) {
+	m, err := mapping.New([]byte(`
+tables:
+  landuse:
+    type: polygon
+    subdivide:
+      max_vertices: 8
+    columns:
+    - {name: osm_id, type: id}
+    - {name: geometry, type: geometry}
+    mapping:
+      landuse: [__any__]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Remove("test_subdivide") })
+	db, err := database.Open(database.Config{
+		ConnectionParams: "memory:test_subdivide",
+		Srid:             3857,
+		ImportSchema:     "import",
+	}, &m.Conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	g := geos.NewGeos()
+	defer g.Finish()
+	var nodes []osm.Node
+	for i := 0; i <= 10; i++ {
+		nodes = append(nodes, osm.Node{Long: float64(i), Lat: 0})
+	}
+	nodes = append(nodes, osm.Node{Long: 10, Lat: 10}, osm.Node{Long: 0, Lat: 10}, osm.Node{Long: 0, Lat: 0})
+	polygon, err := geom.Polygon(g, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	way := osm.Way{Element: osm.Element{ID: 1, Tags: osm.Tags{"landuse": "forest"}}, Refs: []int64{1, 2, 3, 1}}
+	if err := db.InsertPolygon(way.Element, geom.Geometry{Geom: polygon}, m.PolygonMatcher.MatchWay(&way)); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := Lookup("test_subdivide").Table("import", "osm_landuse").ByID(1)
+	if len(rows) < 2 {
+		t.Fatalf("polygon not subdivided %v", rows)
+	}
+	for _, row := range rows {
+		g, err := row.Geometry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.SRID != 3857 {
+			t.Errorf("unexpected SRID %d of part", g.SRID)
+		}
+	}
+}
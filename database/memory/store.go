@@ -0,0 +1,563 @@
+package memory
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq/hstore"
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/geom"
+	"github.com/pkg/errors"
+)
+
+var (
+	storesMu sync.Mutex
+	stores   = make(map[string]*Store)
+)
+
+// Lookup returns the store of the connection memory:name. The store is
+// created on first use and keeps all tables until Remove, so that an
+// import, the deployment and diff imports can use the same tables.
+func Lookup(name string) *Store {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	s, ok := stores[name]
+	if !ok {
+		s = &Store{schemas: make(map[string]map[string]*Table)}
+		stores[name] = s
+	}
+	return s
+}
+
+// Remove removes the store of memory:name with all tables.
+func Remove(name string) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	delete(stores, name)
+}
+
+// Store contains the tables of all schemas.
+type Store struct {
+	mu      sync.RWMutex
+	schemas map[string]map[string]*Table
+}
+
+// Table returns the table name (with prefix) from schema, or nil if the
+// table does not exist.
+func (s *Store) Table(schema, name string) *Table {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.schemas[schema][name]
+}
+
+// TableNames returns the sorted names of all tables in schema.
+func (s *Store) TableNames(schema string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var names []string
+	for name := range s.schemas[schema] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// putTable adds t to schema and replaces any existing table.
+func (s *Store) putTable(schema string, t *Table) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.schemas[schema] == nil {
+		s.schemas[schema] = make(map[string]*Table)
+	}
+	s.schemas[schema][t.Name] = t
+}
+
+// dropTable removes the table from schema and returns the removed table.
+func (s *Store) dropTable(schema, name string) *Table {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.schemas[schema][name]
+	delete(s.schemas[schema], name)
+	return t
+}
+
+// moveTable moves the table from one schema to another, like
+// ALTER TABLE SET SCHEMA.
+func (s *Store) moveTable(name, from, to string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.schemas[from][name]
+	if !ok {
+		return
+	}
+	delete(s.schemas[from], name)
+	if s.schemas[to] == nil {
+		s.schemas[to] = make(map[string]*Table)
+	}
+	s.schemas[to][name] = t
+}
+
+// Column of a table.
+type Column struct {
+	Name string
+	// Type is the type of the mapping column, e.g. id or hstore_tags.
+	Type string
+	// goType is the value type of the column, e.g. int64 or geometry.
+	goType string
+}
+
+// Table contains the rows of a table. All methods are safe for concurrent
+// use.
+type Table struct {
+	Name    string
+	Columns []Column
+	// Indices are the names of the indices that PostGIS would have
+	// created for this table.
+	Indices []string
+
+	mu      sync.RWMutex
+	rows    map[int64]*Row
+	byOSMID map[int64][]*Row
+	nextID  int64
+	idIdx   int
+	geomIdx int
+}
+
+func newTable(name string, columns []Column) *Table {
+	t := &Table{
+		Name:    name,
+		Columns: columns,
+		rows:    make(map[int64]*Row),
+		byOSMID: make(map[int64][]*Row),
+		idIdx:   -1,
+		geomIdx: -1,
+	}
+	for i, col := range columns {
+		if col.Type == "id" && t.idIdx == -1 {
+			t.idIdx = i
+		}
+		if (col.goType == "geometry" || col.goType == "validated_geometry") && t.geomIdx == -1 {
+			t.geomIdx = i
+		}
+	}
+	return t
+}
+
+// column returns the index of the column name, or -1.
+func (t *Table) column(name string) int {
+	for i, col := range t.Columns {
+		if col.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *Table) addIndex(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, idx := range t.Indices {
+		if idx == name {
+			return
+		}
+	}
+	t.Indices = append(t.Indices, name)
+}
+
+// insert adds a row with the values in the order of the columns. The
+// values are converted to the column types, like PostgreSQL would
+// convert them.
+func (t *Table) insert(values []interface{}) (*Row, error) {
+	converted, err := t.convertValues(values)
+	if err != nil {
+		return nil, err
+	}
+	row := &Row{Values: converted, table: t}
+	row.updateBounds()
+	t.add(row)
+	return row, nil
+}
+
+// update sets the values of the row, if they differ from the current
+// values. It returns the previous values for replace.
+func (t *Table) update(row *Row, values []interface{}) ([]interface{}, bool, error) {
+	converted, err := t.convertValues(values)
+	if err != nil {
+		return nil, false, err
+	}
+	t.mu.RLock()
+	prev := row.Values
+	t.mu.RUnlock()
+	if t.equalValues(prev, converted) {
+		return nil, false, nil
+	}
+	t.replace(row, converted)
+	return prev, true, nil
+}
+
+// replace sets the already converted values of the row. The OSM ID of the
+// row needs to stay the same.
+func (t *Table) replace(row *Row, values []interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	row.Values = values
+	row.updateBounds()
+}
+
+// equalValues returns whether both converted values are equal, like IS NOT
+// DISTINCT FROM. hstore values are equal regardless of the order of the
+// tags.
+func (t *Table) equalValues(a, b []interface{}) bool {
+	for i, col := range t.Columns {
+		if col.goType == "hstore_string" && a[i] != nil && b[i] != nil {
+			var ha, hb hstore.Hstore
+			if err := ha.Scan([]byte(a[i].(string))); err != nil {
+				return false
+			}
+			if err := hb.Scan([]byte(b[i].(string))); err != nil {
+				return false
+			}
+			if len(ha.Map) != len(hb.Map) {
+				return false
+			}
+			for k, v := range ha.Map {
+				if w, ok := hb.Map[k]; !ok || v != w {
+					return false
+				}
+			}
+			continue
+		}
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// convertValues converts all values to the types of the columns.
+func (t *Table) convertValues(values []interface{}) ([]interface{}, error) {
+	if len(values) != len(t.Columns) {
+		return nil, errors.Errorf("row with %d values for %d columns of %q", len(values), len(t.Columns), t.Name)
+	}
+	converted := make([]interface{}, len(values))
+	for i, v := range values {
+		var err error
+		converted[i], err = convert(t.Columns[i].goType, v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "column %q of %q", t.Columns[i].Name, t.Name)
+		}
+	}
+	return converted, nil
+}
+
+func (t *Table) add(row *Row) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	row.ID = t.nextID
+	t.rows[row.ID] = row
+	if osmID, ok := row.OSMID(); ok {
+		t.byOSMID[osmID] = append(t.byOSMID[osmID], row)
+	}
+}
+
+// restore adds a removed row with its previous ID.
+func (t *Table) restore(row *Row) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rows[row.ID] = row
+	if osmID, ok := row.OSMID(); ok {
+		t.byOSMID[osmID] = append(t.byOSMID[osmID], row)
+	}
+}
+
+// remove removes the row from the table.
+func (t *Table) remove(row *Row) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.rows, row.ID)
+	osmID, ok := row.OSMID()
+	if !ok {
+		return
+	}
+	rows := t.byOSMID[osmID]
+	for i, r := range rows {
+		if r == row {
+			rows = append(rows[:i:i], rows[i+1:]...)
+			break
+		}
+	}
+	if len(rows) == 0 {
+		delete(t.byOSMID, osmID)
+	} else {
+		t.byOSMID[osmID] = rows
+	}
+}
+
+// Len returns the number of rows.
+func (t *Table) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.rows)
+}
+
+// Rows returns all rows in the order they were inserted.
+func (t *Table) Rows() []*Row {
+	t.mu.RLock()
+	rows := make([]*Row, 0, len(t.rows))
+	for _, r := range t.rows {
+		rows = append(rows, r)
+	}
+	t.mu.RUnlock()
+	sortRows(rows)
+	return rows
+}
+
+// ByID returns all rows with the OSM ID.
+func (t *Table) ByID(osmID int64) []*Row {
+	t.mu.RLock()
+	rows := append([]*Row(nil), t.byOSMID[osmID]...)
+	t.mu.RUnlock()
+	sortRows(rows)
+	return rows
+}
+
+// InBBox returns all rows with a geometry that intersects the bounding
+// box.
+func (t *Table) InBBox(minx, miny, maxx, maxy float64) []*Row {
+	t.mu.RLock()
+	var rows []*Row
+	for _, r := range t.rows {
+		if r.hasBounds && r.bounds[0] <= maxx && r.bounds[2] >= minx && r.bounds[1] <= maxy && r.bounds[3] >= miny {
+			rows = append(rows, r)
+		}
+	}
+	t.mu.RUnlock()
+	sortRows(rows)
+	return rows
+}
+
+// Where returns all rows that match the SQL condition, e.g.
+// "type IN ('primary', 'secondary') AND ST_Length(geometry) > 100".
+// See the documentation of the memory backend for the supported SQL.
+func (t *Table) Where(condition string) ([]*Row, error) {
+	f, err := compileFilter(condition, t.Columns)
+	if err != nil {
+		return nil, err
+	}
+	var rows []*Row
+	for _, r := range t.Rows() {
+		if f.match(r) {
+			rows = append(rows, r)
+		}
+	}
+	return rows, nil
+}
+
+func sortRows(rows []*Row) {
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+}
+
+// Row of a table. Values are nil (NULL), int64, float64, bool or string.
+// Geometries and hstore values are stored as strings (hex encoded EWKB and
+// the text format of hstore).
+type Row struct {
+	// ID is the serial ID of the row.
+	ID        int64
+	Values    []interface{}
+	table     *Table
+	bounds    [4]float64
+	hasBounds bool
+}
+
+// updateBounds sets the bounds of the geometry of the row.
+func (r *Row) updateBounds() {
+	r.hasBounds = false
+	if r.table.geomIdx == -1 {
+		return
+	}
+	if wkb, ok := r.Values[r.table.geomIdx].(string); ok {
+		if b, err := geom.EWKBHexBounds([]byte(wkb)); err == nil {
+			r.bounds = [4]float64{b.MinX, b.MinY, b.MaxX, b.MaxY}
+			r.hasBounds = true
+		}
+	}
+}
+
+// Value returns the value of the column, or nil for NULL values and
+// unknown columns.
+func (r *Row) Value(column string) interface{} {
+	if i := r.table.column(column); i != -1 {
+		return r.Values[i]
+	}
+	return nil
+}
+
+// OSMID returns the value of the id column.
+func (r *Row) OSMID() (int64, bool) {
+	if r.table.idIdx == -1 {
+		return 0, false
+	}
+	id, ok := r.Values[r.table.idIdx].(int64)
+	return id, ok
+}
+
+// String returns the value of a string or hstore column.
+func (r *Row) String(column string) (string, bool) {
+	v, ok := r.Value(column).(string)
+	return v, ok
+}
+
+// Int returns the value of an integer column.
+func (r *Row) Int(column string) (int64, bool) {
+	v, ok := r.Value(column).(int64)
+	return v, ok
+}
+
+// Float returns the value of a float or integer column.
+func (r *Row) Float(column string) (float64, bool) {
+	switch v := r.Value(column).(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// Bool returns the value of a bool column.
+func (r *Row) Bool(column string) (bool, bool) {
+	v, ok := r.Value(column).(bool)
+	return v, ok
+}
+
+// Tags returns the decoded value of an hstore column. NULL values of
+// single tags are returned as empty strings.
+func (r *Row) Tags(column string) (map[string]string, error) {
+	s, ok := r.String(column)
+	if !ok {
+		return nil, nil
+	}
+	tags, err := database.DecodeHstore(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding hstore of column %q", column)
+	}
+	return tags, nil
+}
+
+// Geometry returns the decoded geometry of the row, or nil if the table
+// has no geometry or if the geometry is NULL.
+func (r *Row) Geometry() (*geom.WKBGeometry, error) {
+	if r.table.geomIdx == -1 {
+		return nil, nil
+	}
+	wkb, ok := r.Values[r.table.geomIdx].(string)
+	if !ok {
+		return nil, nil
+	}
+	return geom.DecodeEWKBHex([]byte(wkb))
+}
+
+// WKT returns the geometry as WKT, like ST_AsText. Returns an empty string
+// if the geometry is NULL or invalid.
+func (r *Row) WKT() string {
+	g, err := r.Geometry()
+	if err != nil || g == nil {
+		return ""
+	}
+	return string(appendWKT(nil, g))
+}
+
+// Text returns the value of the column in the text format of PostgreSQL,
+// e.g. "true" for bool columns. Returns false for NULL values.
+func (r *Row) Text(column string) (string, bool) {
+	i := r.table.column(column)
+	if i == -1 {
+		return "", false
+	}
+	switch v := r.Values[i].(type) {
+	case string:
+		return v, true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 32), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// convert converts v to the value type of the column. Returns an error
+// for values that PostgreSQL would reject.
+func convert(goType string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch goType {
+	case "int8", "int32", "int64":
+		var i int64
+		switch v := v.(type) {
+		case int:
+			i = int64(v)
+		case int8:
+			i = int64(v)
+		case int16:
+			i = int64(v)
+		case int32:
+			i = int64(v)
+		case int64:
+			i = v
+		case string:
+			var err error
+			i, err = strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.Errorf("unsupported type %T for integer", v)
+		}
+		if (goType == "int8" && (i < math.MinInt16 || i > math.MaxInt16)) ||
+			(goType == "int32" && (i < math.MinInt32 || i > math.MaxInt32)) {
+			return nil, errors.Errorf("%d out of range for %s", i, goType)
+		}
+		return i, nil
+	case "float32":
+		switch v := v.(type) {
+		case float32:
+			return float64(v), nil
+		case float64:
+			return float64(float32(v)), nil
+		case int64:
+			return float64(float32(v)), nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 32)
+			return f, err
+		}
+		return nil, errors.Errorf("unsupported type %T for float", v)
+	case "bool":
+		switch v := v.(type) {
+		case bool:
+			return v, nil
+		case string:
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "t", "true", "y", "yes", "on", "1":
+				return true, nil
+			case "f", "false", "n", "no", "off", "0":
+				return false, nil
+			}
+			return nil, errors.Errorf("invalid bool %q", v)
+		}
+		return nil, errors.Errorf("unsupported type %T for bool", v)
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	}
+	return nil, errors.Errorf("unsupported type %T for %s", v, goType)
+}
@@ -0,0 +1,90 @@
+package memory
+
+import (
+	"testing"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/geom"
+)
+
+func TestInsertValues(t *testing.T) {
+	tbl := newTable("test", []Column{
+		{Name: "osm_id", Type: "id", goType: "int64"},
+		{Name: "layer", Type: "wayzorder", goType: "int8"},
+		{Name: "area", Type: "area", goType: "float32"},
+		{Name: "bridge", Type: "bool", goType: "bool"},
+		{Name: "tags", Type: "hstore_tags", goType: "hstore_string"},
+	})
+	row, err := tbl.insert([]interface{}{int64(1), "-1", float32(0.1), "yes", `"name"=>"Foo", "ref"=>NULL`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := row.Int("layer"); v != -1 {
+		t.Errorf("unexpected layer %v", v)
+	}
+	if v, _ := row.Text("area"); v != "0.1" {
+		t.Errorf("unexpected area %q", v)
+	}
+	if v, _ := row.Text("bridge"); v != "true" {
+		t.Errorf("unexpected bridge %q", v)
+	}
+	if _, ok := row.Text("missing"); ok {
+		t.Error("unexpected value for unknown column")
+	}
+	if tags, err := row.Tags("tags"); err != nil || len(tags) != 2 || tags["name"] != "Foo" || tags["ref"] != "" {
+		t.Errorf("unexpected tags %v %v", tags, err)
+	}
+
+	for _, values := range [][]interface{}{
+		{int64(1), int64(40000), nil, nil, nil},
+		{int64(1), "x", nil, nil, nil},
+		{int64(1), nil, nil, "maybe", nil},
+		{int64(1), nil, nil},
+	} {
+		if _, err := tbl.insert(values); err == nil {
+			t.Errorf("expected error for %v", values)
+		}
+	}
+	if tbl.Len() != 1 {
+		t.Errorf("unexpected rows %d", tbl.Len())
+	}
+}
+
+func TestWKT(t *testing.T) {
+	nodes := []osm.Node{{Long: 0, Lat: 0}, {Long: 10.5, Lat: 0}, {Long: 10.5, Lat: 10}, {Long: 0, Lat: 0}}
+	line, err := geom.NodesAsEWKBHexLineString(nodes[:2], 3857)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poly, err := geom.NodesAsEWKBHexPolygon(nodes, 3857)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		wkb string
+		wkt string
+	}{
+		{string(geom.NodeAsEWKBHexPoint(osm.Node{Long: 1, Lat: -2}, 3857)), "POINT(1 -2)"},
+		{string(line), "LINESTRING(0 0,10.5 0)"},
+		{string(poly), "POLYGON((0 0,10.5 0,10.5 10,0 0))"},
+	} {
+		g, err := geom.DecodeEWKBHex([]byte(tc.wkb))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wkt := string(appendWKT(nil, g)); wkt != tc.wkt {
+			t.Errorf("unexpected WKT %q, expected %q", wkt, tc.wkt)
+		}
+	}
+
+	multi := &geom.WKBGeometry{Type: geom.WKBMultiPolygon, Geometries: []*geom.WKBGeometry{
+		{Type: geom.WKBPolygon, Rings: [][]geom.Coord{{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 1, Y: 1}, {X: 0, Y: 0}}}},
+		{Type: geom.WKBPolygon, Rings: [][]geom.Coord{{{X: 5, Y: 5}, {X: 6, Y: 5}, {X: 6, Y: 6}, {X: 5, Y: 5}}}},
+	}}
+	if wkt := string(appendWKT(nil, multi)); wkt != "MULTIPOLYGON(((0 0,1 0,1 1,0 0)),((5 5,6 5,6 6,5 5)))" {
+		t.Errorf("unexpected WKT %q", wkt)
+	}
+	if wkt := string(appendWKT(nil, &geom.WKBGeometry{Type: geom.WKBGeometryCollection})); wkt != "GEOMETRYCOLLECTION EMPTY" {
+		t.Errorf("unexpected WKT %q", wkt)
+	}
+}
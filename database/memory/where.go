@@ -0,0 +1,553 @@
+package memory
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/omniscale/imposm3/geom"
+	"github.com/pkg/errors"
+)
+
+// SQL conditions
+//
+// Generalized and merged tables filter their source with the sql_filter of
+// the mapping. filter implements the subset of SQL that is used by these
+// filters: comparisons, [NOT] IN, IS [NOT] NULL, AND, OR, NOT and the
+// functions ST_Area and ST_Length. NULL values follow the three-valued
+// logic of SQL, rows only match if the condition is true.
+
+// filter is a compiled SQL condition.
+type filter struct {
+	eval evalFunc
+}
+
+// evalFunc returns nil (NULL), int64, float64, string or bool.
+type evalFunc func(r *Row) interface{}
+
+// compileFilter compiles the SQL condition for a table with columns.
+func compileFilter(condition string, columns []Column) (*filter, error) {
+	tokens, err := tokenize(condition)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %q", condition)
+	}
+	p := &parser{tokens: tokens, columns: columns}
+	eval, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = errors.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %q", condition)
+	}
+	return &filter{eval: eval}, nil
+}
+
+// match returns whether the condition is true for the row.
+func (f *filter) match(r *Row) bool {
+	return f.eval(r) == true
+}
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokQuotedIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(s) {
+					return nil, errors.Errorf("unterminated quote at %d", i)
+				}
+				if s[j] == c {
+					if j+1 < len(s) && s[j+1] == c {
+						b.WriteByte(c)
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[j])
+				j++
+			}
+			kind := tokString
+			if c == '"' {
+				kind = tokQuotedIdent
+			}
+			tokens = append(tokens, token{kind, b.String()})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == 'e' || s[j] == 'E' ||
+				(s[j] == '-' || s[j] == '+') && (s[j-1] == 'e' || s[j-1] == 'E')) {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, s[i:j]})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || s[j] >= '0' && s[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, s[i:j]})
+			i = j
+		default:
+			op := string(c)
+			if i+1 < len(s) {
+				switch two := s[i : i+2]; two {
+				case "<=", ">=", "<>", "!=", "::":
+					op = two
+				}
+			}
+			switch op {
+			case "=", "<", ">", "<=", ">=", "<>", "!=", "(", ")", ",", "-", "::":
+			default:
+				return nil, errors.Errorf("unexpected %q at %d", op, i)
+			}
+			tokens = append(tokens, token{tokOp, op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens  []token
+	pos     int
+	columns []Column
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return token{}, false
+}
+
+// keyword consumes the next token if it is the keyword kw.
+func (p *parser) keyword(kw string) bool {
+	if t, ok := p.peek(); ok && t.kind == tokIdent && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// op consumes the next token if it is the operator op.
+func (p *parser) op(op string) bool {
+	if t, ok := p.peek(); ok && t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.op(op) {
+		if t, ok := p.peek(); ok {
+			return errors.Errorf("expected %q, got %q", op, t.text)
+		}
+		return errors.Errorf("expected %q at end", op)
+	}
+	return nil
+}
+
+func (p *parser) or() (evalFunc, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		a, b := left, right
+		left = func(r *Row) interface{} {
+			va, vb := a(r), b(r)
+			if va == true || vb == true {
+				return true
+			}
+			if va == nil || vb == nil {
+				return nil
+			}
+			return false
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (evalFunc, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		a, b := left, right
+		left = func(r *Row) interface{} {
+			va, vb := a(r), b(r)
+			if va == false || vb == false {
+				return false
+			}
+			if va == nil || vb == nil {
+				return nil
+			}
+			return true
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) not() (evalFunc, error) {
+	if p.keyword("NOT") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *Row) interface{} {
+			if v, ok := e(r).(bool); ok {
+				return !v
+			}
+			return nil
+		}, nil
+	}
+	return p.predicate()
+}
+
+func (p *parser) predicate() (evalFunc, error) {
+	left, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if p.keyword("IS") {
+		negate := p.keyword("NOT")
+		if !p.keyword("NULL") {
+			return nil, errors.New("expected NULL after IS")
+		}
+		return func(r *Row) interface{} {
+			return (left(r) == nil) != negate
+		}, nil
+	}
+	negate := p.keyword("NOT")
+	if p.keyword("IN") {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		var list []evalFunc
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			if !p.op(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(r *Row) interface{} {
+			v := left(r)
+			if v == nil {
+				return nil
+			}
+			var result interface{} = false
+			for _, e := range list {
+				switch c := compare(v, e(r)); {
+				case c == nil:
+					result = nil
+				case *c == 0:
+					return !negate
+				}
+			}
+			if result == nil {
+				return nil
+			}
+			return negate
+		}, nil
+	} else if negate {
+		return nil, errors.New("expected IN after NOT")
+	}
+
+	t, ok := p.peek()
+	if !ok || t.kind != tokOp {
+		return left, nil
+	}
+	var cmp func(c int) bool
+	switch t.text {
+	case "=":
+		cmp = func(c int) bool { return c == 0 }
+	case "<>", "!=":
+		cmp = func(c int) bool { return c != 0 }
+	case "<":
+		cmp = func(c int) bool { return c < 0 }
+	case "<=":
+		cmp = func(c int) bool { return c <= 0 }
+	case ">":
+		cmp = func(c int) bool { return c > 0 }
+	case ">=":
+		cmp = func(c int) bool { return c >= 0 }
+	default:
+		return left, nil
+	}
+	p.pos++
+	right, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	return func(r *Row) interface{} {
+		c := compare(left(r), right(r))
+		if c == nil {
+			return nil
+		}
+		return cmp(*c)
+	}, nil
+}
+
+func (p *parser) value() (evalFunc, error) {
+	v, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	// casts are ignored, values are compared by their type
+	for p.op("::") {
+		if t, ok := p.peek(); !ok || t.kind != tokIdent {
+			return nil, errors.New("expected type after ::")
+		}
+		p.pos++
+	}
+	return v, nil
+}
+
+func (p *parser) primary() (evalFunc, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, errors.New("unexpected end")
+	}
+	p.pos++
+	switch t.kind {
+	case tokNumber:
+		v, err := parseNumber(t.text)
+		if err != nil {
+			return nil, err
+		}
+		return func(*Row) interface{} { return v }, nil
+	case tokString:
+		return func(*Row) interface{} { return t.text }, nil
+	case tokQuotedIdent:
+		return p.column(t.text)
+	case tokOp:
+		switch t.text {
+		case "(":
+			e, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expect(")")
+		case "-":
+			n, ok := p.peek()
+			if !ok || n.kind != tokNumber {
+				return nil, errors.New("expected number after -")
+			}
+			p.pos++
+			v, err := parseNumber("-" + n.text)
+			if err != nil {
+				return nil, err
+			}
+			return func(*Row) interface{} { return v }, nil
+		}
+		return nil, errors.Errorf("unexpected %q", t.text)
+	}
+
+	switch strings.ToUpper(t.text) {
+	case "NULL":
+		return func(*Row) interface{} { return nil }, nil
+	case "TRUE":
+		return func(*Row) interface{} { return true }, nil
+	case "FALSE":
+		return func(*Row) interface{} { return false }, nil
+	}
+	if p.op("(") {
+		return p.function(t.text)
+	}
+	return p.column(strings.ToLower(t.text))
+}
+
+func (p *parser) column(name string) (evalFunc, error) {
+	for i, col := range p.columns {
+		if col.Name == name {
+			idx := i
+			return func(r *Row) interface{} { return r.Values[idx] }, nil
+		}
+	}
+	return nil, errors.Errorf("unknown column %q", name)
+}
+
+func (p *parser) function(name string) (evalFunc, error) {
+	var fn func(*geom.WKBGeometry) float64
+	switch strings.ToLower(name) {
+	case "st_area":
+		fn = area
+	case "st_length":
+		fn = length
+	default:
+		return nil, errors.Errorf("unsupported function %s", name)
+	}
+	arg, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return func(r *Row) interface{} {
+		wkb, ok := arg(r).(string)
+		if !ok {
+			return nil
+		}
+		g, err := geom.DecodeEWKBHex([]byte(wkb))
+		if err != nil {
+			return nil
+		}
+		return fn(g)
+	}, nil
+}
+
+func parseNumber(s string) (interface{}, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, errors.Errorf("invalid number %q", s)
+	}
+	return f, nil
+}
+
+// compare returns -1, 0 or 1, or nil if a or b is NULL or if the values
+// are not comparable.
+func compare(a, b interface{}) *int {
+	if a == nil || b == nil {
+		return nil
+	}
+	var c int
+	switch a := a.(type) {
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return nil
+		}
+		c = strings.Compare(a, b)
+	case bool:
+		b, ok := b.(bool)
+		if !ok {
+			return nil
+		}
+		switch {
+		case a == b:
+		case !a:
+			c = -1
+		default:
+			c = 1
+		}
+	default:
+		fa, ok := toFloat(a)
+		if !ok {
+			return nil
+		}
+		fb, ok := toFloat(b)
+		if !ok {
+			return nil
+		}
+		switch {
+		case fa < fb:
+			c = -1
+		case fa > fb:
+			c = 1
+		}
+	}
+	return &c
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// area returns the area of all polygons, like ST_Area.
+func area(g *geom.WKBGeometry) float64 {
+	switch g.Type {
+	case geom.WKBPolygon:
+		var a float64
+		for i, ring := range g.Rings {
+			if i == 0 {
+				a += math.Abs(ringArea(ring))
+			} else {
+				a -= math.Abs(ringArea(ring))
+			}
+		}
+		return a
+	case geom.WKBMultiPolygon, geom.WKBGeometryCollection:
+		var a float64
+		for _, part := range g.Geometries {
+			a += area(part)
+		}
+		return a
+	}
+	return 0
+}
+
+func ringArea(ring []geom.Coord) float64 {
+	var a float64
+	for i := 0; i+1 < len(ring); i++ {
+		a += ring[i].X*ring[i+1].Y - ring[i+1].X*ring[i].Y
+	}
+	return a / 2
+}
+
+// length returns the length of all linestrings, like ST_Length.
+func length(g *geom.WKBGeometry) float64 {
+	switch g.Type {
+	case geom.WKBLineString:
+		var l float64
+		for i := 0; i+1 < len(g.Coords); i++ {
+			l += math.Hypot(g.Coords[i+1].X-g.Coords[i].X, g.Coords[i+1].Y-g.Coords[i].Y)
+		}
+		return l
+	case geom.WKBMultiLineString, geom.WKBGeometryCollection:
+		var l float64
+		for _, part := range g.Geometries {
+			l += length(part)
+		}
+		return l
+	}
+	return 0
+}
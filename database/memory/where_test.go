@@ -0,0 +1,91 @@
+package memory
+
+import (
+	"testing"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/geom"
+)
+
+func TestWhere(t *testing.T) {
+	tbl := newTable("test", []Column{
+		{Name: "osm_id", Type: "id", goType: "int64"},
+		{Name: "type", Type: "mapping_value", goType: "string"},
+		{Name: "layer", Type: "integer", goType: "int32"},
+		{Name: "geometry", Type: "geometry", goType: "geometry"},
+	})
+	square := func(size float64) string {
+		wkb, err := geom.NodesAsEWKBHexPolygon([]osm.Node{
+			{Long: 0, Lat: 0}, {Long: size, Lat: 0}, {Long: size, Lat: size}, {Long: 0, Lat: size}, {Long: 0, Lat: 0},
+		}, 3857)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(wkb)
+	}
+	for _, values := range [][]interface{}{
+		{int64(1), "park", int64(1), square(10)},
+		{int64(2), "forest", nil, square(100)},
+		{int64(3), "park", "-1", square(1)},
+		{int64(4), "it's", int64(2), nil},
+	} {
+		if _, err := tbl.insert(values); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		where string
+		ids   []int64
+	}{
+		{"type = 'park'", []int64{1, 3}},
+		{"type <> 'park'", []int64{2, 4}},
+		{"layer > 0", []int64{1, 4}},
+		{"NOT layer > 0", []int64{3}},
+		{"layer IS NULL", []int64{2}},
+		{"layer IS NOT NULL AND type IN ('forest', 'park')", []int64{1, 3}},
+		{"type NOT IN ('park')", []int64{2, 4}},
+		{"layer IN (1, NULL)", []int64{1}},
+		{"layer NOT IN (1, NULL)", nil},
+		{"type = 'it''s'", []int64{4}},
+		{`"type" = 'forest' OR layer = -1`, []int64{2, 3}},
+		{"ST_Area(geometry)>50.000000", []int64{1, 2}},
+		{"(ST_Area(geometry) < 5000 OR layer = 2) AND osm_id != 1", []int64{3, 4}},
+		{"ST_Length(geometry) = 0", []int64{1, 2, 3}},
+		{"layer::integer >= 1.5", []int64{4}},
+	} {
+		rows, err := tbl.Where(tc.where)
+		if err != nil {
+			t.Errorf("%s: %v", tc.where, err)
+			continue
+		}
+		var ids []int64
+		for _, r := range rows {
+			id, _ := r.OSMID()
+			ids = append(ids, id)
+		}
+		if len(ids) != len(tc.ids) {
+			t.Errorf("%s: unexpected rows %v", tc.where, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tc.ids[i] {
+				t.Errorf("%s: unexpected rows %v", tc.where, ids)
+				break
+			}
+		}
+	}
+
+	for _, where := range []string{
+		"foo = 1",
+		"type = 'park",
+		"type IN ('park'",
+		"ST_Buffer(geometry) > 1",
+		"type = 'park' layer",
+		"type ~ 'park'",
+	} {
+		if _, err := tbl.Where(where); err == nil {
+			t.Errorf("expected error for %s", where)
+		}
+	}
+}
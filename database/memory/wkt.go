@@ -0,0 +1,93 @@
+package memory
+
+import (
+	"strconv"
+
+	"github.com/omniscale/imposm3/geom"
+)
+
+var wktNames = map[int]string{
+	geom.WKBPoint:              "POINT",
+	geom.WKBLineString:         "LINESTRING",
+	geom.WKBPolygon:            "POLYGON",
+	geom.WKBMultiPoint:         "MULTIPOINT",
+	geom.WKBMultiLineString:    "MULTILINESTRING",
+	geom.WKBMultiPolygon:       "MULTIPOLYGON",
+	geom.WKBGeometryCollection: "GEOMETRYCOLLECTION",
+}
+
+// appendWKT appends g in the WKT format of ST_AsText, e.g.
+// "LINESTRING(1 2,3 4)".
+func appendWKT(buf []byte, g *geom.WKBGeometry) []byte {
+	buf = append(buf, wktNames[g.Type]...)
+	if isEmpty(g) {
+		return append(buf, " EMPTY"...)
+	}
+	return appendWKTBody(buf, g)
+}
+
+func appendWKTBody(buf []byte, g *geom.WKBGeometry) []byte {
+	buf = append(buf, '(')
+	switch g.Type {
+	case geom.WKBPoint, geom.WKBLineString:
+		buf = appendCoords(buf, g.Coords)
+	case geom.WKBPolygon:
+		buf = appendRings(buf, g.Rings)
+	case geom.WKBMultiPoint:
+		for i, p := range g.Geometries {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendCoords(buf, p.Coords)
+		}
+	case geom.WKBMultiLineString, geom.WKBMultiPolygon:
+		for i, part := range g.Geometries {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendWKTBody(buf, part)
+		}
+	case geom.WKBGeometryCollection:
+		for i, part := range g.Geometries {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendWKT(buf, part)
+		}
+	}
+	return append(buf, ')')
+}
+
+func appendRings(buf []byte, rings [][]geom.Coord) []byte {
+	for i, ring := range rings {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, '(')
+		buf = appendCoords(buf, ring)
+		buf = append(buf, ')')
+	}
+	return buf
+}
+
+func appendCoords(buf []byte, coords []geom.Coord) []byte {
+	for i, c := range coords {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = strconv.AppendFloat(buf, c.X, 'f', -1, 64)
+		buf = append(buf, ' ')
+		buf = strconv.AppendFloat(buf, c.Y, 'f', -1, 64)
+	}
+	return buf
+}
+
+func isEmpty(g *geom.WKBGeometry) bool {
+	switch g.Type {
+	case geom.WKBPoint, geom.WKBLineString:
+		return len(g.Coords) == 0
+	case geom.WKBPolygon:
+		return len(g.Rings) == 0
+	}
+	return len(g.Geometries) == 0
+}
@@ -0,0 +1,245 @@
+package pmtiles
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	headerSize = 127
+	// the header and the root directory need to fit into the first 16kB
+	maxRootSize = 16384 - headerSize
+
+	compressionGzip = 2
+	tileTypeMVT     = 1
+)
+
+// tileID returns the ID of the tile on the Hilbert curve of all zoom
+// levels, as defined by the PMTiles specification.
+func tileID(z uint8, x, y uint32) uint64 {
+	// number of tiles of all lower zoom levels
+	acc := (uint64(1)<<(2*uint64(z)) - 1) / 3
+	var d uint64
+	for s := uint32(1) << z >> 1; s > 0; s >>= 1 {
+		var rx, ry uint32
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		d += uint64(s) * uint64(s) * uint64((3*rx)^ry)
+		if ry == 0 {
+			if rx == 1 {
+				x = s - 1 - x
+				y = s - 1 - y
+			}
+			x, y = y, x
+		}
+	}
+	return acc + d
+}
+
+// tileZXY returns the zoom level and the x/y of the tile ID.
+func tileZXY(id uint64) (uint8, uint32, uint32) {
+	var acc uint64
+	z := uint8(0)
+	for ; ; z++ {
+		n := uint64(1) << (2 * uint64(z))
+		if acc+n > id {
+			break
+		}
+		acc += n
+	}
+	d := id - acc
+	var x, y uint32
+	for s := uint32(1); s < uint32(1)<<z; s <<= 1 {
+		rx := uint32(1 & (d / 2))
+		ry := uint32(1 & (d ^ uint64(rx)))
+		if ry == 0 {
+			if rx == 1 {
+				x = s - 1 - x
+				y = s - 1 - y
+			}
+			x, y = y, x
+		}
+		x += s * rx
+		y += s * ry
+		d /= 4
+	}
+	return z, x, y
+}
+
+// entry is a directory entry. Entries with runLength 0 point to leaf
+// directories.
+type entry struct {
+	tileID    uint64
+	offset    uint64
+	length    uint32
+	runLength uint32
+}
+
+// encodeDirectory returns the gzip compressed directory.
+func encodeDirectory(entries []entry) ([]byte, error) {
+	var buf []byte
+	buf = binary.AppendUvarint(buf, uint64(len(entries)))
+	var lastID uint64
+	for _, e := range entries {
+		buf = binary.AppendUvarint(buf, e.tileID-lastID)
+		lastID = e.tileID
+	}
+	for _, e := range entries {
+		buf = binary.AppendUvarint(buf, uint64(e.runLength))
+	}
+	for _, e := range entries {
+		buf = binary.AppendUvarint(buf, uint64(e.length))
+	}
+	for i, e := range entries {
+		// 0 for entries that directly follow the previous entry
+		if i > 0 && e.offset == entries[i-1].offset+uint64(entries[i-1].length) {
+			buf = binary.AppendUvarint(buf, 0)
+		} else {
+			buf = binary.AppendUvarint(buf, e.offset+1)
+		}
+	}
+	return gzipBytes(buf)
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// directories returns the root directory and all leaf directories. Leaf
+// directories are only created if the root directory would exceed
+// maxRootSize.
+func directories(entries []entry) (root []byte, leaves []byte, err error) {
+	root, err = encodeDirectory(entries)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(root) <= maxRootSize {
+		return root, nil, nil
+	}
+
+	for leafSize := 4096; ; leafSize *= 2 {
+		var rootEntries []entry
+		leaves = leaves[:0]
+		for i := 0; i < len(entries); i += leafSize {
+			end := i + leafSize
+			if end > len(entries) {
+				end = len(entries)
+			}
+			leaf, err := encodeDirectory(entries[i:end])
+			if err != nil {
+				return nil, nil, err
+			}
+			rootEntries = append(rootEntries, entry{
+				tileID: entries[i].tileID,
+				offset: uint64(len(leaves)),
+				length: uint32(len(leaf)),
+			})
+			leaves = append(leaves, leaf...)
+		}
+		root, err = encodeDirectory(rootEntries)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(root) <= maxRootSize {
+			return root, leaves, nil
+		}
+	}
+}
+
+// header of the archive. The bounds are in EPSG:4326.
+type header struct {
+	rootOffset, rootLength         uint64
+	metadataOffset, metadataLength uint64
+	leavesOffset, leavesLength     uint64
+	dataOffset, dataLength         uint64
+	addressedTiles                 uint64
+	tileEntries                    uint64
+	tileContents                   uint64
+	minZoom, maxZoom               uint8
+	bounds                         [4]float64
+}
+
+func (h *header) encode() []byte {
+	buf := make([]byte, 0, headerSize)
+	buf = append(buf, "PMTiles"...)
+	buf = append(buf, 3)
+	for _, v := range []uint64{
+		h.rootOffset, h.rootLength,
+		h.metadataOffset, h.metadataLength,
+		h.leavesOffset, h.leavesLength,
+		h.dataOffset, h.dataLength,
+		h.addressedTiles, h.tileEntries, h.tileContents,
+	} {
+		buf = binary.LittleEndian.AppendUint64(buf, v)
+	}
+	// tiles are written in the order of their tile ID
+	clustered := byte(1)
+	buf = append(buf, clustered, compressionGzip, compressionGzip, tileTypeMVT, h.minZoom, h.maxZoom)
+	for _, v := range h.bounds {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(e7(v)))
+	}
+	buf = append(buf, h.minZoom)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(e7((h.bounds[0]+h.bounds[2])/2)))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(e7((h.bounds[1]+h.bounds[3])/2)))
+	return buf
+}
+
+func e7(v float64) int32 {
+	return int32(math.Round(v * 1e7))
+}
+
+// writeArchive writes the archive with the tile data from data, which
+// contains dataLength bytes of tiles in the order of entries.
+func writeArchive(w io.Writer, h header, entries []entry, metadata []byte, data io.Reader) error {
+	root, leaves, err := directories(entries)
+	if err != nil {
+		return errors.Wrap(err, "encoding directories")
+	}
+	metadata, err = gzipBytes(metadata)
+	if err != nil {
+		return errors.Wrap(err, "encoding metadata")
+	}
+
+	h.rootOffset = headerSize
+	h.rootLength = uint64(len(root))
+	h.metadataOffset = h.rootOffset + h.rootLength
+	h.metadataLength = uint64(len(metadata))
+	h.leavesOffset = h.metadataOffset + h.metadataLength
+	h.leavesLength = uint64(len(leaves))
+	h.dataOffset = h.leavesOffset + h.leavesLength
+	h.tileEntries = uint64(len(entries))
+	for _, e := range entries {
+		h.addressedTiles += uint64(e.runLength)
+	}
+
+	for _, b := range [][]byte{h.encode(), root, metadata, leaves} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	n, err := io.Copy(w, data)
+	if err != nil {
+		return err
+	}
+	if uint64(n) != h.dataLength {
+		return errors.Errorf("wrote %d bytes of tile data, expected %d", n, h.dataLength)
+	}
+	return nil
+}
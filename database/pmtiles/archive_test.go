@@ -0,0 +1,173 @@
+package pmtiles
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestTileID(t *testing.T) {
+	for _, tc := range []struct {
+		z    uint8
+		x, y uint32
+		id   uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 1},
+		{1, 0, 1, 2},
+		{1, 1, 1, 3},
+		{1, 1, 0, 4},
+		{2, 0, 0, 5},
+		{12, 3423, 1763, 19078479},
+	} {
+		if id := tileID(tc.z, tc.x, tc.y); id != tc.id {
+			t.Errorf("unexpected id for %d/%d/%d: %d != %d", tc.z, tc.x, tc.y, id, tc.id)
+		}
+		if z, x, y := tileZXY(tc.id); z != tc.z || x != tc.x || y != tc.y {
+			t.Errorf("unexpected tile for %d: %d/%d/%d", tc.id, z, x, y)
+		}
+	}
+	for z := uint8(0); z < 6; z++ {
+		for x := uint32(0); x < 1<<z; x++ {
+			for y := uint32(0); y < 1<<z; y++ {
+				if rz, rx, ry := tileZXY(tileID(z, x, y)); rz != z || rx != x || ry != y {
+					t.Fatalf("%d/%d/%d != %d/%d/%d", z, x, y, rz, rx, ry)
+				}
+			}
+		}
+	}
+}
+
+func gunzip(t *testing.T, b []byte) []byte {
+	t.Helper()
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func decodeDirectory(t *testing.T, b []byte) []entry {
+	t.Helper()
+	buf := gunzip(t, b)
+	next := func() uint64 {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			t.Fatal("invalid directory")
+		}
+		buf = buf[n:]
+		return v
+	}
+	entries := make([]entry, next())
+	var lastID uint64
+	for i := range entries {
+		lastID += next()
+		entries[i].tileID = lastID
+	}
+	for i := range entries {
+		entries[i].runLength = uint32(next())
+	}
+	for i := range entries {
+		entries[i].length = uint32(next())
+	}
+	for i := range entries {
+		offset := next()
+		if offset == 0 && i > 0 {
+			entries[i].offset = entries[i-1].offset + uint64(entries[i-1].length)
+		} else {
+			entries[i].offset = offset - 1
+		}
+	}
+	return entries
+}
+
+func TestDirectories(t *testing.T) {
+	entries := []entry{
+		{tileID: 0, offset: 0, length: 100, runLength: 1},
+		{tileID: 5, offset: 100, length: 50, runLength: 3},
+		{tileID: 9, offset: 0, length: 100, runLength: 1},
+	}
+	root, leaves, err := directories(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) != 0 {
+		t.Error("unexpected leaf directories")
+	}
+	if decoded := decodeDirectory(t, root); !reflect.DeepEqual(decoded, entries) {
+		t.Errorf("unexpected directory %v", decoded)
+	}
+
+	// pseudo random IDs and lengths that do not compress well
+	entries = make([]entry, 50000)
+	var offset, id uint64
+	rnd := uint32(1)
+	for i := range entries {
+		rnd = rnd*1664525 + 1013904223
+		id += 1 + uint64(rnd>>24)
+		length := 1000 + (rnd>>16)%50000
+		entries[i] = entry{tileID: id, offset: offset, length: length, runLength: 1}
+		offset += uint64(length)
+	}
+	root, leaves, err = directories(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root) > maxRootSize || len(leaves) == 0 {
+		t.Fatalf("expected leaf directories, root is %d bytes", len(root))
+	}
+	var all []entry
+	for _, e := range decodeDirectory(t, root) {
+		if e.runLength != 0 {
+			t.Fatalf("root entry %v does not point to leaf", e)
+		}
+		all = append(all, decodeDirectory(t, leaves[e.offset:e.offset+uint64(e.length)])...)
+	}
+	if !reflect.DeepEqual(all, entries) {
+		t.Error("unexpected entries in leaf directories")
+	}
+}
+
+func TestHeader(t *testing.T) {
+	h := header{
+		rootOffset:     127,
+		rootLength:     10,
+		dataLength:     1000,
+		addressedTiles: 7,
+		minZoom:        2,
+		maxZoom:        14,
+		bounds:         [4]float64{9.5, 53, 10.5, 54},
+	}
+	b := h.encode()
+	if len(b) != headerSize {
+		t.Fatalf("unexpected header size %d", len(b))
+	}
+	if string(b[:7]) != "PMTiles" || b[7] != 3 {
+		t.Errorf("unexpected magic %q", b[:8])
+	}
+	if v := binary.LittleEndian.Uint64(b[8:]); v != 127 {
+		t.Errorf("unexpected root offset %d", v)
+	}
+	if v := binary.LittleEndian.Uint64(b[72:]); v != 7 {
+		t.Errorf("unexpected addressed tiles %d", v)
+	}
+	if b[96] != 1 || b[97] != compressionGzip || b[98] != compressionGzip || b[99] != tileTypeMVT {
+		t.Errorf("unexpected flags %v", b[96:100])
+	}
+	if b[100] != 2 || b[101] != 14 {
+		t.Errorf("unexpected zoom levels %v", b[100:102])
+	}
+	if v := int32(binary.LittleEndian.Uint32(b[102:])); v != 95000000 {
+		t.Errorf("unexpected min lon %d", v)
+	}
+	if v := int32(binary.LittleEndian.Uint32(b[123:])); v != 535000000 {
+		t.Errorf("unexpected center lat %d", v)
+	}
+}
@@ -0,0 +1,5 @@
+/*
+Package pmtiles implements the database interfaces for PMTiles archives with
+Mapbox Vector Tiles.
+*/
+package pmtiles
@@ -0,0 +1,227 @@
+package pmtiles
+
+import (
+	"math"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// Mapbox Vector Tile specification version 2.1
+
+const (
+	tileExtent = 4096
+
+	featurePoint      = 1
+	featureLineString = 2
+	featurePolygon    = 3
+
+	cmdMoveTo    = 1
+	cmdLineTo    = 2
+	cmdClosePath = 7
+
+	wireVarint  = 0
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// value is a property value, kind is the field number of the value in the
+// Value message.
+type value struct {
+	kind byte
+	s    string
+	i    int64
+	f    float32
+	b    bool
+}
+
+const (
+	valueString = 1
+	valueFloat  = 2
+	valueInt    = 4
+	valueBool   = 7
+)
+
+// point is a coordinate in tile units.
+type point struct {
+	x, y int32
+}
+
+// tileGeometry is a clipped and simplified geometry in tile units. parts
+// are the points (as single part), the lines or the rings of all polygons.
+// Rings are not closed and exterior rings are followed by their interior
+// rings.
+type tileGeometry struct {
+	typ   int
+	parts [][]point
+}
+
+type tileFeature struct {
+	// id is the OSM ID, features with negative IDs are written without ID
+	id         int64
+	geom       tileGeometry
+	properties []property
+}
+
+type property struct {
+	key   string
+	value value
+}
+
+// layer collects the features of one layer of a tile.
+type layer struct {
+	name     string
+	features proto.Buffer
+	keys     []string
+	keyIdx   map[string]uint32
+	values   []value
+	valueIdx map[value]uint32
+}
+
+func newLayer(name string) *layer {
+	return &layer{
+		name:     name,
+		keyIdx:   make(map[string]uint32),
+		valueIdx: make(map[value]uint32),
+	}
+}
+
+func (l *layer) empty() bool {
+	return len(l.features.Bytes()) == 0
+}
+
+func (l *layer) addFeature(f *tileFeature) {
+	var tags []uint32
+	for _, p := range f.properties {
+		k, ok := l.keyIdx[p.key]
+		if !ok {
+			k = uint32(len(l.keys))
+			l.keys = append(l.keys, p.key)
+			l.keyIdx[p.key] = k
+		}
+		v, ok := l.valueIdx[p.value]
+		if !ok {
+			v = uint32(len(l.values))
+			l.values = append(l.values, p.value)
+			l.valueIdx[p.value] = v
+		}
+		tags = append(tags, k, v)
+	}
+
+	var msg proto.Buffer
+	if f.id >= 0 {
+		encodeKey(&msg, 1, wireVarint)
+		msg.EncodeVarint(uint64(f.id))
+	}
+	if len(tags) > 0 {
+		encodeKey(&msg, 2, wireBytes)
+		msg.EncodeRawBytes(packed(tags))
+	}
+	encodeKey(&msg, 3, wireVarint)
+	msg.EncodeVarint(uint64(f.geom.typ))
+	encodeKey(&msg, 4, wireBytes)
+	msg.EncodeRawBytes(packed(encodeGeometry(&f.geom)))
+
+	encodeKey(&l.features, 2, wireBytes)
+	l.features.EncodeRawBytes(msg.Bytes())
+}
+
+// encode appends the Layer message to the Tile message.
+func (l *layer) encode(tile *proto.Buffer) {
+	var msg proto.Buffer
+	encodeKey(&msg, 15, wireVarint)
+	msg.EncodeVarint(2)
+	encodeKey(&msg, 1, wireBytes)
+	msg.EncodeStringBytes(l.name)
+	// features are already encoded as field 2
+	msg.SetBuf(append(msg.Bytes(), l.features.Bytes()...))
+	for _, k := range l.keys {
+		encodeKey(&msg, 3, wireBytes)
+		msg.EncodeStringBytes(k)
+	}
+	for _, v := range l.values {
+		encodeKey(&msg, 4, wireBytes)
+		msg.EncodeRawBytes(encodeValue(v))
+	}
+	encodeKey(&msg, 5, wireVarint)
+	msg.EncodeVarint(tileExtent)
+
+	encodeKey(tile, 3, wireBytes)
+	tile.EncodeRawBytes(msg.Bytes())
+}
+
+func encodeValue(v value) []byte {
+	var msg proto.Buffer
+	switch v.kind {
+	case valueString:
+		encodeKey(&msg, valueString, wireBytes)
+		msg.EncodeStringBytes(v.s)
+	case valueFloat:
+		encodeKey(&msg, valueFloat, wireFixed32)
+		msg.EncodeFixed32(uint64(math.Float32bits(v.f)))
+	case valueInt:
+		encodeKey(&msg, valueInt, wireVarint)
+		msg.EncodeVarint(uint64(v.i))
+	case valueBool:
+		encodeKey(&msg, valueBool, wireVarint)
+		if v.b {
+			msg.EncodeVarint(1)
+		} else {
+			msg.EncodeVarint(0)
+		}
+	}
+	return msg.Bytes()
+}
+
+func encodeKey(b *proto.Buffer, field, wireType int) {
+	b.EncodeVarint(uint64(field<<3 | wireType))
+}
+
+func packed(v []uint32) []byte {
+	var b proto.Buffer
+	for _, u := range v {
+		b.EncodeVarint(uint64(u))
+	}
+	return b.Bytes()
+}
+
+func command(id, count int) uint32 {
+	return uint32(id&0x7) | uint32(count)<<3
+}
+
+func zigzag(v int32) uint32 {
+	return uint32((v << 1) ^ (v >> 31))
+}
+
+// encodeGeometry returns the geometry commands of g.
+func encodeGeometry(g *tileGeometry) []uint32 {
+	var cmds []uint32
+	var cx, cy int32
+	add := func(p point) {
+		cmds = append(cmds, zigzag(p.x-cx), zigzag(p.y-cy))
+		cx, cy = p.x, p.y
+	}
+
+	if g.typ == featurePoint {
+		if len(g.parts) == 0 {
+			return nil
+		}
+		cmds = append(cmds, command(cmdMoveTo, len(g.parts[0])))
+		for _, p := range g.parts[0] {
+			add(p)
+		}
+		return cmds
+	}
+
+	for _, part := range g.parts {
+		cmds = append(cmds, command(cmdMoveTo, 1))
+		add(part[0])
+		cmds = append(cmds, command(cmdLineTo, len(part)-1))
+		for _, p := range part[1:] {
+			add(p)
+		}
+		if g.typ == featurePolygon {
+			cmds = append(cmds, command(cmdClosePath, 1))
+		}
+	}
+	return cmds
+}
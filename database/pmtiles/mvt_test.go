@@ -0,0 +1,127 @@
+package pmtiles
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+func TestEncodeGeometry(t *testing.T) {
+	// examples from the vector tile specification
+	for _, tc := range []struct {
+		name     string
+		geom     tileGeometry
+		expected []uint32
+	}{
+		{
+			name:     "point",
+			geom:     tileGeometry{typ: featurePoint, parts: [][]point{{{25, 17}}}},
+			expected: []uint32{9, 50, 34},
+		},
+		{
+			name:     "multipoint",
+			geom:     tileGeometry{typ: featurePoint, parts: [][]point{{{5, 7}, {3, 2}}}},
+			expected: []uint32{17, 10, 14, 3, 9},
+		},
+		{
+			name:     "linestring",
+			geom:     tileGeometry{typ: featureLineString, parts: [][]point{{{2, 2}, {2, 10}, {10, 10}}}},
+			expected: []uint32{9, 4, 4, 18, 0, 16, 16, 0},
+		},
+		{
+			name: "multilinestring",
+			geom: tileGeometry{typ: featureLineString, parts: [][]point{
+				{{2, 2}, {2, 10}, {10, 10}},
+				{{1, 1}, {3, 5}},
+			}},
+			expected: []uint32{9, 4, 4, 18, 0, 16, 16, 0, 9, 17, 17, 10, 4, 8},
+		},
+		{
+			name:     "polygon",
+			geom:     tileGeometry{typ: featurePolygon, parts: [][]point{{{3, 6}, {8, 12}, {20, 34}}}},
+			expected: []uint32{9, 6, 12, 18, 10, 12, 24, 44, 15},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if cmds := encodeGeometry(&tc.geom); !reflect.DeepEqual(cmds, tc.expected) {
+				t.Errorf("%v != %v", cmds, tc.expected)
+			}
+		})
+	}
+}
+
+// decodeFields returns the raw values of all fields of a message. Varints
+// are returned as uint64, everything else as []byte.
+func decodeFields(t *testing.T, msg []byte) map[uint64][]interface{} {
+	t.Helper()
+	fields := make(map[uint64][]interface{})
+	b := proto.NewBuffer(msg)
+	for {
+		key, err := b.DecodeVarint()
+		if err != nil {
+			break
+		}
+		var v interface{}
+		switch key & 7 {
+		case wireVarint:
+			v, err = b.DecodeVarint()
+		case wireBytes:
+			v, err = b.DecodeRawBytes(true)
+		case wireFixed32:
+			v, err = b.DecodeFixed32()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields[key>>3] = append(fields[key>>3], v)
+	}
+	return fields
+}
+
+func TestLayer(t *testing.T) {
+	l := newLayer("pois")
+	if !l.empty() {
+		t.Error("new layer not empty")
+	}
+	for i, name := range []string{"Cafe", "Bar", "Cafe"} {
+		l.addFeature(&tileFeature{
+			id:   int64(i + 1),
+			geom: tileGeometry{typ: featurePoint, parts: [][]point{{{25, 17}}}},
+			properties: []property{
+				{key: "name", value: value{kind: valueString, s: name}},
+				{key: "population", value: value{kind: valueInt, i: 100}},
+			},
+		})
+	}
+	l.addFeature(&tileFeature{id: -1, geom: tileGeometry{typ: featurePoint, parts: [][]point{{{1, 1}}}}})
+
+	var tile proto.Buffer
+	l.encode(&tile)
+	layers := decodeFields(t, tile.Bytes())[3]
+	if len(layers) != 1 {
+		t.Fatalf("unexpected layers %v", layers)
+	}
+	layer := decodeFields(t, layers[0].([]byte))
+	if layer[15][0].(uint64) != 2 || string(layer[1][0].([]byte)) != "pois" || layer[5][0].(uint64) != tileExtent {
+		t.Errorf("unexpected layer %v", layer)
+	}
+	if len(layer[3]) != 2 || len(layer[4]) != 3 {
+		t.Errorf("unexpected keys %v or values %v", layer[3], layer[4])
+	}
+	features := layer[2]
+	if len(features) != 4 {
+		t.Fatalf("unexpected features %v", features)
+	}
+	third := decodeFields(t, features[2].([]byte))
+	if third[1][0].(uint64) != 3 || third[3][0].(uint64) != featurePoint {
+		t.Errorf("unexpected feature %v", third)
+	}
+	// same key/value indices as the first feature
+	if !reflect.DeepEqual(third[2][0], []byte{0, 0, 1, 1}) {
+		t.Errorf("unexpected tags %v", third[2][0])
+	}
+	if _, ok := decodeFields(t, features[3].([]byte))[1]; ok {
+		t.Error("unexpected id for negative OSM ID")
+	}
+}
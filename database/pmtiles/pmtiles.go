@@ -0,0 +1,631 @@
+package pmtiles
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/log"
+	"github.com/omniscale/imposm3/mapping"
+	"github.com/omniscale/imposm3/mapping/config"
+	"github.com/omniscale/imposm3/proj"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMinZoom = 0
+	defaultMaxZoom = 14
+)
+
+// PMTiles writes all tables as layers of vector tiles into a single
+// PMTiles archive. Features are collected in temporary spill files during
+// the import and the tiles are created on Finish. Diff imports are not
+// supported.
+type PMTiles struct {
+	path string
+	// dir for all temporary files
+	dir    string
+	layers []*tableLayer
+	tables map[string]*tableLayer
+	// initialized is true after Init
+	initialized bool
+	// runSize of the tile entry sorter
+	runSize int
+}
+
+// tableLayer is the layer of a table.
+type tableLayer struct {
+	name             string
+	idx              uint16
+	columns          []layerColumn
+	geomIdx          int
+	minZoom, maxZoom uint8
+
+	mu     sync.Mutex
+	spill  *spillFile
+	bounds [4]float64
+	count  int
+}
+
+type layerColumn struct {
+	name   string
+	goType string
+	rowIdx int
+}
+
+func New(conf database.Config, m *config.Mapping) (database.DB, error) {
+	path := strings.TrimSpace(strings.TrimPrefix(conf.ConnectionParams, "pmtiles:"))
+	if path == "" {
+		return nil, errors.New("missing file for pmtiles, e.g. pmtiles:/path/to/file.pmtiles")
+	}
+	if conf.Srid != 3857 {
+		return nil, errors.Errorf("pmtiles requires -srid 3857, not %d", conf.Srid)
+	}
+	db := &PMTiles{
+		path:    path,
+		dir:     filepath.Dir(path),
+		tables:  make(map[string]*tableLayer),
+		runSize: defaultRunSize,
+	}
+
+	names := make([]string, 0, len(m.Tables))
+	for name := range m.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := m.Tables[name]
+		l := &tableLayer{name: name, geomIdx: -1, minZoom: defaultMinZoom, maxZoom: defaultMaxZoom}
+		if t.Zoom != nil {
+			l.minZoom, l.maxZoom = uint8(t.Zoom.Min), uint8(t.Zoom.Max)
+		}
+		for i, col := range t.Columns {
+			colType, err := mapping.MakeColumnType(col)
+			if err != nil {
+				return nil, errors.Wrapf(err, "creating column %q of table %q", col.Name, name)
+			}
+			if colType.GoType == "geometry" || colType.GoType == "validated_geometry" {
+				if l.geomIdx == -1 {
+					l.geomIdx = i
+				}
+				continue
+			}
+			l.columns = append(l.columns, layerColumn{name: col.Name, goType: colType.GoType, rowIdx: i})
+		}
+		if l.geomIdx == -1 {
+			log.Printf("[warn] table %q without geometry is not written to pmtiles", name)
+			continue
+		}
+		l.idx = uint16(len(db.layers))
+		db.layers = append(db.layers, l)
+		db.tables[name] = l
+	}
+
+	if len(m.GeneralizedTables) > 0 || len(m.MergedTables) > 0 {
+		log.Println("[warn] generalized and merged tables are not supported by pmtiles")
+	}
+	return db, nil
+}
+
+// Init creates the spill files for all layers.
+func (db *PMTiles) Init() error {
+	if err := os.MkdirAll(db.dir, 0755); err != nil {
+		return errors.Wrap(err, "creating pmtiles dir")
+	}
+	for _, l := range db.layers {
+		s, err := newSpillFile(db.dir, ".imposm-pmtiles-"+l.name+"-*")
+		if err != nil {
+			db.removeTmp()
+			return errors.Wrapf(err, "creating spill file for table %q", l.name)
+		}
+		l.spill = s
+		l.bounds = [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+		l.count = 0
+	}
+	db.initialized = true
+	return nil
+}
+
+func (db *PMTiles) Begin() error {
+	if !db.initialized {
+		return errors.New("pmtiles does not support diff imports")
+	}
+	return nil
+}
+
+// End writes all buffered features into the spill files.
+func (db *PMTiles) End() error {
+	for _, l := range db.layers {
+		if err := l.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *PMTiles) Abort() error {
+	db.removeTmp()
+	return nil
+}
+
+func (db *PMTiles) Close() error {
+	db.removeTmp()
+	return nil
+}
+
+func (db *PMTiles) removeTmp() {
+	for _, l := range db.layers {
+		if l.spill != nil {
+			l.spill.remove()
+			l.spill = nil
+		}
+	}
+	db.initialized = false
+}
+
+func (db *PMTiles) InsertPoint(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	return db.insert(elem, &geom, matches)
+}
+
+func (db *PMTiles) InsertLineString(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	return db.insert(elem, &geom, matches)
+}
+
+func (db *PMTiles) InsertPolygon(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	return db.insert(elem, &geom, matches)
+}
+
+func (db *PMTiles) insert(elem osm.Element, geom *geom.Geometry, matches []mapping.Match) error {
+	for _, match := range matches {
+		if err := db.write(match.Table.Name, elem.ID, match.Row(&elem, geom)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *PMTiles) InsertRelationMember(rel osm.Relation, m osm.Member, mi int, parents []int64, geom geom.Geometry, matches []mapping.Match) error {
+	for _, match := range matches {
+		if err := db.write(match.Table.Name, rel.ID, match.MemberRow(&rel, &m, mi, parents, &geom)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write appends the row as feature record to the spill file of the layer.
+func (db *PMTiles) write(tableName string, id int64, row []interface{}) error {
+	l, ok := db.tables[tableName]
+	if !ok {
+		return nil // table without geometry
+	}
+	if l.geomIdx >= len(row) {
+		return nil
+	}
+	wkbHex, ok := row[l.geomIdx].(string)
+	if !ok || wkbHex == "" {
+		return nil
+	}
+	b, err := geom.EWKBHexBounds([]byte(wkbHex))
+	if err != nil {
+		return nil // empty geometry
+	}
+	wkb, err := hex.DecodeString(wkbHex)
+	if err != nil {
+		return errors.Wrapf(err, "decoding geometry for table %q", tableName)
+	}
+	rec := featureRecord{
+		bounds: [4]float64{b.MinX, b.MinY, b.MaxX, b.MaxY},
+		id:     id,
+		wkb:    wkb,
+	}
+	for i, c := range l.columns {
+		if c.rowIdx >= len(row) {
+			continue
+		}
+		if v, ok := makeValue(c.goType, row[c.rowIdx]); ok {
+			rec.properties = append(rec.properties, recordProperty{column: i, value: v})
+		}
+	}
+	buf := appendRecord(nil, &rec)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.spill == nil {
+		return errors.New("pmtiles: write outside of import")
+	}
+	if _, err := l.spill.write(buf); err != nil {
+		return errors.Wrapf(err, "writing features of table %q", tableName)
+	}
+	l.bounds[0] = math.Min(l.bounds[0], rec.bounds[0])
+	l.bounds[1] = math.Min(l.bounds[1], rec.bounds[1])
+	l.bounds[2] = math.Max(l.bounds[2], rec.bounds[2])
+	l.bounds[3] = math.Max(l.bounds[3], rec.bounds[3])
+	l.count++
+	return nil
+}
+
+// makeValue converts v to a property value of the tile. ok is false for
+// NULL values and values that do not match the column type.
+func makeValue(goType string, v interface{}) (value, bool) {
+	switch goType {
+	case "string":
+		if s, ok := v.(string); ok {
+			return value{kind: valueString, s: s}, true
+		}
+	case "hstore_string":
+		// vector tiles have no nested values, hstore values are encoded
+		// as JSON objects
+		if s, ok := v.(string); ok {
+			tags, err := database.DecodeHstore(s)
+			if err != nil {
+				return value{}, false
+			}
+			b, err := json.Marshal(tags)
+			if err != nil {
+				return value{}, false
+			}
+			return value{kind: valueString, s: string(b)}, true
+		}
+	case "int8", "int32", "int64":
+		switch v := v.(type) {
+		case int:
+			return value{kind: valueInt, i: int64(v)}, true
+		case int8:
+			return value{kind: valueInt, i: int64(v)}, true
+		case int16:
+			return value{kind: valueInt, i: int64(v)}, true
+		case int32:
+			return value{kind: valueInt, i: int64(v)}, true
+		case int64:
+			return value{kind: valueInt, i: v}, true
+		case string:
+			if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return value{kind: valueInt, i: i}, true
+			}
+		}
+	case "float32":
+		switch v := v.(type) {
+		case float32:
+			return value{kind: valueFloat, f: v}, true
+		case float64:
+			return value{kind: valueFloat, f: float32(v)}, true
+		}
+	case "bool":
+		if b, ok := v.(bool); ok {
+			return value{kind: valueBool, b: b}, true
+		}
+	}
+	return value{}, false
+}
+
+func (l *tableLayer) flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.spill == nil {
+		return nil
+	}
+	if err := l.spill.flush(); err != nil {
+		return errors.Wrapf(err, "writing features of table %q", l.name)
+	}
+	return nil
+}
+
+// Generalize is a no-op, features are simplified for each zoom level.
+func (db *PMTiles) Generalize() error { return nil }
+
+func (db *PMTiles) EnableGeneralizeUpdates() {}
+func (db *PMTiles) GeneralizeUpdates() error { return nil }
+
+// Optimize is a no-op.
+func (db *PMTiles) Optimize() error { return nil }
+
+// Finish creates all tiles and writes the PMTiles archive.
+func (db *PMTiles) Finish() error {
+	if !db.initialized {
+		return nil
+	}
+	defer db.removeTmp()
+	for _, l := range db.layers {
+		if err := l.flush(); err != nil {
+			return err
+		}
+	}
+
+	step := log.Step("Collecting tiles")
+	sorter := &entrySorter{dir: db.dir, runSize: db.runSize}
+	defer sorter.remove()
+	for _, l := range db.layers {
+		if err := l.addTileEntries(sorter); err != nil {
+			return err
+		}
+	}
+	step()
+
+	step = log.Step("Writing tiles")
+	data, err := os.CreateTemp(db.dir, ".imposm-pmtiles-data-*")
+	if err != nil {
+		return errors.Wrap(err, "creating tile data file")
+	}
+	defer func() {
+		data.Close()
+		os.Remove(data.Name())
+	}()
+	h, entries, err := db.writeTiles(sorter, data)
+	if err != nil {
+		return err
+	}
+	step()
+
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "reading tile data")
+	}
+	f, err := os.Create(db.path)
+	if err != nil {
+		return errors.Wrap(err, "creating pmtiles file")
+	}
+	if err := writeArchive(f, h, entries, db.metadata(), data); err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing pmtiles file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "closing pmtiles file")
+	}
+	return nil
+}
+
+// addTileEntries adds an entry for each tile of each zoom level that a
+// feature of the layer intersects.
+func (l *tableLayer) addTileEntries(sorter *entrySorter) error {
+	if _, err := l.spill.f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "reading features of table %q", l.name)
+	}
+	r := newRecordScanner(l.spill.f)
+	for r.scan() {
+		offset, size, b := r.offset, r.size, r.bounds
+		for z := l.minZoom; z <= l.maxZoom; z++ {
+			minX, minY, maxX, maxY := tileRange(b, z)
+			for x := minX; x <= maxX; x++ {
+				for y := minY; y <= maxY; y++ {
+					e := tileEntry{tileID: tileID(z, x, y), layer: l.idx, offset: offset, size: size}
+					if err := sorter.add(e); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	if r.err != nil {
+		return errors.Wrapf(r.err, "reading features of table %q", l.name)
+	}
+	return nil
+}
+
+type tileJob struct {
+	id      uint64
+	entries []tileEntry
+	result  chan tileResult
+}
+
+type tileResult struct {
+	data []byte
+	err  error
+}
+
+// writeTiles encodes all tiles in parallel and writes them in the order of
+// their tile ID into data. Identical tiles with consecutive IDs are
+// written only once.
+func (db *PMTiles) writeTiles(sorter *entrySorter, data io.Writer) (header, []entry, error) {
+	h := header{minZoom: mapping.MaxZoom}
+	for _, l := range db.layers {
+		if l.minZoom < h.minZoom {
+			h.minZoom = l.minZoom
+		}
+		if l.maxZoom > h.maxZoom {
+			h.maxZoom = l.maxZoom
+		}
+	}
+	h.bounds = db.bounds()
+
+	workers := runtime.NumCPU()
+	jobs := make(chan *tileJob, workers*4)
+	ordered := make(chan *tileJob, workers*4)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				data, err := db.encodeTile(j.id, j.entries)
+				j.result <- tileResult{data: data, err: err}
+			}
+		}()
+	}
+
+	sortErr := make(chan error, 1)
+	go func() {
+		var cur *tileJob
+		send := func() {
+			if cur != nil {
+				jobs <- cur
+				ordered <- cur
+			}
+		}
+		err := sorter.each(func(e tileEntry) error {
+			if cur == nil || cur.id != e.tileID {
+				send()
+				cur = &tileJob{id: e.tileID, result: make(chan tileResult, 1)}
+			}
+			cur.entries = append(cur.entries, e)
+			return nil
+		})
+		send()
+		close(jobs)
+		close(ordered)
+		sortErr <- err
+	}()
+
+	var entries []entry
+	var offset uint64
+	var last []byte
+	var firstErr error
+	for j := range ordered {
+		res := <-j.result
+		if firstErr != nil {
+			continue // drain remaining jobs
+		}
+		if res.err != nil {
+			firstErr = res.err
+			continue
+		}
+		if res.data == nil {
+			continue // all features were clipped
+		}
+		if n := len(entries); n > 0 && bytes.Equal(res.data, last) &&
+			entries[n-1].tileID+uint64(entries[n-1].runLength) == j.id {
+			entries[n-1].runLength++
+			continue
+		}
+		if _, err := data.Write(res.data); err != nil {
+			firstErr = errors.Wrap(err, "writing tile data")
+			continue
+		}
+		entries = append(entries, entry{tileID: j.id, offset: offset, length: uint32(len(res.data)), runLength: 1})
+		offset += uint64(len(res.data))
+		last = res.data
+		h.tileContents++
+	}
+	wg.Wait()
+	if err := <-sortErr; err != nil && firstErr == nil {
+		firstErr = err
+	}
+	h.dataLength = offset
+	return h, entries, firstErr
+}
+
+// encodeTile returns the gzip compressed vector tile, or nil if no feature
+// intersects the tile.
+func (db *PMTiles) encodeTile(id uint64, entries []tileEntry) ([]byte, error) {
+	z, x, y := tileZXY(id)
+	t := newTileTransform(z, x, y)
+
+	var tile proto.Buffer
+	var cur *layer
+	flushLayer := func() {
+		if cur != nil && !cur.empty() {
+			cur.encode(&tile)
+		}
+	}
+	var buf []byte
+	for _, e := range entries {
+		l := db.layers[e.layer]
+		if cur == nil || cur.name != l.name {
+			flushLayer()
+			cur = newLayer(l.name)
+		}
+		if cap(buf) < int(e.size) {
+			buf = make([]byte, e.size)
+		}
+		buf = buf[:e.size]
+		if _, err := l.spill.f.ReadAt(buf, e.offset); err != nil {
+			return nil, errors.Wrapf(err, "reading features of table %q", l.name)
+		}
+		rec, err := decodeRecord(buf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading features of table %q", l.name)
+		}
+		g, err := geom.DecodeEWKB(rec.wkb)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding geometry of table %q", l.name)
+		}
+		tg, ok := clipGeometry(g, t)
+		if !ok {
+			continue
+		}
+		f := tileFeature{id: rec.id, geom: tg}
+		for _, p := range rec.properties {
+			f.properties = append(f.properties, property{key: l.columns[p.column].name, value: p.value})
+		}
+		cur.addFeature(&f)
+	}
+	flushLayer()
+	if len(tile.Bytes()) == 0 {
+		return nil, nil
+	}
+	return gzipBytes(tile.Bytes())
+}
+
+// bounds returns the bounds of all features in EPSG:4326.
+func (db *PMTiles) bounds() [4]float64 {
+	b := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, l := range db.layers {
+		if l.count == 0 {
+			continue
+		}
+		b[0] = math.Min(b[0], l.bounds[0])
+		b[1] = math.Min(b[1], l.bounds[1])
+		b[2] = math.Max(b[2], l.bounds[2])
+		b[3] = math.Max(b[3], l.bounds[3])
+	}
+	if b[0] > b[2] {
+		return [4]float64{}
+	}
+	b[0], b[1] = proj.MercToWgs(b[0], b[1])
+	b[2], b[3] = proj.MercToWgs(b[2], b[3])
+	return b
+}
+
+type vectorLayer struct {
+	ID      string            `json:"id"`
+	Fields  map[string]string `json:"fields"`
+	MinZoom int               `json:"minzoom"`
+	MaxZoom int               `json:"maxzoom"`
+}
+
+// metadata returns the metadata JSON with the TileJSON vector_layers.
+func (db *PMTiles) metadata() []byte {
+	layers := make([]vectorLayer, 0, len(db.layers))
+	for _, l := range db.layers {
+		vl := vectorLayer{
+			ID:      l.name,
+			Fields:  make(map[string]string),
+			MinZoom: int(l.minZoom),
+			MaxZoom: int(l.maxZoom),
+		}
+		for _, c := range l.columns {
+			switch c.goType {
+			case "bool":
+				vl.Fields[c.name] = "Boolean"
+			case "int8", "int32", "int64", "float32":
+				vl.Fields[c.name] = "Number"
+			default:
+				vl.Fields[c.name] = "String"
+			}
+		}
+		layers = append(layers, vl)
+	}
+	name := strings.TrimSuffix(filepath.Base(db.path), filepath.Ext(db.path))
+	b, _ := json.Marshal(struct {
+		Name         string        `json:"name"`
+		Format       string        `json:"format"`
+		VectorLayers []vectorLayer `json:"vector_layers"`
+	}{name, "pbf", layers})
+	return b
+}
+
+func init() {
+	database.Register("pmtiles", New)
+}
@@ -0,0 +1,146 @@
+package pmtiles
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/mapping"
+	"github.com/omniscale/imposm3/proj"
+)
+
+const testMapping = `
+tables:
+  pois:
+    type: point
+    zoom: {min: 10, max: 12}
+    columns:
+    - {name: osm_id, type: id}
+    - {name: geometry, type: geometry}
+    - {name: name, type: string, key: name}
+    - {name: population, type: integer, key: population}
+    mapping:
+      place: [city]
+`
+
+func TestImport(t *testing.T) {
+	m, err := mapping.New([]byte(testMapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "out", "hamburg.pmtiles")
+
+	if _, err := database.Open(database.Config{ConnectionParams: "pmtiles:" + path, Srid: 4326}, &m.Conf); err == nil {
+		t.Error("expected error for EPSG:4326")
+	}
+
+	db, err := database.Open(database.Config{ConnectionParams: "pmtiles:" + path, Srid: 3857}, &m.Conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// merge multiple sort files
+	db.(*PMTiles).runSize = 2
+
+	if err := db.Begin(); err == nil {
+		t.Error("expected error for diff import")
+	}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	x, y := proj.WgsToMerc(9.99, 53.55)
+	node := osm.Node{Long: x, Lat: y}
+	node.ID = 42
+	node.Tags = osm.Tags{"place": "city", "name": "Hamburg", "population": "1800000"}
+	g := geom.Geometry{Wkb: geom.NodeAsEWKBHexPoint(node, 3857)}
+	if err := db.InsertPoint(node.Element, g, m.PointMatcher.MatchNode(&node)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.End(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.(database.Generalizer).Generalize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.(database.Finisher).Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("temporary files not removed: %v", files)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:7]) != "PMTiles" || b[100] != 10 || b[101] != 12 {
+		t.Fatalf("unexpected header %q", b[:headerSize])
+	}
+	u64 := func(pos int) uint64 { return binary.LittleEndian.Uint64(b[pos:]) }
+	if addressed := u64(72); addressed != 3 {
+		t.Errorf("unexpected number of tiles %d", addressed)
+	}
+	entries := decodeDirectory(t, b[u64(8):u64(8)+u64(16)])
+	if len(entries) != 3 {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+	if z, x, y := tileZXY(entries[2].tileID); z != 12 || x != 2161 || y != 1323 {
+		t.Errorf("unexpected tile %d/%d/%d", z, x, y)
+	}
+	if !strings.Contains(string(gunzip(t, b[u64(24):u64(24)+u64(32)])), `"vector_layers":[{"id":"pois"`) {
+		t.Error("unexpected metadata")
+	}
+
+	e := entries[2]
+	tile := gunzip(t, b[u64(56)+e.offset:u64(56)+e.offset+uint64(e.length)])
+	layers := decodeFields(t, tile)[3]
+	if len(layers) != 1 {
+		t.Fatalf("unexpected layers %v", layers)
+	}
+	layer := decodeFields(t, layers[0].([]byte))
+	if string(layer[1][0].([]byte)) != "pois" || len(layer[2]) != 1 {
+		t.Errorf("unexpected layer %v", layer)
+	}
+	feature := decodeFields(t, layer[2][0].([]byte))
+	if feature[1][0].(uint64) != 42 {
+		t.Errorf("unexpected feature %v", feature)
+	}
+	var keys []string
+	for _, k := range layer[3] {
+		keys = append(keys, string(k.([]byte)))
+	}
+	if len(keys) != 3 || keys[0] != "osm_id" || keys[1] != "name" || keys[2] != "population" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+}
+
+func TestMakeValue(t *testing.T) {
+	for _, tc := range []struct {
+		goType   string
+		v        interface{}
+		expected value
+		ok       bool
+	}{
+		{"string", "Hamburg", value{kind: valueString, s: "Hamburg"}, true},
+		{"hstore_string", `"name"=>"Hamburg", "place"=>"city"`, value{kind: valueString, s: `{"name":"Hamburg","place":"city"}`}, true},
+		{"int64", "1800000", value{kind: valueInt, i: 1800000}, true},
+		{"bool", nil, value{}, false},
+	} {
+		if v, ok := makeValue(tc.goType, tc.v); v != tc.expected || ok != tc.ok {
+			t.Errorf("unexpected value for %s %v: %v %v", tc.goType, tc.v, v, ok)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package pmtiles
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// spillFile collects the encoded features of a table.
+type spillFile struct {
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+func newSpillFile(dir, pattern string) (*spillFile, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &spillFile{f: f, w: bufio.NewWriterSize(f, 256*1024)}, nil
+}
+
+// write appends the record and returns its offset.
+func (s *spillFile) write(record []byte) (int64, error) {
+	offset := s.size
+	if _, err := s.w.Write(record); err != nil {
+		return 0, err
+	}
+	s.size += int64(len(record))
+	return offset, nil
+}
+
+func (s *spillFile) flush() error {
+	return s.w.Flush()
+}
+
+func (s *spillFile) remove() {
+	s.f.Close()
+	os.Remove(s.f.Name())
+}
+
+// featureRecord is a feature in the spill file. The geometry is stored as
+// WKB in EPSG:3857.
+type featureRecord struct {
+	bounds     [4]float64
+	id         int64
+	wkb        []byte
+	properties []recordProperty
+}
+
+type recordProperty struct {
+	// column is the index of the column in the layer
+	column int
+	value  value
+}
+
+// appendRecord appends the size prefixed record.
+func appendRecord(buf []byte, r *featureRecord) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0)
+	for _, v := range r.bounds {
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+	}
+	buf = binary.AppendVarint(buf, r.id)
+	buf = binary.AppendUvarint(buf, uint64(len(r.wkb)))
+	buf = append(buf, r.wkb...)
+	buf = binary.AppendUvarint(buf, uint64(len(r.properties)))
+	for _, p := range r.properties {
+		buf = binary.AppendUvarint(buf, uint64(p.column))
+		buf = append(buf, p.value.kind)
+		switch p.value.kind {
+		case valueString:
+			buf = binary.AppendUvarint(buf, uint64(len(p.value.s)))
+			buf = append(buf, p.value.s...)
+		case valueInt:
+			buf = binary.AppendVarint(buf, p.value.i)
+		case valueFloat:
+			buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(p.value.f))
+		case valueBool:
+			if p.value.b {
+				buf = append(buf, 1)
+			} else {
+				buf = append(buf, 0)
+			}
+		}
+	}
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(buf)-start-4))
+	return buf
+}
+
+var errInvalidRecord = errors.New("invalid feature record")
+
+// recordReader decodes size prefixed records.
+type recordReader struct {
+	buf []byte
+	err error
+}
+
+func (r *recordReader) next(n int) []byte {
+	if r.err != nil || len(r.buf) < n {
+		r.err = errInvalidRecord
+		return make([]byte, n)
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *recordReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errInvalidRecord
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *recordReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errInvalidRecord
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func decodeRecord(buf []byte) (*featureRecord, error) {
+	r := recordReader{buf: buf}
+	size := binary.LittleEndian.Uint32(r.next(4))
+	if int(size) != len(r.buf) {
+		return nil, errInvalidRecord
+	}
+	rec := &featureRecord{}
+	for i := range rec.bounds {
+		rec.bounds[i] = math.Float64frombits(binary.LittleEndian.Uint64(r.next(8)))
+	}
+	rec.id = r.varint()
+	rec.wkb = r.next(int(r.uvarint()))
+	n := r.uvarint()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		p := recordProperty{column: int(r.uvarint())}
+		p.value.kind = r.next(1)[0]
+		switch p.value.kind {
+		case valueString:
+			p.value.s = string(r.next(int(r.uvarint())))
+		case valueInt:
+			p.value.i = r.varint()
+		case valueFloat:
+			p.value.f = math.Float32frombits(binary.LittleEndian.Uint32(r.next(4)))
+		case valueBool:
+			p.value.b = r.next(1)[0] == 1
+		default:
+			return nil, errInvalidRecord
+		}
+		rec.properties = append(rec.properties, p)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return rec, nil
+}
+
+// tileEntry references a feature record of a layer for a single tile.
+type tileEntry struct {
+	tileID uint64
+	layer  uint16
+	offset int64
+	size   uint32
+}
+
+const tileEntrySize = 8 + 2 + 8 + 4
+
+func (e tileEntry) less(o tileEntry) bool {
+	if e.tileID != o.tileID {
+		return e.tileID < o.tileID
+	}
+	if e.layer != o.layer {
+		return e.layer < o.layer
+	}
+	return e.offset < o.offset
+}
+
+func appendTileEntry(buf []byte, e tileEntry) []byte {
+	buf = binary.LittleEndian.AppendUint64(buf, e.tileID)
+	buf = binary.LittleEndian.AppendUint16(buf, e.layer)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(e.offset))
+	return binary.LittleEndian.AppendUint32(buf, e.size)
+}
+
+func readTileEntry(r io.Reader, buf []byte) (tileEntry, error) {
+	if _, err := io.ReadFull(r, buf[:tileEntrySize]); err != nil {
+		return tileEntry{}, err
+	}
+	return tileEntry{
+		tileID: binary.LittleEndian.Uint64(buf),
+		layer:  binary.LittleEndian.Uint16(buf[8:]),
+		offset: int64(binary.LittleEndian.Uint64(buf[10:])),
+		size:   binary.LittleEndian.Uint32(buf[18:]),
+	}, nil
+}
+
+// entrySorter sorts tile entries that do not fit into memory. Entries are
+// sorted in runs of runSize entries that are written into temporary
+// files and merged afterwards.
+type entrySorter struct {
+	dir     string
+	runSize int
+	entries []tileEntry
+	runs    []*os.File
+}
+
+const defaultRunSize = 4 * 1024 * 1024
+
+func (s *entrySorter) add(e tileEntry) error {
+	s.entries = append(s.entries, e)
+	if len(s.entries) >= s.runSize {
+		return s.writeRun()
+	}
+	return nil
+}
+
+func (s *entrySorter) sortEntries() {
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].less(s.entries[j]) })
+}
+
+func (s *entrySorter) writeRun() error {
+	s.sortEntries()
+	f, err := os.CreateTemp(s.dir, ".imposm-pmtiles-run-*")
+	if err != nil {
+		return errors.Wrap(err, "creating sort file")
+	}
+	s.runs = append(s.runs, f)
+	w := bufio.NewWriterSize(f, 256*1024)
+	buf := make([]byte, 0, tileEntrySize)
+	for _, e := range s.entries {
+		if _, err := w.Write(appendTileEntry(buf[:0], e)); err != nil {
+			return errors.Wrap(err, "writing sort file")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "writing sort file")
+	}
+	s.entries = s.entries[:0]
+	return nil
+}
+
+// each calls fn for all entries in sorted order.
+func (s *entrySorter) each(fn func(tileEntry) error) error {
+	if len(s.runs) == 0 {
+		s.sortEntries()
+		for _, e := range s.entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(s.entries) > 0 {
+		if err := s.writeRun(); err != nil {
+			return err
+		}
+	}
+
+	h := &runHeap{}
+	for _, f := range s.runs {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrap(err, "reading sort file")
+		}
+		r := &run{r: bufio.NewReaderSize(f, 64*1024), buf: make([]byte, tileEntrySize)}
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			*h = append(*h, r)
+		}
+	}
+	heap.Init(h)
+	for h.Len() > 0 {
+		r := (*h)[0]
+		if err := fn(r.cur); err != nil {
+			return err
+		}
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+func (s *entrySorter) remove() {
+	for _, f := range s.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.runs = nil
+	s.entries = nil
+}
+
+type run struct {
+	r   io.Reader
+	buf []byte
+	cur tileEntry
+}
+
+func (r *run) next() (bool, error) {
+	e, err := readTileEntry(r.r, r.buf)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "reading sort file")
+	}
+	r.cur = e
+	return true, nil
+}
+
+type runHeap []*run
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return h[i].cur.less(h[j].cur) }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*run)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// recordScanner reads the offset, size and bounds of all records of a
+// spill file.
+type recordScanner struct {
+	r      *bufio.Reader
+	offset int64
+	size   uint32
+	bounds [4]float64
+	next   int64
+	err    error
+}
+
+func newRecordScanner(r io.Reader) *recordScanner {
+	return &recordScanner{r: bufio.NewReaderSize(r, 256*1024)}
+}
+
+func (s *recordScanner) scan() bool {
+	var buf [4 + 32]byte
+	if _, err := io.ReadFull(s.r, buf[:]); err != nil {
+		if err != io.EOF {
+			s.err = err
+		}
+		return false
+	}
+	size := binary.LittleEndian.Uint32(buf[:])
+	if size < 32 {
+		s.err = errInvalidRecord
+		return false
+	}
+	for i := range s.bounds {
+		s.bounds[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf[4+8*i:]))
+	}
+	if _, err := s.r.Discard(int(size) - 32); err != nil {
+		s.err = err
+		return false
+	}
+	s.offset = s.next
+	s.size = size + 4
+	s.next += int64(s.size)
+	return true
+}
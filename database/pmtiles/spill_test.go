@@ -0,0 +1,85 @@
+package pmtiles
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRecord(t *testing.T) {
+	rec := featureRecord{
+		bounds: [4]float64{1, 2, 3, 4},
+		id:     -42,
+		wkb:    []byte{1, 2, 3},
+		properties: []recordProperty{
+			{column: 0, value: value{kind: valueString, s: "Hamburg"}},
+			{column: 2, value: value{kind: valueInt, i: -1800000}},
+			{column: 3, value: value{kind: valueFloat, f: 1.5}},
+			{column: 4, value: value{kind: valueBool, b: true}},
+		},
+	}
+	buf := appendRecord(nil, &rec)
+	decoded, err := decodeRecord(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*decoded, rec) {
+		t.Errorf("%v != %v", decoded, rec)
+	}
+	if _, err := decodeRecord(buf[:len(buf)-1]); err == nil {
+		t.Error("expected error for truncated record")
+	}
+
+	second := featureRecord{bounds: [4]float64{5, 6, 7, 8}}
+	buf = appendRecord(buf, &second)
+	s := newRecordScanner(bytes.NewReader(buf))
+	var bounds [][4]float64
+	var offsets []int64
+	for s.scan() {
+		bounds = append(bounds, s.bounds)
+		offsets = append(offsets, s.offset)
+	}
+	if s.err != nil {
+		t.Fatal(s.err)
+	}
+	if !reflect.DeepEqual(bounds, [][4]float64{rec.bounds, second.bounds}) {
+		t.Errorf("unexpected bounds %v", bounds)
+	}
+	if offsets[0] != 0 || offsets[1] != int64(len(appendRecord(nil, &rec))) {
+		t.Errorf("unexpected offsets %v", offsets)
+	}
+}
+
+func TestEntrySorter(t *testing.T) {
+	for _, runSize := range []int{1000, 7} {
+		s := &entrySorter{dir: t.TempDir(), runSize: runSize}
+		var expected []tileEntry
+		for i := 0; i < 100; i++ {
+			e := tileEntry{tileID: uint64((i * 37) % 50), layer: uint16(i % 3), offset: int64(i), size: 10}
+			expected = append(expected, e)
+			if err := s.add(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var sorted []tileEntry
+		if err := s.each(func(e tileEntry) error {
+			sorted = append(sorted, e)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if runSize == 7 && len(s.runs) == 0 {
+			t.Error("expected sort files")
+		}
+		s.remove()
+
+		if len(sorted) != len(expected) {
+			t.Fatalf("unexpected number of entries %d", len(sorted))
+		}
+		for i := 1; i < len(sorted); i++ {
+			if sorted[i].less(sorted[i-1]) {
+				t.Fatalf("entries not sorted at %d: %v %v", i, sorted[i-1], sorted[i])
+			}
+		}
+	}
+}
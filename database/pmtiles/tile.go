@@ -0,0 +1,367 @@
+package pmtiles
+
+import (
+	"math"
+
+	"github.com/omniscale/imposm3/geom"
+)
+
+const (
+	// tileBuffer is the buffer around each tile in tile units. Geometries
+	// are clipped at the buffer.
+	tileBuffer = 64
+	// simplifyTolerance is the tolerance for the simplification of lines
+	// and polygons in tile units (half a pixel for 256 pixel tiles).
+	simplifyTolerance = 8
+
+	// mercOrigin is the max. x/y of EPSG:3857
+	mercOrigin = 20037508.342789244
+)
+
+type fpoint struct {
+	x, y float64
+}
+
+// tileTransform converts EPSG:3857 coordinates into tile units.
+type tileTransform struct {
+	x0, y0 float64
+	scale  float64
+}
+
+func newTileTransform(z uint8, x, y uint32) tileTransform {
+	size := tileSize(z)
+	return tileTransform{
+		x0:    -mercOrigin + float64(x)*size,
+		y0:    mercOrigin - float64(y)*size,
+		scale: tileExtent / size,
+	}
+}
+
+func (t tileTransform) apply(c geom.Coord) fpoint {
+	return fpoint{(c.X - t.x0) * t.scale, (t.y0 - c.Y) * t.scale}
+}
+
+// tileSize returns the width of a tile in EPSG:3857 units.
+func tileSize(z uint8) float64 {
+	return 2 * mercOrigin / float64(uint64(1)<<z)
+}
+
+// tileRange returns the range of tiles at zoom z that intersect bounds
+// (minx, miny, maxx, maxy in EPSG:3857), including the tile buffer.
+func tileRange(bounds [4]float64, z uint8) (minX, minY, maxX, maxY uint32) {
+	size := tileSize(z)
+	buf := size * tileBuffer / tileExtent
+	max := float64(uint64(1)<<z - 1)
+	clamp := func(v float64) uint32 {
+		return uint32(math.Max(0, math.Min(max, math.Floor(v))))
+	}
+	minX = clamp((bounds[0] - buf + mercOrigin) / size)
+	maxX = clamp((bounds[2] + buf + mercOrigin) / size)
+	minY = clamp((mercOrigin - bounds[3] - buf) / size)
+	maxY = clamp((mercOrigin - bounds[1] + buf) / size)
+	return minX, minY, maxX, maxY
+}
+
+// clipGeometry transforms g into tile units, clips it at the tile buffer
+// and simplifies lines and polygons. ok is false if nothing of g remains
+// within the tile.
+func clipGeometry(g *geom.WKBGeometry, t tileTransform) (tg tileGeometry, ok bool) {
+	const min, max = -tileBuffer, tileExtent + tileBuffer
+
+	addPoint := func(g *geom.WKBGeometry) {
+		for _, c := range g.Coords {
+			p := t.apply(c)
+			if p.x < min || p.x > max || p.y < min || p.y > max {
+				continue
+			}
+			if len(tg.parts) == 0 {
+				tg.parts = append(tg.parts, nil)
+			}
+			tg.parts[0] = append(tg.parts[0], round(p))
+		}
+	}
+	addLine := func(g *geom.WKBGeometry) {
+		for _, part := range clipLine(transform(g.Coords, t), min, max) {
+			line := roundPoints(simplify(part, simplifyTolerance))
+			if len(line) >= 2 {
+				tg.parts = append(tg.parts, line)
+			}
+		}
+	}
+	addPolygon := func(g *geom.WKBGeometry) {
+		for i, ring := range g.Rings {
+			r := clipRing(openRing(transform(ring, t)), min, max)
+			if len(r) > 0 {
+				// simplify as closed line
+				r = simplify(append(r, r[0]), simplifyTolerance)
+				r = r[:len(r)-1]
+			}
+			rounded := roundPoints(r)
+			if len(rounded) > 1 && rounded[0] == rounded[len(rounded)-1] {
+				rounded = rounded[:len(rounded)-1]
+			}
+			area := ringArea(rounded)
+			if len(rounded) < 3 || area == 0 {
+				if i == 0 {
+					// interior rings are dropped with the exterior ring
+					return
+				}
+				continue
+			}
+			// exterior rings have a positive area in tile units
+			if (i == 0) != (area > 0) {
+				reverse(rounded)
+			}
+			tg.parts = append(tg.parts, rounded)
+		}
+	}
+
+	switch g.Type {
+	case geom.WKBPoint:
+		tg.typ = featurePoint
+		addPoint(g)
+	case geom.WKBMultiPoint:
+		tg.typ = featurePoint
+		for _, p := range g.Geometries {
+			addPoint(p)
+		}
+	case geom.WKBLineString:
+		tg.typ = featureLineString
+		addLine(g)
+	case geom.WKBMultiLineString:
+		tg.typ = featureLineString
+		for _, l := range g.Geometries {
+			addLine(l)
+		}
+	case geom.WKBPolygon:
+		tg.typ = featurePolygon
+		addPolygon(g)
+	case geom.WKBMultiPolygon:
+		tg.typ = featurePolygon
+		for _, p := range g.Geometries {
+			addPolygon(p)
+		}
+	default:
+		return tg, false
+	}
+	return tg, len(tg.parts) > 0
+}
+
+func transform(coords []geom.Coord, t tileTransform) []fpoint {
+	pts := make([]fpoint, len(coords))
+	for i, c := range coords {
+		pts[i] = t.apply(c)
+	}
+	return pts
+}
+
+// openRing removes the closing point of ring.
+func openRing(ring []fpoint) []fpoint {
+	if len(ring) > 1 && ring[0] == ring[len(ring)-1] {
+		return ring[:len(ring)-1]
+	}
+	return ring
+}
+
+func round(p fpoint) point {
+	return point{int32(math.Round(p.x)), int32(math.Round(p.y))}
+}
+
+// roundPoints rounds all points and removes repeated points.
+func roundPoints(pts []fpoint) []point {
+	result := make([]point, 0, len(pts))
+	for _, p := range pts {
+		rp := round(p)
+		if len(result) > 0 && result[len(result)-1] == rp {
+			continue
+		}
+		result = append(result, rp)
+	}
+	return result
+}
+
+func ringArea(ring []point) int64 {
+	var area int64
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		area += int64(ring[i].x)*int64(ring[j].y) - int64(ring[j].x)*int64(ring[i].y)
+	}
+	return area
+}
+
+func reverse(ring []point) {
+	for i, j := 0, len(ring)-1; i < j; i, j = i+1, j-1 {
+		ring[i], ring[j] = ring[j], ring[i]
+	}
+}
+
+// clipLine clips line at the rectangle min/max and returns all parts
+// within the rectangle.
+func clipLine(line []fpoint, min, max float64) [][]fpoint {
+	var parts [][]fpoint
+	var cur []fpoint
+	for i := 1; i < len(line); i++ {
+		a, b, ok := clipSegment(line[i-1], line[i], min, max)
+		if !ok {
+			if len(cur) > 0 {
+				parts = append(parts, cur)
+				cur = nil
+			}
+			continue
+		}
+		if len(cur) > 0 && cur[len(cur)-1] != a {
+			parts = append(parts, cur)
+			cur = nil
+		}
+		if len(cur) == 0 {
+			cur = append(cur, a)
+		}
+		cur = append(cur, b)
+		if b != line[i] {
+			// segment leaves the rectangle
+			parts = append(parts, cur)
+			cur = nil
+		}
+	}
+	if len(cur) > 0 {
+		parts = append(parts, cur)
+	}
+	return parts
+}
+
+// clipSegment clips the segment a-b with the Liang-Barsky algorithm.
+// Points within the rectangle are returned unchanged.
+func clipSegment(a, b fpoint, min, max float64) (fpoint, fpoint, bool) {
+	t0, t1 := 0.0, 1.0
+	dx, dy := b.x-a.x, b.y-a.y
+	for _, c := range [4][2]float64{
+		{-dx, a.x - min}, {dx, max - a.x},
+		{-dy, a.y - min}, {dy, max - a.y},
+	} {
+		p, q := c[0], c[1]
+		if p == 0 {
+			if q < 0 {
+				return a, b, false
+			}
+			continue
+		}
+		r := q / p
+		if p < 0 {
+			if r > t1 {
+				return a, b, false
+			}
+			if r > t0 {
+				t0 = r
+			}
+		} else {
+			if r < t0 {
+				return a, b, false
+			}
+			if r < t1 {
+				t1 = r
+			}
+		}
+	}
+	ca, cb := a, b
+	if t0 > 0 {
+		ca = fpoint{a.x + t0*dx, a.y + t0*dy}
+	}
+	if t1 < 1 {
+		cb = fpoint{a.x + t1*dx, a.y + t1*dy}
+	}
+	return ca, cb, true
+}
+
+// clipRing clips the (open) ring at the rectangle min/max with the
+// Sutherland-Hodgman algorithm.
+func clipRing(ring []fpoint, min, max float64) []fpoint {
+	inside := [4]func(p fpoint) bool{
+		func(p fpoint) bool { return p.x >= min },
+		func(p fpoint) bool { return p.x <= max },
+		func(p fpoint) bool { return p.y >= min },
+		func(p fpoint) bool { return p.y <= max },
+	}
+	intersect := func(a, b fpoint, edge int) fpoint {
+		switch edge {
+		case 0, 1:
+			x := min
+			if edge == 1 {
+				x = max
+			}
+			return fpoint{x, a.y + (x-a.x)*(b.y-a.y)/(b.x-a.x)}
+		default:
+			y := min
+			if edge == 3 {
+				y = max
+			}
+			return fpoint{a.x + (y-a.y)*(b.x-a.x)/(b.y-a.y), y}
+		}
+	}
+
+	for edge := 0; edge < 4; edge++ {
+		if len(ring) == 0 {
+			return nil
+		}
+		out := make([]fpoint, 0, len(ring))
+		prev := ring[len(ring)-1]
+		prevIn := inside[edge](prev)
+		for _, p := range ring {
+			in := inside[edge](p)
+			if in != prevIn {
+				out = append(out, intersect(prev, p, edge))
+			}
+			if in {
+				out = append(out, p)
+			}
+			prev, prevIn = p, in
+		}
+		ring = out
+	}
+	return ring
+}
+
+// simplify simplifies the line with the Douglas-Peucker algorithm.
+func simplify(pts []fpoint, tolerance float64) []fpoint {
+	if len(pts) < 3 {
+		return pts
+	}
+	keep := make([]bool, len(pts))
+	keep[0], keep[len(pts)-1] = true, true
+	stack := [][2]int{{0, len(pts) - 1}}
+	for len(stack) > 0 {
+		first, last := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+		maxDist, idx := 0.0, -1
+		for i := first + 1; i < last; i++ {
+			if d := segmentDistSq(pts[i], pts[first], pts[last]); d > maxDist {
+				maxDist, idx = d, i
+			}
+		}
+		if idx >= 0 && maxDist > tolerance*tolerance {
+			keep[idx] = true
+			stack = append(stack, [2]int{first, idx}, [2]int{idx, last})
+		}
+	}
+	result := make([]fpoint, 0, len(pts))
+	for i, p := range pts {
+		if keep[i] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// segmentDistSq returns the squared distance of p to the segment a-b.
+func segmentDistSq(p, a, b fpoint) float64 {
+	dx, dy := b.x-a.x, b.y-a.y
+	if dx != 0 || dy != 0 {
+		t := ((p.x-a.x)*dx + (p.y-a.y)*dy) / (dx*dx + dy*dy)
+		if t > 1 {
+			a = b
+		} else if t > 0 {
+			a = fpoint{a.x + t*dx, a.y + t*dy}
+		}
+	}
+	dx, dy = p.x-a.x, p.y-a.y
+	return dx*dx + dy*dy
+}
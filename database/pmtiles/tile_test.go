@@ -0,0 +1,102 @@
+package pmtiles
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/omniscale/imposm3/geom"
+)
+
+func TestClipLine(t *testing.T) {
+	line := []fpoint{{-10, 5}, {5, 5}, {5, 20}, {8, 20}, {8, 5}, {15, 5}}
+	parts := clipLine(line, 0, 10)
+	expected := [][]fpoint{
+		{{0, 5}, {5, 5}, {5, 10}},
+		{{8, 10}, {8, 5}, {10, 5}},
+	}
+	if !reflect.DeepEqual(parts, expected) {
+		t.Errorf("unexpected parts %v", parts)
+	}
+	if parts := clipLine([]fpoint{{20, 20}, {30, 30}}, 0, 10); len(parts) != 0 {
+		t.Errorf("unexpected parts outside %v", parts)
+	}
+}
+
+func TestClipRing(t *testing.T) {
+	ring := []fpoint{{-5, -5}, {5, -5}, {5, 5}, {-5, 5}}
+	clipped := clipRing(ring, 0, 10)
+	if ringArea(roundPoints(clipped)) != 2*25 && ringArea(roundPoints(clipped)) != -2*25 {
+		t.Errorf("unexpected ring %v", clipped)
+	}
+	if clipped := clipRing([]fpoint{{20, 20}, {30, 20}, {30, 30}}, 0, 10); len(clipped) != 0 {
+		t.Errorf("unexpected ring outside %v", clipped)
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	line := []fpoint{{0, 0}, {5, 1}, {10, 0}, {10, 10}}
+	if s := simplify(line, 2); !reflect.DeepEqual(s, []fpoint{{0, 0}, {10, 0}, {10, 10}}) {
+		t.Errorf("unexpected line %v", s)
+	}
+	if s := simplify(line, 0.5); len(s) != 4 {
+		t.Errorf("unexpected line %v", s)
+	}
+}
+
+func TestClipGeometry(t *testing.T) {
+	// tile 0/0/0 covers the whole world
+	tt := newTileTransform(0, 0, 0)
+	square := func(x0, y0, x1, y1 float64) []geom.Coord {
+		// counter-clockwise in EPSG:3857
+		return []geom.Coord{{X: x0, Y: y0}, {X: x1, Y: y0}, {X: x1, Y: y1}, {X: x0, Y: y1}, {X: x0, Y: y0}}
+	}
+	poly := &geom.WKBGeometry{Type: geom.WKBPolygon, Rings: [][]geom.Coord{
+		square(0, 0, mercOrigin, mercOrigin),
+		square(mercOrigin/4, mercOrigin/4, mercOrigin/2, mercOrigin/2),
+	}}
+	tg, ok := clipGeometry(poly, tt)
+	if !ok || tg.typ != featurePolygon || len(tg.parts) != 2 {
+		t.Fatalf("unexpected geometry %v", tg)
+	}
+	if ringArea(tg.parts[0]) <= 0 || ringArea(tg.parts[1]) >= 0 {
+		t.Errorf("unexpected winding order %v", tg.parts)
+	}
+	if !reflect.DeepEqual(tg.parts[0], []point{{2048, 0}, {4096, 0}, {4096, 2048}, {2048, 2048}}) {
+		t.Errorf("unexpected exterior ring %v", tg.parts[0])
+	}
+
+	// tile 1/0/0 is north-west of the polygon, only the buffer overlaps
+	tg, ok = clipGeometry(poly, newTileTransform(1, 0, 0))
+	if !ok || len(tg.parts) != 1 {
+		t.Fatalf("unexpected geometry %v", tg)
+	}
+	for _, p := range tg.parts[0] {
+		if p.x < tileExtent {
+			t.Errorf("point %v outside of buffer", p)
+		}
+	}
+
+	// tiny polygons are removed
+	tiny := &geom.WKBGeometry{Type: geom.WKBPolygon, Rings: [][]geom.Coord{square(0, 0, 1, 1)}}
+	if _, ok := clipGeometry(tiny, tt); ok {
+		t.Error("tiny polygon not removed")
+	}
+
+	pt := &geom.WKBGeometry{Type: geom.WKBPoint, Coords: []geom.Coord{{X: -mercOrigin / 2, Y: mercOrigin / 2}}}
+	tg, ok = clipGeometry(pt, tt)
+	if !ok || !reflect.DeepEqual(tg.parts, [][]point{{{1024, 1024}}}) {
+		t.Errorf("unexpected point %v", tg)
+	}
+}
+
+func TestTileRange(t *testing.T) {
+	b := [4]float64{-1, -1, 1, 1}
+	if minX, minY, maxX, maxY := tileRange(b, 1); minX != 0 || minY != 0 || maxX != 1 || maxY != 1 {
+		t.Errorf("unexpected range %d %d %d %d", minX, minY, maxX, maxY)
+	}
+	b = [4]float64{-mercOrigin / 2, mercOrigin / 4, -mercOrigin / 2, mercOrigin / 4}
+	// point on the edge of 2/0/1 and 2/1/1
+	if minX, minY, maxX, maxY := tileRange(b, 2); minX != 0 || minY != 1 || maxX != 1 || maxY != 1 {
+		t.Errorf("unexpected range %d %d %d %d", minX, minY, maxX, maxY)
+	}
+}
@@ -0,0 +1,277 @@
+package postgis
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ChangesTable is the name of the table with all changes of diff imports.
+const ChangesTable = "imposm_changes"
+
+// Operations of the records in the ChangesTable.
+const (
+	changeInsert = "insert"
+	changeUpdate = "update"
+	changeDelete = "delete"
+)
+
+// changeTable contains the columns of a table that are required to record
+// changes.
+type changeTable struct {
+	FullName string
+	// IDColumn is the name of the OSM ID column.
+	IDColumn string
+	// IDIndex is the position of the OSM ID in inserted rows.
+	IDIndex int
+	// GeometryColumn is empty for tables without geometry.
+	GeometryColumn string
+	// History is true for tables with previous versions of the rows.
+	History bool
+}
+
+// pendingChange is an inserted or updated OSM ID. These changes are
+// recorded after all rows of the OSM ID are inserted.
+type pendingChange struct {
+	sequence int
+	op       string
+	// prevBBox is the envelope of the rows before an update.
+	prevBBox sql.NullString
+}
+
+// changeLog records all inserts, updates and deletes of diff imports in
+// the ChangesTable, in the same transaction as the changes.
+type changeLog struct {
+	schema    string
+	retention time.Duration
+	tx        *sql.Tx
+	tables    map[string]changeTable
+
+	mu       sync.Mutex
+	sequence int
+	pending  map[string]map[int64]pendingChange
+}
+
+func newChangeLog(pg *PostGIS, tx *sql.Tx) (*changeLog, error) {
+	cl := &changeLog{
+		schema:    pg.Config.ImportSchema,
+		retention: pg.Config.ChangesRetention,
+		tx:        tx,
+		tables:    changeTables(pg),
+		pending:   make(map[string]map[int64]pendingChange),
+	}
+	for _, stmt := range createChangesTableSQL(cl.schema, pg.Config.Srid) {
+		if _, err := tx.Exec(stmt); err != nil {
+			return nil, &SQLError{stmt, err}
+		}
+	}
+	return cl, nil
+}
+
+// changeTables returns all tables with an OSM ID column. Generalized
+// tables are updated with SQL from their source tables and their changes
+// are not recorded.
+func changeTables(pg *PostGIS) map[string]changeTable {
+	tables := make(map[string]changeTable)
+	for name, spec := range pg.Tables {
+		idx := spec.idColumn()
+		if idx == -1 {
+			continue
+		}
+		tables[name] = changeTable{
+			FullName:       spec.FullName,
+			IDColumn:       spec.Columns[idx].Name,
+			IDIndex:        idx,
+			GeometryColumn: geometryColumn(spec.Columns),
+			History:        spec.History,
+		}
+	}
+	return tables
+}
+
+func geometryColumn(columns []ColumnSpec) string {
+	for _, col := range columns {
+		if col.Type.Name() == "GEOMETRY" {
+			return col.Name
+		}
+	}
+	return ""
+}
+
+func createChangesTableSQL(schema string, srid int) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s"."%s" (
+    id BIGSERIAL PRIMARY KEY,
+    sequence BIGINT NOT NULL,
+    table_name VARCHAR NOT NULL,
+    osm_id BIGINT NOT NULL,
+    operation VARCHAR NOT NULL,
+    bbox GEOMETRY(Geometry, %d),
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+)`, schema, ChangesTable, srid),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s_sequence" ON "%s"."%s" (sequence)`,
+			ChangesTable, schema, ChangesTable),
+	}
+}
+
+// recordSQL returns the statement that records a change of the OSM ID
+// with the envelope of all current rows and of the optional previous
+// envelope. Nothing is recorded if the OSM ID has no rows.
+func (cl *changeLog) recordSQL(t changeTable) string {
+	bbox := "NULL::Geometry"
+	if t.GeometryColumn != "" {
+		bbox = fmt.Sprintf(`ST_Envelope(ST_Collect(ARRAY[$5::Geometry, ST_Collect("%s")]))`, t.GeometryColumn)
+	}
+	return fmt.Sprintf(`INSERT INTO "%s"."%s" (sequence, table_name, osm_id, operation, bbox) SELECT $1, $2, $3, $4, %s FROM "%s"."%s" WHERE "%s" = $3%s HAVING count(*) > 0`,
+		cl.schema, ChangesTable,
+		bbox,
+		cl.schema, t.FullName, t.IDColumn, t.currentSQL(),
+	)
+}
+
+// bboxSQL returns the query for the envelope of all rows of the OSM ID.
+func (cl *changeLog) bboxSQL(t changeTable) string {
+	return fmt.Sprintf(`SELECT ST_Envelope(ST_Collect("%s"))::text FROM "%s"."%s" WHERE "%s" = $1%s`,
+		t.GeometryColumn, cl.schema, t.FullName, t.IDColumn, t.currentSQL(),
+	)
+}
+
+// currentSQL returns the additional condition for the current rows of
+// history tables.
+func (t changeTable) currentSQL() string {
+	if !t.History {
+		return ""
+	}
+	return " AND " + currentSQL
+}
+
+func (cl *changeLog) pruneSQL() string {
+	return fmt.Sprintf(`DELETE FROM "%s"."%s" WHERE created < now() - $1::interval`,
+		cl.schema, ChangesTable,
+	)
+}
+
+// setSequence records all pending changes of the previous sequence and
+// removes changes that are older than the retention.
+func (cl *changeLog) setSequence(seq int) error {
+	if err := cl.flush(); err != nil {
+		return err
+	}
+	cl.mu.Lock()
+	cl.sequence = seq
+	cl.mu.Unlock()
+	if cl.retention > 0 {
+		interval := fmt.Sprintf("%d seconds", int64(cl.retention/time.Second))
+		if _, err := cl.tx.Exec(cl.pruneSQL(), interval); err != nil {
+			return &SQLError{cl.pruneSQL(), err}
+		}
+	}
+	return nil
+}
+
+func (cl *changeLog) record(table string, id int64, op string, prevBBox sql.NullString, seq int) error {
+	t, ok := cl.tables[table]
+	if !ok {
+		return nil
+	}
+	var bbox interface{}
+	if prevBBox.Valid {
+		bbox = prevBBox.String
+	}
+	args := []interface{}{seq, table, id, op}
+	if t.GeometryColumn != "" {
+		args = append(args, bbox)
+	}
+	if _, err := cl.tx.Exec(cl.recordSQL(t), args...); err != nil {
+		return &SQLError{cl.recordSQL(t), err}
+	}
+	return nil
+}
+
+// deleted records the deletion of the OSM ID. It needs to be called
+// before the rows are deleted.
+func (cl *changeLog) deleted(table string, id int64) error {
+	cl.mu.Lock()
+	seq := cl.sequence
+	if p, ok := cl.pending[table][id]; ok {
+		// recorded insert/update is outdated
+		delete(cl.pending[table], id)
+		if err := cl.record(table, id, p.op, p.prevBBox, p.sequence); err != nil {
+			cl.mu.Unlock()
+			return err
+		}
+	}
+	cl.mu.Unlock()
+	return cl.record(table, id, changeDelete, sql.NullString{}, seq)
+}
+
+// inserted marks the OSM ID of the row as inserted.
+func (cl *changeLog) inserted(table string, row []interface{}) {
+	t, ok := cl.tables[table]
+	if !ok || t.IDIndex >= len(row) {
+		return
+	}
+	id, ok := row[t.IDIndex].(int64)
+	if !ok {
+		return
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if _, ok := cl.pending[table][id]; ok {
+		return
+	}
+	cl.mark(table, id, pendingChange{sequence: cl.sequence, op: changeInsert})
+}
+
+// bbox returns the envelope of all rows of the OSM ID, for updated.
+func (cl *changeLog) bbox(table string, id int64) (sql.NullString, error) {
+	var bbox sql.NullString
+	t, ok := cl.tables[table]
+	if !ok || t.GeometryColumn == "" {
+		return bbox, nil
+	}
+	if err := cl.tx.QueryRow(cl.bboxSQL(t), id).Scan(&bbox); err != nil {
+		return bbox, &SQLError{cl.bboxSQL(t), err}
+	}
+	return bbox, nil
+}
+
+// updated marks the OSM ID as updated, prevBBox is the envelope before
+// the update.
+func (cl *changeLog) updated(table string, id int64, prevBBox sql.NullString) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.mark(table, id, pendingChange{sequence: cl.sequence, op: changeUpdate, prevBBox: prevBBox})
+}
+
+func (cl *changeLog) mark(table string, id int64, p pendingChange) {
+	if cl.pending[table] == nil {
+		cl.pending[table] = make(map[int64]pendingChange)
+	}
+	cl.pending[table][id] = p
+}
+
+// flush records all pending inserts and updates.
+func (cl *changeLog) flush() error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for table, pending := range cl.pending {
+		ids := make([]int64, 0, len(pending))
+		for id := range pending {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			p := pending[id]
+			if err := cl.record(table, id, p.op, p.prevBBox, p.sequence); err != nil {
+				return errors.Wrapf(err, "recording change of %d in %q", id, table)
+			}
+		}
+		delete(cl.pending, table)
+	}
+	return nil
+}
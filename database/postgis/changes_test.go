@@ -0,0 +1,80 @@
+package postgis
+
+import (
+	"testing"
+
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/mapping"
+)
+
+func TestChangeLogSQL(t *testing.T) {
+	m, err := mapping.New([]byte(`
+    tables:
+      roads:
+        type: linestring
+        columns:
+        - {name: osm_id, type: id}
+        - {name: geometry, type: geometry}
+        mapping:
+          highway: [__any__]
+      routes:
+        type: relation
+        columns:
+        - {name: osm_id, type: id}
+        - {name: name, type: string, key: name}
+        mapping:
+          route: [__any__]
+      nodes:
+        type: point
+        columns:
+        - {name: geometry, type: geometry}
+        mapping:
+          amenity: [__any__]
+    generalized_tables:
+      roads_gen:
+        source: roads
+        tolerance: 10
+    `))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pg := &PostGIS{
+		Config:            database.Config{Srid: 3857, ImportSchema: "public"},
+		Prefix:            "osm_",
+		Tables:            make(map[string]*TableSpec),
+		GeneralizedTables: make(map[string]*GeneralizedTableSpec),
+		MergedTables:      make(map[string]*MergedTableSpec),
+	}
+	if err := pg.prepareTables(&m.Conf); err != nil {
+		t.Fatal(err)
+	}
+	cl := &changeLog{
+		schema:  "public",
+		tables:  changeTables(pg),
+		pending: make(map[string]map[int64]pendingChange),
+	}
+	if _, ok := cl.tables["nodes"]; ok {
+		t.Error("table without OSM ID recorded")
+	}
+	if _, ok := cl.tables["roads_gen"]; ok {
+		t.Error("generalized table recorded")
+	}
+	for _, tc := range []struct {
+		table    string
+		expected string
+	}{
+		{"roads", `INSERT INTO "public"."imposm_changes" (sequence, table_name, osm_id, operation, bbox) SELECT $1, $2, $3, $4, ST_Envelope(ST_Collect(ARRAY[$5::Geometry, ST_Collect("geometry")])) FROM "public"."osm_roads" WHERE "osm_id" = $3 HAVING count(*) > 0`},
+		{"routes", `INSERT INTO "public"."imposm_changes" (sequence, table_name, osm_id, operation, bbox) SELECT $1, $2, $3, $4, NULL::Geometry FROM "public"."osm_routes" WHERE "osm_id" = $3 HAVING count(*) > 0`},
+	} {
+		if sql := cl.recordSQL(cl.tables[tc.table]); sql != tc.expected {
+			t.Errorf("unexpected SQL for %s\n%s\nexpected\n%s", tc.table, sql, tc.expected)
+		}
+	}
+
+	cl.inserted("roads", []interface{}{int64(42), "0102..."})
+	cl.inserted("roads", []interface{}{int64(42), "0102..."})
+	cl.updated("roads", 7, cl.pending["roads"][42].prevBBox)
+	if p := cl.pending["roads"]; len(p) != 2 || p[42].op != changeInsert || p[7].op != changeUpdate {
+		t.Errorf("unexpected pending changes %v", p)
+	}
+}
@@ -0,0 +1,619 @@
+package postgis
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Binary COPY
+//
+// lib/pq only supports COPY in text format. For binary COPY, each table
+// uses its own database connection and the COPY messages are sent directly
+// on the underlying network connection. This is safe as lib/pq does not
+// read or write on the connection while it is idle, and the transaction
+// is not used until the COPY is finished.
+
+// binaryCopyHeader is the signature, flags and header extension length of
+// the binary COPY format.
+var binaryCopyHeader = []byte("PGCOPY\n\377\r\n\000\000\000\000\000\000\000\000\000")
+
+// copyBufferSize is the size of a single CopyData message.
+const copyBufferSize = 64 * 1024
+
+// binaryValueEncoder appends the binary representation of v to buf. v is
+// never nil.
+type binaryValueEncoder func(buf []byte, v driver.Value) ([]byte, error)
+
+// binaryRowEncoder encodes rows in the binary COPY format.
+type binaryRowEncoder struct {
+	columns []binaryValueEncoder
+}
+
+func newBinaryRowEncoder(spec *TableSpec) (*binaryRowEncoder, error) {
+	enc := &binaryRowEncoder{}
+	for _, col := range spec.Columns {
+		var e binaryValueEncoder
+		switch col.Type.Name() {
+		case "VARCHAR":
+			e = encodeBinaryText
+		case "BOOL":
+			e = encodeBinaryBool
+		case "SMALLINT":
+			e = makeBinaryIntEncoder(16)
+		case "INT":
+			e = makeBinaryIntEncoder(32)
+		case "BIGINT":
+			e = makeBinaryIntEncoder(64)
+		case "REAL":
+			e = encodeBinaryReal
+		case "HSTORE":
+			e = encodeBinaryHstore
+		case "GEOMETRY":
+			e = encodeBinaryGeometry
+		default:
+			return nil, errors.Errorf("binary COPY not supported for column %q of type %s", col.Name, col.Type.Name())
+		}
+		enc.columns = append(enc.columns, e)
+	}
+	return enc, nil
+}
+
+// appendRow appends the tuple for row to buf.
+func (enc *binaryRowEncoder) appendRow(buf []byte, row []interface{}) ([]byte, error) {
+	if len(row) != len(enc.columns) {
+		return buf, errors.Errorf("row with %d values for %d columns", len(row), len(enc.columns))
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(row)))
+	for i, v := range row {
+		// convert to the same types as for the text format
+		dv, err := driver.DefaultParameterConverter.ConvertValue(v)
+		if err != nil {
+			return buf, err
+		}
+		if dv == nil {
+			buf = binary.BigEndian.AppendUint32(buf, math.MaxUint32) // -1 for NULL
+			continue
+		}
+		lenPos := len(buf)
+		buf = append(buf, 0, 0, 0, 0)
+		buf, err = enc.columns[i](buf, dv)
+		if err != nil {
+			return buf, errors.Wrapf(err, "encoding value %v", v)
+		}
+		binary.BigEndian.PutUint32(buf[lenPos:], uint32(len(buf)-lenPos-4))
+	}
+	return buf, nil
+}
+
+func encodeBinaryText(buf []byte, v driver.Value) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return append(buf, v...), nil
+	case []byte:
+		return append(buf, v...), nil
+	case int64:
+		return strconv.AppendInt(buf, v, 10), nil
+	case float64:
+		return strconv.AppendFloat(buf, v, 'f', -1, 64), nil
+	case bool:
+		return strconv.AppendBool(buf, v), nil
+	}
+	return buf, errors.Errorf("unsupported type %T for text", v)
+}
+
+func encodeBinaryBool(buf []byte, v driver.Value) ([]byte, error) {
+	var b bool
+	switch v := v.(type) {
+	case bool:
+		b = v
+	case int64:
+		b = v != 0
+	case string:
+		var err error
+		if b, err = parseBool(v); err != nil {
+			return buf, err
+		}
+	default:
+		return buf, errors.Errorf("unsupported type %T for bool", v)
+	}
+	if b {
+		return append(buf, 1), nil
+	}
+	return append(buf, 0), nil
+}
+
+// parseBool parses boolean values like PostgreSQL.
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "t", "true", "y", "yes", "on", "1":
+		return true, nil
+	case "f", "false", "n", "no", "off", "0":
+		return false, nil
+	}
+	return false, errors.Errorf("invalid bool %q", s)
+}
+
+func makeBinaryIntEncoder(bits int) binaryValueEncoder {
+	return func(buf []byte, v driver.Value) ([]byte, error) {
+		var i int64
+		switch v := v.(type) {
+		case int64:
+			i = v
+		case float64:
+			i = int64(math.Round(v))
+		case bool:
+			if v {
+				i = 1
+			}
+		case string:
+			var err error
+			if i, err = strconv.ParseInt(strings.TrimSpace(v), 10, bits); err != nil {
+				return buf, err
+			}
+		default:
+			return buf, errors.Errorf("unsupported type %T for integer", v)
+		}
+		switch bits {
+		case 16:
+			if i < math.MinInt16 || i > math.MaxInt16 {
+				return buf, errors.Errorf("%d out of range for smallint", i)
+			}
+			return binary.BigEndian.AppendUint16(buf, uint16(i)), nil
+		case 32:
+			if i < math.MinInt32 || i > math.MaxInt32 {
+				return buf, errors.Errorf("%d out of range for integer", i)
+			}
+			return binary.BigEndian.AppendUint32(buf, uint32(i)), nil
+		}
+		return binary.BigEndian.AppendUint64(buf, uint64(i)), nil
+	}
+}
+
+func encodeBinaryReal(buf []byte, v driver.Value) ([]byte, error) {
+	var f float64
+	switch v := v.(type) {
+	case float64:
+		f = v
+	case int64:
+		f = float64(v)
+	case string:
+		var err error
+		if f, err = strconv.ParseFloat(strings.TrimSpace(v), 32); err != nil {
+			return buf, err
+		}
+	default:
+		return buf, errors.Errorf("unsupported type %T for real", v)
+	}
+	return binary.BigEndian.AppendUint32(buf, math.Float32bits(float32(f))), nil
+}
+
+// encodeBinaryHstore encodes hstore values in the text format (as created
+// by hstore_tags columns) as binary hstore.
+func encodeBinaryHstore(buf []byte, v driver.Value) ([]byte, error) {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return buf, errors.Errorf("unsupported type %T for hstore", v)
+	}
+	pairs, err := parseHstore(s)
+	if err != nil {
+		return buf, err
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(pairs)))
+	for _, p := range pairs {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.key)))
+		buf = append(buf, p.key...)
+		if p.null {
+			buf = binary.BigEndian.AppendUint32(buf, math.MaxUint32)
+			continue
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.value)))
+		buf = append(buf, p.value...)
+	}
+	return buf, nil
+}
+
+type hstorePair struct {
+	key   string
+	value string
+	null  bool
+}
+
+// parseHstore parses the text representation of an hstore, e.g.
+// `"name"=>"Foo", "a\"b"=>NULL`. PostgreSQL removes duplicate keys.
+func parseHstore(s string) ([]hstorePair, error) {
+	var pairs []hstorePair
+	p := hstoreParser{s: s}
+	for {
+		p.skipSpace()
+		if p.eof() {
+			return pairs, nil
+		}
+		if len(pairs) > 0 {
+			if !p.consume(",") {
+				return nil, errors.Errorf("expected ',' in hstore %q", s)
+			}
+			p.skipSpace()
+		}
+		key, quoted, err := p.token()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.consume("=>") {
+			return nil, errors.Errorf("expected '=>' in hstore %q", s)
+		}
+		p.skipSpace()
+		value, valueQuoted, err := p.token()
+		if err != nil {
+			return nil, err
+		}
+		if !quoted && key == "" {
+			return nil, errors.Errorf("empty key in hstore %q", s)
+		}
+		pair := hstorePair{key: key, value: value}
+		if !valueQuoted && strings.EqualFold(value, "NULL") {
+			pair.value = ""
+			pair.null = true
+		}
+		pairs = append(pairs, pair)
+	}
+}
+
+type hstoreParser struct {
+	s   string
+	pos int
+}
+
+func (p *hstoreParser) eof() bool { return p.pos >= len(p.s) }
+
+func (p *hstoreParser) skipSpace() {
+	for !p.eof() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t' || p.s[p.pos] == '\n' || p.s[p.pos] == '\r') {
+		p.pos++
+	}
+}
+
+func (p *hstoreParser) consume(s string) bool {
+	if strings.HasPrefix(p.s[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+// token returns the next quoted or unquoted key or value.
+func (p *hstoreParser) token() (string, bool, error) {
+	if p.eof() {
+		return "", false, errors.Errorf("unexpected end of hstore %q", p.s)
+	}
+	if p.s[p.pos] != '"' {
+		start := p.pos
+		for !p.eof() {
+			c := p.s[p.pos]
+			if c == ',' || c == '=' || c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+				break
+			}
+			p.pos++
+		}
+		return p.s[start:p.pos], false, nil
+	}
+	p.pos++ // opening quote
+	var b strings.Builder
+	for !p.eof() {
+		c := p.s[p.pos]
+		p.pos++
+		switch c {
+		case '\\':
+			if p.eof() {
+				return "", true, errors.Errorf("unexpected end of hstore %q", p.s)
+			}
+			b.WriteByte(p.s[p.pos])
+			p.pos++
+		case '"':
+			return b.String(), true, nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", true, errors.Errorf("unterminated string in hstore %q", p.s)
+}
+
+// encodeBinaryGeometry encodes hex encoded (E)WKB as binary geometry.
+func encodeBinaryGeometry(buf []byte, v driver.Value) ([]byte, error) {
+	var wkbHex string
+	switch v := v.(type) {
+	case string:
+		wkbHex = v
+	case []byte:
+		wkbHex = string(v)
+	default:
+		return buf, errors.Errorf("unsupported type %T for geometry", v)
+	}
+	n := hex.DecodedLen(len(wkbHex))
+	start := len(buf)
+	buf = append(buf, make([]byte, n)...)
+	if _, err := hex.Decode(buf[start:], []byte(wkbHex)); err != nil {
+		return buf[:start], errors.Wrap(err, "decoding hex wkb")
+	}
+	return buf, nil
+}
+
+// binaryCopy writes rows with COPY in binary format into a table.
+type binaryCopy struct {
+	conn net.Conn
+	enc  *binaryRowEncoder
+	buf  []byte
+}
+
+// startBinaryCopy starts COPY FROM STDIN for spec. conn needs to be the
+// network connection of an idle transaction.
+func startBinaryCopy(conn net.Conn, spec *TableSpec) (*binaryCopy, error) {
+	enc, err := newBinaryRowEncoder(spec)
+	if err != nil {
+		return nil, err
+	}
+	bc := &binaryCopy{
+		conn: conn,
+		enc:  enc,
+		buf:  make([]byte, 0, copyBufferSize+4096),
+	}
+
+	query := spec.CopySQL() + " WITH (FORMAT binary)"
+	msg := []byte{'Q', 0, 0, 0, 0}
+	msg = append(msg, query...)
+	msg = append(msg, 0)
+	if err := bc.send(msg); err != nil {
+		return nil, err
+	}
+
+	var copyErr error
+	for {
+		t, body, err := bc.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case 'G': // CopyInResponse
+			if len(body) < 1 || body[0] != 1 {
+				bc.abort("binary format not supported")
+				return nil, errors.New("server did not accept binary COPY")
+			}
+			bc.resetBuf()
+			bc.buf = append(bc.buf, binaryCopyHeader...)
+			return bc, nil
+		case 'E':
+			copyErr = parseErrorResponse(body)
+		case 'Z':
+			if copyErr == nil {
+				copyErr = errors.New("unexpected ReadyForQuery in response to COPY")
+			}
+			return nil, copyErr
+		case 'N', 'S': // notices and parameter status
+		default:
+			return nil, errors.Errorf("unexpected response %q for COPY", t)
+		}
+	}
+}
+
+// Insert encodes row into the current CopyData message. The message is sent
+// when it is full.
+func (bc *binaryCopy) Insert(row []interface{}) error {
+	var err error
+	start := len(bc.buf)
+	bc.buf, err = bc.enc.appendRow(bc.buf, row)
+	if err != nil {
+		bc.buf = bc.buf[:start]
+		return err
+	}
+	if len(bc.buf) >= copyBufferSize {
+		return bc.flush()
+	}
+	return nil
+}
+
+// Finish sends the remaining rows and waits till the COPY is completed.
+func (bc *binaryCopy) Finish() error {
+	bc.buf = binary.BigEndian.AppendUint16(bc.buf, math.MaxUint16) // -1 as trailer
+	if err := bc.flush(); err != nil {
+		return err
+	}
+	if err := bc.send([]byte{'c', 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	return bc.waitReady()
+}
+
+// abort cancels the COPY. The transaction is in a failed state afterwards.
+func (bc *binaryCopy) abort(reason string) {
+	msg := []byte{'f', 0, 0, 0, 0}
+	msg = append(msg, reason...)
+	msg = append(msg, 0)
+	if err := bc.send(msg); err != nil {
+		return
+	}
+	bc.waitReady()
+}
+
+func (bc *binaryCopy) waitReady() error {
+	var copyErr error
+	for {
+		t, body, err := bc.receive()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case 'E':
+			if copyErr == nil {
+				copyErr = parseErrorResponse(body)
+			}
+		case 'Z':
+			return copyErr
+		case 'C', 'N', 'S':
+		default:
+			return errors.Errorf("unexpected response %q during COPY", t)
+		}
+	}
+}
+
+func (bc *binaryCopy) resetBuf() {
+	bc.buf = append(bc.buf[:0], 'd', 0, 0, 0, 0)
+}
+
+func (bc *binaryCopy) flush() error {
+	if len(bc.buf) > 5 {
+		if err := bc.send(bc.buf); err != nil {
+			return err
+		}
+	}
+	bc.resetBuf()
+	return nil
+}
+
+// send sets the length of the message and writes it to the connection.
+func (bc *binaryCopy) send(msg []byte) error {
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(msg)-1))
+	if _, err := bc.conn.Write(msg); err != nil {
+		return errors.Wrap(err, "writing COPY data")
+	}
+	return nil
+}
+
+// receive reads a single message from the connection.
+func (bc *binaryCopy) receive() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(bc.conn, header[:]); err != nil {
+		return 0, nil, errors.Wrap(err, "reading COPY response")
+	}
+	n := int(binary.BigEndian.Uint32(header[1:])) - 4
+	if n < 0 {
+		return 0, nil, errors.New("invalid message length in COPY response")
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(bc.conn, body); err != nil {
+		return 0, nil, errors.Wrap(err, "reading COPY response")
+	}
+	return header[0], body, nil
+}
+
+// parseErrorResponse returns the fields of an ErrorResponse message as
+// pq.Error, like errors from lib/pq.
+func parseErrorResponse(body []byte) error {
+	err := &pq.Error{}
+	for len(body) > 1 {
+		field := body[0]
+		end := 1
+		for end < len(body) && body[end] != 0 {
+			end++
+		}
+		value := string(body[1:end])
+		if end < len(body) {
+			end++
+		}
+		body = body[end:]
+		switch field {
+		case 'S':
+			err.Severity = value
+		case 'C':
+			err.Code = pq.ErrorCode(value)
+		case 'M':
+			err.Message = value
+		case 'D':
+			err.Detail = value
+		case 'H':
+			err.Hint = value
+		case 'P':
+			err.Position = value
+		case 'W':
+			err.Where = value
+		case 's':
+			err.Schema = value
+		case 't':
+			err.Table = value
+		case 'c':
+			err.Column = value
+		case 'n':
+			err.Constraint = value
+		}
+	}
+	return err
+}
+
+// copyDialer keeps the last network connection that lib/pq opened with
+// this dialer.
+type copyDialer struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (d *copyDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *copyDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+func (d *copyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.conn = conn
+	d.mu.Unlock()
+	return conn, nil
+}
+
+func (d *copyDialer) lastConn() net.Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.conn
+}
+
+// openCopyDB opens a new DB with a single connection for binary COPY.
+// It returns the DB and the dialer with the network connection.
+func (pg *PostGIS) openCopyDB() (*sql.DB, *copyDialer, error) {
+	if !sslDisabled(pg.Params) {
+		return nil, nil, errors.New("binary COPY requires sslmode=disable")
+	}
+	connector, err := pq.NewConnector(pg.Params)
+	if err != nil {
+		return nil, nil, err
+	}
+	dialer := &copyDialer{}
+	connector.Dialer(dialer)
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(1)
+	return db, dialer, nil
+}
+
+// sslDisabled returns whether params or PGSSLMODE disable SSL. The network
+// connection is only usable for binary COPY without SSL.
+func sslDisabled(params string) bool {
+	for _, p := range strings.Fields(params) {
+		if strings.HasPrefix(p, "sslmode=") {
+			return strings.Trim(strings.TrimPrefix(p, "sslmode="), "'") == "disable"
+		}
+	}
+	return os.Getenv("PGSSLMODE") == "disable"
+}
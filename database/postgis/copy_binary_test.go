@@ -0,0 +1,272 @@
+package postgis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/lib/pq"
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/geom"
+)
+
+func binaryTestSpec() *TableSpec {
+	return &TableSpec{
+		Schema:   "import",
+		FullName: "osm_test",
+		Columns: []ColumnSpec{
+			{Name: "osm_id", Type: pgTypes["int64"]},
+			{Name: "name", Type: pgTypes["string"]},
+			{Name: "oneway", Type: pgTypes["bool"]},
+			{Name: "layer", Type: pgTypes["int8"]},
+			{Name: "z_order", Type: pgTypes["int32"]},
+			{Name: "area", Type: pgTypes["float32"]},
+			{Name: "tags", Type: pgTypes["hstore_string"]},
+			{Name: "geometry", Type: pgTypes["geometry"]},
+		},
+	}
+}
+
+func TestBinaryRowEncoder(t *testing.T) {
+	enc, err := newBinaryRowEncoder(binaryTestSpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wkb := geom.NodeAsEWKBHexPoint(osm.Node{Long: 10, Lat: 53}, 4326)
+	row := []interface{}{int64(-42), "Straße", true, "-1", 5, float32(1.5), `"name"=>"Foo"`, string(wkb)}
+	buf, err := enc.appendRow(nil, row)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wkbBytes, _ := hex.DecodeString(string(wkb))
+	expected := []byte{0, 8}
+	field := func(data ...byte) {
+		expected = binary.BigEndian.AppendUint32(expected, uint32(len(data)))
+		expected = append(expected, data...)
+	}
+	field(0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xd6)
+	field([]byte("Straße")...)
+	field(1)
+	field(0xff, 0xff)
+	field(0, 0, 0, 5)
+	field(0x3f, 0xc0, 0, 0)
+	field(0, 0, 0, 1, 0, 0, 0, 4, 'n', 'a', 'm', 'e', 0, 0, 0, 3, 'F', 'o', 'o')
+	field(wkbBytes...)
+	if !bytes.Equal(buf, expected) {
+		t.Errorf("unexpected row\n%x\n%x", buf, expected)
+	}
+
+	// NULL values
+	buf, err = enc.appendRow(nil, []interface{}{int64(1), nil, nil, nil, nil, nil, nil, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != 2+12+7*4 || !bytes.Equal(buf[len(buf)-4:], []byte{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("unexpected row with NULL values %x", buf)
+	}
+
+	for _, row := range [][]interface{}{
+		{int64(1), "", true, 1000000, 1, 1.0, "", ""},
+		{int64(1), "", "maybe", 1, 1, 1.0, "", ""},
+		{int64(1), "", true, 1, 1, 1.0, `"name"=>`, ""},
+		{int64(1), "", true, 1, 1, 1.0, "", "0101XX"},
+		{int64(1)},
+	} {
+		if _, err := enc.appendRow(nil, row); err == nil {
+			t.Errorf("expected error for %v", row)
+		}
+	}
+}
+
+func TestBinaryRowEncoderUnsupportedType(t *testing.T) {
+	spec := &TableSpec{Columns: []ColumnSpec{
+		{Name: "foo", Type: &simpleColumnType{"JSON"}},
+	}}
+	if _, err := newBinaryRowEncoder(spec); err == nil {
+		t.Error("expected error for unsupported column type")
+	}
+}
+
+func TestParseHstore(t *testing.T) {
+	for _, tc := range []struct {
+		hstore   string
+		expected []hstorePair
+	}{
+		{``, nil},
+		{`"name"=>"Foo"`, []hstorePair{{key: "name", value: "Foo"}}},
+		{`"a"=>"1", "b"=>"2"`, []hstorePair{{key: "a", value: "1"}, {key: "b", value: "2"}}},
+		{`"a\"b"=>"c\\d"`, []hstorePair{{key: `a"b`, value: `c\d`}}},
+		{`a => NULL ,b=>"NULL"`, []hstorePair{{key: "a", null: true}, {key: "b", value: "NULL"}}},
+		{`""=>""`, []hstorePair{{key: "", value: ""}}},
+	} {
+		pairs, err := parseHstore(tc.hstore)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", tc.hstore, err)
+			continue
+		}
+		if !reflect.DeepEqual(pairs, tc.expected) {
+			t.Errorf("unexpected pairs for %q: %v", tc.hstore, pairs)
+		}
+	}
+
+	for _, hstore := range []string{`"a"`, `"a"=>"b" "c"=>"d"`, `"a=>"b"`, `=>"b"`, `"a"=>"b\`} {
+		if _, err := parseHstore(hstore); err == nil {
+			t.Errorf("expected error for %q", hstore)
+		}
+	}
+}
+
+// fakeCopyServer reads all messages from conn and responds like
+// PostgreSQL to a COPY in binary format.
+func fakeCopyServer(t *testing.T, conn net.Conn, copyErr bool) (query string, data []byte) {
+	msg := func(t byte, body ...byte) []byte {
+		m := []byte{t, 0, 0, 0, 0}
+		m = append(m, body...)
+		binary.BigEndian.PutUint32(m[1:], uint32(len(m)-1))
+		return m
+	}
+	read := func() (byte, []byte) {
+		var header [5]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			t.Error(err)
+			return 0, nil
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			t.Error(err)
+		}
+		return header[0], body
+	}
+
+	typ, body := read()
+	if typ != 'Q' {
+		t.Errorf("expected query, got %q", typ)
+	}
+	query = string(bytes.TrimRight(body, "\x00"))
+	conn.Write(msg('G', 1, 0, 0))
+	for {
+		typ, body = read()
+		switch typ {
+		case 'd':
+			data = append(data, body...)
+		case 'c':
+			if copyErr {
+				conn.Write(msg('E', []byte("SERROR\x00C22P04\x00Minvalid data\x00\x00")...))
+			} else {
+				conn.Write(msg('C', []byte("COPY 2\x00")...))
+			}
+			conn.Write(msg('Z', 'T'))
+			return query, data
+		default:
+			t.Errorf("unexpected message %q", typ)
+			return query, data
+		}
+	}
+}
+
+func TestBinaryCopy(t *testing.T) {
+	spec := &TableSpec{
+		Schema:   "import",
+		FullName: "osm_test",
+		Columns: []ColumnSpec{
+			{Name: "osm_id", Type: pgTypes["int64"]},
+			{Name: "name", Type: pgTypes["string"]},
+		},
+	}
+	for _, copyErr := range []bool{false, true} {
+		client, server := net.Pipe()
+		var query string
+		var data []byte
+		done := make(chan struct{})
+		go func() {
+			query, data = fakeCopyServer(t, server, copyErr)
+			close(done)
+		}()
+
+		bc, err := startBinaryCopy(client, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bc.Insert([]interface{}{int64(1), "foo"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := bc.Insert([]interface{}{int64(2), nil}); err != nil {
+			t.Fatal(err)
+		}
+		err = bc.Finish()
+		<-done
+		client.Close()
+		server.Close()
+
+		if copyErr {
+			if pqErr, ok := err.(*pq.Error); !ok || pqErr.Code != "22P04" || pqErr.Message != "invalid data" {
+				t.Errorf("unexpected error %#v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != `COPY "import"."osm_test" ("osm_id", "name") FROM STDIN WITH (FORMAT binary)` {
+			t.Error("unexpected query", query)
+		}
+		expected := append([]byte{}, binaryCopyHeader...)
+		expected = append(expected,
+			0, 2, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 3, 'f', 'o', 'o',
+			0, 2, 0, 0, 0, 8, 0, 0, 0, 0, 0, 0, 0, 2, 0xff, 0xff, 0xff, 0xff,
+			0xff, 0xff,
+		)
+		if !bytes.Equal(data, expected) {
+			t.Errorf("unexpected COPY data\n%x\n%x", data, expected)
+		}
+	}
+}
+
+func TestSSLDisabled(t *testing.T) {
+	t.Setenv("PGSSLMODE", "")
+	for _, tc := range []struct {
+		params   string
+		expected bool
+	}{
+		{"host=localhost sslmode=disable", true},
+		{"host=localhost sslmode='disable'", true},
+		{"host=localhost sslmode=require", false},
+		{"host=localhost", false},
+	} {
+		if sslDisabled(tc.params) != tc.expected {
+			t.Errorf("unexpected result for %q", tc.params)
+		}
+	}
+	t.Setenv("PGSSLMODE", "disable")
+	if !sslDisabled("host=localhost") {
+		t.Error("expected disabled ssl from PGSSLMODE")
+	}
+}
+
+func BenchmarkBinaryRowEncoder(b *testing.B) {
+	enc, err := newBinaryRowEncoder(binaryTestSpec())
+	if err != nil {
+		b.Fatal(err)
+	}
+	wkb, err := geom.NodesAsEWKBHexLineString([]osm.Node{
+		{Long: 10, Lat: 53}, {Long: 10.001, Lat: 53.001}, {Long: 10.002, Lat: 53.001},
+		{Long: 10.003, Lat: 53.002}, {Long: 10.004, Lat: 53.004},
+	}, 3857)
+	if err != nil {
+		b.Fatal(err)
+	}
+	row := []interface{}{int64(123456789), "Hauptstraße", true, 0, 5, float32(0), `"highway"=>"residential", "name"=>"Hauptstraße"`, string(wkb)}
+	buf := make([]byte, 0, 4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if buf, err = enc.appendRow(buf[:0], row); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
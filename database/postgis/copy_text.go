@@ -0,0 +1,68 @@
+package postgis
+
+import (
+	"database/sql/driver"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Text COPY
+//
+// Bulk imports send rows in the text format with the COPY support of
+// lib/pq. textRowEncoder creates the same rows for COPY files that are
+// written without a database connection.
+
+// textRowEncoder encodes rows in the text COPY format.
+type textRowEncoder struct{}
+
+// appendRow appends the line for row to buf.
+func (enc textRowEncoder) appendRow(buf []byte, row []interface{}) ([]byte, error) {
+	for i, v := range row {
+		if i > 0 {
+			buf = append(buf, '\t')
+		}
+		dv, err := driver.DefaultParameterConverter.ConvertValue(v)
+		if err != nil {
+			return buf, err
+		}
+		switch dv := dv.(type) {
+		case nil:
+			buf = append(buf, `\N`...)
+		case int64:
+			buf = strconv.AppendInt(buf, dv, 10)
+		case float64:
+			buf = strconv.AppendFloat(buf, dv, 'f', -1, 64)
+		case bool:
+			buf = strconv.AppendBool(buf, dv)
+		case string:
+			buf = appendEscapedText(buf, dv)
+		case []byte:
+			buf = appendEscapedText(buf, `\x`+hex.EncodeToString(dv))
+		default:
+			return buf, errors.Errorf("unsupported type %T for text COPY", dv)
+		}
+	}
+	return append(buf, '\n'), nil
+}
+
+// appendEscapedText appends s with escaped backslashes and control
+// characters that separate columns and rows.
+func appendEscapedText(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			buf = append(buf, '\\', '\\')
+		case '\n':
+			buf = append(buf, '\\', 'n')
+		case '\r':
+			buf = append(buf, '\\', 'r')
+		case '\t':
+			buf = append(buf, '\\', 't')
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
@@ -0,0 +1,22 @@
+package postgis
+
+import (
+	"testing"
+)
+
+func TestTextRowEncoder(t *testing.T) {
+	enc := textRowEncoder{}
+	row := []interface{}{int64(-42), "Foo\tBar\\\nBaz", true, 5, float32(1.5), nil, []byte{1, 2}}
+	buf, err := enc.appendRow(nil, row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "-42\tFoo\\tBar\\\\\\nBaz\ttrue\t5\t1.5\t\\N\t\\\\x0102\n"
+	if string(buf) != expected {
+		t.Errorf("unexpected row\n%q\n%q", buf, expected)
+	}
+
+	if _, err := enc.appendRow(nil, []interface{}{struct{}{}}); err == nil {
+		t.Error("expected error for unsupported type")
+	}
+}
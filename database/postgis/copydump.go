@@ -0,0 +1,536 @@
+package postgis
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/log"
+	"github.com/omniscale/imposm3/mapping"
+	"github.com/omniscale/imposm3/mapping/config"
+	"github.com/pkg/errors"
+)
+
+// CopyDump writes all tables into COPY files and a schema.sql that creates
+// the tables, loads the files with psql and creates the generalized
+// tables and indices. The dump can be loaded into databases that Imposm
+// can't connect to. Diff imports are not supported.
+type CopyDump struct {
+	pg  *PostGIS
+	dir string
+	// gzip compresses all COPY files
+	gzip bool
+	// chunkSize splits the COPY files of a table after chunkSize bytes of
+	// uncompressed rows, 0 to write a single file for each table
+	chunkSize int64
+	optimize  bool
+
+	mu sync.Mutex
+	// files contains the names of the COPY files of each table
+	files map[string][]string
+}
+
+// dumpFile is the name of the generated SQL file.
+const dumpFile = "schema.sql"
+
+// NewCopyDump returns a CopyDump for connections like
+// copydump:/path/to/dir?prefix=osm_&compress=gzip&chunk_size=1024
+func NewCopyDump(conf database.Config, m *config.Mapping) (database.DB, error) {
+	params := strings.TrimSpace(strings.TrimPrefix(conf.ConnectionParams, "copydump:"))
+	var query string
+	if i := strings.IndexByte(params, '?'); i >= 0 {
+		params, query = params[:i], params[i+1:]
+	}
+	if params == "" {
+		return nil, errors.New("missing directory for copydump, e.g. copydump:/path/to/dir")
+	}
+	opts, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing copydump options")
+	}
+
+	db := &CopyDump{
+		dir:   params,
+		files: make(map[string][]string),
+		pg: &PostGIS{
+			Config:            conf,
+			Tables:            make(map[string]*TableSpec),
+			GeneralizedTables: make(map[string]*GeneralizedTableSpec),
+			MergedTables:      make(map[string]*MergedTableSpec),
+		},
+	}
+	_, db.pg.Prefix = stripPrefixFromConnectionParams("prefix=" + opts.Get("prefix"))
+
+	switch opts.Get("compress") {
+	case "":
+	case "gzip":
+		db.gzip = true
+	default:
+		return nil, errors.Errorf("unsupported compression %q for copydump, only gzip is supported", opts.Get("compress"))
+	}
+	if v := opts.Get("chunk_size"); v != "" {
+		mb, err := strconv.Atoi(v)
+		if err != nil || mb <= 0 {
+			return nil, errors.Errorf("chunk_size for copydump needs to be a positive number of MB, got %q", v)
+		}
+		db.chunkSize = int64(mb) * 1024 * 1024
+	}
+
+	if err := db.pg.prepareTables(m); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Init creates the directory and removes the COPY files of previous dumps.
+func (db *CopyDump) Init() error {
+	if err := os.MkdirAll(db.dir, 0755); err != nil {
+		return errors.Wrap(err, "creating copydump dir")
+	}
+	for _, spec := range db.pg.Tables {
+		files, err := filepath.Glob(filepath.Join(db.dir, spec.FullName+".*.*copy*"))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err := os.Remove(f); err != nil {
+				return errors.Wrap(err, "removing previous dump")
+			}
+		}
+	}
+	db.files = make(map[string][]string)
+	return nil
+}
+
+func (db *CopyDump) Begin() error {
+	return errors.New("copydump does not support diff imports")
+}
+
+// BeginBulk starts writing the COPY files of all tables.
+func (db *CopyDump) BeginBulk() error {
+	txr := &TxRouter{Tables: make(map[string]TableTx)}
+	for name, spec := range db.pg.Tables {
+		key, err := db.pg.sortKey(spec)
+		if err != nil {
+			return err
+		}
+		tt := newDumpTableTx(db, spec, key)
+		if err := tt.Begin(nil); err != nil {
+			txr.Abort()
+			return err
+		}
+		txr.Tables[name] = tt
+	}
+	db.pg.txRouter = txr
+	return nil
+}
+
+func (db *CopyDump) End() error {
+	if db.pg.txRouter != nil {
+		err := db.pg.txRouter.End()
+		db.pg.txRouter = nil
+		return err
+	}
+	return nil
+}
+
+func (db *CopyDump) Abort() error {
+	if db.pg.txRouter != nil {
+		err := db.pg.txRouter.Abort()
+		db.pg.txRouter = nil
+		return err
+	}
+	return nil
+}
+
+func (db *CopyDump) Close() error {
+	return db.Abort()
+}
+
+func (db *CopyDump) InsertPoint(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	return db.pg.InsertPoint(elem, geom, matches)
+}
+
+func (db *CopyDump) InsertLineString(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	return db.pg.InsertLineString(elem, geom, matches)
+}
+
+func (db *CopyDump) InsertPolygon(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	return db.pg.InsertPolygon(elem, geom, matches)
+}
+
+func (db *CopyDump) InsertRelationMember(rel osm.Relation, m osm.Member, mi int, parents []int64, geom geom.Geometry, matches []mapping.Match) error {
+	return db.pg.InsertRelationMember(rel, m, mi, parents, geom, matches)
+}
+
+// Generalize is a no-op, the generalized and merged tables are created by
+// schema.sql.
+func (db *CopyDump) Generalize() error { return nil }
+
+func (db *CopyDump) EnableGeneralizeUpdates() {}
+func (db *CopyDump) GeneralizeUpdates() error { return nil }
+
+// Optimize adds the clustering of all tables to schema.sql.
+func (db *CopyDump) Optimize() error {
+	db.optimize = true
+	return nil
+}
+
+// Finish writes schema.sql.
+func (db *CopyDump) Finish() error {
+	defer log.Step("Writing " + dumpFile)()
+	f, err := os.Create(filepath.Join(db.dir, dumpFile))
+	if err != nil {
+		return errors.Wrap(err, "creating dump file")
+	}
+	w := bufio.NewWriter(f)
+	db.writeSchema(w)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing dump file")
+	}
+	return f.Close()
+}
+
+// writeSchema writes all SQL statements in the same order as a bulk
+// import into PostGIS.
+func (db *CopyDump) writeSchema(w io.Writer) {
+	pg := db.pg
+	schema := pg.Config.ImportSchema
+	stmt := func(sql string) {
+		sql = strings.TrimSpace(sql)
+		if !strings.HasSuffix(sql, ";") {
+			sql += ";"
+		}
+		fmt.Fprintln(w, sql)
+	}
+	drop := func(tableName string) {
+		stmt(fmt.Sprintf(`DROP TABLE IF EXISTS "%s"."%s"`, schema, tableName))
+	}
+
+	fmt.Fprintf(w, "-- Load with psql from this directory: psql -v ON_ERROR_STOP=1 -f %s\n", dumpFile)
+	if schema != "public" {
+		stmt(fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS "%s"`, schema))
+	}
+	// the replication state of previous diff imports does not match the
+	// new tables
+	stmt(dropStateTableSQL(schema))
+
+	tables := make([]*TableSpec, 0, len(pg.Tables))
+	for _, spec := range pg.Tables {
+		tables = append(tables, spec)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].FullName < tables[j].FullName })
+	var generalized []*GeneralizedTableSpec
+	for _, name := range pg.sortedGeneralizedTables() {
+		generalized = append(generalized, pg.GeneralizedTables[name])
+	}
+	var merged []*MergedTableSpec
+	for _, spec := range pg.MergedTables {
+		merged = append(merged, spec)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].FullName < merged[j].FullName })
+
+	for _, spec := range tables {
+		fmt.Fprintf(w, "\n-- %s\n", spec.FullName)
+		if spec.History {
+			stmt(fmt.Sprintf(`DROP VIEW IF EXISTS "%s"."%s"`, schema, spec.CurrentViewName()))
+		}
+		drop(spec.FullName)
+		stmt(spec.CreateTableSQL())
+		if sql := addGeometryColumnSQL(spec.FullName, *spec); sql != "" {
+			stmt(sql)
+		}
+		if spec.History {
+			stmt(spec.CreateCurrentViewSQL())
+		}
+	}
+
+	fmt.Fprintln(w)
+	db.mu.Lock()
+	for _, spec := range tables {
+		target := strings.TrimSuffix(strings.TrimPrefix(spec.CopySQL(), "COPY "), " FROM STDIN")
+		for _, name := range db.files[spec.FullName] {
+			source := "'" + name + "'"
+			if db.gzip {
+				source = "PROGRAM 'gzip -dc " + name + "'"
+			}
+			options := ""
+			if pg.Config.CopyFormat == "binary" {
+				options = " WITH (FORMAT binary)"
+			}
+			// psql meta-commands need to be on a single line
+			fmt.Fprintf(w, "\\copy %s FROM %s%s\n", target, source, options)
+		}
+	}
+	db.mu.Unlock()
+
+	for _, spec := range generalized {
+		fmt.Fprintf(w, "\n-- %s\n", spec.FullName)
+		drop(spec.FullName)
+		stmt(pg.generalizeTableSQL(spec))
+	}
+	for _, spec := range merged {
+		fmt.Fprintf(w, "\n-- %s\n", spec.FullName)
+		drop(spec.FullName)
+		stmt(spec.CreateTableSQL())
+	}
+
+	// all tables with the arguments for clusterSteps and indexSteps
+	type indexedTable struct {
+		name        string
+		srid        int
+		columns     []ColumnSpec
+		generalized bool
+		brin        bool
+	}
+	var indexed []indexedTable
+	for _, spec := range tables {
+		indexed = append(indexed, indexedTable{spec.FullName, spec.Srid, spec.Columns, false, pg.Config.BrinIndex})
+	}
+	for _, spec := range generalized {
+		indexed = append(indexed, indexedTable{spec.FullName, spec.Source.Srid, spec.Source.Columns, true, false})
+	}
+	for _, spec := range merged {
+		indexed = append(indexed, indexedTable{spec.FullName, spec.Source.Srid, spec.Columns, true, false})
+	}
+
+	var steps []sqlStep
+	if db.optimize {
+		for _, t := range indexed {
+			if pg.Config.SortOrder != "" {
+				// sorted tables are already clustered
+				steps = append(steps, sqlStep{
+					fmt.Sprintf("Analyzing %q", t.name),
+					fmt.Sprintf(`ANALYZE "%s"."%s"`, schema, t.name),
+				})
+			} else {
+				steps = append(steps, clusterSteps(schema, t.name, t.srid, t.columns)...)
+			}
+		}
+	}
+	for _, t := range indexed {
+		steps = append(steps, indexSteps(schema, t.name, t.columns, t.generalized, t.brin)...)
+	}
+	fmt.Fprintln(w)
+	for _, s := range steps {
+		fmt.Fprintf(w, "-- %s\n", s.desc)
+		stmt(s.sql)
+	}
+}
+
+// rowEncoder appends a row in a COPY format to buf.
+type rowEncoder interface {
+	appendRow(buf []byte, row []interface{}) ([]byte, error)
+}
+
+// dumpTableTx writes the rows of a table into one or more COPY files.
+type dumpTableTx struct {
+	db   *CopyDump
+	spec *TableSpec
+	enc  rowEncoder
+	rows chan []interface{}
+	wg   sync.WaitGroup
+	// sorter collects all rows if the rows should be sorted
+	sorter *rowSorter
+
+	err   error
+	files []string
+	f     *os.File
+	gz    *gzip.Writer
+	w     *bufio.Writer
+	size  int64
+	buf   []byte
+}
+
+func newDumpTableTx(db *CopyDump, spec *TableSpec, key func(row []interface{}) uint64) *dumpTableTx {
+	tt := &dumpTableTx{
+		db:   db,
+		spec: spec,
+		rows: make(chan []interface{}, 64),
+	}
+	if key != nil {
+		tt.sorter = newRowSorter(key, filepath.Join(db.pg.Config.SortDir, spec.FullName))
+	}
+	return tt
+}
+
+func (tt *dumpTableTx) Begin(*sql.Tx) error {
+	if tt.db.pg.Config.CopyFormat == "binary" {
+		enc, err := newBinaryRowEncoder(tt.spec)
+		if err != nil {
+			return err
+		}
+		tt.enc = enc
+	} else {
+		tt.enc = textRowEncoder{}
+	}
+	if err := tt.nextFile(); err != nil {
+		return err
+	}
+	tt.wg.Add(1)
+	go tt.loop()
+	return nil
+}
+
+func (tt *dumpTableTx) loop() {
+	defer tt.wg.Done()
+	for row := range tt.rows {
+		if tt.err != nil {
+			continue
+		}
+		if tt.sorter != nil {
+			tt.err = tt.sorter.add(row)
+		} else {
+			tt.err = tt.write(row)
+		}
+	}
+}
+
+func (tt *dumpTableTx) Insert(row []interface{}) error {
+	tt.rows <- row
+	return nil
+}
+
+func (tt *dumpTableTx) Delete(id int64) (int64, error) {
+	return 0, errors.New("copydump does not support diff imports")
+}
+
+func (tt *dumpTableTx) Upsert(id int64, rows [][]interface{}) (int64, error) {
+	return 0, errors.New("copydump does not support diff imports")
+}
+
+func (tt *dumpTableTx) End() {
+	if tt.rows != nil {
+		close(tt.rows)
+		tt.wg.Wait()
+		tt.rows = nil
+	}
+}
+
+// Commit writes the remaining rows and closes the last COPY file.
+func (tt *dumpTableTx) Commit() error {
+	tt.End()
+	if tt.sorter != nil {
+		defer tt.sorter.close()
+		if tt.err == nil {
+			step := log.Step(fmt.Sprintf("Writing sorted rows into %q", tt.spec.FullName))
+			tt.err = tt.sorter.each(tt.write)
+			step()
+		}
+	}
+	if tt.err == nil {
+		tt.err = tt.closeFile()
+	}
+	if tt.err != nil {
+		tt.Rollback()
+		return errors.Wrapf(tt.err, "writing COPY file for %q", tt.spec.FullName)
+	}
+	tt.db.mu.Lock()
+	tt.db.files[tt.spec.FullName] = tt.files
+	tt.db.mu.Unlock()
+	return nil
+}
+
+// Rollback removes all COPY files of the table.
+func (tt *dumpTableTx) Rollback() {
+	tt.End()
+	if tt.sorter != nil {
+		tt.sorter.close()
+	}
+	if tt.f != nil {
+		tt.f.Close()
+		tt.f = nil
+	}
+	for _, name := range tt.files {
+		os.Remove(filepath.Join(tt.db.dir, name))
+	}
+	tt.files = nil
+}
+
+func (tt *dumpTableTx) write(row []interface{}) error {
+	if tt.db.chunkSize > 0 && tt.size >= tt.db.chunkSize {
+		if err := tt.closeFile(); err != nil {
+			return err
+		}
+		if err := tt.nextFile(); err != nil {
+			return err
+		}
+	}
+	var err error
+	tt.buf, err = tt.enc.appendRow(tt.buf[:0], row)
+	if err != nil {
+		return errors.Wrapf(err, "encoding row %v", row)
+	}
+	tt.size += int64(len(tt.buf))
+	_, err = tt.w.Write(tt.buf)
+	return err
+}
+
+// nextFile creates the next COPY file, e.g. osm_roads.0001.copy.gz
+func (tt *dumpTableTx) nextFile() error {
+	ext := ".copy"
+	if tt.db.pg.Config.CopyFormat == "binary" {
+		ext = ".pgcopy"
+	}
+	if tt.db.gzip {
+		ext += ".gz"
+	}
+	name := fmt.Sprintf("%s.%04d%s", tt.spec.FullName, len(tt.files), ext)
+	f, err := os.Create(filepath.Join(tt.db.dir, name))
+	if err != nil {
+		return err
+	}
+	tt.f = f
+	tt.files = append(tt.files, name)
+	tt.size = 0
+	if tt.db.gzip {
+		tt.gz = gzip.NewWriter(f)
+		tt.w = bufio.NewWriterSize(tt.gz, copyBufferSize)
+	} else {
+		tt.w = bufio.NewWriterSize(f, copyBufferSize)
+	}
+	if tt.db.pg.Config.CopyFormat == "binary" {
+		_, err = tt.w.Write(binaryCopyHeader)
+	}
+	return err
+}
+
+func (tt *dumpTableTx) closeFile() error {
+	if tt.db.pg.Config.CopyFormat == "binary" {
+		trailer := binary.BigEndian.AppendUint16(nil, math.MaxUint16) // -1 as trailer
+		if _, err := tt.w.Write(trailer); err != nil {
+			return err
+		}
+	}
+	if err := tt.w.Flush(); err != nil {
+		return err
+	}
+	if tt.gz != nil {
+		if err := tt.gz.Close(); err != nil {
+			return err
+		}
+		tt.gz = nil
+	}
+	err := tt.f.Close()
+	tt.f = nil
+	return err
+}
+
+func init() {
+	database.Register("copydump", NewCopyDump)
+}
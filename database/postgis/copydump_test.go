@@ -0,0 +1,204 @@
+package postgis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/mapping"
+)
+
+const copyDumpMapping = `
+tables:
+  places:
+    type: point
+    columns:
+    - {name: osm_id, type: id}
+    - {name: geometry, type: geometry}
+    - {name: name, type: string, key: name}
+    mapping:
+      place: [city]
+generalized_tables:
+  places_gen:
+    source: places
+    tolerance: 100
+`
+
+func importCopyDump(t *testing.T, conn string, copyFormat string, names ...string) *CopyDump {
+	t.Helper()
+	m, err := mapping.New([]byte(copyDumpMapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.Open(database.Config{
+		ConnectionParams: conn,
+		Srid:             3857,
+		ImportSchema:     "import",
+		CopyFormat:       copyFormat,
+	}, &m.Conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Begin(); err == nil {
+		t.Error("expected error for diff import")
+	}
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.(database.BulkBeginner).BeginBulk(); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		node := osm.Node{Long: float64(i), Lat: float64(i)}
+		node.ID = int64(i + 1)
+		node.Tags = osm.Tags{"place": "city", "name": name}
+		g := geom.Geometry{Wkb: geom.NodeAsEWKBHexPoint(node, 3857)}
+		if err := db.InsertPoint(node.Element, g, m.PointMatcher.MatchNode(&node)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.End(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.(database.Generalizer).Generalize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.(database.Optimizer).Optimize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.(database.Finisher).Finish(); err != nil {
+		t.Fatal(err)
+	}
+	return db.(*CopyDump)
+}
+
+func TestCopyDump(t *testing.T) {
+	dir := t.TempDir()
+	importCopyDump(t, "copydump:"+dir, "text", "Hamburg", "Tab\tCity")
+
+	b, err := os.ReadFile(filepath.Join(dir, "osm_places.0000.copy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "2\t") || !strings.HasSuffix(lines[1], "\tTab\\tCity") {
+		t.Errorf("unexpected rows %q", lines)
+	}
+
+	b, err = os.ReadFile(filepath.Join(dir, dumpFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := string(b)
+	for _, part := range []string{
+		`CREATE SCHEMA IF NOT EXISTS "import";`,
+		`DROP TABLE IF EXISTS "import"."imposm_state";`,
+		`DROP TABLE IF EXISTS "import"."osm_places";`,
+		`CREATE TABLE IF NOT EXISTS "import"."osm_places"`,
+		`SELECT AddGeometryColumn('import', 'osm_places', 'geometry', '3857', 'POINT', 2);`,
+		`\copy "import"."osm_places" ("osm_id", "geometry", "name") FROM 'osm_places.0000.copy'` + "\n",
+		`CREATE TABLE "import"."osm_places_gen" AS (SELECT`,
+		`CLUSTER "osm_places_geom_geohash" ON "import"."osm_places";`,
+		`CREATE INDEX "osm_places_geom" ON "import"."osm_places" USING GIST ("geometry");`,
+		`CREATE INDEX "osm_places_gen_osm_id_idx" ON "import"."osm_places_gen" USING BTREE ("osm_id");`,
+	} {
+		if !strings.Contains(schema, part) {
+			t.Errorf("missing %q in:\n%s", part, schema)
+		}
+	}
+	for _, order := range [][2]string{
+		{`\copy "import"."osm_places"`, `CREATE TABLE "import"."osm_places_gen"`},
+		{`CREATE TABLE "import"."osm_places_gen"`, `CLUSTER "osm_places_geom_geohash"`},
+		{`CLUSTER "osm_places_geom_geohash"`, `CREATE INDEX "osm_places_geom"`},
+	} {
+		if strings.Index(schema, order[0]) > strings.Index(schema, order[1]) {
+			t.Errorf("%q not before %q", order[0], order[1])
+		}
+	}
+
+	// previous files are removed
+	importCopyDump(t, "copydump:"+dir+"?prefix=osm&compress=gzip&chunk_size=1", "binary", "Hamburg")
+	if _, err := os.Stat(filepath.Join(dir, "osm_places.0000.copy")); !os.IsNotExist(err) {
+		t.Error("previous dump not removed")
+	}
+	f, err := os.Open(filepath.Join(dir, "osm_places.0000.pgcopy.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, binaryCopyHeader) || !bytes.HasSuffix(b, []byte{0xff, 0xff}) {
+		t.Errorf("unexpected binary COPY file %q", b)
+	}
+	b, err = os.ReadFile(filepath.Join(dir, dumpFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `FROM PROGRAM 'gzip -dc osm_places.0000.pgcopy.gz' WITH (FORMAT binary)`) {
+		t.Errorf("missing gzip COPY in:\n%s", b)
+	}
+}
+
+func TestCopyDumpChunks(t *testing.T) {
+	m, err := mapping.New([]byte(copyDumpMapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	db, err := NewCopyDump(database.Config{ConnectionParams: "copydump:" + dir}, &m.Conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cd := db.(*CopyDump)
+	cd.chunkSize = 20
+	if err := cd.Init(); err != nil {
+		t.Fatal(err)
+	}
+	tt := newDumpTableTx(cd, cd.pg.Tables["places"], nil)
+	if err := tt.Begin(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Hamburg", "Bremen", "Kiel"} {
+		tt.Insert([]interface{}{int64(1), nil, name})
+	}
+	if err := tt.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	files := cd.files["osm_places"]
+	if len(files) != 2 || files[1] != "osm_places.0001.copy" {
+		t.Fatalf("unexpected files %v", files)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, files[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "1\t\\N\tKiel\n" {
+		t.Errorf("unexpected rows in second chunk %q", b)
+	}
+
+	for _, conn := range []string{
+		"copydump:",
+		"copydump:" + dir + "?compress=zstd",
+		"copydump:" + dir + "?chunk_size=-1",
+	} {
+		if _, err := NewCopyDump(database.Config{ConnectionParams: conn}, &m.Conf); err == nil {
+			t.Errorf("expected error for %q", conn)
+		}
+	}
+}
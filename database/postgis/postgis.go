@@ -2,16 +2,20 @@ package postgis
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	pq "github.com/lib/pq"
 	osm "github.com/omniscale/go-osm"
 	"github.com/omniscale/imposm3/database"
 	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/geom/geos"
 	"github.com/omniscale/imposm3/log"
 	"github.com/omniscale/imposm3/mapping"
 	"github.com/omniscale/imposm3/mapping/config"
@@ -40,6 +44,21 @@ func createTable(tx *sql.Tx, spec TableSpec) error {
 	var sql string
 	var err error
 
+	// the table or view of a previous import with or without history
+	name := spec.CurrentViewName()
+	isView, err := viewExists(tx, spec.Schema, name)
+	if err != nil {
+		return err
+	}
+	if isView {
+		if err := dropViewIfExists(tx, spec.Schema, name); err != nil {
+			return err
+		}
+	} else if spec.History {
+		if err := dropTableIfExists(tx, spec.Schema, name); err != nil {
+			return err
+		}
+	}
 	err = dropTableIfExists(tx, spec.Schema, spec.FullName)
 	if err != nil {
 		return err
@@ -55,10 +74,34 @@ func createTable(tx *sql.Tx, spec TableSpec) error {
 	if err != nil {
 		return err
 	}
+
+	if spec.History {
+		// the view includes the geometry column added above
+		sql = spec.CreateCurrentViewSQL()
+		if _, err := tx.Exec(sql); err != nil {
+			return &SQLError{sql, err}
+		}
+	}
 	return nil
 }
 
 func addGeometryColumn(tx *sql.Tx, tableName string, spec TableSpec) error {
+	sql := addGeometryColumnSQL(tableName, spec)
+	if sql == "" {
+		return nil
+	}
+	row := tx.QueryRow(sql)
+	var void interface{}
+	err := row.Scan(&void)
+	if err != nil {
+		return &SQLError{sql, err}
+	}
+	return nil
+}
+
+// addGeometryColumnSQL returns the AddGeometryColumn statement for the
+// geometry column of spec, or an empty string if the table has no geometry.
+func addGeometryColumnSQL(tableName string, spec TableSpec) string {
 	colName := ""
 	for _, col := range spec.Columns {
 		if col.Type.Name() == "GEOMETRY" {
@@ -68,22 +111,15 @@ func addGeometryColumn(tx *sql.Tx, tableName string, spec TableSpec) error {
 	}
 
 	if colName == "" {
-		return nil
+		return ""
 	}
 
 	geomType := strings.ToUpper(spec.GeometryType)
 	if geomType == "POLYGON" {
 		geomType = "GEOMETRY" // for multipolygon support
 	}
-	sql := fmt.Sprintf("SELECT AddGeometryColumn('%s', '%s', '%s', '%d', '%s', 2);",
+	return fmt.Sprintf("SELECT AddGeometryColumn('%s', '%s', '%s', '%d', '%s', 2);",
 		spec.Schema, tableName, colName, spec.Srid, geomType)
-	row := tx.QueryRow(sql)
-	var void interface{}
-	err := row.Scan(&void)
-	if err != nil {
-		return &SQLError{sql, err}
-	}
-	return nil
 }
 
 func (pg *PostGIS) createSchema(schema string) error {
@@ -114,7 +150,9 @@ func (pg *PostGIS) createSchema(schema string) error {
 	return nil
 }
 
-// Init creates schema and tables, drops existing data.
+// Init creates schema and tables, drops existing data. The replication
+// state of previous diff imports is removed, as it does not match the new
+// tables.
 func (pg *PostGIS) Init() error {
 	if err := pg.createSchema(pg.Config.ImportSchema); err != nil {
 		return err
@@ -130,6 +168,9 @@ func (pg *PostGIS) Init() error {
 			return err
 		}
 	}
+	if _, err := tx.Exec(dropStateTableSQL(pg.Config.ImportSchema)); err != nil {
+		return &SQLError{dropStateTableSQL(pg.Config.ImportSchema), err}
+	}
 	err = tx.Commit()
 	if err != nil {
 		return err
@@ -147,12 +188,12 @@ func (pg *PostGIS) Finish() error {
 		worker = 1
 	}
 
-	p := newWorkerPool(worker, len(pg.Tables)+len(pg.GeneralizedTables))
+	p := newWorkerPool(worker, len(pg.Tables)+len(pg.GeneralizedTables)+len(pg.MergedTables))
 	for _, tbl := range pg.Tables {
 		tableName := tbl.FullName
 		table := tbl
 		p.in <- func() error {
-			return createIndex(pg, tableName, table.Columns, false)
+			return createIndex(pg, tableName, table.Columns, false, pg.Config.BrinIndex)
 		}
 	}
 
@@ -160,7 +201,15 @@ func (pg *PostGIS) Finish() error {
 		tableName := tbl.FullName
 		table := tbl
 		p.in <- func() error {
-			return createIndex(pg, tableName, table.Source.Columns, true)
+			return createIndex(pg, tableName, table.Source.Columns, true, false)
+		}
+	}
+
+	for _, tbl := range pg.MergedTables {
+		tableName := tbl.FullName
+		table := tbl
+		p.in <- func() error {
+			return createIndex(pg, tableName, table.Columns, true, false)
 		}
 	}
 
@@ -172,7 +221,30 @@ func (pg *PostGIS) Finish() error {
 	return nil
 }
 
-func createIndex(pg *PostGIS, tableName string, columns []ColumnSpec, generalizedTable bool) error {
+// sqlStep is a single SQL statement with a description for log.Step.
+type sqlStep struct {
+	desc string
+	sql  string
+}
+
+// createIndex creates the geometry and ID indices. brin creates a BRIN
+// instead of a GiST index for the geometry, for tables that were sorted
+// on import.
+func createIndex(pg *PostGIS, tableName string, columns []ColumnSpec, generalizedTable bool, brin bool) error {
+	for _, s := range indexSteps(pg.Config.ImportSchema, tableName, columns, generalizedTable, brin) {
+		step := log.Step(s.desc)
+		_, err := pg.Db.Exec(s.sql)
+		step()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexSteps returns the statements for all indices of createIndex.
+func indexSteps(schema, tableName string, columns []ColumnSpec, generalizedTable bool, brin bool) []sqlStep {
+	var steps []sqlStep
 	foundIDCol := false
 	for _, cs := range columns {
 		if cs.Name == "id" {
@@ -182,14 +254,15 @@ func createIndex(pg *PostGIS, tableName string, columns []ColumnSpec, generalize
 
 	for _, col := range columns {
 		if col.Type.Name() == "GEOMETRY" {
-			sql := fmt.Sprintf(`CREATE INDEX "%s_geom" ON "%s"."%s" USING GIST ("%s")`,
-				tableName, pg.Config.ImportSchema, tableName, col.Name)
-			step := log.Step(fmt.Sprintf("Creating geometry index on %s", tableName))
-			_, err := pg.Db.Exec(sql)
-			step()
-			if err != nil {
-				return err
+			method := "GIST"
+			if brin {
+				method = "BRIN"
 			}
+			steps = append(steps, sqlStep{
+				fmt.Sprintf("Creating geometry index on %s", tableName),
+				fmt.Sprintf(`CREATE INDEX "%s_geom" ON "%s"."%s" USING %s ("%s")`,
+					tableName, schema, tableName, method, col.Name),
+			})
 		}
 		if col.FieldType.Name == "id" && (foundIDCol || generalizedTable) {
 			// Create index for OSM ID required for diff updates, but only if
@@ -197,20 +270,39 @@ func createIndex(pg *PostGIS, tableName string, columns []ColumnSpec, generalize
 			// The explicit `id` column prevented the creation of our composite
 			// PRIMARY KEY index of id (serial) and OSM ID.
 			// Generalized tables also do not have a PRIMARY KEY.
-			sql := fmt.Sprintf(`CREATE INDEX "%s_%s_idx" ON "%s"."%s" USING BTREE ("%s")`,
-				tableName, col.Name, pg.Config.ImportSchema, tableName, col.Name)
-			step := log.Step(fmt.Sprintf("Creating OSM id index on %s", tableName))
-			_, err := pg.Db.Exec(sql)
-			step()
-			if err != nil {
-				return err
+			steps = append(steps, sqlStep{
+				fmt.Sprintf("Creating OSM id index on %s", tableName),
+				fmt.Sprintf(`CREATE INDEX "%s_%s_idx" ON "%s"."%s" USING BTREE ("%s")`,
+					tableName, col.Name, schema, tableName, col.Name),
+			})
+		}
+	}
+
+	var memberCols []string
+	for _, name := range []string{"member_parent_id", "member_id"} {
+		for _, col := range columns {
+			if col.FieldType.Name == name {
+				memberCols = append(memberCols, `"`+col.Name+`"`)
+				break
 			}
 		}
 	}
-	return nil
+	if len(memberCols) == 2 {
+		// Composite index for relation_member tables with flattened members
+		// to query all members of a nested relation.
+		steps = append(steps, sqlStep{
+			fmt.Sprintf("Creating member index on %s", tableName),
+			fmt.Sprintf(`CREATE INDEX "%s_member_idx" ON "%s"."%s" USING BTREE (%s)`,
+				tableName, schema, tableName, strings.Join(memberCols, ", ")),
+		})
+	}
+	return steps
 }
 
 func (pg *PostGIS) GeneralizeUpdates() error {
+	if err := pg.flushUpserts(); err != nil {
+		return err
+	}
 	defer log.Step("Updating generalized tables")()
 	for _, table := range pg.sortedGeneralizedTables() {
 		if ids, ok := pg.updatedIDs[table]; ok {
@@ -219,10 +311,72 @@ func (pg *PostGIS) GeneralizeUpdates() error {
 			}
 		}
 	}
+	if err := pg.mergeUpdates(); err != nil {
+		return err
+	}
 	pg.updatedIDs = make(map[string][]int64) // reset for multiple diff imports in same tx
+	pg.dirtyGroups = make(map[string]map[string][]interface{})
+	return nil
+}
+
+// mergeUpdates recreates the merged linestrings of all groups that were
+// modified since the last update.
+func (pg *PostGIS) mergeUpdates() error {
+	if len(pg.MergedTables) == 0 {
+		return nil
+	}
+	defer log.Step("Updating merged tables")()
+	for name, table := range pg.MergedTables {
+		for _, id := range pg.updatedIDs[name] {
+			if err := pg.markDirtyGroup(table, id); err != nil {
+				return err
+			}
+		}
+		for _, group := range pg.dirtyGroups[name] {
+			if _, err := pg.txRouter.tx.Exec(table.DeleteGroupSQL(), group...); err != nil {
+				return errors.Wrapf(err, "deleting group from merged table %q", table.FullName)
+			}
+			if _, err := pg.txRouter.tx.Exec(table.InsertGroupSQL(), group...); err != nil {
+				return errors.Wrapf(err, "merging group into merged table %q", table.FullName)
+			}
+		}
+	}
 	return nil
 }
 
+// markDirtyGroup queries the group of the source row with id and marks
+// this group for update of the merged table.
+func (pg *PostGIS) markDirtyGroup(table *MergedTableSpec, id int64) error {
+	rows, err := pg.txRouter.tx.Query(table.GroupSQL(), id)
+	if err != nil {
+		return errors.Wrapf(err, "querying group of %d from %q", id, table.Source.FullName)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		group := make([]interface{}, len(table.GroupBy))
+		ptrs := make([]interface{}, len(group))
+		for i := range group {
+			ptrs[i] = &group[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return errors.Wrapf(err, "querying group of %d from %q", id, table.Source.FullName)
+		}
+		for i, v := range group {
+			if b, ok := v.([]byte); ok {
+				group[i] = string(b)
+			}
+		}
+		key := fmt.Sprintf("%#v", group)
+		pg.updateIDsMu.Lock()
+		if pg.dirtyGroups[table.Name] == nil {
+			pg.dirtyGroups[table.Name] = make(map[string][]interface{})
+		}
+		pg.dirtyGroups[table.Name][key] = group
+		pg.updateIDsMu.Unlock()
+	}
+	return rows.Err()
+}
+
 func (pg *PostGIS) Generalize() error {
 	defer log.Step("Creating generalized tables")()
 
@@ -275,6 +429,42 @@ func (pg *PostGIS) Generalize() error {
 			return err
 		}
 	}
+
+	p = newWorkerPool(worker, len(pg.MergedTables))
+	for _, table := range pg.MergedTables {
+		tbl := table // for following closure
+		p.in <- func() error {
+			return pg.mergeTable(tbl)
+		}
+	}
+	return p.wait()
+}
+
+func (pg *PostGIS) mergeTable(table *MergedTableSpec) error {
+	defer log.Step(fmt.Sprintf("Merging %s into %s",
+		table.Source.FullName, table.FullName))()
+
+	tx, err := pg.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer rollbackIfTx(&tx)
+
+	if err := dropTableIfExists(tx, pg.Config.ImportSchema, table.FullName); err != nil {
+		return errors.Wrap(err, "dropping existing table")
+	}
+
+	sql := table.CreateTableSQL()
+	_, err = tx.Exec(sql)
+	if err != nil {
+		return &SQLError{sql, err}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrapf(err, "commiting tx for merged table %q", table.FullName)
+	}
+	tx = nil // set nil to prevent rollback
 	return nil
 }
 
@@ -288,9 +478,37 @@ func (pg *PostGIS) generalizeTable(table *GeneralizedTableSpec) error {
 	}
 	defer rollbackIfTx(&tx)
 
-	var where string
+	if err := dropTableIfExists(tx, pg.Config.ImportSchema, table.FullName); err != nil {
+		return errors.Wrap(err, "dropping existing table")
+	}
+
+	sql := pg.generalizeTableSQL(table)
+	_, err = tx.Exec(sql)
+	if err != nil {
+		return &SQLError{sql, err}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Wrapf(err, "commiting tx for generalizes table %q", table.FullName)
+	}
+	tx = nil // set nil to prevent rollback
+	return nil
+}
+
+// generalizeTableSQL returns the statement that creates the generalized
+// table from its source.
+func (pg *PostGIS) generalizeTableSQL(table *GeneralizedTableSpec) string {
+	var conds []string
+	if table.SourceGeneralized == nil && table.Source.History {
+		conds = append(conds, currentSQL)
+	}
 	if table.Where != "" {
-		where = " WHERE " + table.Where
+		conds = append(conds, "("+table.Where+")")
+	}
+	var where string
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
 	}
 	var cols []string
 
@@ -298,10 +516,6 @@ func (pg *PostGIS) generalizeTable(table *GeneralizedTableSpec) error {
 		cols = append(cols, col.Type.GeneralizeSQL(&col, table))
 	}
 
-	if err := dropTableIfExists(tx, pg.Config.ImportSchema, table.FullName); err != nil {
-		return errors.Wrap(err, "dropping existing table")
-	}
-
 	columnSQL := strings.Join(cols, ",\n")
 
 	var sourceTable string
@@ -310,25 +524,18 @@ func (pg *PostGIS) generalizeTable(table *GeneralizedTableSpec) error {
 	} else {
 		sourceTable = table.Source.FullName
 	}
-	sql := fmt.Sprintf(`CREATE TABLE "%s"."%s" AS (SELECT %s FROM "%s"."%s"%s)`,
+	return fmt.Sprintf(`CREATE TABLE "%s"."%s" AS (SELECT %s FROM "%s"."%s"%s)`,
 		pg.Config.ImportSchema, table.FullName, columnSQL, pg.Config.ImportSchema,
 		sourceTable, where)
-
-	_, err = tx.Exec(sql)
-	if err != nil {
-		return &SQLError{sql, err}
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		return errors.Wrapf(err, "commiting tx for generalizes table %q", table.FullName)
-	}
-	tx = nil // set nil to prevent rollback
-	return nil
 }
 
 // Optimize clusters tables on new GeoHash index.
+// Optimize clusters all tables on the geometry. Tables that were sorted
+// on import are already clustered and only analyzed.
 func (pg *PostGIS) Optimize() error {
+	if pg.Config.SortOrder != "" {
+		return pg.analyze()
+	}
 	defer log.Step("Clustering on geometry")()
 
 	worker := int(runtime.GOMAXPROCS(0))
@@ -336,7 +543,7 @@ func (pg *PostGIS) Optimize() error {
 		worker = 1
 	}
 
-	p := newWorkerPool(worker, len(pg.Tables)+len(pg.GeneralizedTables))
+	p := newWorkerPool(worker, len(pg.Tables)+len(pg.GeneralizedTables)+len(pg.MergedTables))
 
 	for _, tbl := range pg.Tables {
 		tableName := tbl.FullName
@@ -352,6 +559,13 @@ func (pg *PostGIS) Optimize() error {
 			return clusterTable(pg, tableName, table.Source.Srid, table.Source.Columns)
 		}
 	}
+	for _, tbl := range pg.MergedTables {
+		tableName := tbl.FullName
+		table := tbl
+		p.in <- func() error {
+			return clusterTable(pg, tableName, table.Source.Srid, table.Columns)
+		}
+	}
 
 	err := p.wait()
 	if err != nil {
@@ -361,40 +575,65 @@ func (pg *PostGIS) Optimize() error {
 	return nil
 }
 
+func (pg *PostGIS) analyze() error {
+	defer log.Step("Analyzing tables")()
+
+	var tables []string
+	for _, tbl := range pg.Tables {
+		tables = append(tables, tbl.FullName)
+	}
+	for _, tbl := range pg.GeneralizedTables {
+		tables = append(tables, tbl.FullName)
+	}
+	for _, tbl := range pg.MergedTables {
+		tables = append(tables, tbl.FullName)
+	}
+	for _, tableName := range tables {
+		sql := fmt.Sprintf(`ANALYZE "%s"."%s"`, pg.Config.ImportSchema, tableName)
+		if _, err := pg.Db.Exec(sql); err != nil {
+			return errors.Wrapf(err, "analyzing %q", tableName)
+		}
+	}
+	return nil
+}
+
 func clusterTable(pg *PostGIS, tableName string, srid int, columns []ColumnSpec) error {
+	for _, s := range clusterSteps(pg.Config.ImportSchema, tableName, srid, columns) {
+		step := log.Step(s.desc)
+		_, err := pg.Db.Exec(s.sql)
+		step()
+		if err != nil {
+			return errors.Wrap(err, s.desc)
+		}
+	}
+	return nil
+}
+
+// clusterSteps returns the statements of clusterTable.
+func clusterSteps(schema, tableName string, srid int, columns []ColumnSpec) []sqlStep {
+	var steps []sqlStep
 	for _, col := range columns {
 		if col.Type.Name() == "GEOMETRY" {
-			step := log.Step(fmt.Sprintf("Indexing %q on geohash", tableName))
-			sql := fmt.Sprintf(`CREATE INDEX "%s_geom_geohash" ON "%s"."%s" (ST_GeoHash(ST_Transform(ST_SetSRID(Box2D(%s), %d), 4326)))`,
-				tableName, pg.Config.ImportSchema, tableName, col.Name, srid)
-			_, err := pg.Db.Exec(sql)
-			step()
-			if err != nil {
-				return errors.Wrapf(err, "indexing %q on geohash", tableName)
-			}
-
-			step = log.Step(fmt.Sprintf("Clustering %q on geohash", tableName))
-			sql = fmt.Sprintf(`CLUSTER "%s_geom_geohash" ON "%s"."%s"`,
-				tableName, pg.Config.ImportSchema, tableName)
-			_, err = pg.Db.Exec(sql)
-			step()
-			if err != nil {
-				return errors.Wrapf(err, "clusering %q on geohash", tableName)
-			}
+			steps = append(steps,
+				sqlStep{
+					fmt.Sprintf("Indexing %q on geohash", tableName),
+					fmt.Sprintf(`CREATE INDEX "%s_geom_geohash" ON "%s"."%s" (ST_GeoHash(ST_Transform(ST_SetSRID(Box2D(%s), %d), 4326)))`,
+						tableName, schema, tableName, col.Name, srid),
+				},
+				sqlStep{
+					fmt.Sprintf("Clustering %q on geohash", tableName),
+					fmt.Sprintf(`CLUSTER "%s_geom_geohash" ON "%s"."%s"`,
+						tableName, schema, tableName),
+				},
+			)
 			break
 		}
 	}
 
-	step := log.Step(fmt.Sprintf("Analysing %q", tableName))
-	sql := fmt.Sprintf(`ANALYSE "%s"."%s"`,
-		pg.Config.ImportSchema, tableName)
-	_, err := pg.Db.Exec(sql)
-	step()
-	if err != nil {
-		return errors.Wrapf(err, "analyzing %q", tableName)
-	}
-
-	return nil
+	return append(steps, sqlStep{
+		fmt.Sprintf("Analysing %q", tableName),
+		fmt.Sprintf(`ANALYSE "%s"."%s"`, schema, tableName),
+	})
 }
 
 type PostGIS struct {
@@ -403,12 +642,30 @@ type PostGIS struct {
 	Config                  database.Config
 	Tables                  map[string]*TableSpec
 	GeneralizedTables       map[string]*GeneralizedTableSpec
+	MergedTables            map[string]*MergedTableSpec
 	Prefix                  string
 	txRouter                *TxRouter
 	updateGeneralizedTables bool
+	// maxPreparedTransactions is the max_prepared_transactions setting
+	// of PostgreSQL, parallel COPY streams require prepared transactions
+	maxPreparedTransactions int
+	// autoCopyStreams is the number of COPY streams that were added
+	// automatically during a bulk import
+	autoCopyStreams int32
 
 	updateIDsMu sync.Mutex
 	updatedIDs  map[string][]int64
+	// dirtyGroups contains the group values of modified merged tables
+	dirtyGroups map[string]map[string][]interface{}
+
+	pendingMu sync.Mutex
+	// pendingUpserts contains the new rows of all deleted OSM IDs for
+	// each table, if Config.Upsert is enabled
+	pendingUpserts map[string]map[int64][][]interface{}
+
+	// committedCounts is the number of changes of each table of the last
+	// End, for Notify
+	committedCounts map[string]int
 }
 
 func (pg *PostGIS) Open() error {
@@ -429,7 +686,7 @@ func (pg *PostGIS) Open() error {
 func (pg *PostGIS) InsertPoint(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
 	for _, match := range matches {
 		row := match.Row(&elem, &geom)
-		if err := pg.txRouter.Insert(match.Table.Name, row); err != nil {
+		if err := pg.insertRow(match.Table.Name, row); err != nil {
 			return err
 		}
 	}
@@ -439,7 +696,7 @@ func (pg *PostGIS) InsertPoint(elem osm.Element, geom geom.Geometry, matches []m
 func (pg *PostGIS) InsertLineString(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
 	for _, match := range matches {
 		row := match.Row(&elem, &geom)
-		if err := pg.txRouter.Insert(match.Table.Name, row); err != nil {
+		if err := pg.insertRow(match.Table.Name, row); err != nil {
 			return err
 		}
 	}
@@ -453,14 +710,42 @@ func (pg *PostGIS) InsertLineString(elem osm.Element, geom geom.Geometry, matche
 			}
 			pg.updateIDsMu.Unlock()
 		}
+		pg.updateIDsMu.Lock()
+		for _, match := range matches {
+			for _, mergedTable := range pg.Tables[match.Table.Name].Merges {
+				pg.updatedIDs[mergedTable.Name] = append(pg.updatedIDs[mergedTable.Name], elem.ID)
+			}
+		}
+		pg.updateIDsMu.Unlock()
 	}
 	return nil
 }
 
+// subdividePool contains the GEOS handles for subdivided polygons. Rows
+// are inserted concurrently by all writer goroutines.
+var subdividePool = sync.Pool{
+	New: func() interface{} {
+		return geos.NewGeos()
+	},
+}
+
 func (pg *PostGIS) InsertPolygon(elem osm.Element, geom geom.Geometry, matches []mapping.Match) error {
+	var g *geos.Geos
 	for _, match := range matches {
+		if maxVertices := match.Subdivide(); maxVertices > 0 {
+			if g == nil {
+				g = subdividePool.Get().(*geos.Geos)
+				defer subdividePool.Put(g)
+				// parts are encoded as EWKB with the SRID of the columns
+				g.SetHandleSrid(pg.Config.Srid)
+			}
+			if err := pg.insertSubdivided(g, elem, geom, match, maxVertices); err != nil {
+				return err
+			}
+			continue
+		}
 		row := match.Row(&elem, &geom)
-		if err := pg.txRouter.Insert(match.Table.Name, row); err != nil {
+		if err := pg.insertRow(match.Table.Name, row); err != nil {
 			return err
 		}
 	}
@@ -478,10 +763,78 @@ func (pg *PostGIS) InsertPolygon(elem osm.Element, geom geom.Geometry, matches [
 	return nil
 }
 
-func (pg *PostGIS) InsertRelationMember(rel osm.Relation, m osm.Member, mi int, geom geom.Geometry, matches []mapping.Match) error {
+// insertSubdivided inserts a row for each part of the subdivided geometry.
+func (pg *PostGIS) insertSubdivided(g *geos.Geos, elem osm.Element, geometry geom.Geometry, match mapping.Match, maxVertices int) error {
+	parts, err := geom.SubdivideGeometry(g, geometry, maxVertices)
+	if err != nil {
+		return errors.Wrapf(err, "subdividing %d for %q", elem.ID, match.Table.Name)
+	}
+	for _, part := range parts {
+		row := match.Row(&elem, &part)
+		if err := pg.insertRow(match.Table.Name, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertRow inserts the row into table. The row is collected for
+// flushUpserts if the OSM ID of the row was deleted in upsert mode.
+func (pg *PostGIS) insertRow(table string, row []interface{}) error {
+	if pg.pendingUpserts != nil {
+		pg.pendingMu.Lock()
+		if pending, ok := pg.pendingUpserts[table]; ok {
+			if id, ok := rowOSMID(pg.Tables[table], row); ok {
+				if rows, ok := pending[id]; ok {
+					pending[id] = append(rows, row)
+					pg.pendingMu.Unlock()
+					return nil
+				}
+			}
+		}
+		pg.pendingMu.Unlock()
+	}
+	return pg.txRouter.Insert(table, row)
+}
+
+// rowOSMID returns the value of the OSM ID column of the row.
+func rowOSMID(spec *TableSpec, row []interface{}) (int64, bool) {
+	if spec == nil {
+		return 0, false
+	}
+	idx := spec.idColumn()
+	if idx == -1 || idx >= len(row) {
+		return 0, false
+	}
+	id, ok := row[idx].(int64)
+	return id, ok
+}
+
+// flushUpserts updates the existing rows of all deleted OSM IDs with the
+// collected rows.
+func (pg *PostGIS) flushUpserts() error {
+	pg.pendingMu.Lock()
+	defer pg.pendingMu.Unlock()
+	for table, pending := range pg.pendingUpserts {
+		ids := make([]int64, 0, len(pending))
+		for id := range pending {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			if err := pg.txRouter.Upsert(table, id, pending[id]); err != nil {
+				return errors.Wrapf(err, "updating %d in %q", id, table)
+			}
+		}
+		delete(pg.pendingUpserts, table)
+	}
+	return nil
+}
+
+func (pg *PostGIS) InsertRelationMember(rel osm.Relation, m osm.Member, mi int, parents []int64, geom geom.Geometry, matches []mapping.Match) error {
 	for _, match := range matches {
-		row := match.MemberRow(&rel, &m, mi, &geom)
-		if err := pg.txRouter.Insert(match.Table.Name, row); err != nil {
+		row := match.MemberRow(&rel, &m, mi, parents, &geom)
+		if err := pg.insertRow(match.Table.Name, row); err != nil {
 			return err
 		}
 	}
@@ -499,7 +852,28 @@ func (pg *PostGIS) InsertRelationMember(rel osm.Relation, m osm.Member, mi int,
 }
 
 func (pg *PostGIS) Delete(id int64, matches []mapping.Match) error {
+	if pg.updateGeneralizedTables {
+		// remember groups of merged tables before the source row is removed
+		for _, match := range matches {
+			for _, mergedTable := range pg.Tables[match.Table.Name].Merges {
+				if err := pg.markDirtyGroup(mergedTable, id); err != nil {
+					return err
+				}
+			}
+		}
+	}
 	for _, match := range matches {
+		spec := pg.Tables[match.Table.Name]
+		if pg.pendingUpserts != nil && spec.idColumn() != -1 && !spec.History {
+			// keep rows until flushUpserts
+			pg.pendingMu.Lock()
+			if pg.pendingUpserts[match.Table.Name] == nil {
+				pg.pendingUpserts[match.Table.Name] = make(map[int64][][]interface{})
+			}
+			pg.pendingUpserts[match.Table.Name][id] = [][]interface{}{}
+			pg.pendingMu.Unlock()
+			continue
+		}
 		if err := pg.txRouter.Delete(match.Table.Name, id); err != nil {
 			return errors.Wrapf(err, "deleting %d from %q", id, match.Table.Name)
 		}
@@ -543,11 +917,15 @@ func (pg *PostGIS) sortedGeneralizedTables() []string {
 func (pg *PostGIS) EnableGeneralizeUpdates() {
 	pg.updateGeneralizedTables = true
 	pg.updatedIDs = make(map[string][]int64)
+	pg.dirtyGroups = make(map[string]map[string][]interface{})
 }
 
 func (pg *PostGIS) Begin() error {
 	var err error
 	pg.txRouter, err = newTxRouter(pg, false)
+	if pg.Config.Upsert {
+		pg.pendingUpserts = make(map[string]map[int64][][]interface{})
+	}
 	return err
 }
 
@@ -558,6 +936,7 @@ func (pg *PostGIS) BeginBulk() error {
 }
 
 func (pg *PostGIS) Abort() error {
+	pg.pendingUpserts = nil
 	if pg.txRouter != nil {
 		return pg.txRouter.Abort()
 	}
@@ -566,8 +945,65 @@ func (pg *PostGIS) Abort() error {
 
 func (pg *PostGIS) End() error {
 	if pg.txRouter != nil {
-		return pg.txRouter.End()
+		if err := pg.flushUpserts(); err != nil {
+			return err
+		}
+		pg.pendingUpserts = nil
+		if err := pg.txRouter.End(); err != nil {
+			return err
+		}
+		pg.committedCounts = pg.txRouter.Counts()
+	}
+	return nil
+}
+
+// SetChangeSequence sets the replication sequence of all following changes,
+// if Config.Changes is enabled.
+func (pg *PostGIS) SetChangeSequence(seq int) error {
+	if pg.txRouter == nil {
+		return nil
+	}
+	if err := pg.flushUpserts(); err != nil {
+		return err
+	}
+	return pg.txRouter.SetChangeSequence(seq)
+}
+
+// SetVersionTime sets the start of all following versions in history
+// tables. Versions start with the time of the transaction if t is zero.
+func (pg *PostGIS) SetVersionTime(t time.Time) error {
+	if pg.txRouter == nil || pg.txRouter.tx == nil {
+		return nil
+	}
+	var value string
+	if !t.IsZero() {
+		value = t.UTC().Format(time.RFC3339Nano)
+	}
+	sql := `SELECT set_config('imposm.version_time', $1, true)`
+	if _, err := pg.txRouter.tx.Exec(sql, value); err != nil {
+		return &SQLError{sql, err}
+	}
+	return nil
+}
+
+// NotifyChannel is the channel of the notifications for each committed
+// diff import.
+const NotifyChannel = "imposm_update"
+
+// Notify sends n as JSON to all listeners of the NotifyChannel.
+func (pg *PostGIS) Notify(n database.Notification) error {
+	n.Changes = pg.committedCounts
+	if n.Changes == nil {
+		n.Changes = map[string]int{}
+	}
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return errors.Wrap(err, "encoding notification")
 	}
+	if _, err := pg.Db.Exec("SELECT pg_notify($1, $2)", NotifyChannel, string(payload)); err != nil {
+		return errors.Wrap(err, "sending notification")
+	}
+	pg.committedCounts = nil
 	return nil
 }
 
@@ -580,6 +1016,7 @@ func New(conf database.Config, m *config.Mapping) (database.DB, error) {
 
 	db.Tables = make(map[string]*TableSpec)
 	db.GeneralizedTables = make(map[string]*GeneralizedTableSpec)
+	db.MergedTables = make(map[string]*MergedTableSpec)
 
 	db.Config = conf
 
@@ -609,19 +1046,20 @@ func New(conf database.Config, m *config.Mapping) (database.DB, error) {
 	params = disableDefaultSsl(params)
 	params, db.Prefix = stripPrefixFromConnectionParams(params)
 
-	for name, table := range m.Tables {
-		db.Tables[name], err = NewTableSpec(db, table)
-		if err != nil {
-			return nil, errors.Wrapf(err, "creating table spec for %q", name)
-		}
+	if err := db.prepareTables(m); err != nil {
+		return nil, err
 	}
-	for name, table := range m.GeneralizedTables {
-		db.GeneralizedTables[name] = NewGeneralizedTableSpec(db, table)
-	}
-	if err := db.prepareGeneralizedTableSources(); err != nil {
-		return nil, errors.Wrap(err, "preparing generalized table sources")
+	if conf.Upsert {
+		for _, spec := range db.Tables {
+			if spec.idColumn() == -1 || spec.History {
+				// always deleted and inserted
+				continue
+			}
+			if err := spec.checkUpsert(); err != nil {
+				return nil, errors.Wrap(err, "-diff-upsert not supported")
+			}
+		}
 	}
-	db.prepareGeneralizations()
 
 	db.Params = params
 	err = db.Open()
@@ -631,6 +1069,32 @@ func New(conf database.Config, m *config.Mapping) (database.DB, error) {
 	return db, nil
 }
 
+// prepareTables creates the specs of all tables, generalized tables and
+// merged tables of the mapping.
+func (pg *PostGIS) prepareTables(m *config.Mapping) error {
+	var err error
+	for name, table := range m.Tables {
+		pg.Tables[name], err = NewTableSpec(pg, table)
+		if err != nil {
+			return errors.Wrapf(err, "creating table spec for %q", name)
+		}
+	}
+	for name, table := range m.GeneralizedTables {
+		pg.GeneralizedTables[name] = NewGeneralizedTableSpec(pg, table)
+	}
+	if err := pg.prepareGeneralizedTableSources(); err != nil {
+		return errors.Wrap(err, "preparing generalized table sources")
+	}
+	pg.prepareGeneralizations()
+	for name, table := range m.MergedTables {
+		pg.MergedTables[name] = NewMergedTableSpec(pg, table)
+	}
+	if err := pg.prepareMergedTables(); err != nil {
+		return errors.Wrap(err, "preparing merged tables")
+	}
+	return nil
+}
+
 // prepareGeneralizedTableSources checks if all generalized table have an
 // existing source and sets .Source to the original source (works even
 // when source is allready generalized).
@@ -670,6 +1134,24 @@ func (pg *PostGIS) prepareGeneralizations() {
 	}
 }
 
+// prepareMergedTables checks if all merged tables have an existing
+// linestring source and adds them to the Merges of the source.
+func (pg *PostGIS) prepareMergedTables() error {
+	for name, table := range pg.MergedTables {
+		source, ok := pg.Tables[table.SourceName]
+		if !ok {
+			return errors.Errorf("missing source %q for merged table %q",
+				table.SourceName, name)
+		}
+		table.Source = source
+		if err := table.prepareColumns(); err != nil {
+			return errors.Wrapf(err, "merged table %q", name)
+		}
+		source.Merges = append(source.Merges, table)
+	}
+	return nil
+}
+
 func init() {
 	database.Register("postgres", New)
 	database.Register("postgis", New)
@@ -1,6 +1,7 @@
 package postgis
 
 import (
+	"database/sql"
 	"fmt"
 
 	"github.com/omniscale/imposm3/log"
@@ -23,8 +24,9 @@ func (pg *PostGIS) rotate(source, dest, backup string) error {
 	}
 	defer rollbackIfTx(&tx)
 
-	for _, tableName := range pg.tableNames() {
-		tableName = pg.Prefix + tableName
+	for _, name := range pg.tableNames() {
+		tableName := pg.fullTableName(name)
+		view := pg.currentViewName(name)
 
 		log.Printf("[info] Rotating %s from %s -> %s -> %s", tableName, source, dest, backup)
 
@@ -49,6 +51,11 @@ func (pg *PostGIS) rotate(source, dest, backup string) error {
 		if destExists {
 			log.Printf("[info] backup of %s, to %s", tableName, backup)
 			if backupExists {
+				if view != "" {
+					if err := dropViewIfExists(tx, backup, view); err != nil {
+						return err
+					}
+				}
 				err = dropTableIfExists(tx, backup, tableName)
 				if err != nil {
 					return err
@@ -59,6 +66,9 @@ func (pg *PostGIS) rotate(source, dest, backup string) error {
 			if err != nil {
 				return err
 			}
+			if err := moveView(tx, dest, view, backup); err != nil {
+				return err
+			}
 		}
 
 		sql := fmt.Sprintf(`ALTER TABLE "%s"."%s" SET SCHEMA "%s"`, source, tableName, dest)
@@ -66,6 +76,13 @@ func (pg *PostGIS) rotate(source, dest, backup string) error {
 		if err != nil {
 			return err
 		}
+		if err := moveView(tx, source, view, dest); err != nil {
+			return err
+		}
+	}
+
+	if err := rotateState(tx, source, dest, backup); err != nil {
+		return err
 	}
 
 	err = tx.Commit()
@@ -93,8 +110,8 @@ func (pg *PostGIS) RemoveBackup() error {
 
 	backup := pg.Config.BackupSchema
 
-	for _, tableName := range pg.tableNames() {
-		tableName = pg.Prefix + tableName
+	for _, name := range pg.tableNames() {
+		tableName := pg.fullTableName(name)
 
 		backupExists, err := tableExists(tx, backup, tableName)
 		if err != nil {
@@ -102,6 +119,11 @@ func (pg *PostGIS) RemoveBackup() error {
 		}
 		if backupExists {
 			log.Printf("[info] removing backup of %s from %s", tableName, backup)
+			if view := pg.currentViewName(name); view != "" {
+				if err := dropViewIfExists(tx, backup, view); err != nil {
+					return err
+				}
+			}
 			err = dropTableIfExists(tx, backup, tableName)
 			if err != nil {
 				return err
@@ -110,6 +132,10 @@ func (pg *PostGIS) RemoveBackup() error {
 		}
 	}
 
+	if _, err := tx.Exec(dropStateTableSQL(backup)); err != nil {
+		return &SQLError{dropStateTableSQL(backup), err}
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return err
@@ -118,6 +144,37 @@ func (pg *PostGIS) RemoveBackup() error {
 	return nil
 }
 
+// fullTableName returns the name of the table in the database, including
+// the prefix and the suffix of history tables.
+func (pg *PostGIS) fullTableName(name string) string {
+	if spec, ok := pg.Tables[name]; ok {
+		return spec.FullName
+	}
+	return pg.Prefix + name
+}
+
+// currentViewName returns the name of the view with the current rows, if
+// name is a history table.
+func (pg *PostGIS) currentViewName(name string) string {
+	if spec, ok := pg.Tables[name]; ok && spec.History {
+		return spec.CurrentViewName()
+	}
+	return ""
+}
+
+// moveView moves the view from source to dest schema. Does nothing if
+// view is empty.
+func moveView(tx *sql.Tx, source, view, dest string) error {
+	if view == "" {
+		return nil
+	}
+	sql := fmt.Sprintf(`ALTER VIEW IF EXISTS "%s"."%s" SET SCHEMA "%s"`, source, view, dest)
+	if _, err := tx.Exec(sql); err != nil {
+		return &SQLError{sql, err}
+	}
+	return nil
+}
+
 // tableNames returns a list of all tables (without prefix).
 func (pg *PostGIS) tableNames() []string {
 	var names []string
@@ -127,5 +184,8 @@ func (pg *PostGIS) tableNames() []string {
 	for name := range pg.GeneralizedTables {
 		names = append(names, name)
 	}
+	for name := range pg.MergedTables {
+		names = append(names, name)
+	}
 	return names
 }
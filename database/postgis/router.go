@@ -2,6 +2,8 @@ package postgis
 
 import (
 	"database/sql"
+	"sync"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 )
@@ -10,6 +12,12 @@ import (
 type TxRouter struct {
 	Tables map[string]TableTx
 	tx     *sql.Tx
+	// changes records all changes if Config.Changes is enabled
+	changes *changeLog
+
+	countsMu sync.Mutex
+	// counts is the number of changed rows for each table
+	counts map[string]int
 }
 
 func newTxRouter(pg *PostGIS, bulkImport bool) (*TxRouter, error) {
@@ -18,8 +26,19 @@ func newTxRouter(pg *PostGIS, bulkImport bool) (*TxRouter, error) {
 	}
 
 	if bulkImport {
+		if err := pg.Db.QueryRow("SHOW max_prepared_transactions").Scan(&pg.maxPreparedTransactions); err != nil {
+			return nil, errors.Wrap(err, "querying max_prepared_transactions")
+		}
+		atomic.StoreInt32(&pg.autoCopyStreams, 0)
 		for tableName, table := range pg.Tables {
-			tt := NewBulkTableTx(pg, table)
+			var tt TableTx
+			if key, err := pg.sortKey(table); err != nil {
+				return nil, err
+			} else if key != nil {
+				tt = NewSortedBulkTableTx(pg, table, key)
+			} else {
+				tt = NewBulkTableTx(pg, table)
+			}
 			err := tt.Begin(nil)
 			if err != nil {
 				return nil, err
@@ -48,6 +67,12 @@ func newTxRouter(pg *PostGIS, bulkImport bool) (*TxRouter, error) {
 			}
 			txr.Tables[tableName] = tt
 		}
+		if pg.Config.Changes {
+			txr.changes, err = newChangeLog(pg, tx)
+			if err != nil {
+				return nil, errors.Wrap(err, "preparing changes table")
+			}
+		}
 	}
 
 	return &txr, nil
@@ -55,6 +80,11 @@ func newTxRouter(pg *PostGIS, bulkImport bool) (*TxRouter, error) {
 
 func (txr *TxRouter) End() error {
 	if txr.tx != nil {
+		if txr.changes != nil {
+			if err := txr.changes.flush(); err != nil {
+				return err
+			}
+		}
 		for _, tt := range txr.Tables {
 			tt.End()
 		}
@@ -87,7 +117,75 @@ func (txr *TxRouter) Insert(table string, row []interface{}) error {
 	if !ok {
 		return errors.New("Insert into unknown table " + table)
 	}
-	return tt.Insert(row)
+	if err := tt.Insert(row); err != nil {
+		return err
+	}
+	txr.count(table, 1)
+	if txr.changes != nil {
+		txr.changes.inserted(table, row)
+	}
+	return nil
+}
+
+// Upsert replaces all rows of the OSM ID in table with rows.
+func (txr *TxRouter) Upsert(table string, id int64, rows [][]interface{}) error {
+	tt, ok := txr.Tables[table]
+	if !ok {
+		return errors.New("Upsert into unknown table " + table)
+	}
+	if txr.changes != nil && len(rows) == 0 {
+		if err := txr.changes.deleted(table, id); err != nil {
+			return err
+		}
+	}
+	var bbox sql.NullString
+	if txr.changes != nil && len(rows) > 0 {
+		var err error
+		if bbox, err = txr.changes.bbox(table, id); err != nil {
+			return err
+		}
+	}
+	n, err := tt.Upsert(id, rows)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		txr.count(table, n)
+		if txr.changes != nil && len(rows) > 0 {
+			txr.changes.updated(table, id, bbox)
+		}
+	}
+	return nil
+}
+
+func (txr *TxRouter) count(table string, n int64) {
+	txr.countsMu.Lock()
+	if txr.counts == nil {
+		txr.counts = make(map[string]int)
+	}
+	txr.counts[table] += int(n)
+	txr.countsMu.Unlock()
+}
+
+// Counts returns the number of inserted, updated and deleted rows for each
+// table.
+func (txr *TxRouter) Counts() map[string]int {
+	txr.countsMu.Lock()
+	defer txr.countsMu.Unlock()
+	counts := make(map[string]int, len(txr.counts))
+	for table, n := range txr.counts {
+		counts[table] = n
+	}
+	return counts
+}
+
+// SetChangeSequence sets the replication sequence of all following
+// changes.
+func (txr *TxRouter) SetChangeSequence(seq int) error {
+	if txr.changes == nil {
+		return nil
+	}
+	return txr.changes.setSequence(seq)
 }
 
 func (txr *TxRouter) Delete(table string, id int64) error {
@@ -95,5 +193,15 @@ func (txr *TxRouter) Delete(table string, id int64) error {
 	if !ok {
 		return errors.New("Delete from unknown table " + table)
 	}
-	return tt.Delete(id)
+	if txr.changes != nil {
+		if err := txr.changes.deleted(table, id); err != nil {
+			return err
+		}
+	}
+	n, err := tt.Delete(id)
+	if err != nil {
+		return err
+	}
+	txr.count(table, n)
+	return nil
 }
@@ -0,0 +1,69 @@
+package postgis
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// stubTableTx is a TableTx without database.
+type stubTableTx struct {
+	rows map[int64]int
+}
+
+func (tt *stubTableTx) Begin(*sql.Tx) error { return nil }
+func (tt *stubTableTx) Insert(row []interface{}) error {
+	tt.rows[row[0].(int64)]++
+	return nil
+}
+func (tt *stubTableTx) Delete(id int64) (int64, error) {
+	n := tt.rows[id]
+	delete(tt.rows, id)
+	return int64(n), nil
+}
+func (tt *stubTableTx) Upsert(id int64, rows [][]interface{}) (int64, error) {
+	n := tt.rows[id] - len(rows)
+	if n < 0 {
+		n = -n
+	}
+	tt.rows[id] = len(rows)
+	return int64(n), nil
+}
+func (tt *stubTableTx) End()          {}
+func (tt *stubTableTx) Commit() error { return nil }
+func (tt *stubTableTx) Rollback()     {}
+
+func TestTxRouterCounts(t *testing.T) {
+	txr := TxRouter{
+		Tables: map[string]TableTx{
+			"roads":     &stubTableTx{rows: make(map[int64]int)},
+			"buildings": &stubTableTx{rows: make(map[int64]int)},
+		},
+	}
+	for _, id := range []int64{1, 2, 3} {
+		if err := txr.Insert("roads", []interface{}{id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := txr.Delete("roads", 1); err != nil {
+		t.Fatal(err)
+	}
+	// no rows to delete
+	if err := txr.Delete("roads", 1); err != nil {
+		t.Fatal(err)
+	}
+	// unchanged
+	if err := txr.Upsert("roads", 2, [][]interface{}{{int64(2)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txr.Upsert("buildings", 4, [][]interface{}{{int64(4)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txr.Insert("unknown", []interface{}{int64(1)}); err == nil {
+		t.Error("expected error for unknown table")
+	}
+
+	counts := txr.Counts()
+	if len(counts) != 2 || counts["roads"] != 4 || counts["buildings"] != 1 {
+		t.Errorf("unexpected counts %v", counts)
+	}
+}
@@ -0,0 +1,337 @@
+package postgis
+
+import (
+	"bufio"
+	"container/heap"
+	"database/sql/driver"
+	"encoding/gob"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/omniscale/imposm3/geom"
+	"github.com/pkg/errors"
+)
+
+// sortBufferSize is the estimated size of all rows of a single table
+// that are sorted in memory before they are written to a run file.
+const sortBufferSize = 64 * 1024 * 1024
+
+// hilbertBits is the resolution of the Hilbert curve for each axis.
+const hilbertBits = 24
+
+// sortRow is a row with the spatial key of its geometry.
+type sortRow struct {
+	Key uint64
+	Row []interface{}
+}
+
+// rowSorter sorts rows by their spatial key with an external merge sort.
+// Rows are collected in memory and written as sorted runs into temporary
+// files when the buffer is full.
+type rowSorter struct {
+	key     func(row []interface{}) uint64
+	dir     string
+	maxSize int
+	rows    []sortRow
+	size    int
+	runs    []string
+}
+
+func newRowSorter(key func(row []interface{}) uint64, dir string) *rowSorter {
+	return &rowSorter{key: key, dir: dir, maxSize: sortBufferSize}
+}
+
+// add adds row to the sorter. All values are converted to driver.Value
+// types, as gob is not able to encode other types (like osm.MemberType)
+// in an interface slice. The COPY encoders do the same conversion, so the
+// written rows are not affected.
+func (s *rowSorter) add(row []interface{}) error {
+	key := s.key(row)
+	for i, v := range row {
+		dv, err := driver.DefaultParameterConverter.ConvertValue(v)
+		if err != nil {
+			return errors.Wrapf(err, "converting value %v for sorting", v)
+		}
+		row[i] = dv
+	}
+	s.rows = append(s.rows, sortRow{Key: key, Row: row})
+	s.size += estimatedRowSize(row)
+	if s.size >= s.maxSize {
+		return s.spill()
+	}
+	return nil
+}
+
+func estimatedRowSize(row []interface{}) int {
+	size := 40
+	for _, v := range row {
+		size += 16
+		if s, ok := v.(string); ok {
+			size += len(s)
+		}
+	}
+	return size
+}
+
+func (s *rowSorter) sortRows() {
+	sort.SliceStable(s.rows, func(i, j int) bool {
+		return s.rows[i].Key < s.rows[j].Key
+	})
+}
+
+// spill writes all rows in memory as sorted run into a temporary file.
+func (s *rowSorter) spill() error {
+	s.sortRows()
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return errors.Wrap(err, "creating sort dir")
+	}
+	f, err := os.CreateTemp(s.dir, "run-*.gob")
+	if err != nil {
+		return errors.Wrap(err, "creating sort run")
+	}
+	s.runs = append(s.runs, f.Name())
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	for i := range s.rows {
+		if err := enc.Encode(&s.rows[i]); err != nil {
+			f.Close()
+			return errors.Wrap(err, "writing sort run")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing sort run")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "writing sort run")
+	}
+	s.rows = nil
+	s.size = 0
+	return nil
+}
+
+// each calls f for all rows in sorted order. Rows with the same key are
+// returned in the order they were added.
+func (s *rowSorter) each(f func(row []interface{}) error) error {
+	s.sortRows()
+	if len(s.runs) == 0 {
+		for _, r := range s.rows {
+			if err := f(r.Row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	h := &runHeap{}
+	for i, name := range s.runs {
+		file, err := os.Open(name)
+		if err != nil {
+			return errors.Wrap(err, "opening sort run")
+		}
+		defer file.Close()
+		r := &sortRun{idx: i, dec: gob.NewDecoder(bufio.NewReader(file))}
+		if err := r.next(); err != nil {
+			return err
+		}
+		if !r.done {
+			heap.Push(h, r)
+		}
+	}
+	// rows in memory were added after all runs
+	mem := &sortRun{idx: len(s.runs), rows: s.rows}
+	if err := mem.next(); err != nil {
+		return err
+	}
+	if !mem.done {
+		heap.Push(h, mem)
+	}
+
+	for h.Len() > 0 {
+		r := (*h)[0]
+		if err := f(r.current.Row); err != nil {
+			return err
+		}
+		if err := r.next(); err != nil {
+			return err
+		}
+		if r.done {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return nil
+}
+
+// close removes the sort dir with all run files.
+func (s *rowSorter) close() {
+	os.RemoveAll(s.dir)
+	s.runs = nil
+	s.rows = nil
+}
+
+// sortRun reads sorted rows from a run file or from memory.
+type sortRun struct {
+	idx     int
+	dec     *gob.Decoder
+	rows    []sortRow
+	current sortRow
+	done    bool
+}
+
+func (r *sortRun) next() error {
+	if r.dec == nil {
+		if len(r.rows) == 0 {
+			r.done = true
+			return nil
+		}
+		r.current = r.rows[0]
+		r.rows = r.rows[1:]
+		return nil
+	}
+	r.current = sortRow{}
+	if err := r.dec.Decode(&r.current); err != nil {
+		if err == io.EOF {
+			r.done = true
+			return nil
+		}
+		return errors.Wrap(err, "reading sort run")
+	}
+	return nil
+}
+
+type runHeap []*sortRun
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	if h[i].current.Key != h[j].current.Key {
+		return h[i].current.Key < h[j].current.Key
+	}
+	return h[i].idx < h[j].idx
+}
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*sortRun)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// sortKey returns the function for the spatial sort key of rows for spec,
+// or nil if the rows should not be sorted.
+func (pg *PostGIS) sortKey(spec *TableSpec) (func(row []interface{}) uint64, error) {
+	if pg.Config.SortOrder == "" {
+		return nil, nil
+	}
+	for i, col := range spec.Columns {
+		if col.Type.Name() == "GEOMETRY" {
+			return spatialKeyFunc(pg.Config.SortOrder, pg.Config.Srid, i)
+		}
+	}
+	return nil, nil
+}
+
+// spatialKeyFunc returns a function that calculates the sort key from
+// the center of the geometry column geomIdx. Rows without a valid geometry
+// are sorted first.
+func spatialKeyFunc(sortOrder string, srid int, geomIdx int) (func(row []interface{}) uint64, error) {
+	var key func(x, y float64) uint64
+	switch sortOrder {
+	case "hilbert":
+		key = func(x, y float64) uint64 {
+			gx, gy := gridCoord(x, y, srid, hilbertBits)
+			return hilbertIndex(gx, gy, hilbertBits)
+		}
+	case "geohash":
+		key = func(x, y float64) uint64 {
+			if srid == 3857 {
+				x, y = mercToLonLat(x, y)
+			}
+			gx, gy := gridCoord(x, y, 4326, 32)
+			return interleaveBits(gx, gy)
+		}
+	default:
+		return nil, errors.Errorf("unknown sort order %q", sortOrder)
+	}
+
+	return func(row []interface{}) uint64 {
+		wkb, ok := row[geomIdx].(string)
+		if !ok {
+			return 0
+		}
+		bounds, err := geom.EWKBHexBounds([]byte(wkb))
+		if err != nil {
+			return 0
+		}
+		return key((bounds.MinX+bounds.MaxX)/2, (bounds.MinY+bounds.MaxY)/2)
+	}, nil
+}
+
+const mercMax = 20037508.342789244
+
+// gridCoord scales x/y from the extent of srid into a grid with 2^bits
+// cells on each axis.
+func gridCoord(x, y float64, srid int, bits uint) (uint32, uint32) {
+	minX, minY, maxX, maxY := -180.0, -90.0, 180.0, 90.0
+	if srid == 3857 {
+		minX, minY, maxX, maxY = -mercMax, -mercMax, mercMax, mercMax
+	}
+	cells := float64(uint64(1)<<bits - 1)
+	scale := func(v, min, max float64) uint32 {
+		f := (v - min) / (max - min)
+		if f < 0 || math.IsNaN(f) {
+			f = 0
+		} else if f > 1 {
+			f = 1
+		}
+		return uint32(f * cells)
+	}
+	return scale(x, minX, maxX), scale(y, minY, maxY)
+}
+
+func mercToLonLat(x, y float64) (float64, float64) {
+	lon := x / mercMax * 180
+	lat := (2*math.Atan(math.Exp(y/mercMax*math.Pi)) - math.Pi/2) * 180 / math.Pi
+	return lon, lat
+}
+
+// hilbertIndex returns the distance of x/y along the Hilbert curve that
+// fills a 2^bits x 2^bits grid.
+func hilbertIndex(x, y uint32, bits uint) uint64 {
+	n := uint32(1) << bits
+	var d uint64
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry uint32
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		d += uint64(s) * uint64(s) * uint64((3*rx)^ry)
+		// rotate quadrant
+		if ry == 0 {
+			if rx == 1 {
+				x = n - 1 - x
+				y = n - 1 - y
+			}
+			x, y = y, x
+		}
+	}
+	return d
+}
+
+// interleaveBits returns the Z-order (Morton code) of x/y, starting with
+// the highest bit of x like geohashes.
+func interleaveBits(x, y uint32) uint64 {
+	var d uint64
+	for i := 31; i >= 0; i-- {
+		d = d<<1 | uint64(x>>uint(i)&1)
+		d = d<<1 | uint64(y>>uint(i)&1)
+	}
+	return d
+}
@@ -0,0 +1,123 @@
+package postgis
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/geom"
+)
+
+func TestHilbertIndex(t *testing.T) {
+	// order of the cells of a 4x4 grid along the curve
+	expected := [][2]uint32{
+		{0, 0}, {1, 0}, {1, 1}, {0, 1},
+		{0, 2}, {0, 3}, {1, 3}, {1, 2},
+		{2, 2}, {2, 3}, {3, 3}, {3, 2},
+		{3, 1}, {2, 1}, {2, 0}, {3, 0},
+	}
+	for d, xy := range expected {
+		if idx := hilbertIndex(xy[0], xy[1], 2); idx != uint64(d) {
+			t.Errorf("unexpected index for %v: %d != %d", xy, idx, d)
+		}
+	}
+}
+
+func TestInterleaveBits(t *testing.T) {
+	if d := interleaveBits(1<<31, 0); d != 1<<63 {
+		t.Errorf("unexpected key %x", d)
+	}
+	if d := interleaveBits(0, 1<<31); d != 1<<62 {
+		t.Errorf("unexpected key %x", d)
+	}
+	if d := interleaveBits(1, 1); d != 3 {
+		t.Errorf("unexpected key %x", d)
+	}
+}
+
+func TestSpatialKeyFunc(t *testing.T) {
+	for _, order := range []string{"hilbert", "geohash"} {
+		key, err := spatialKeyFunc(order, 4326, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		point := func(x, y float64) []interface{} {
+			return []interface{}{int64(1), string(geom.NodeAsEWKBHexPoint(osm.Node{Long: x, Lat: y}, 4326))}
+		}
+		// nearby points are closer than points on the other side of the world
+		a, b, c := key(point(8.0, 53.0)), key(point(8.001, 53.001)), key(point(-120, -40))
+		if diff(a, b) >= diff(a, c) {
+			t.Errorf("%s: unexpected keys %d %d %d", order, a, b, c)
+		}
+		if k := key([]interface{}{int64(1), nil}); k != 0 {
+			t.Errorf("%s: expected 0 for missing geometry, got %d", order, k)
+		}
+	}
+	if _, err := spatialKeyFunc("unknown", 4326, 1); err == nil {
+		t.Error("expected error for unknown sort order")
+	}
+}
+
+func diff(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+type testString string
+
+func TestRowSorter(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sort")
+	s := newRowSorter(func(row []interface{}) uint64 {
+		return uint64(row[0].(int64) % 7)
+	}, dir)
+	s.maxSize = 1000 // spill after a few rows
+
+	for i := int64(0); i < 200; i++ {
+		var name interface{}
+		if i%3 == 0 {
+			name = "foo"
+		}
+		row := []interface{}{i, name, int8(1), float32(2.5), true, osm.RelationMember, testString("bar"), []byte{1, 2}}
+		if err := s.add(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.runs) == 0 {
+		t.Fatal("expected sort runs")
+	}
+
+	var rows [][]interface{}
+	err := s.each(func(row []interface{}) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 200 {
+		t.Fatalf("unexpected number of rows: %d", len(rows))
+	}
+	for i := 1; i < len(rows); i++ {
+		prev, cur := rows[i-1][0].(int64), rows[i][0].(int64)
+		if prev%7 > cur%7 || (prev%7 == cur%7 && prev > cur) {
+			t.Fatalf("rows not sorted at %d: %d %d", i, prev, cur)
+		}
+	}
+	for _, row := range rows {
+		id := row[0].(int64)
+		// values are converted to driver.Value types
+		if (id%3 == 0) != (row[1] == "foo") || row[2] != int64(1) || row[3] != float64(2.5) || row[4] != true ||
+			row[5] != int64(osm.RelationMember) || row[6] != "bar" || !bytes.Equal(row[7].([]byte), []byte{1, 2}) {
+			t.Fatalf("unexpected row %v", row)
+		}
+	}
+
+	s.close()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("sort dir not removed")
+	}
+}
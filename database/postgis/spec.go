@@ -22,8 +22,33 @@ type TableSpec struct {
 	GeometryType    string
 	Srid            int
 	Generalizations []*GeneralizedTableSpec
+	Merges          []*MergedTableSpec
+	// ParallelCopy is the number of parallel COPY streams for bulk
+	// imports. The number is chosen automatically if 0.
+	ParallelCopy int
+	// History tables keep previous versions of all rows, see
+	// currentSQL. The rows are stored in FullName with historySuffix and
+	// the current rows are available in a view with the name of the table.
+	History bool
 }
 
+// historySuffix is appended to the name of history tables.
+const historySuffix = "_history"
+
+// Columns of history tables with the time range of each version.
+const (
+	validFromColumn = "valid_from"
+	validToColumn   = "valid_to"
+)
+
+// versionTimeSQL is the start of new versions in history tables. It is
+// the timestamp from SetVersionTime, or the time of the transaction.
+const versionTimeSQL = `COALESCE(NULLIF(current_setting('imposm.version_time', true), '')::timestamptz, now())`
+
+// currentSQL is the condition for the current version of rows in
+// history tables.
+const currentSQL = `"` + validToColumn + `" IS NULL`
+
 type GeneralizedTableSpec struct {
 	Name              string
 	FullName          string
@@ -66,6 +91,12 @@ func (spec *TableSpec) CreateTableSQL() string {
 		}
 		cols = append(cols, col.AsSQL())
 	}
+	if spec.History {
+		cols = append(cols,
+			`"`+validFromColumn+`" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()`,
+			`"`+validToColumn+`" TIMESTAMP WITH TIME ZONE`,
+		)
+	}
 
 	// Make composite PRIMARY KEY of serial `id` and OSM ID. But only if the
 	// user did not provide a custom `id` colum which might not be unique.
@@ -91,6 +122,10 @@ func (spec *TableSpec) InsertSQL() string {
 		vars = append(vars,
 			col.Type.PrepareInsertSQL(len(vars)+1, spec))
 	}
+	if spec.History {
+		cols = append(cols, `"`+validFromColumn+`"`)
+		vars = append(vars, versionTimeSQL)
+	}
 	columns := strings.Join(cols, ", ")
 	placeholders := strings.Join(vars, ", ")
 
@@ -129,6 +164,17 @@ func (spec *TableSpec) DeleteSQL() string {
 		panic("missing id column")
 	}
 
+	if spec.History {
+		// close the current version instead of removing it
+		return fmt.Sprintf(`UPDATE "%s"."%s" SET "%s" = %s WHERE "%s" = $1 AND %s`,
+			spec.Schema,
+			spec.FullName,
+			validToColumn, versionTimeSQL,
+			idColumnName,
+			currentSQL,
+		)
+	}
+
 	return fmt.Sprintf(`DELETE FROM "%s"."%s" WHERE "%s" = $1`,
 		spec.Schema,
 		spec.FullName,
@@ -136,12 +182,99 @@ func (spec *TableSpec) DeleteSQL() string {
 	)
 }
 
+// CurrentViewName returns the name of the view with the current rows of
+// a history table, the name of the table without historySuffix.
+func (spec *TableSpec) CurrentViewName() string {
+	return strings.TrimSuffix(spec.FullName, historySuffix)
+}
+
+// CreateCurrentViewSQL returns the statement that creates the view with
+// the current rows of a history table.
+func (spec *TableSpec) CreateCurrentViewSQL() string {
+	return fmt.Sprintf(`CREATE VIEW "%s"."%s" AS SELECT * FROM "%s"."%s" WHERE %s`,
+		spec.Schema, spec.CurrentViewName(),
+		spec.Schema, spec.FullName,
+		currentSQL,
+	)
+}
+
+// idColumn returns the index of the OSM ID column, or -1.
+func (spec *TableSpec) idColumn() int {
+	for i, col := range spec.Columns {
+		if col.FieldType.Name == "id" {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkUpsert returns an error if the rows of the table can't be updated
+// in place. Upserts require the OSM ID column and the serial id column
+// for a stable order of the rows of an OSM ID. The serial id column is
+// missing if the mapping contains a custom id column.
+func (spec *TableSpec) checkUpsert() error {
+	if spec.idColumn() == -1 {
+		return errors.Errorf("missing OSM ID column in %q", spec.FullName)
+	}
+	for _, col := range spec.Columns {
+		if col.Name == "id" {
+			return errors.Errorf("custom id column in %q, upserts require the serial id column", spec.FullName)
+		}
+	}
+	return nil
+}
+
+// PartsSQL returns the query for the ctid of all rows of an OSM ID. The
+// rows are ordered by the serial id. The position of a row is its part.
+func (spec *TableSpec) PartsSQL() (string, error) {
+	if err := spec.checkUpsert(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`SELECT ctid::text FROM "%s"."%s" WHERE "%s" = $1 ORDER BY "id"`,
+		spec.Schema,
+		spec.FullName,
+		spec.Columns[spec.idColumn()].Name,
+	), nil
+}
+
+// UpdatePartSQL returns the statement that updates the row with the ctid
+// (last placeholder), but only if any column changed.
+func (spec *TableSpec) UpdatePartSQL() string {
+	var cols []string
+	var vars []string
+	for _, col := range spec.Columns {
+		cols = append(cols, "\""+col.Name+"\"")
+		vars = append(vars,
+			col.Type.PrepareInsertSQL(len(vars)+1, spec))
+	}
+	columns := strings.Join(cols, ", ")
+	values := strings.Join(vars, ", ")
+
+	return fmt.Sprintf(`UPDATE "%s"."%s" SET (%s) = ROW(%s) WHERE ctid = $%d::tid AND ROW(%s) IS DISTINCT FROM ROW(%s)`,
+		spec.Schema,
+		spec.FullName,
+		columns, values,
+		len(vars)+1,
+		columns, values,
+	)
+}
+
+// DeletePartSQL returns the statement that removes the row with the ctid.
+func (spec *TableSpec) DeletePartSQL() string {
+	return fmt.Sprintf(`DELETE FROM "%s"."%s" WHERE ctid = $1::tid`,
+		spec.Schema,
+		spec.FullName,
+	)
+}
+
 func NewTableSpec(pg *PostGIS, t *config.Table) (*TableSpec, error) {
 	var geomType string
 	if mapping.TableType(t.Type) == mapping.RelationMemberTable {
 		geomType = "geometry"
 	} else if mapping.TableType(t.Type) == mapping.PointOrPolygonTable {
 		geomType = "geometry"
+	} else if mapping.TableType(t.Type) == mapping.AddressInterpolationTable {
+		geomType = "point"
 	} else {
 		geomType = string(t.Type)
 	}
@@ -152,6 +285,11 @@ func NewTableSpec(pg *PostGIS, t *config.Table) (*TableSpec, error) {
 		Schema:       pg.Config.ImportSchema,
 		GeometryType: geomType,
 		Srid:         pg.Config.Srid,
+		ParallelCopy: t.ParallelCopy,
+		History:      t.History,
+	}
+	if spec.History {
+		spec.FullName += historySuffix
 	}
 	for _, column := range t.Columns {
 		columnType, err := mapping.MakeColumnType(column)
@@ -219,6 +357,9 @@ func (spec *GeneralizedTableSpec) InsertSQL() string {
 	}
 
 	where := fmt.Sprintf(` WHERE "%s" = $1`, idColumnName)
+	if spec.SourceGeneralized == nil && spec.Source.History {
+		where += " AND " + currentSQL
+	}
 	if spec.Where != "" {
 		where += " AND (" + spec.Where + ")"
 	}
@@ -236,3 +377,168 @@ func (spec *GeneralizedTableSpec) InsertSQL() string {
 	return sql
 
 }
+
+// MergedTableSpec is a table with merged linestrings of a source table. All
+// linestrings with the same values in the GroupBy columns are merged.
+type MergedTableSpec struct {
+	Name       string
+	FullName   string
+	Schema     string
+	SourceName string
+	Source     *TableSpec
+	GroupBy    []string
+	Tolerance  float64
+	Where      string
+	// Columns are the GroupBy columns and the geometry column of the source.
+	Columns []ColumnSpec
+}
+
+func NewMergedTableSpec(pg *PostGIS, t *config.MergedTable) *MergedTableSpec {
+	spec := MergedTableSpec{
+		Name:       t.Name,
+		FullName:   pg.Prefix + t.Name,
+		Schema:     pg.Config.ImportSchema,
+		SourceName: t.SourceTableName,
+		GroupBy:    t.GroupBy,
+		Tolerance:  t.Tolerance,
+		Where:      t.SQLFilter,
+	}
+	return &spec
+}
+
+// prepareColumns checks the source table and the GroupBy columns.
+func (spec *MergedTableSpec) prepareColumns() error {
+	if spec.Source.GeometryType != "linestring" {
+		return errors.Errorf("source %q is not a linestring table", spec.SourceName)
+	}
+	var geomCol *ColumnSpec
+	for i, col := range spec.Source.Columns {
+		if col.Type.Name() == "GEOMETRY" {
+			geomCol = &spec.Source.Columns[i]
+			break
+		}
+	}
+	if geomCol == nil {
+		return errors.Errorf("source %q has no geometry column", spec.SourceName)
+	}
+	if spec.Source.idColumn() == -1 {
+		return errors.Errorf("source %q has no id column", spec.SourceName)
+	}
+
+	spec.Columns = nil
+	for _, name := range spec.GroupBy {
+		found := false
+		for _, col := range spec.Source.Columns {
+			if col.Name == name && col.Type.Name() != "GEOMETRY" {
+				spec.Columns = append(spec.Columns, col)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("group_by column %q not found in source %q", name, spec.SourceName)
+		}
+	}
+	spec.Columns = append(spec.Columns, *geomCol)
+	return nil
+}
+
+func (spec *MergedTableSpec) geometryColumn() string {
+	return spec.Columns[len(spec.Columns)-1].Name
+}
+
+func (spec *MergedTableSpec) groupColumnsSQL() string {
+	var cols []string
+	for _, name := range spec.GroupBy {
+		cols = append(cols, `"`+name+`"`)
+	}
+	return strings.Join(cols, ", ")
+}
+
+// groupWhereSQL returns the condition for a single group, with placeholders
+// starting at $1.
+func (spec *MergedTableSpec) groupWhereSQL() string {
+	var conds []string
+	for i, name := range spec.GroupBy {
+		conds = append(conds, fmt.Sprintf(`"%s" IS NOT DISTINCT FROM $%d`, name, i+1))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// selectSQL returns the query for all merged linestrings of the source.
+// where is an optional condition for the source rows.
+func (spec *MergedTableSpec) selectSQL(where string) string {
+	var conds []string
+	if spec.Source.History {
+		conds = append(conds, currentSQL)
+	}
+	if spec.Where != "" {
+		conds = append(conds, "("+spec.Where+")")
+	}
+	if where != "" {
+		conds = append(conds, where)
+	}
+	var whereSQL string
+	if len(conds) > 0 {
+		whereSQL = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	geomCol := spec.geometryColumn()
+	geomSQL := fmt.Sprintf(`"%s"`, geomCol)
+	if spec.Tolerance > 0 {
+		geomSQL = fmt.Sprintf(`ST_SimplifyPreserveTopology("%s", %f)`, geomCol, spec.Tolerance)
+	}
+	groupCols := spec.groupColumnsSQL()
+
+	return fmt.Sprintf(`SELECT %s, %s::Geometry AS "%s" FROM (
+            SELECT %s, (ST_Dump(ST_LineMerge(ST_Collect("%s")))).geom AS "%s"
+            FROM "%s"."%s"%s
+            GROUP BY %s
+        ) AS merged`,
+		groupCols, geomSQL, geomCol,
+		groupCols, geomCol, geomCol,
+		spec.Source.Schema, spec.Source.FullName, whereSQL,
+		groupCols,
+	)
+}
+
+func (spec *MergedTableSpec) CreateTableSQL() string {
+	return fmt.Sprintf(`CREATE TABLE "%s"."%s" AS (%s)`,
+		spec.Schema, spec.FullName, spec.selectSQL(""))
+}
+
+// GroupSQL returns the query for the group values of a single source row.
+func (spec *MergedTableSpec) GroupSQL() string {
+	var idColumnName string
+	for _, col := range spec.Source.Columns {
+		if col.FieldType.Name == "id" {
+			idColumnName = col.Name
+			break
+		}
+	}
+
+	if idColumnName == "" {
+		panic("missing id column")
+	}
+
+	where := fmt.Sprintf(`"%s" = $1`, idColumnName)
+	if spec.Source.History {
+		where += " AND " + currentSQL
+	}
+	return fmt.Sprintf(`SELECT %s FROM "%s"."%s" WHERE %s`,
+		spec.groupColumnsSQL(), spec.Source.Schema, spec.Source.FullName, where)
+}
+
+// DeleteGroupSQL returns the statement to remove all merged linestrings of
+// a single group.
+func (spec *MergedTableSpec) DeleteGroupSQL() string {
+	return fmt.Sprintf(`DELETE FROM "%s"."%s" WHERE %s`,
+		spec.Schema, spec.FullName, spec.groupWhereSQL())
+}
+
+// InsertGroupSQL returns the statement to merge the linestrings of a single
+// group.
+func (spec *MergedTableSpec) InsertGroupSQL() string {
+	return fmt.Sprintf(`INSERT INTO "%s"."%s" (%s)`,
+		spec.Schema, spec.FullName, spec.selectSQL(spec.groupWhereSQL()))
+}
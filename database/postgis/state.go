@@ -0,0 +1,107 @@
+package postgis
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/omniscale/go-osm/state"
+	"github.com/pkg/errors"
+)
+
+// StateTable is the name of the table with the replication state of the
+// last diff import.
+const StateTable = "imposm_state"
+
+func createStateTableSQL(schema string) string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s"."%s" (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    sequence BIGINT NOT NULL,
+    timestamp TIMESTAMP WITH TIME ZONE,
+    url VARCHAR
+)`, schema, StateTable)
+}
+
+func writeStateSQL(schema string) string {
+	return fmt.Sprintf(`INSERT INTO "%s"."%s" (id, sequence, timestamp, url) VALUES (1, $1, $2, $3)
+ON CONFLICT (id) DO UPDATE SET sequence = EXCLUDED.sequence, timestamp = EXCLUDED.timestamp, url = EXCLUDED.url`,
+		schema, StateTable)
+}
+
+func readStateSQL(schema string) string {
+	return fmt.Sprintf(`SELECT sequence, timestamp, url FROM "%s"."%s" WHERE id = 1`, schema, StateTable)
+}
+
+// ReadState returns the replication state of the last committed diff
+// import, or nil if no state was written.
+func (pg *PostGIS) ReadState() (*state.DiffState, error) {
+	var exists bool
+	table := fmt.Sprintf(`"%s"."%s"`, pg.Config.ImportSchema, StateTable)
+	if err := pg.Db.QueryRow("SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+		return nil, errors.Wrapf(err, "checking for %s", table)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	var s state.DiffState
+	var timestamp sql.NullTime
+	var url sql.NullString
+	err := pg.Db.QueryRow(readStateSQL(pg.Config.ImportSchema)).Scan(&s.Sequence, &timestamp, &url)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &SQLError{readStateSQL(pg.Config.ImportSchema), err}
+	}
+	s.Time = timestamp.Time.UTC()
+	s.URL = url.String
+	return &s, nil
+}
+
+// WriteState stores the replication state in the transaction of the diff
+// import. The state is committed with End.
+func (pg *PostGIS) WriteState(s *state.DiffState) error {
+	if pg.txRouter == nil || pg.txRouter.tx == nil {
+		return errors.New("writing state requires a diff import transaction")
+	}
+	schema := pg.Config.ImportSchema
+	if _, err := pg.txRouter.tx.Exec(createStateTableSQL(schema)); err != nil {
+		return &SQLError{createStateTableSQL(schema), err}
+	}
+	var timestamp interface{}
+	if !s.Time.IsZero() {
+		timestamp = s.Time
+	}
+	if _, err := pg.txRouter.tx.Exec(writeStateSQL(schema), s.Sequence, timestamp, s.URL); err != nil {
+		return &SQLError{writeStateSQL(schema), err}
+	}
+	return nil
+}
+
+func dropStateTableSQL(schema string) string {
+	return fmt.Sprintf(`DROP TABLE IF EXISTS "%s"."%s"`, schema, StateTable)
+}
+
+// rotateState moves the state table like the tables of the mapping. The
+// state of dest is moved to backup, even if source has no state, as it
+// does not belong to the tables from source.
+func rotateState(tx *sql.Tx, source, dest, backup string) error {
+	destExists, err := tableExists(tx, dest, StateTable)
+	if err != nil {
+		return err
+	}
+	if destExists {
+		if _, err := tx.Exec(dropStateTableSQL(backup)); err != nil {
+			return &SQLError{dropStateTableSQL(backup), err}
+		}
+		sql := fmt.Sprintf(`ALTER TABLE "%s"."%s" SET SCHEMA "%s"`, dest, StateTable, backup)
+		if _, err := tx.Exec(sql); err != nil {
+			return &SQLError{sql, err}
+		}
+	}
+	sql := fmt.Sprintf(`ALTER TABLE IF EXISTS "%s"."%s" SET SCHEMA "%s"`, source, StateTable, dest)
+	if _, err := tx.Exec(sql); err != nil {
+		return &SQLError{sql, err}
+	}
+	return nil
+}
@@ -1,116 +1,486 @@
 package postgis
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/lib/pq"
 	"github.com/omniscale/imposm3/log"
+	"github.com/pkg/errors"
 )
 
 type TableTx interface {
 	Begin(*sql.Tx) error
 	Insert(row []interface{}) error
-	Delete(id int64) error
+	// Delete removes all rows of the OSM ID. It returns the number of
+	// deleted rows.
+	Delete(id int64) (int64, error)
+	// Upsert replaces all rows of the OSM ID with rows. It returns the
+	// number of inserted, updated and deleted rows.
+	Upsert(id int64, rows [][]interface{}) (int64, error)
 	End()
 	Commit() error
 	Rollback()
 }
 
+// maxAutoCopyStreams is the number of parallel COPY streams for a table
+// without parallel_copy option.
+const maxAutoCopyStreams = 4
+
 type bulkTableTx struct {
-	Pg         *PostGIS
-	Tx         *sql.Tx
-	Table      string
-	Spec       *TableSpec
-	InsertStmt *sql.Stmt
-	InsertSQL  string
-	wg         *sync.WaitGroup
-	rows       chan []interface{}
+	Pg    *PostGIS
+	Table string
+	Spec  *TableSpec
+	wg    *sync.WaitGroup
+	// rows are consumed by all streams. A shared channel hands each row
+	// to the next idle stream. Rows are not sharded by stream, as
+	// unsorted tables need no order and all streams are committed
+	// together, so rows of one element may end up in different streams.
+	rows chan []interface{}
+	// sorter collects all rows if the rows should be sorted before COPY
+	sorter  *rowSorter
+	sortErr error
+
+	// mu protects streams, maxStreams, autoCopyStreams and binary
+	mu sync.Mutex
+	// streams consume rows in parallel, each with its own transaction
+	streams    []*copyStream
+	maxStreams int
+	// autoStreams adds streams (up to maxStreams) when all streams are busy
+	autoStreams bool
+	// autoCopyStreams is the number of streams that were added
+	// automatically and are counted in Pg.autoCopyStreams
+	autoCopyStreams int32
+	// binary is true if new streams should use binary COPY
+	binary bool
 }
 
 func NewBulkTableTx(pg *PostGIS, spec *TableSpec) TableTx {
 	tt := &bulkTableTx{
-		Pg:    pg,
-		Table: spec.FullName,
-		Spec:  spec,
-		wg:    &sync.WaitGroup{},
-		rows:  make(chan []interface{}, 64),
+		Pg:         pg,
+		Table:      spec.FullName,
+		Spec:       spec,
+		wg:         &sync.WaitGroup{},
+		rows:       make(chan []interface{}, 64),
+		binary:     pg.Config.CopyFormat == "binary",
+		maxStreams: 1,
+	}
+	if spec.ParallelCopy > 0 {
+		tt.maxStreams = spec.ParallelCopy
+	} else if n := min(maxAutoCopyStreams, pg.maxPreparedTransactions); n > 1 {
+		// parallel streams are committed with prepared transactions
+		tt.maxStreams = n
+		tt.autoStreams = true
+	}
+	return tt
+}
+
+// NewSortedBulkTableTx returns a bulk TableTx that sorts all rows by the
+// spatial key of their geometry. The rows are copied into the table on
+// Commit.
+func NewSortedBulkTableTx(pg *PostGIS, spec *TableSpec, key func(row []interface{}) uint64) TableTx {
+	tt := &bulkTableTx{
+		Pg:     pg,
+		Table:  spec.FullName,
+		Spec:   spec,
+		wg:     &sync.WaitGroup{},
+		rows:   make(chan []interface{}, 64),
+		sorter: newRowSorter(key, filepath.Join(pg.Config.SortDir, spec.FullName)),
+		binary: pg.Config.CopyFormat == "binary",
+		// parallel streams would not keep the order of the rows
+		maxStreams: 1,
 	}
-	tt.wg.Add(1)
-	go tt.loop()
 	return tt
 }
 
+func (tt *bulkTableTx) truncateSQL() string {
+	return fmt.Sprintf(`TRUNCATE TABLE "%s"."%s" RESTART IDENTITY`, tt.Pg.Config.ImportSchema, tt.Table)
+}
+
+// deleteSQL empties the table for parallel streams. TRUNCATE locks the
+// table till the end of the transaction and would block the COPY of the
+// other streams.
+func (tt *bulkTableTx) deleteSQL() string {
+	return fmt.Sprintf(`DELETE FROM "%s"."%s"`, tt.Pg.Config.ImportSchema, tt.Table)
+}
+
+// Begin starts the COPY streams. The first stream empties the table within
+// its transaction. Parallel streams are committed together with prepared
+// transactions, see Commit. tx is not used, as each stream requires its
+// own connection.
 func (tt *bulkTableTx) Begin(tx *sql.Tx) error {
-	var err error
-	if tx == nil {
-		tx, err = tt.Pg.Db.Begin()
+	if tt.maxStreams > 1 && !tt.autoStreams && tt.maxStreams > tt.Pg.maxPreparedTransactions {
+		return errors.Errorf("parallel_copy of %q requires max_prepared_transactions of at least %d, PostgreSQL allows %d",
+			tt.Table, tt.maxStreams, tt.Pg.maxPreparedTransactions)
+	}
+	streams := tt.maxStreams
+	if tt.autoStreams {
+		streams = 1
+	}
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	for i := 0; i < streams; i++ {
+		if err := tt.addStream(i == 0); err != nil {
+			tt.rollbackStreams()
+			return err
+		}
+	}
+	return nil
+}
+
+// addStream begins a new COPY stream and starts consuming rows. The stream
+// empties the table if first is true. tt.mu needs to be locked.
+func (tt *bulkTableTx) addStream(first bool) error {
+	emptySQL := ""
+	if first {
+		emptySQL = tt.truncateSQL()
+		if tt.maxStreams > 1 {
+			emptySQL = tt.deleteSQL()
+		}
+	}
+	var s *copyStream
+	if tt.binary {
+		var err error
+		s, err = tt.beginBinaryStream(emptySQL)
+		if err != nil {
+			log.Printf("[warn] binary COPY for %q not available, using text format: %s", tt.Table, err)
+			tt.binary = false
+		}
+	}
+	if s == nil {
+		var err error
+		s, err = tt.beginTextStream(emptySQL)
 		if err != nil {
 			return err
 		}
 	}
-	tt.Tx = tx
+	tt.streams = append(tt.streams, s)
+	tt.wg.Add(1)
+	go tt.loop(s)
+	return nil
+}
 
-	_, err = tx.Exec(fmt.Sprintf(`TRUNCATE TABLE "%s"."%s" RESTART IDENTITY`, tt.Pg.Config.ImportSchema, tt.Table))
+// beginTextStream starts a text COPY in a new transaction. The transaction
+// is started with BEGIN on a dedicated connection, as prepared transactions
+// are not supported by sql.Tx.
+func (tt *bulkTableTx) beginTextStream(emptySQL string) (*copyStream, error) {
+	conn, err := tt.Pg.Db.Conn(context.Background())
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	tt.InsertSQL = tt.Spec.CopySQL()
-
-	stmt, err := tt.Tx.Prepare(tt.InsertSQL)
+	s := &copyStream{conn: conn, sql: tt.Spec.CopySQL()}
+	if err := s.begin(emptySQL); err != nil {
+		return nil, err
+	}
+	stmt, err := conn.PrepareContext(context.Background(), s.sql)
 	if err != nil {
-		return &SQLError{tt.InsertSQL, err}
+		s.rollback()
+		return nil, &SQLError{s.sql, err}
 	}
-	tt.InsertStmt = stmt
+	s.stmt = stmt
+	return s, nil
+}
 
-	return nil
+// beginBinaryStream starts a binary COPY in a new transaction on a
+// dedicated connection.
+func (tt *bulkTableTx) beginBinaryStream(emptySQL string) (*copyStream, error) {
+	db, dialer, err := tt.Pg.openCopyDB()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &copyStream{
+		conn: conn,
+		db:   db,
+		sql:  tt.Spec.CopySQL() + " WITH (FORMAT binary)",
+	}
+	if err := s.begin(emptySQL); err != nil {
+		return nil, err
+	}
+	netConn := dialer.lastConn()
+	if netConn == nil {
+		s.rollback()
+		return nil, errors.New("no connection")
+	}
+	s.binCopy, err = startBinaryCopy(netConn, tt.Spec)
+	if err != nil {
+		s.rollback()
+		return nil, &SQLError{s.sql, err}
+	}
+	return s, nil
 }
 
 func (tt *bulkTableTx) Insert(row []interface{}) error {
+	if tt.autoStreams {
+		select {
+		case tt.rows <- row:
+			return nil
+		default:
+			// all streams are busy
+			tt.addAutoStream()
+		}
+	}
 	tt.rows <- row
 	return nil
 }
 
-func (tt *bulkTableTx) loop() {
+// addAutoStream adds another stream, unless the table or all tables
+// already use the maximum number of streams. The number of automatic
+// streams of all tables is limited by the number of CPUs.
+func (tt *bulkTableTx) addAutoStream() {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if len(tt.streams) >= tt.maxStreams {
+		return
+	}
+	if atomic.AddInt32(&tt.Pg.autoCopyStreams, 1) > int32(runtime.NumCPU()) {
+		atomic.AddInt32(&tt.Pg.autoCopyStreams, -1)
+		tt.maxStreams = len(tt.streams)
+		return
+	}
+	if err := tt.addStream(false); err != nil {
+		log.Printf("[warn] adding COPY stream for %q: %s", tt.Table, err)
+		atomic.AddInt32(&tt.Pg.autoCopyStreams, -1)
+		tt.maxStreams = len(tt.streams)
+		return
+	}
+	tt.autoCopyStreams++
+}
+
+func (tt *bulkTableTx) loop(s *copyStream) {
 	for row := range tt.rows {
-		_, err := tt.InsertStmt.Exec(row...)
+		if tt.sorter != nil {
+			if err := tt.sorter.add(row); err != nil && tt.sortErr == nil {
+				tt.sortErr = err
+			}
+			continue
+		}
+		err := s.insert(row)
 		if err != nil {
-			// InsertStmt uses COPY so the error may not be related to this row.
+			// COPY errors may not be related to this row.
 			// Abort the import as the whole transaction is lost anyway.
-			log.Fatalf("[fatal] bulk insert into %q: %s", tt.Table, &SQLError{tt.InsertSQL, err})
+			log.Fatalf("[fatal] bulk insert into %q: %s", tt.Table, &SQLError{s.sql, err})
 		}
 	}
 	tt.wg.Done()
 }
 
-func (tt *bulkTableTx) Delete(id int64) error {
+func (tt *bulkTableTx) Delete(id int64) (int64, error) {
 	panic("unable to delete in bulkImport mode")
 }
 
+func (tt *bulkTableTx) Upsert(id int64, rows [][]interface{}) (int64, error) {
+	panic("unable to upsert in bulkImport mode")
+}
+
 func (tt *bulkTableTx) End() {
 	close(tt.rows)
 	tt.wg.Wait()
 }
 
+// Commit commits all streams. A single stream is committed directly.
+// Parallel streams are prepared with PREPARE TRANSACTION after all
+// streams have finished their COPY, and committed with COMMIT PREPARED
+// once all streams are prepared. No rows are committed if any stream
+// fails before.
 func (tt *bulkTableTx) Commit() error {
 	tt.End()
-	if tt.InsertStmt != nil {
-		_, err := tt.InsertStmt.Exec()
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	defer tt.releaseAutoStreams()
+	if tt.sorter != nil {
+		defer tt.sorter.close()
+		if tt.sortErr != nil {
+			tt.rollbackStreams()
+			return errors.Wrapf(tt.sortErr, "sorting %q", tt.Table)
+		}
+		s := tt.streams[0]
+		step := log.Step(fmt.Sprintf("Writing sorted rows into %q", tt.Table))
+		err := tt.sorter.each(func(row []interface{}) error {
+			if err := s.insert(row); err != nil {
+				return &SQLError{s.sql, err}
+			}
+			return nil
+		})
+		step()
 		if err != nil {
+			tt.rollbackStreams()
 			return err
 		}
 	}
-	err := tt.Tx.Commit()
+	for _, s := range tt.streams {
+		if err := s.finish(); err != nil {
+			tt.rollbackStreams()
+			return &SQLError{s.sql, err}
+		}
+	}
+	if len(tt.streams) == 1 {
+		s := tt.streams[0]
+		tt.streams = nil
+		return s.commit()
+	}
+
+	for i, s := range tt.streams {
+		gid := fmt.Sprintf("imposm_%s_%d_%d", tt.Table, os.Getpid(), i)
+		if err := s.prepare(gid); err != nil {
+			tt.rollbackStreams()
+			return errors.Wrapf(err, "preparing transaction of %q", tt.Table)
+		}
+	}
+	var failed []string
+	var err error
+	for _, s := range tt.streams {
+		if _, e := tt.Pg.Db.Exec(`COMMIT PREPARED ` + pq.QuoteLiteral(s.gid)); e != nil {
+			failed = append(failed, s.gid)
+			err = e
+		}
+	}
+	tt.streams = nil
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "committing prepared transactions of %q, commit or roll back %s manually",
+			tt.Table, strings.Join(failed, ", "))
 	}
-	tt.Tx = nil
 	return nil
 }
 
 func (tt *bulkTableTx) Rollback() {
-	rollbackIfTx(&tt.Tx)
+	if tt.sorter != nil {
+		tt.sorter.close()
+	}
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tt.rollbackStreams()
+	tt.releaseAutoStreams()
+}
+
+// rollbackStreams rolls back all streams. tt.mu needs to be locked.
+func (tt *bulkTableTx) rollbackStreams() {
+	for _, s := range tt.streams {
+		if s.gid != "" {
+			if _, err := tt.Pg.Db.Exec(`ROLLBACK PREPARED ` + pq.QuoteLiteral(s.gid)); err != nil {
+				log.Printf("[warn] rollback of prepared transaction %s: %s", s.gid, err)
+			}
+			continue
+		}
+		s.rollback()
+	}
+	tt.streams = nil
+}
+
+// releaseAutoStreams allows other tables to add the automatic streams of
+// this table. tt.mu needs to be locked.
+func (tt *bulkTableTx) releaseAutoStreams() {
+	atomic.AddInt32(&tt.Pg.autoCopyStreams, -tt.autoCopyStreams)
+	tt.autoCopyStreams = 0
+}
+
+// copyStream is a single COPY into a table within its own transaction on a
+// dedicated connection.
+type copyStream struct {
+	conn *sql.Conn
+	sql  string
+	stmt *sql.Stmt
+	// binCopy writes rows with binary COPY on the connection of db,
+	// instead of stmt
+	binCopy *binaryCopy
+	db      *sql.DB
+	// gid is the ID of the prepared transaction
+	gid string
+}
+
+// begin starts the transaction and executes emptySQL if it is not empty.
+// The connection is closed on errors.
+func (s *copyStream) begin(emptySQL string) error {
+	if _, err := s.conn.ExecContext(context.Background(), "BEGIN"); err != nil {
+		s.close()
+		return err
+	}
+	if emptySQL != "" {
+		if _, err := s.conn.ExecContext(context.Background(), emptySQL); err != nil {
+			s.rollback()
+			return &SQLError{emptySQL, err}
+		}
+	}
+	return nil
+}
+
+func (s *copyStream) insert(row []interface{}) error {
+	if s.binCopy != nil {
+		return s.binCopy.Insert(row)
+	}
+	_, err := s.stmt.Exec(row...)
+	return err
+}
+
+// finish ends the COPY and returns any error of the COPY.
+func (s *copyStream) finish() error {
+	if s.binCopy != nil {
+		err := s.binCopy.Finish()
+		s.binCopy = nil
+		return err
+	}
+	if s.stmt != nil {
+		_, err := s.stmt.Exec()
+		s.stmt.Close()
+		s.stmt = nil
+		return err
+	}
+	return nil
+}
+
+func (s *copyStream) commit() error {
+	_, err := s.conn.ExecContext(context.Background(), "COMMIT")
+	s.close()
+	return err
+}
+
+// prepare prepares the transaction for COMMIT PREPARED and closes the
+// connection.
+func (s *copyStream) prepare(gid string) error {
+	_, err := s.conn.ExecContext(context.Background(), `PREPARE TRANSACTION `+pq.QuoteLiteral(gid))
+	if err != nil {
+		return err
+	}
+	s.gid = gid
+	s.close()
+	return nil
+}
+
+func (s *copyStream) rollback() {
+	if s.binCopy != nil {
+		s.binCopy.abort("import aborted")
+		s.binCopy = nil
+	}
+	if s.stmt != nil {
+		s.stmt.Close()
+		s.stmt = nil
+	}
+	if s.conn != nil {
+		s.conn.ExecContext(context.Background(), "ROLLBACK")
+	}
+	s.close()
+}
+
+func (s *copyStream) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if s.db != nil {
+		s.db.Close()
+		s.db = nil
+	}
 }
 
 type syncTableTx struct {
@@ -122,6 +492,14 @@ type syncTableTx struct {
 	DeleteStmt *sql.Stmt
 	InsertSQL  string
 	DeleteSQL  string
+
+	// statements for Upsert, prepared on first use
+	PartsStmt      *sql.Stmt
+	UpdatePartStmt *sql.Stmt
+	DeletePartStmt *sql.Stmt
+	PartsSQL       string
+	UpdatePartSQL  string
+	DeletePartSQL  string
 }
 
 type tableSpec interface {
@@ -129,6 +507,14 @@ type tableSpec interface {
 	DeleteSQL() string
 }
 
+// upsertSpec is a tableSpec with stable parts for each OSM ID.
+type upsertSpec interface {
+	tableSpec
+	PartsSQL() (string, error)
+	UpdatePartSQL() string
+	DeletePartSQL() string
+}
+
 func NewSynchronousTableTx(pg *PostGIS, tableName string, spec tableSpec) TableTx {
 	tt := &syncTableTx{
 		Pg:    pg,
@@ -174,10 +560,101 @@ func (tt *syncTableTx) Insert(row []interface{}) error {
 	return nil
 }
 
-func (tt *syncTableTx) Delete(id int64) error {
-	_, err := tt.DeleteStmt.Exec(id)
+func (tt *syncTableTx) Delete(id int64) (int64, error) {
+	res, err := tt.DeleteStmt.Exec(id)
+	if err != nil {
+		return 0, &SQLInsertError{SQLError{tt.DeleteSQL, err}, id}
+	}
+	return res.RowsAffected()
+}
+
+// Upsert updates the existing rows of the OSM ID with rows, row by row in
+// the order of PartsSQL. Rows are only updated if any value changed.
+// Additional rows are inserted and remaining rows are deleted.
+func (tt *syncTableTx) Upsert(id int64, rows [][]interface{}) (int64, error) {
+	if err := tt.prepareUpsert(); err != nil {
+		return 0, err
+	}
+	parts, err := tt.parts(id)
 	if err != nil {
-		return &SQLInsertError{SQLError{tt.DeleteSQL, err}, id}
+		return 0, err
+	}
+	var affected int64
+	for i, row := range rows {
+		if i >= len(parts) {
+			if err := tt.Insert(row); err != nil {
+				return 0, err
+			}
+			affected++
+			continue
+		}
+		args := make([]interface{}, len(row), len(row)+1)
+		copy(args, row)
+		res, err := tt.UpdatePartStmt.Exec(append(args, parts[i])...)
+		if err != nil {
+			return 0, &SQLInsertError{SQLError{tt.UpdatePartSQL, err}, row}
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		affected += n
+	}
+	for i := len(rows); i < len(parts); i++ {
+		if _, err := tt.DeletePartStmt.Exec(parts[i]); err != nil {
+			return 0, &SQLInsertError{SQLError{tt.DeletePartSQL, err}, id}
+		}
+		affected++
+	}
+	return affected, nil
+}
+
+// parts returns the ctid of all rows of the OSM ID.
+func (tt *syncTableTx) parts(id int64) ([]string, error) {
+	rows, err := tt.PartsStmt.Query(id)
+	if err != nil {
+		return nil, &SQLInsertError{SQLError{tt.PartsSQL, err}, id}
+	}
+	defer rows.Close()
+	var parts []string
+	for rows.Next() {
+		var ctid string
+		if err := rows.Scan(&ctid); err != nil {
+			return nil, err
+		}
+		parts = append(parts, ctid)
+	}
+	return parts, rows.Err()
+}
+
+func (tt *syncTableTx) prepareUpsert() error {
+	if tt.PartsStmt != nil {
+		return nil
+	}
+	spec, ok := tt.Spec.(upsertSpec)
+	if !ok {
+		return errors.Errorf("upsert into %q not supported", tt.Table)
+	}
+	partsSQL, err := spec.PartsSQL()
+	if err != nil {
+		return errors.Wrapf(err, "upsert into %q not supported", tt.Table)
+	}
+	tt.PartsSQL = partsSQL
+	tt.UpdatePartSQL = spec.UpdatePartSQL()
+	tt.DeletePartSQL = spec.DeletePartSQL()
+	for _, s := range []struct {
+		stmt **sql.Stmt
+		sql  string
+	}{
+		{&tt.UpdatePartStmt, tt.UpdatePartSQL},
+		{&tt.DeletePartStmt, tt.DeletePartSQL},
+		{&tt.PartsStmt, tt.PartsSQL},
+	} {
+		stmt, err := tt.Tx.Prepare(s.sql)
+		if err != nil {
+			return &SQLError{s.sql, err}
+		}
+		*s.stmt = stmt
 	}
 	return nil
 }
@@ -0,0 +1,228 @@
+package postgis
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/omniscale/imposm3/database"
+	"github.com/omniscale/imposm3/mapping"
+)
+
+func TestBulkTableTxStreams(t *testing.T) {
+	m, err := mapping.New([]byte(`
+    tables:
+      roads:
+        type: linestring
+        parallel_copy: 2
+        columns:
+        - {name: geometry, type: geometry}
+        mapping:
+          highway: [__any__]
+      buildings:
+        type: polygon
+        columns:
+        - {name: geometry, type: geometry}
+        mapping:
+          building: [__any__]
+    `))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pg := &PostGIS{
+		Config:                  database.Config{Srid: 3857, SortOrder: "hilbert"},
+		maxPreparedTransactions: 10,
+	}
+	for _, tc := range []struct {
+		table      string
+		maxStreams int
+		auto       bool
+	}{
+		{"roads", 2, false},
+		{"buildings", maxAutoCopyStreams, true},
+	} {
+		spec, err := NewTableSpec(pg, m.Conf.Tables[tc.table])
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt := NewBulkTableTx(pg, spec).(*bulkTableTx)
+		if tt.maxStreams != tc.maxStreams || tt.autoStreams != tc.auto {
+			t.Errorf("unexpected streams for %s: %d %v", tc.table, tt.maxStreams, tt.autoStreams)
+		}
+
+		// sorted tables are written with a single stream
+		key, err := pg.sortKey(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tt = NewSortedBulkTableTx(pg, spec, key).(*bulkTableTx)
+		if tt.maxStreams != 1 || tt.autoStreams {
+			t.Errorf("unexpected streams for sorted %s: %d %v", tc.table, tt.maxStreams, tt.autoStreams)
+		}
+	}
+
+	// parallel streams require prepared transactions
+	pg.maxPreparedTransactions = 0
+	spec, err := NewTableSpec(pg, m.Conf.Tables["buildings"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tt := NewBulkTableTx(pg, spec).(*bulkTableTx); tt.maxStreams != 1 || tt.autoStreams {
+		t.Errorf("unexpected streams without prepared transactions: %d %v", tt.maxStreams, tt.autoStreams)
+	}
+	spec, err = NewTableSpec(pg, m.Conf.Tables["roads"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewBulkTableTx(pg, spec).Begin(nil); err == nil || !strings.Contains(err.Error(), "max_prepared_transactions") {
+		t.Errorf("expected max_prepared_transactions error, got %v", err)
+	}
+
+	if _, err := mapping.New([]byte(`
+    tables:
+      roads:
+        type: linestring
+        parallel_copy: -1
+        mapping:
+          highway: [__any__]
+    `)); err == nil {
+		t.Error("expected error for negative parallel_copy")
+	}
+}
+
+func TestUpsertSQL(t *testing.T) {
+	m, err := mapping.New([]byte(`
+    tables:
+      roads:
+        type: linestring
+        columns:
+        - {name: osm_id, type: id}
+        - {name: geometry, type: geometry}
+        - {name: name, type: string, key: name}
+        mapping:
+          highway: [__any__]
+    `))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pg := &PostGIS{Config: database.Config{Srid: 3857, ImportSchema: "import"}, Prefix: "osm_"}
+	spec, err := NewTableSpec(pg, m.Conf.Tables["roads"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	partsSQL, err := spec.PartsSQL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		sql      string
+		expected string
+	}{
+		{partsSQL, `SELECT ctid::text FROM "import"."osm_roads" WHERE "osm_id" = $1 ORDER BY "id"`},
+		{spec.UpdatePartSQL(), `UPDATE "import"."osm_roads" SET ("osm_id", "geometry", "name") = ROW($1, $2::Geometry, $3) WHERE ctid = $4::tid AND ROW("osm_id", "geometry", "name") IS DISTINCT FROM ROW($1, $2::Geometry, $3)`},
+		{spec.DeletePartSQL(), `DELETE FROM "import"."osm_roads" WHERE ctid = $1::tid`},
+	} {
+		if tc.sql != tc.expected {
+			t.Errorf("unexpected SQL\n%s\nexpected\n%s", tc.sql, tc.expected)
+		}
+	}
+
+	// rows of tables with a custom id column have no stable order
+	m, err = mapping.New([]byte(`
+    tables:
+      roads:
+        type: linestring
+        columns:
+        - {name: id, type: id}
+        - {name: geometry, type: geometry}
+        mapping:
+          highway: [__any__]
+    `))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err = NewTableSpec(pg, m.Conf.Tables["roads"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spec.PartsSQL(); err == nil {
+		t.Error("expected error for custom id column")
+	}
+}
+
+func TestHistorySQL(t *testing.T) {
+	m, err := mapping.New([]byte(`
+    tables:
+      roads:
+        type: linestring
+        history: true
+        columns:
+        - {name: osm_id, type: id}
+        - {name: geometry, type: geometry}
+        - {name: name, type: string, key: name}
+        mapping:
+          highway: [__any__]
+    generalized_tables:
+      roads_gen:
+        source: roads
+        tolerance: 10
+    merged_tables:
+      roads_merged:
+        source: roads
+        group_by: [name]
+    `))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pg := &PostGIS{
+		Config:            database.Config{Srid: 3857, ImportSchema: "import"},
+		Prefix:            "osm_",
+		Tables:            make(map[string]*TableSpec),
+		GeneralizedTables: make(map[string]*GeneralizedTableSpec),
+		MergedTables:      make(map[string]*MergedTableSpec),
+	}
+	if err := pg.prepareTables(&m.Conf); err != nil {
+		t.Fatal(err)
+	}
+	spec := pg.Tables["roads"]
+	if !spec.History {
+		t.Fatal("history not set")
+	}
+	if sql := spec.CreateTableSQL(); !strings.Contains(sql, `"valid_from" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()`) ||
+		!strings.Contains(sql, `"valid_to" TIMESTAMP WITH TIME ZONE`) {
+		t.Errorf("missing version columns in\n%s", sql)
+	}
+	for _, tc := range []struct {
+		sql      string
+		expected string
+	}{
+		{spec.InsertSQL(), `INSERT INTO "import"."osm_roads_history" ("osm_id", "geometry", "name", "valid_from") VALUES ($1, $2::Geometry, $3, ` + versionTimeSQL + `)`},
+		{spec.DeleteSQL(), `UPDATE "import"."osm_roads_history" SET "valid_to" = ` + versionTimeSQL + ` WHERE "osm_id" = $1 AND "valid_to" IS NULL`},
+		{spec.CreateCurrentViewSQL(), `CREATE VIEW "import"."osm_roads" AS SELECT * FROM "import"."osm_roads_history" WHERE "valid_to" IS NULL`},
+		{pg.MergedTables["roads_merged"].GroupSQL(), `SELECT "name" FROM "import"."osm_roads_history" WHERE "osm_id" = $1 AND "valid_to" IS NULL`},
+	} {
+		if tc.sql != tc.expected {
+			t.Errorf("unexpected SQL\n%s\nexpected\n%s", tc.sql, tc.expected)
+		}
+	}
+	for _, sql := range []string{
+		pg.GeneralizedTables["roads_gen"].InsertSQL(),
+		pg.generalizeTableSQL(pg.GeneralizedTables["roads_gen"]),
+		pg.MergedTables["roads_merged"].CreateTableSQL(),
+	} {
+		if !strings.Contains(sql, `"valid_to" IS NULL`) || !strings.Contains(sql, `"import"."osm_roads_history"`) {
+			t.Errorf("source rows not limited to current version\n%s", sql)
+		}
+	}
+	if view := pg.currentViewName("roads"); view != "osm_roads" {
+		t.Errorf("unexpected view %q", view)
+	}
+	if name := pg.fullTableName("roads"); name != "osm_roads_history" {
+		t.Errorf("unexpected table %q", name)
+	}
+	if name := pg.fullTableName("roads_gen"); name != "osm_roads_gen" {
+		t.Errorf("unexpected table %q", name)
+	}
+	if view := pg.currentViewName("roads_gen"); view != "" {
+		t.Errorf("unexpected view %q for generalized table", view)
+	}
+}
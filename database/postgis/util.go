@@ -93,6 +93,23 @@ func dropTableIfExists(tx *sql.Tx, schema, table string) error {
 	return nil
 }
 
+func viewExists(tx *sql.Tx, schema, view string) (bool, error) {
+	var exists bool
+	sqlStmt := `SELECT EXISTS(SELECT * FROM information_schema.views WHERE table_name=$1 AND table_schema=$2)`
+	if err := tx.QueryRow(sqlStmt, view, schema).Scan(&exists); err != nil {
+		return false, &SQLError{sqlStmt, err}
+	}
+	return exists, nil
+}
+
+func dropViewIfExists(tx *sql.Tx, schema, view string) error {
+	sqlStmt := fmt.Sprintf(`DROP VIEW IF EXISTS "%s"."%s"`, schema, view)
+	if _, err := tx.Exec(sqlStmt); err != nil {
+		return &SQLError{sqlStmt, err}
+	}
+	return nil
+}
+
 // rollbackIfTx rollsback transaction if tx is not nil.
 func rollbackIfTx(tx **sql.Tx) {
 	if *tx != nil {
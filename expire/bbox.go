@@ -0,0 +1,69 @@
+package expire
+
+import (
+	"math"
+	"sync"
+
+	osm "github.com/omniscale/go-osm"
+)
+
+// BBox collects the bounding box of all expired coordinates.
+type BBox struct {
+	mu sync.Mutex
+	b  bbox
+}
+
+func NewBBox() *BBox {
+	bb := &BBox{}
+	bb.Reset()
+	return bb
+}
+
+func (bb *BBox) Expire(long, lat float64) {
+	bb.ExpireNodes([]osm.Node{{Long: long, Lat: lat}}, false)
+}
+
+func (bb *BBox) ExpireNodes(nodes []osm.Node, closed bool) {
+	b := nodesBbox(nodes)
+	if b.isEmpty() {
+		return
+	}
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	bb.b.minx = math.Min(bb.b.minx, b.minx)
+	bb.b.miny = math.Min(bb.b.miny, b.miny)
+	bb.b.maxx = math.Max(bb.b.maxx, b.maxx)
+	bb.b.maxy = math.Max(bb.b.maxy, b.maxy)
+}
+
+// Bounds returns the bounding box as minx, miny, maxx, maxy. It returns
+// false if no coordinates were expired since the last Reset.
+func (bb *BBox) Bounds() ([4]float64, bool) {
+	bb.mu.Lock()
+	defer bb.mu.Unlock()
+	if bb.b.isEmpty() {
+		return [4]float64{}, false
+	}
+	return [4]float64{bb.b.minx, bb.b.miny, bb.b.maxx, bb.b.maxy}, true
+}
+
+func (bb *BBox) Reset() {
+	bb.mu.Lock()
+	bb.b = bbox{math.MaxFloat64, math.MaxFloat64, -math.MaxFloat64, -math.MaxFloat64}
+	bb.mu.Unlock()
+}
+
+// Multi passes all expired coordinates to each Expireor.
+type Multi []Expireor
+
+func (m Multi) Expire(long, lat float64) {
+	for _, e := range m {
+		e.Expire(long, lat)
+	}
+}
+
+func (m Multi) ExpireNodes(nodes []osm.Node, closed bool) {
+	for _, e := range m {
+		e.ExpireNodes(nodes, closed)
+	}
+}
@@ -0,0 +1,30 @@
+package expire
+
+import (
+	"testing"
+
+	osm "github.com/omniscale/go-osm"
+)
+
+func TestBBox(t *testing.T) {
+	bb := NewBBox()
+	if _, ok := bb.Bounds(); ok {
+		t.Fatal("expected empty bbox")
+	}
+	tl := NewTileList(14, "")
+	m := Multi{bb, tl}
+	m.Expire(8.3, 53.2)
+	m.ExpireNodes([]osm.Node{{Long: 8.1, Lat: 53.5}, {Long: 0, Lat: 0}, {Long: 8.2, Lat: 53.1}}, false)
+	b, ok := bb.Bounds()
+	if !ok || b != [4]float64{8.1, 53.1, 8.3, 53.5} {
+		t.Errorf("unexpected bbox %v", b)
+	}
+	if len(tl.tiles[14]) == 0 {
+		t.Error("tiles not expired")
+	}
+
+	bb.Reset()
+	if _, ok := bb.Bounds(); ok {
+		t.Error("expected empty bbox after reset")
+	}
+}
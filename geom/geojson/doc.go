@@ -1,4 +1,5 @@
 /*
-Package geojson creates GEOS geometries from GeoJSON files.
+Package geojson creates GEOS geometries from GeoJSON files and encodes
+(E)WKB geometries as GeoJSON.
 */
 package geojson
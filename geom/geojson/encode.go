@@ -0,0 +1,119 @@
+package geojson
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/omniscale/imposm3/geom"
+)
+
+// Transform converts the coordinates of a geometry, e.g. from EPSG:3857 to
+// EPSG:4326.
+type Transform func(x, y float64) (float64, float64)
+
+// AppendGeometry appends the GeoJSON geometry object of g to buf. The
+// coordinates are converted with transform (if not nil) and rounded to
+// precision decimal places (if not negative).
+func AppendGeometry(buf []byte, g *geom.WKBGeometry, transform Transform, precision int) []byte {
+	e := encoder{buf: buf, transform: transform, precision: precision}
+	e.geometry(g)
+	return e.buf
+}
+
+var geometryTypes = map[int]string{
+	geom.WKBPoint:              "Point",
+	geom.WKBLineString:         "LineString",
+	geom.WKBPolygon:            "Polygon",
+	geom.WKBMultiPoint:         "MultiPoint",
+	geom.WKBMultiLineString:    "MultiLineString",
+	geom.WKBMultiPolygon:       "MultiPolygon",
+	geom.WKBGeometryCollection: "GeometryCollection",
+}
+
+type encoder struct {
+	buf       []byte
+	transform Transform
+	precision int
+}
+
+func (e *encoder) geometry(g *geom.WKBGeometry) {
+	e.buf = append(e.buf, `{"type":"`...)
+	e.buf = append(e.buf, geometryTypes[g.Type]...)
+	if g.Type == geom.WKBGeometryCollection {
+		e.buf = append(e.buf, `","geometries":[`...)
+		for i, part := range g.Geometries {
+			if i > 0 {
+				e.buf = append(e.buf, ',')
+			}
+			e.geometry(part)
+		}
+		e.buf = append(e.buf, "]}"...)
+		return
+	}
+	e.buf = append(e.buf, `","coordinates":`...)
+	e.coordinates(g)
+	e.buf = append(e.buf, '}')
+}
+
+// coordinates appends the coordinates array of g.
+func (e *encoder) coordinates(g *geom.WKBGeometry) {
+	switch g.Type {
+	case geom.WKBPoint:
+		if len(g.Coords) == 0 {
+			e.buf = append(e.buf, "[]"...)
+			return
+		}
+		e.coord(g.Coords[0])
+	case geom.WKBLineString:
+		e.coordList(g.Coords)
+	case geom.WKBPolygon:
+		e.buf = append(e.buf, '[')
+		for i, ring := range g.Rings {
+			if i > 0 {
+				e.buf = append(e.buf, ',')
+			}
+			e.coordList(ring)
+		}
+		e.buf = append(e.buf, ']')
+	default:
+		e.buf = append(e.buf, '[')
+		for i, part := range g.Geometries {
+			if i > 0 {
+				e.buf = append(e.buf, ',')
+			}
+			e.coordinates(part)
+		}
+		e.buf = append(e.buf, ']')
+	}
+}
+
+func (e *encoder) coordList(coords []geom.Coord) {
+	e.buf = append(e.buf, '[')
+	for i, c := range coords {
+		if i > 0 {
+			e.buf = append(e.buf, ',')
+		}
+		e.coord(c)
+	}
+	e.buf = append(e.buf, ']')
+}
+
+func (e *encoder) coord(c geom.Coord) {
+	x, y := c.X, c.Y
+	if e.transform != nil {
+		x, y = e.transform(x, y)
+	}
+	e.buf = append(e.buf, '[')
+	e.float(x)
+	e.buf = append(e.buf, ',')
+	e.float(y)
+	e.buf = append(e.buf, ']')
+}
+
+func (e *encoder) float(v float64) {
+	if e.precision >= 0 {
+		p := math.Pow10(e.precision)
+		v = math.Round(v*p) / p
+	}
+	e.buf = strconv.AppendFloat(e.buf, v, 'f', -1, 64)
+}
@@ -0,0 +1,48 @@
+package geojson
+
+import (
+	"testing"
+
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/geom"
+)
+
+func TestAppendGeometry(t *testing.T) {
+	point := geom.NodeAsEWKBHexPoint(osm.Node{Long: 10.123456789, Lat: 53.5}, 4326)
+	line, err := geom.NodesAsEWKBHexLineString([]osm.Node{{Long: 1, Lat: 2}, {Long: 3, Lat: 4}}, 4326)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poly, err := geom.NodesAsEWKBHexPolygon([]osm.Node{{Long: 0, Lat: 0}, {Long: 1, Lat: 0}, {Long: 1, Lat: 1}, {Long: 0, Lat: 0}}, 4326)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		wkb       string
+		transform Transform
+		precision int
+		expected  string
+	}{
+		{string(point), nil, -1, `{"type":"Point","coordinates":[10.123456789,53.5]}`},
+		{string(point), nil, 4, `{"type":"Point","coordinates":[10.1235,53.5]}`},
+		{string(line), func(x, y float64) (float64, float64) { return x * 2, y * 2 }, -1,
+			`{"type":"LineString","coordinates":[[2,4],[6,8]]}`},
+		{string(poly), nil, -1, `{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}`},
+		// MULTIPOINT((1 2),(3 4)), big endian
+		{"0000000004000000020000000001" + "3FF00000000000004000000000000000" +
+			"0000000001" + "40080000000000004010000000000000", nil, -1,
+			`{"type":"MultiPoint","coordinates":[[1,2],[3,4]]}`},
+		// GEOMETRYCOLLECTION(POINT(1 2))
+		{"010700000001000000" + "0101000000000000000000F03F0000000000000040", nil, -1,
+			`{"type":"GeometryCollection","geometries":[{"type":"Point","coordinates":[1,2]}]}`},
+	} {
+		g, err := geom.DecodeEWKBHex([]byte(tc.wkb))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result := string(AppendGeometry(nil, g, tc.transform, tc.precision)); result != tc.expected {
+			t.Errorf("unexpected geometry %s != %s", result, tc.expected)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package geom
 
 import (
+	"encoding/hex"
 	"errors"
 	"math"
 
@@ -14,8 +15,30 @@ type GeometryError struct {
 }
 
 type Geometry struct {
+	// Geom is nil for geometries that were encoded without GEOS, use
+	// GeosGeom to read it.
 	Geom *geos.Geom
 	Wkb  []byte
+	// Part is the index of this geometry for subdivided geometries.
+	Part int
+}
+
+// GeosGeom returns the GEOS geometry. The geometry is created from the
+// (E)WKB with g, if the geometry was encoded without GEOS. Returns nil if
+// the WKB is invalid.
+func (geom *Geometry) GeosGeom(g *geos.Geos) *geos.Geom {
+	if geom.Geom != nil || len(geom.Wkb) == 0 {
+		return geom.Geom
+	}
+	wkb := make([]byte, hex.DecodedLen(len(geom.Wkb)))
+	if _, err := hex.Decode(wkb, geom.Wkb); err != nil {
+		return nil
+	}
+	geom.Geom = g.FromWkb(wkb)
+	if geom.Geom != nil {
+		g.DestroyLater(geom.Geom)
+	}
+	return geom.Geom
 }
 
 func (e *GeometryError) Error() string {
@@ -1,6 +1,7 @@
 package geom
 
 import (
+	"math"
 	"testing"
 
 	osm "github.com/omniscale/go-osm"
@@ -197,3 +198,57 @@ func TestUnduplicateNodes(t *testing.T) {
 	}
 
 }
+
+func TestSubdivide(t *testing.T) {
+	g := geos.NewGeos()
+	defer g.Finish()
+
+	// polygon with 41 vertices
+	var nodes []osm.Node
+	for i := 0; i <= 10; i++ {
+		nodes = append(nodes, osm.Node{Long: float64(i), Lat: 0})
+	}
+	for i := 1; i <= 10; i++ {
+		nodes = append(nodes, osm.Node{Long: 10, Lat: float64(i)})
+	}
+	for i := 9; i >= 0; i-- {
+		nodes = append(nodes, osm.Node{Long: float64(i), Lat: 10})
+	}
+	for i := 9; i >= 0; i-- {
+		nodes = append(nodes, osm.Node{Long: 0, Lat: float64(i)})
+	}
+	geom, err := Polygon(g, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts, err := Subdivide(g, geom, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) < 2 {
+		t.Fatalf("expected multiple parts, got %d", len(parts))
+	}
+	area := 0.0
+	for _, p := range parts {
+		if n := g.NumCoordinates(p); n > 16 {
+			t.Errorf("part with %d vertices", n)
+		}
+		area += p.Area()
+	}
+	if math.Abs(area-100) > 1e-9 {
+		t.Errorf("unexpected area of all parts %f", area)
+	}
+
+	parts, err = Subdivide(g, geom, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 {
+		t.Errorf("expected single part, got %d", len(parts))
+	}
+
+	if _, err := Subdivide(g, geom, 4); err == nil {
+		t.Error("expected error for small max_vertices")
+	}
+}
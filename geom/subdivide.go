@@ -0,0 +1,114 @@
+package geom
+
+import (
+	"errors"
+
+	"github.com/omniscale/imposm3/geom/geos"
+)
+
+// maxSubdivideDepth limits the recursion of Subdivide for geometries that
+// can't be split any further (e.g. many vertices at the same coordinate).
+const maxSubdivideDepth = 50
+
+// Subdivide splits geom into parts with at most maxVertices vertices each.
+// Polygons are split recursively at the center of the longer side of their
+// bounds. Returns geom as the only part if it has less vertices.
+// Returned parts are new allocated geometries, geom is not destroyed.
+func Subdivide(g *geos.Geos, geom *geos.Geom, maxVertices int) ([]*geos.Geom, error) {
+	if maxVertices < 8 {
+		return nil, errors.New("subdivide requires at least 8 vertices")
+	}
+	return subdivide(g, geom, maxVertices, 0), nil
+}
+
+func subdivide(g *geos.Geos, geom *geos.Geom, maxVertices int, depth int) []*geos.Geom {
+	if g.IsEmpty(geom) {
+		return nil
+	}
+	if int(g.NumCoordinates(geom)) <= maxVertices || depth > maxSubdivideDepth {
+		return []*geos.Geom{g.Clone(geom)}
+	}
+
+	geomType := g.Type(geom)
+	if geomType == "MultiPolygon" || geomType == "GeometryCollection" {
+		var result []*geos.Geom
+		for _, part := range g.Geoms(geom) {
+			result = append(result, subdivide(g, part, maxVertices, depth+1)...)
+		}
+		return result
+	}
+	if geomType != "Polygon" {
+		return []*geos.Geom{g.Clone(geom)}
+	}
+
+	bounds := geom.Bounds()
+	a, b := bounds, bounds
+	if bounds.MaxX-bounds.MinX >= bounds.MaxY-bounds.MinY {
+		center := bounds.MinX + (bounds.MaxX-bounds.MinX)/2
+		a.MaxX, b.MinX = center, center
+	} else {
+		center := bounds.MinY + (bounds.MaxY-bounds.MinY)/2
+		a.MaxY, b.MinY = center, center
+	}
+
+	var result []*geos.Geom
+	for _, half := range []geos.Bounds{a, b} {
+		clip := g.BoundsPolygon(half)
+		if clip == nil {
+			return []*geos.Geom{g.Clone(geom)}
+		}
+		part := g.Intersection(geom, clip)
+		g.Destroy(clip)
+		if part == nil {
+			return []*geos.Geom{g.Clone(geom)}
+		}
+		for _, p := range polygonParts(g, part) {
+			result = append(result, subdivide(g, p, maxVertices, depth+1)...)
+		}
+		g.Destroy(part)
+	}
+	return result
+}
+
+// polygonParts returns all polygons of geom. Intersections can result in
+// collections with lines or points where the polygon touches the clip bounds.
+func polygonParts(g *geos.Geos, geom *geos.Geom) []*geos.Geom {
+	switch g.Type(geom) {
+	case "Polygon":
+		return []*geos.Geom{geom}
+	case "MultiPolygon", "GeometryCollection":
+		var result []*geos.Geom
+		for _, part := range g.Geoms(geom) {
+			result = append(result, polygonParts(g, part)...)
+		}
+		return result
+	}
+	return nil
+}
+
+// SubdivideGeometry splits geom into parts with at most maxVertices
+// vertices (see Subdivide). Part is set to the index of each part.
+func SubdivideGeometry(g *geos.Geos, geom Geometry, maxVertices int) ([]Geometry, error) {
+	geosGeom := geom.GeosGeom(g)
+	if geosGeom == nil {
+		return nil, errors.New("missing geometry for subdivide")
+	}
+	if int(g.NumCoordinates(geosGeom)) <= maxVertices {
+		return []Geometry{geom}, nil
+	}
+	parts, err := Subdivide(g, geosGeom, maxVertices)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Geometry, 0, len(parts))
+	for i, p := range parts {
+		g.DestroyLater(p)
+		elem, err := AsGeomElement(g, p)
+		if err != nil {
+			return nil, err
+		}
+		elem.Part = i
+		result = append(result, elem)
+	}
+	return result, nil
+}
@@ -1,65 +1,368 @@
 package geom
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"math"
 
 	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/geom/geos"
 )
 
 const (
 	wkbSridFlag       = 0x20000000
+	wkbPointType      = 1
 	wkbLineStringType = 2
 	wkbPolygonType    = 3
+	wkbZFlag          = 0x80000000
+	wkbMFlag          = 0x40000000
 )
 
+// The EWKB functions encode geometries without GEOS. The hex output is
+// identical to the output of geos.AsEwkbHex.
+
+// NodeAsEWKBHexPoint returns the node as hex encoded (E)WKB point.
+func NodeAsEWKBHexPoint(node osm.Node, srid int) []byte {
+	w := newEWKBWriter(wkbPointType, srid, 16)
+	w.coord(node.Long, node.Lat)
+	return w.hex()
+}
+
+// NodesAsEWKBHexLineString returns the nodes as hex encoded (E)WKB
+// linestring. Duplicate nodes are removed.
 func NodesAsEWKBHexLineString(nodes []osm.Node, srid int) ([]byte, error) {
 	nodes = unduplicateNodes(nodes)
 	if len(nodes) < 2 {
 		return nil, ErrorOneNodeWay
 	}
-	buf := &bytes.Buffer{}
-	binary.Write(buf, binary.LittleEndian, uint8(1)) // little endian
-	if srid != 0 {
-		binary.Write(buf, binary.LittleEndian, uint32(wkbLineStringType|wkbSridFlag))
-		binary.Write(buf, binary.LittleEndian, uint32(srid))
-	} else {
-		binary.Write(buf, binary.LittleEndian, uint32(wkbLineStringType))
+	w := newEWKBWriter(wkbLineStringType, srid, 4+16*len(nodes))
+	w.uint32(uint32(len(nodes)))
+	for _, nd := range nodes {
+		w.coord(nd.Long, nd.Lat)
 	}
-	binary.Write(buf, binary.LittleEndian, uint32(len(nodes)))
+	return w.hex(), nil
+}
 
+func NodesAsEWKBHexPolygon(nodes []osm.Node, srid int) ([]byte, error) {
+	// TODO undup nodes and check if closed
+	w := newEWKBWriter(wkbPolygonType, srid, 8+16*len(nodes))
+	w.uint32(1) // one ring
+	w.uint32(uint32(len(nodes)))
 	for _, nd := range nodes {
-		binary.Write(buf, binary.LittleEndian, nd.Long)
-		binary.Write(buf, binary.LittleEndian, nd.Lat)
+		w.coord(nd.Long, nd.Lat)
 	}
+	return w.hex(), nil
+}
 
-	src := buf.Bytes()
-	dst := make([]byte, hex.EncodedLen(len(src)))
-	hex.Encode(dst, src)
-	return dst, nil
+// ewkbWriter encodes little endian (E)WKB into a preallocated buffer.
+type ewkbWriter struct {
+	buf []byte
 }
 
-func NodesAsEWKBHexPolygon(nodes []osm.Node, srid int) ([]byte, error) {
-	// TODO undup nodes and check if closed
-	buf := &bytes.Buffer{}
-	binary.Write(buf, binary.LittleEndian, uint8(1)) // little endian
+// newEWKBWriter writes the header for wkbType. size is the number of bytes
+// that follow the header.
+func newEWKBWriter(wkbType uint32, srid int, size int) *ewkbWriter {
+	w := &ewkbWriter{buf: make([]byte, 0, 9+size)}
+	w.buf = append(w.buf, 1) // little endian
 	if srid != 0 {
-		binary.Write(buf, binary.LittleEndian, uint32(wkbPolygonType|wkbSridFlag))
-		binary.Write(buf, binary.LittleEndian, uint32(srid))
+		w.uint32(wkbType | wkbSridFlag)
+		w.uint32(uint32(srid))
 	} else {
-		binary.Write(buf, binary.LittleEndian, uint32(wkbPolygonType))
+		w.uint32(wkbType)
 	}
-	binary.Write(buf, binary.LittleEndian, uint32(1)) // one ring
-	binary.Write(buf, binary.LittleEndian, uint32(len(nodes)))
+	return w
+}
 
-	for _, nd := range nodes {
-		binary.Write(buf, binary.LittleEndian, nd.Long)
-		binary.Write(buf, binary.LittleEndian, nd.Lat)
+func (w *ewkbWriter) uint32(v uint32) {
+	w.buf = binary.LittleEndian.AppendUint32(w.buf, v)
+}
+
+func (w *ewkbWriter) coord(x, y float64) {
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(x))
+	w.buf = binary.LittleEndian.AppendUint64(w.buf, math.Float64bits(y))
+}
+
+const hexDigits = "0123456789ABCDEF"
+
+// hex returns the upper case hex encoding of the buffer, like GEOS.
+func (w *ewkbWriter) hex() []byte {
+	dst := make([]byte, len(w.buf)*2)
+	for i, b := range w.buf {
+		dst[i*2] = hexDigits[b>>4]
+		dst[i*2+1] = hexDigits[b&0x0f]
+	}
+	return dst
+}
+
+var errInvalidWKB = errors.New("invalid wkb")
+
+// EWKBHexBounds returns the bounds of a hex encoded (E)WKB geometry,
+// without GEOS. Z and M values are ignored. Returns an error for empty
+// geometries.
+func EWKBHexBounds(wkbHex []byte) (geos.Bounds, error) {
+	buf := make([]byte, hex.DecodedLen(len(wkbHex)))
+	if _, err := hex.Decode(buf, wkbHex); err != nil {
+		return geos.Bounds{}, err
+	}
+	r := wkbBoundsReader{
+		wkbReader: wkbReader{buf: buf},
+		bounds:    geos.Bounds{MinX: math.Inf(1), MinY: math.Inf(1), MaxX: math.Inf(-1), MaxY: math.Inf(-1)},
+	}
+	if err := r.geometry(); err != nil {
+		return geos.Bounds{}, err
+	}
+	if r.bounds.MinX > r.bounds.MaxX {
+		return geos.Bounds{}, errors.New("empty geometry")
+	}
+	return r.bounds, nil
+}
+
+// wkbReader reads the values of a (E)WKB geometry.
+type wkbReader struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+func (r *wkbReader) uint32() (uint32, error) {
+	if len(r.buf) < 4 {
+		return 0, errInvalidWKB
+	}
+	v := r.order.Uint32(r.buf)
+	r.buf = r.buf[4:]
+	return v, nil
+}
+
+// header reads the byte order and the type of the next geometry. It
+// returns the type without flags and the number of dimensions of each
+// coordinate.
+func (r *wkbReader) header() (wkbType uint32, srid int, dims int, err error) {
+	if len(r.buf) < 1 {
+		return 0, 0, 0, errInvalidWKB
+	}
+	if r.buf[0] == 0 {
+		r.order = binary.BigEndian
+	} else {
+		r.order = binary.LittleEndian
+	}
+	r.buf = r.buf[1:]
+	wkbType, err = r.uint32()
+	if err != nil {
+		return 0, 0, 0, err
 	}
+	if wkbType&wkbSridFlag != 0 {
+		s, err := r.uint32()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		srid = int(s)
+	}
+	dims = 2
+	if wkbType&wkbZFlag != 0 {
+		dims++
+	}
+	if wkbType&wkbMFlag != 0 {
+		dims++
+	}
+	wkbType &^= wkbSridFlag | wkbZFlag | wkbMFlag
+	// ISO WKB types for Z (1000), M (2000) and ZM (3000)
+	switch wkbType / 1000 {
+	case 1, 2:
+		dims++
+	case 3:
+		dims += 2
+	}
+	wkbType %= 1000
+	return wkbType, srid, dims, nil
+}
+
+type wkbBoundsReader struct {
+	wkbReader
+	bounds geos.Bounds
+}
+
+func (r *wkbBoundsReader) coords(n uint32, dims int) error {
+	if uint64(len(r.buf)) < uint64(n)*uint64(dims)*8 {
+		return errInvalidWKB
+	}
+	for i := uint32(0); i < n; i++ {
+		x := math.Float64frombits(r.order.Uint64(r.buf))
+		y := math.Float64frombits(r.order.Uint64(r.buf[8:]))
+		r.buf = r.buf[dims*8:]
+		if math.IsNaN(x) || math.IsNaN(y) {
+			continue // empty point
+		}
+		r.bounds.MinX = math.Min(r.bounds.MinX, x)
+		r.bounds.MinY = math.Min(r.bounds.MinY, y)
+		r.bounds.MaxX = math.Max(r.bounds.MaxX, x)
+		r.bounds.MaxY = math.Max(r.bounds.MaxY, y)
+	}
+	return nil
+}
+
+func (r *wkbBoundsReader) geometry() error {
+	wkbType, _, dims, err := r.header()
+	if err != nil {
+		return err
+	}
+
+	switch wkbType {
+	case wkbPointType:
+		return r.coords(1, dims)
+	case wkbLineStringType:
+		n, err := r.uint32()
+		if err != nil {
+			return err
+		}
+		return r.coords(n, dims)
+	case wkbPolygonType:
+		rings, err := r.uint32()
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i < rings; i++ {
+			n, err := r.uint32()
+			if err != nil {
+				return err
+			}
+			if err := r.coords(n, dims); err != nil {
+				return err
+			}
+		}
+		return nil
+	case 4, 5, 6, 7: // multi geometries and collections
+		n, err := r.uint32()
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i < n; i++ {
+			if err := r.geometry(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errInvalidWKB
+}
+
+// WKB geometry types
+const (
+	WKBPoint              = wkbPointType
+	WKBLineString         = wkbLineStringType
+	WKBPolygon            = wkbPolygonType
+	WKBMultiPoint         = 4
+	WKBMultiLineString    = 5
+	WKBMultiPolygon       = 6
+	WKBGeometryCollection = 7
+)
 
-	src := buf.Bytes()
-	dst := make([]byte, hex.EncodedLen(len(src)))
-	hex.Encode(dst, src)
-	return dst, nil
+// Coord is a single x/y coordinate.
+type Coord struct {
+	X, Y float64
+}
+
+// WKBGeometry is a geometry decoded without GEOS. Z and M values are
+// dropped.
+type WKBGeometry struct {
+	// Type is one of the WKB geometry types (WKBPoint, etc.).
+	Type int
+	SRID int
+	// Coords of points (a single or no coordinate for empty points) and
+	// linestrings.
+	Coords []Coord
+	// Rings of polygons, starting with the exterior ring.
+	Rings [][]Coord
+	// Geometries of multi geometries and collections.
+	Geometries []*WKBGeometry
+}
+
+// DecodeEWKBHex decodes a hex encoded (E)WKB geometry without GEOS.
+func DecodeEWKBHex(wkbHex []byte) (*WKBGeometry, error) {
+	buf := make([]byte, hex.DecodedLen(len(wkbHex)))
+	if _, err := hex.Decode(buf, wkbHex); err != nil {
+		return nil, err
+	}
+	return DecodeEWKB(buf)
+}
+
+// DecodeEWKB decodes a binary (E)WKB geometry without GEOS.
+func DecodeEWKB(wkb []byte) (*WKBGeometry, error) {
+	r := wkbDecoder{wkbReader{buf: wkb}}
+	return r.geometry()
+}
+
+type wkbDecoder struct {
+	wkbReader
+}
+
+func (r *wkbDecoder) coords(n uint32, dims int) ([]Coord, error) {
+	if uint64(len(r.buf)) < uint64(n)*uint64(dims)*8 {
+		return nil, errInvalidWKB
+	}
+	coords := make([]Coord, 0, n)
+	for i := uint32(0); i < n; i++ {
+		x := math.Float64frombits(r.order.Uint64(r.buf))
+		y := math.Float64frombits(r.order.Uint64(r.buf[8:]))
+		r.buf = r.buf[dims*8:]
+		coords = append(coords, Coord{x, y})
+	}
+	return coords, nil
+}
+
+func (r *wkbDecoder) geometry() (*WKBGeometry, error) {
+	wkbType, srid, dims, err := r.header()
+	if err != nil {
+		return nil, err
+	}
+	g := &WKBGeometry{Type: int(wkbType), SRID: srid}
+
+	switch wkbType {
+	case wkbPointType:
+		g.Coords, err = r.coords(1, dims)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(g.Coords[0].X) || math.IsNaN(g.Coords[0].Y) {
+			g.Coords = nil // empty point
+		}
+		return g, nil
+	case wkbLineStringType:
+		n, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		g.Coords, err = r.coords(n, dims)
+		return g, err
+	case wkbPolygonType:
+		rings, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < rings; i++ {
+			n, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+			ring, err := r.coords(n, dims)
+			if err != nil {
+				return nil, err
+			}
+			g.Rings = append(g.Rings, ring)
+		}
+		return g, nil
+	case WKBMultiPoint, WKBMultiLineString, WKBMultiPolygon, WKBGeometryCollection:
+		n, err := r.uint32()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < n; i++ {
+			part, err := r.geometry()
+			if err != nil {
+				return nil, err
+			}
+			g.Geometries = append(g.Geometries, part)
+		}
+		return g, nil
+	}
+	return nil, errInvalidWKB
 }
@@ -36,6 +36,68 @@ func TestWkbLineString(t *testing.T) {
 	}
 }
 
+func TestWkbPoint(t *testing.T) {
+	for _, tc := range []struct {
+		node osm.Node
+		srid int
+		wkb  string
+	}{
+		{osm.Node{Long: 1, Lat: 2}, 0, "0101000000000000000000F03F0000000000000040"},
+		{osm.Node{Long: 1, Lat: 2}, 4326, "0101000020E6100000000000000000F03F0000000000000040"},
+		{osm.Node{Long: -0.5, Lat: 0}, 3857, "0101000020110F0000000000000000E0BF0000000000000000"},
+	} {
+		if wkb := string(NodeAsEWKBHexPoint(tc.node, tc.srid)); wkb != tc.wkb {
+			t.Errorf("unexpected wkb for %v: %s != %s", tc.node, wkb, tc.wkb)
+		}
+	}
+}
+
+func TestWkbLineStringDuplicateNodes(t *testing.T) {
+	nodes := []osm.Node{{Long: 1, Lat: 2}, {Long: 1, Lat: 2}}
+	if _, err := NodesAsEWKBHexLineString(nodes, 4326); err != ErrorOneNodeWay {
+		t.Errorf("expected ErrorOneNodeWay, got %v", err)
+	}
+	nodes = append(nodes, osm.Node{Long: 0, Lat: 0})
+	wkb, err := NodesAsEWKBHexLineString(nodes, 4326)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "0102000020E610000002000000000000000000F03F000000000000004000000000000000000000000000000000"
+	if string(wkb) != expected {
+		t.Errorf("unexpected wkb: %s != %s", wkb, expected)
+	}
+}
+
+func TestEWKBHexBounds(t *testing.T) {
+	nodes := []osm.Node{{Long: 1, Lat: 2}, {Long: -3, Lat: 5}, {Long: 4, Lat: -1}, {Long: 1, Lat: 2}}
+	line, _ := NodesAsEWKBHexLineString(nodes, 4326)
+	poly, _ := NodesAsEWKBHexPolygon(nodes, 0)
+	for _, wkb := range [][]byte{line, poly} {
+		bounds, err := EWKBHexBounds(wkb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bounds != (geos.Bounds{MinX: -3, MinY: -1, MaxX: 4, MaxY: 5}) {
+			t.Errorf("unexpected bounds %v", bounds)
+		}
+	}
+
+	// MULTIPOINT Z ((1 2 3), (4 5 6)) as big endian EWKB
+	bounds, err := EWKBHexBounds([]byte("00A0000004000010E600000002" +
+		"00800000013FF000000000000040000000000000004008000000000000" +
+		"0080000001401000000000000040140000000000004018000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounds != (geos.Bounds{MinX: 1, MinY: 2, MaxX: 4, MaxY: 5}) {
+		t.Errorf("unexpected bounds %v", bounds)
+	}
+
+	if _, err := EWKBHexBounds([]byte("0102000000")); err == nil {
+		t.Error("expected error for truncated wkb")
+	}
+}
+
 func TestWkbPolygon(t *testing.T) {
 	nodes := make([]osm.Node, 5)
 	nodes[0] = osm.Node{Lat: 1.123, Long: -0.2}
@@ -86,3 +148,38 @@ func BenchmarkAsWkbSrid(b *testing.B) {
 		g.AsEwkbHex(p)
 	}
 }
+
+func TestDecodeEWKBHex(t *testing.T) {
+	wkb, err := NodesAsEWKBHexLineString([]osm.Node{{Long: 1, Lat: 2}, {Long: 3, Lat: 4}}, 3857)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := DecodeEWKBHex(wkb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Type != WKBLineString || g.SRID != 3857 || len(g.Coords) != 2 || g.Coords[1] != (Coord{3, 4}) {
+		t.Errorf("unexpected geometry %#v", g)
+	}
+
+	// MULTIPOLYGON Z with a single polygon
+	g, err = DecodeEWKBHex([]byte("01EE030000" + "01000000" +
+		"01EB030000" + "01000000" + "04000000" +
+		"000000000000000000000000000000000000000000000000" +
+		"000000000000F03F00000000000000000000000000000000" +
+		"000000000000F03F000000000000F03F0000000000000000" +
+		"000000000000000000000000000000000000000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Type != WKBMultiPolygon || len(g.Geometries) != 1 || len(g.Geometries[0].Rings[0]) != 4 ||
+		g.Geometries[0].Rings[0][2] != (Coord{1, 1}) {
+		t.Errorf("unexpected geometry %#v", g)
+	}
+
+	for _, invalid := range []string{"", "0102000000", "010200000002000000000000000000F03F", "0109000000"} {
+		if _, err := DecodeEWKBHex([]byte(invalid)); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
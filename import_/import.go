@@ -11,6 +11,10 @@ import (
 	"github.com/omniscale/imposm3/cache"
 	"github.com/omniscale/imposm3/config"
 	"github.com/omniscale/imposm3/database"
+	_ "github.com/omniscale/imposm3/database/flatgeobuf"
+	_ "github.com/omniscale/imposm3/database/geojsonseq"
+	_ "github.com/omniscale/imposm3/database/memory"
+	_ "github.com/omniscale/imposm3/database/pmtiles"
 	_ "github.com/omniscale/imposm3/database/postgis"
 	"github.com/omniscale/imposm3/geom/limit"
 	"github.com/omniscale/imposm3/log"
@@ -64,6 +68,10 @@ func Import(importOpts config.Import) {
 			ImportSchema:     baseOpts.Schemas.Import,
 			ProductionSchema: baseOpts.Schemas.Production,
 			BackupSchema:     baseOpts.Schemas.Backup,
+			SortOrder:        importOpts.SortOrder,
+			SortDir:          filepath.Join(baseOpts.CacheDir, "sort"),
+			BrinIndex:        importOpts.BrinIndex,
+			CopyFormat:       importOpts.CopyFormat,
 		}
 		db, err = database.Open(conf, &tagmapping.Conf)
 		if err != nil {
@@ -157,7 +165,10 @@ func Import(importOpts config.Import) {
 		}
 
 		var diffCache *cache.DiffCache
-		if importOpts.Diff {
+		// parent_way_tags columns require the node to way references
+		// of the diff cache
+		parentWayTags := tagmapping.HasParentWayTags()
+		if importOpts.Diff || parentWayTags {
 			diffCache = cache.NewDiffCache(baseOpts.CacheDir)
 			if err = diffCache.Remove(); err != nil {
 				log.Fatal(err)
@@ -174,6 +185,7 @@ func Import(importOpts config.Import) {
 		if diffCache != nil {
 			diffCache.Coords.SetLinearImport(true)
 			diffCache.Ways.SetLinearImport(true)
+			diffCache.Relations.SetLinearImport(true)
 		}
 		osmCache.Coords.SetReadOnly(true)
 
@@ -200,16 +212,23 @@ func Import(importOpts config.Import) {
 			progress,
 			tagmapping.PolygonMatcher,
 			tagmapping.LineStringMatcher,
+			tagmapping.AddressInterpolationMatcher,
 			baseOpts.Srid,
 		)
 		wayWriter.SetLimiter(geometryLimiter)
+		wayWriter.SetParentWayKeys(tagmapping.ParentWayTagKeys())
 		wayWriter.EnableConcurrent()
 		wayWriter.Start()
 		wayWriter.Wait() // blocks till the Ways.Iter() finishes
-		osmCache.Ways.Close()
+		if parentWayTags {
+			// node writer requires ways and the node to way references
+			diffCache.Coords.SetLinearImport(false)
+		} else {
+			osmCache.Ways.Close()
+		}
 
 		nodes := osmCache.Nodes.Iter()
-		nodeWriter := writer.NewNodeWriter(osmCache, nodes, db,
+		nodeWriter := writer.NewNodeWriter(osmCache, diffCache, nodes, db,
 			progress,
 			tagmapping.PointMatcher,
 			baseOpts.Srid,
@@ -227,7 +246,7 @@ func Import(importOpts config.Import) {
 
 		progress.Stop()
 
-		if importOpts.Diff {
+		if diffCache != nil {
 			diffCache.Close()
 		}
 
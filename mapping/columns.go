@@ -11,6 +11,7 @@ import (
 	"github.com/omniscale/imposm3/log"
 
 	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/geom/geos"
 	"github.com/omniscale/imposm3/mapping/config"
 	"github.com/pkg/errors"
 )
@@ -31,8 +32,11 @@ func init() {
 		"member_role":          {"member_role", "string", nil, nil, RelationMemberRole, true},
 		"member_type":          {"member_type", "int8", nil, nil, RelationMemberType, true},
 		"member_index":         {"member_index", "int32", nil, nil, RelationMemberIndex, true},
+		"member_parent_id":     {"member_parent_id", "int64", nil, nil, RelationMemberParentID, true},
+		"member_path":          {"member_path", "string", nil, nil, RelationMemberPath, true},
 		"geometry":             {"geometry", "geometry", Geometry, nil, nil, false},
 		"validated_geometry":   {"validated_geometry", "validated_geometry", Geometry, nil, nil, false},
+		"part":                 {"part", "int32", Part, nil, nil, false},
 		"hstore_tags":          {"hstore_tags", "hstore_string", nil, MakeHStoreString, nil, false},
 		"wayzorder":            {"wayzorder", "int32", nil, MakeWayZOrder, nil, false},
 		"pseudoarea":           {"pseudoarea", "float32", nil, MakePseudoArea, nil, false},
@@ -42,6 +46,7 @@ func init() {
 		"enumerate":            {"enumerate", "int32", nil, MakeEnumerate, nil, false},
 		"expression":           {"expression", "string", nil, MakeExpression, nil, false},
 		"string_suffixreplace": {"string_suffixreplace", "string", nil, MakeSuffixReplace, nil, false},
+		"parent_way_tags":      {"parent_way_tags", "string", nil, MakeParentWayTags, nil, false},
 
 		"categorize_int":             {Name: "categorize_int", GoType: "int32", MakeFunc: MakeCategorizeInt},
 		"geojson_intersects":         {Name: "geojson_intersects", GoType: "bool", MakeFunc: MakeIntersectsField},
@@ -50,7 +55,7 @@ func init() {
 }
 
 type MakeValue func(string, *osm.Element, *geom.Geometry, Match) interface{}
-type MakeMemberValue func(*osm.Relation, *osm.Member, int, Match) interface{}
+type MakeMemberValue func(*osm.Relation, *osm.Member, int, []int64, Match) interface{}
 
 type MakeMakeValue func(string, ColumnType, config.Column) (MakeValue, error)
 
@@ -121,22 +126,42 @@ func MakeMappingValue(columnName string, columnType ColumnType, column config.Co
 	}, nil
 }
 
-func RelationMemberType(rel *osm.Relation, member *osm.Member, memberIndex int, match Match) interface{} {
+func RelationMemberType(rel *osm.Relation, member *osm.Member, memberIndex int, parents []int64, match Match) interface{} {
 	return member.Type
 }
 
-func RelationMemberRole(rel *osm.Relation, member *osm.Member, memberIndex int, match Match) interface{} {
+func RelationMemberRole(rel *osm.Relation, member *osm.Member, memberIndex int, parents []int64, match Match) interface{} {
 	return member.Role
 }
 
-func RelationMemberID(rel *osm.Relation, member *osm.Member, memberIndex int, match Match) interface{} {
+func RelationMemberID(rel *osm.Relation, member *osm.Member, memberIndex int, parents []int64, match Match) interface{} {
 	return member.ID
 }
 
-func RelationMemberIndex(rel *osm.Relation, member *osm.Member, memberIndex int, match Match) interface{} {
+func RelationMemberIndex(rel *osm.Relation, member *osm.Member, memberIndex int, parents []int64, match Match) interface{} {
 	return memberIndex
 }
 
+// RelationMemberParentID returns the ID of the relation that contains the
+// member directly. This is the matched relation itself, unless the members
+// are flattened.
+func RelationMemberParentID(rel *osm.Relation, member *osm.Member, memberIndex int, parents []int64, match Match) interface{} {
+	if len(parents) == 0 {
+		return nil
+	}
+	return parents[len(parents)-1]
+}
+
+// RelationMemberPath returns the IDs of all relations from the matched
+// relation down to the member, separated by slashes (e.g. 100911/100901).
+func RelationMemberPath(rel *osm.Relation, member *osm.Member, memberIndex int, parents []int64, match Match) interface{} {
+	path := make([]string, len(parents))
+	for i, id := range parents {
+		path[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(path, "/")
+}
+
 func Direction(val string, elem *osm.Element, geom *geom.Geometry, match Match) interface{} {
 	if val == "1" || val == "yes" || val == "true" {
 		return 1
@@ -151,16 +176,22 @@ func Geometry(val string, elem *osm.Element, geom *geom.Geometry, match Match) i
 	return string(geom.Wkb)
 }
 
+// Part returns the index of the geometry part for subdivided geometries.
+func Part(val string, elem *osm.Element, geom *geom.Geometry, match Match) interface{} {
+	return geom.Part
+}
+
 func MakePseudoArea(columnName string, columnType ColumnType, column config.Column) (MakeValue, error) {
 	log.Println("[warn] pseudoarea type is deprecated and will be removed. See area and webmerc_area type.")
 	return Area, nil
 }
 
 func Area(val string, elem *osm.Element, geom *geom.Geometry, match Match) interface{} {
-	if geom.Geom == nil {
+	geosGeom := geosGeom(geom)
+	if geosGeom == nil {
 		return nil
 	}
-	area := geom.Geom.Area()
+	area := geosGeom.Area()
 	if area == 0.0 {
 		return nil
 	}
@@ -168,15 +199,16 @@ func Area(val string, elem *osm.Element, geom *geom.Geometry, match Match) inter
 }
 
 func WebmercArea(val string, elem *osm.Element, geom *geom.Geometry, match Match) interface{} {
-	if geom.Geom == nil {
+	geosGeom := geosGeom(geom)
+	if geosGeom == nil {
 		return nil
 	}
-	area := geom.Geom.Area()
+	area := geosGeom.Area()
 	if area == 0.0 {
 		return nil
 	}
 
-	bounds := geom.Geom.Bounds()
+	bounds := geosGeom.Bounds()
 	midY := bounds.MinY + (bounds.MaxY-bounds.MinY)/2
 
 	pole := 6378137 * math.Pi // 20037508.342789244
@@ -383,6 +415,10 @@ type columnExprEnv struct {
 	Key   string            `expr:"key"`
 	Value string            `expr:"value"`
 	Tag   string            `expr:"tag"`
+	elementExprEnv
+	// Role and Index of the member for relation_member tables.
+	Role  string `expr:"role"`
+	Index int    `expr:"index"`
 }
 
 func MakeExpression(columnName string, columnType ColumnType, column config.Column) (MakeValue, error) {
@@ -400,15 +436,28 @@ func MakeExpression(columnName string, columnType ColumnType, column config.Colu
 	if err != nil {
 		return nil, errors.Wrapf(err, "invalid expression for column %s", columnName)
 	}
+	needsGeometry := usesIdentifiers(program, geometryExprIdentifiers)
 
 	expressionValue := func(val string, elem *osm.Element, geom *geom.Geometry, match Match) interface{} {
-		result, err := expr.Run(program, columnExprEnv{
+		env := columnExprEnv{
 			Tags:  elem.Tags,
 			ID:    elem.ID,
 			Key:   match.Key,
 			Value: match.Value,
 			Tag:   val,
-		})
+		}
+		env.Type = match.elementType
+		env.Closed = match.closed
+		if match.member != nil {
+			env.Role = match.member.Role
+			env.Index = match.memberIndex
+		}
+		if needsGeometry && geom != nil {
+			g := geometryTransformPool.Get().(*geos.Geos)
+			env.setGeometry(g, geom.GeosGeom(g))
+			geometryTransformPool.Put(g)
+		}
+		result, err := expr.Run(program, env)
 		if err != nil {
 			return nil
 		}
@@ -483,3 +532,81 @@ func MakeSuffixReplace(columnName string, columnType ColumnType, column config.C
 
 	return suffixReplace, nil
 }
+
+// MakeParentWayTags returns the value of the key from all ways that
+// reference the node (see Match.SetParentWays). The aggregation arg defines
+// how values of multiple ways are combined: join (all distinct values
+// separated by semicolon, default), first (value of the way with the lowest
+// ID), min or max (numeric if all values are numbers).
+func MakeParentWayTags(columnName string, columnType ColumnType, column config.Column) (MakeValue, error) {
+	key := string(column.Key)
+	if key == "" {
+		return nil, errors.New("missing key for parent_way_tags")
+	}
+	aggregation := "join"
+	if v, ok := column.Args["aggregation"]; ok {
+		aggregation, ok = v.(string)
+		if !ok {
+			return nil, errors.New("aggregation in args for parent_way_tags not a string")
+		}
+	}
+	switch aggregation {
+	case "join", "first", "min", "max":
+	default:
+		return nil, errors.Errorf("unknown aggregation %q for parent_way_tags", aggregation)
+	}
+
+	parentWayTags := func(val string, elem *osm.Element, geom *geom.Geometry, match Match) interface{} {
+		var values []string
+		for _, w := range match.parentWays {
+			if v := w.Tags[key]; v != "" {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			return nil
+		}
+		switch aggregation {
+		case "first":
+			return values[0]
+		case "min":
+			return aggregateValues(values, func(a, b float64) bool { return a < b }, func(a, b string) bool { return a < b })
+		case "max":
+			return aggregateValues(values, func(a, b float64) bool { return a > b }, func(a, b string) bool { return a > b })
+		}
+		seen := make(map[string]struct{}, len(values))
+		distinct := values[:0:0]
+		for _, v := range values {
+			if _, ok := seen[v]; !ok {
+				seen[v] = struct{}{}
+				distinct = append(distinct, v)
+			}
+		}
+		return strings.Join(distinct, ";")
+	}
+
+	return parentWayTags, nil
+}
+
+// aggregateValues returns the value for which better returns true compared
+// to all other values. Values are compared as numbers if all values are
+// numeric.
+func aggregateValues(values []string, betterNum func(a, b float64) bool, betterStr func(a, b string) bool) string {
+	nums := make([]float64, len(values))
+	numeric := true
+	for i, v := range values {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			numeric = false
+			break
+		}
+		nums[i] = f
+	}
+	result := 0
+	for i := 1; i < len(values); i++ {
+		if numeric && betterNum(nums[i], nums[result]) || !numeric && betterStr(values[i], values[result]) {
+			result = i
+		}
+	}
+	return values[result]
+}
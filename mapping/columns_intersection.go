@@ -85,12 +85,16 @@ func MakeIntersectsFeatureField(fieldName string, fieldType ColumnType, field co
 	g := geos.NewGeos()
 
 	makeValue := func(val string, elem *osm.Element, geom *geom.Geometry, m Match) interface{} {
-		indices := g.IndexQuery(idx, geom.Geom)
+		geosGeom := geom.GeosGeom(g)
+		if geosGeom == nil {
+			return nil
+		}
+		indices := g.IndexQuery(idx, geosGeom)
 
 		for _, idx := range indices {
 			preparedGeom := &preparedGeoms[idx]
 			preparedGeom.Lock()
-			if g.PreparedIntersects(preparedGeom.geom, geom.Geom) {
+			if g.PreparedIntersects(preparedGeom.geom, geosGeom) {
 				if v, ok := features[idx].properties[propertyName]; ok {
 					preparedGeom.Unlock()
 					return v
@@ -113,12 +117,16 @@ func MakeIntersectsField(fieldName string, fieldType ColumnType, field config.Co
 	g := geos.NewGeos()
 
 	makeValue := func(val string, elem *osm.Element, geom *geom.Geometry, m Match) interface{} {
-		indices := g.IndexQuery(idx, geom.Geom)
+		geosGeom := geom.GeosGeom(g)
+		if geosGeom == nil {
+			return nil
+		}
+		indices := g.IndexQuery(idx, geosGeom)
 
 		for _, idx := range indices {
 			preparedGeom := &preparedGeoms[idx]
 			preparedGeom.Lock()
-			if g.PreparedIntersects(preparedGeom.geom, geom.Geom) {
+			if g.PreparedIntersects(preparedGeom.geom, geosGeom) {
 				preparedGeom.Unlock()
 				return true
 			}
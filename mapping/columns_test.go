@@ -305,6 +305,106 @@ func TestMakeSuffixReplace(t *testing.T) {
 	}
 }
 
+func TestRelationMemberParent(t *testing.T) {
+	rel := &osm.Relation{Element: osm.Element{ID: 100911}}
+	member := &osm.Member{ID: 100501, Type: osm.WayMember}
+
+	if result := RelationMemberParentID(rel, member, 0, []int64{100911}, Match{}); result != int64(100911) {
+		t.Error(result)
+	}
+	if result := RelationMemberParentID(rel, member, 0, []int64{100911, 100901}, Match{}); result != int64(100901) {
+		t.Error(result)
+	}
+	if result := RelationMemberParentID(rel, member, 0, nil, Match{}); result != nil {
+		t.Error(result)
+	}
+
+	if result := RelationMemberPath(rel, member, 0, []int64{100911}, Match{}); result != "100911" {
+		t.Error(result)
+	}
+	if result := RelationMemberPath(rel, member, 0, []int64{100911, 100901}, Match{}); result != "100911/100901" {
+		t.Error(result)
+	}
+}
+
+func TestMakeParentWayTags(t *testing.T) {
+	ways := []*osm.Way{
+		{Element: osm.Element{ID: 1, Tags: osm.Tags{"highway": "footway", "layer": "1"}}},
+		{Element: osm.Element{ID: 2, Tags: osm.Tags{"highway": "primary", "layer": "-1"}}},
+		{Element: osm.Element{ID: 3, Tags: osm.Tags{"highway": "footway", "layer": "10"}}},
+		{Element: osm.Element{ID: 4, Tags: osm.Tags{"name": "Main St"}}},
+	}
+	match := Match{parentWays: ways}
+
+	for _, tc := range []struct {
+		key         string
+		aggregation string
+		expected    interface{}
+	}{
+		{"highway", "", "footway;primary"},
+		{"highway", "first", "footway"},
+		{"highway", "max", "primary"},
+		{"layer", "min", "-1"},
+		{"layer", "max", "10"},
+		{"bridge", "", nil},
+	} {
+		column := config.Column{Name: "parent", Key: config.Key(tc.key), Type: "parent_way_tags"}
+		if tc.aggregation != "" {
+			column.Args = map[string]interface{}{"aggregation": tc.aggregation}
+		}
+		parentWayTags, err := MakeParentWayTags("parent", ColumnType{}, column)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result := parentWayTags("", nil, nil, match); result != tc.expected {
+			t.Errorf("unexpected result %v for %s/%s, expected %v", result, tc.key, tc.aggregation, tc.expected)
+		}
+	}
+
+	if _, err := MakeParentWayTags("parent", ColumnType{}, config.Column{Name: "parent", Type: "parent_way_tags"}); err == nil {
+		t.Error("expected error for missing key")
+	}
+	if _, err := MakeParentWayTags("parent", ColumnType{}, config.Column{Name: "parent", Key: "highway", Type: "parent_way_tags",
+		Args: map[string]interface{}{"aggregation": "sum"}}); err == nil {
+		t.Error("expected error for unknown aggregation")
+	}
+}
+
+func TestParentWayTagKeys(t *testing.T) {
+	m, err := New([]byte(`
+    tables:
+      crossings:
+        type: point
+        columns:
+        - {name: osm_id, type: id}
+        - {name: highway, type: parent_way_tags, key: highway}
+        - {name: layer, type: parent_way_tags, key: layer, args: {aggregation: max}}
+        - {name: highway_first, type: parent_way_tags, key: highway, args: {aggregation: first}}
+        mapping:
+          highway: [crossing]
+      roads:
+        type: linestring
+        columns:
+        - {name: osm_id, type: id}
+        mapping:
+          highway: [primary]
+    `))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := m.ParentWayTagKeys()
+	if len(keys) != 2 || keys[0] != "highway" || keys[1] != "layer" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	// footways are not inserted, but they are parent ways of their nodes
+	if !keys.Match(osm.Tags{"highway": "footway"}) {
+		t.Error("way with highway tag not matched")
+	}
+	if keys.Match(osm.Tags{"building": "yes"}) {
+		t.Error("way without parent way tags matched")
+	}
+}
+
 func TestHstoreString(t *testing.T) {
 	column := config.Column{
 		Name: "tags",
@@ -375,6 +475,36 @@ func TestMakeExpression(t *testing.T) {
 	}
 }
 
+func TestMakeExpressionElementContext(t *testing.T) {
+	column := config.Column{
+		Name: "expr",
+		Type: "expression",
+		Args: map[string]interface{}{"expression": `type + "-" + string(closed) + "-" + role + "-" + string(index)`},
+	}
+	expressionValue, err := MakeExpression("expr", ColumnType{}, column)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	elem := &osm.Element{
+		ID:   42,
+		Tags: osm.Tags{"name": "Court"},
+	}
+	match := Match{Key: "sport", Value: "tennis", elementType: "way", closed: true}
+	result := expressionValue("", elem, nil, match)
+	if result != "way-true--0" {
+		t.Errorf("unexpected expression result: %v", result)
+	}
+
+	match = Match{Key: "type", Value: "route", elementType: "relation", closed: true}
+	match.member = &osm.Member{Role: "stop"}
+	match.memberIndex = 2
+	result = expressionValue("", &osm.Element{ID: 1}, nil, match)
+	if result != "relation-true-stop-2" {
+		t.Errorf("unexpected expression result: %v", result)
+	}
+}
+
 func TestMakeExpressionInvalidArgs(t *testing.T) {
 	_, err := MakeExpression("expr", ColumnType{}, config.Column{
 		Name: "expr",
@@ -393,6 +523,16 @@ func TestMakeExpressionInvalidArgs(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected error for non-string expression")
 	}
+
+	// metadata of elements is not loaded
+	_, err = MakeExpression("expr", ColumnType{}, config.Column{
+		Name: "expr",
+		Type: "expression",
+		Args: map[string]interface{}{"expression": `version > 1`},
+	})
+	if err == nil {
+		t.Fatal("expected error for unknown variable")
+	}
 }
 
 func TestMakeExpressionNonStringResult(t *testing.T) {
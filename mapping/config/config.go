@@ -9,8 +9,12 @@ import (
 type Mapping struct {
 	Tables            Tables            `yaml:"tables"`
 	GeneralizedTables GeneralizedTables `yaml:"generalized_tables"`
+	MergedTables      MergedTables      `yaml:"merged_tables"`
 	Tags              Tags              `yaml:"tags"`
 	Areas             Areas             `yaml:"areas"`
+	// TagRewrites normalize the tags of all elements before they are
+	// filtered and matched.
+	TagRewrites []*TagRewrite `yaml:"tag_rewrites"`
 	// SingleIDSpace mangles the overlapping node/way/relation IDs
 	// to be unique (nodes positive, ways negative, relations negative -1e17)
 	SingleIDSpace bool `yaml:"use_single_id_space"`
@@ -42,6 +46,29 @@ type Table struct {
 	RelationTypes []string              `yaml:"relation_types"`
 	Comment       string                `yaml:"_comment"`
 	MultiValues   []Key                 `yaml:"multi_values"`
+	// FlattenMembers expands members of type relation recursively into
+	// their node and way members (only for relation_member tables).
+	FlattenMembers bool `yaml:"flatten_members"`
+	// Subdivide splits large polygons into multiple rows.
+	Subdivide *Subdivide `yaml:"subdivide"`
+	// ParallelCopy is the number of parallel COPY streams for bulk
+	// imports. Imposm chooses the number if it is not set.
+	ParallelCopy int `yaml:"parallel_copy"`
+	// Zoom is the range of zoom levels of the layer for vector tile
+	// outputs.
+	Zoom *Zoom `yaml:"zoom"`
+	// History keeps previous versions of all rows with valid_from and
+	// valid_to timestamps, instead of deleting them during diff imports.
+	History bool `yaml:"history"`
+}
+
+type Zoom struct {
+	Min int `yaml:"min"`
+	Max int `yaml:"max"`
+}
+
+type Subdivide struct {
+	MaxVertices int `yaml:"max_vertices"`
 }
 
 type GeneralizedTables map[string]*GeneralizedTable
@@ -52,6 +79,15 @@ type GeneralizedTable struct {
 	SQLFilter       string  `yaml:"sql_filter"`
 }
 
+type MergedTables map[string]*MergedTable
+type MergedTable struct {
+	Name            string
+	SourceTableName string   `yaml:"source"`
+	GroupBy         []string `yaml:"group_by"`
+	Tolerance       float64  `yaml:"tolerance"`
+	SQLFilter       string   `yaml:"sql_filter"`
+}
+
 type Filters struct {
 	ExcludeTags   *[][]string    `yaml:"exclude_tags"`
 	Reject        KeyValues      `yaml:"reject"`
@@ -59,6 +95,40 @@ type Filters struct {
 	RejectRegexp  KeyRegexpValue `yaml:"reject_regexp"`
 	RequireRegexp KeyRegexpValue `yaml:"require_regexp"`
 	Filter        string         `yaml:"filter"`
+	// Member filters are only valid for relation_member tables.
+	MemberRoles        []string `yaml:"member_roles"`
+	ExcludeMemberRoles []string `yaml:"exclude_member_roles"`
+	MemberTypes        []string `yaml:"member_types"`
+	MemberFilter       string   `yaml:"member_filter"`
+	// Geometry filters are evaluated after the geometry was built.
+	MinArea        float64 `yaml:"min_area"`
+	MaxArea        float64 `yaml:"max_area"`
+	MinLength      float64 `yaml:"min_length"`
+	MaxVertices    int     `yaml:"max_vertices"`
+	GeometryFilter string  `yaml:"geometry_filter"`
+}
+
+// TagRewrite is a single rewrite rule. Each rule requires exactly one of
+// the rewrite options.
+type TagRewrite struct {
+	RenameKey map[Key]Key               `yaml:"rename_key"`
+	MapValues map[Key]map[string]string `yaml:"map_values"`
+	Lowercase []Key                     `yaml:"lowercase"`
+	Trim      []Key                     `yaml:"trim"`
+	Replace   *TagReplace               `yaml:"replace"`
+	SetTag    *SetTag                   `yaml:"set_tag"`
+}
+
+type TagReplace struct {
+	Key         Key    `yaml:"key"`
+	Regexp      string `yaml:"regexp"`
+	Replacement string `yaml:"replacement"`
+}
+
+type SetTag struct {
+	Key   Key    `yaml:"key"`
+	Value string `yaml:"value"`
+	If    string `yaml:"if"`
 }
 
 type Areas struct {
@@ -0,0 +1,68 @@
+package mapping
+
+import (
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm"
+	"github.com/omniscale/imposm3/geom/geos"
+)
+
+// elementExprEnv is the element and geometry context for column and filter
+// expressions.
+type elementExprEnv struct {
+	// Type is point, way or relation.
+	Type   string `expr:"type"`
+	Closed bool   `expr:"closed"`
+
+	GeometryType string    `expr:"geometry_type"`
+	Area         float64   `expr:"area"`
+	Length       float64   `expr:"length"`
+	Bounds       []float64 `expr:"bounds"`
+	NumPoints    int       `expr:"num_points"`
+}
+
+// geometryExprIdentifiers are only available after the geometry was built.
+var geometryExprIdentifiers = map[string]struct{}{
+	"geometry_type": {},
+	"area":          {},
+	"length":        {},
+	"bounds":        {},
+	"num_points":    {},
+}
+
+func (env *elementExprEnv) setGeometry(g *geos.Geos, geom *geos.Geom) {
+	if geom == nil {
+		return
+	}
+	env.GeometryType = g.Type(geom)
+	env.Area = geom.Area()
+	env.Length = geom.Length()
+	b := geom.Bounds()
+	env.Bounds = []float64{b.MinX, b.MinY, b.MaxX, b.MaxY}
+	env.NumPoints = int(g.NumCoordinates(geom))
+}
+
+// usesIdentifiers returns whether the expression of program references
+// any of the identifiers.
+func usesIdentifiers(program *vm.Program, identifiers ...map[string]struct{}) bool {
+	v := &identifierVisitor{identifiers: identifiers}
+	node := program.Node()
+	ast.Walk(&node, v)
+	return v.found
+}
+
+type identifierVisitor struct {
+	identifiers []map[string]struct{}
+	found       bool
+}
+
+func (v *identifierVisitor) Visit(node *ast.Node) {
+	ident, ok := (*node).(*ast.IdentifierNode)
+	if !ok {
+		return
+	}
+	for _, ids := range v.identifiers {
+		if _, ok := ids[ident.Value]; ok {
+			v.found = true
+		}
+	}
+}
@@ -22,9 +22,11 @@ func (m *Mapping) NodeTagFilter() TagFilterer {
 	tags := make(map[Key]bool)
 	m.extraTags(PointTable, tags)
 	m.extraTags(RelationMemberTable, tags)
+	m.extraTags(AddressInterpolationTable, tags)
 	splitKeys, splitAny := m.multiValueKeysForFilters(PointTable, RelationMemberTable)
 	return &tagFilter{
 		mappings:       mappings.asTagMap(),
+		patterns:       mappings.patterns(),
 		extraTags:      tags,
 		splitKeys:      splitKeys,
 		splitAny:       splitAny,
@@ -39,13 +41,17 @@ func (m *Mapping) WayTagFilter() TagFilterer {
 	mappings := make(TagTableMapping)
 	m.mappings(LineStringTable, mappings)
 	m.mappings(PolygonTable, mappings)
+	m.mappings(AddressInterpolationTable, mappings)
 	tags := make(map[Key]bool)
 	m.extraTags(LineStringTable, tags)
 	m.extraTags(PolygonTable, tags)
 	m.extraTags(RelationMemberTable, tags)
-	splitKeys, splitAny := m.multiValueKeysForFilters(LineStringTable, PolygonTable, RelationMemberTable)
+	m.extraTags(AddressInterpolationTable, tags)
+	m.parentWayTags(tags)
+	splitKeys, splitAny := m.multiValueKeysForFilters(LineStringTable, PolygonTable, RelationMemberTable, AddressInterpolationTable)
 	return &tagFilter{
 		mappings:       mappings.asTagMap(),
+		patterns:       mappings.patterns(),
 		extraTags:      tags,
 		splitKeys:      splitKeys,
 		splitAny:       splitAny,
@@ -76,6 +82,7 @@ func (m *Mapping) RelationTagFilter() TagFilterer {
 	splitKeys, splitAny := m.multiValueKeysForFilters(LineStringTable, PolygonTable, RelationTable, RelationMemberTable)
 	return &tagFilter{
 		mappings:       mappings.asTagMap(),
+		patterns:       mappings.patterns(),
 		extraTags:      tags,
 		splitKeys:      splitKeys,
 		splitAny:       splitAny,
@@ -87,6 +94,7 @@ type tagMap map[Key]map[Value]struct{}
 
 type tagFilter struct {
 	mappings       tagMap
+	patterns       []tagPattern
 	extraTags      map[Key]bool
 	splitKeys      map[Key]bool
 	splitAny       bool
@@ -105,6 +113,8 @@ func (f *tagFilter) Filter(tags *osm.Tags) {
 				continue
 			} else if mappingValueMatches(values, v, splitValues) {
 				continue
+			} else if f.matchesPattern(k, v, splitValues) {
+				continue
 			} else if _, ok := f.extraTags[Key(k)]; !ok {
 				if f.matchesIncludeRegex(k) {
 					continue
@@ -112,7 +122,7 @@ func (f *tagFilter) Filter(tags *osm.Tags) {
 				delete(*tags, k)
 			}
 		} else if _, ok := f.extraTags[Key(k)]; !ok {
-			if f.matchesIncludeRegex(k) {
+			if f.matchesIncludeRegex(k) || f.matchesPattern(k, v, splitValues) {
 				continue
 			}
 			delete(*tags, k)
@@ -120,6 +130,26 @@ func (f *tagFilter) Filter(tags *osm.Tags) {
 	}
 }
 
+func (f *tagFilter) matchesPattern(k, v string, splitValues bool) bool {
+	for i := range f.patterns {
+		p := &f.patterns[i]
+		if !p.matchesKey(k) {
+			continue
+		}
+		if p.matchesValue(v) {
+			return true
+		}
+		if splitValues {
+			for _, value := range splitTagValues(v) {
+				if p.matchesValue(value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 func (f *tagFilter) matchesIncludeRegex(k string) bool {
 	for _, includeRegexp := range f.includeRegexps {
 		if includeRegexp.MatchString(k) {
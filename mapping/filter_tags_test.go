@@ -6,6 +6,8 @@ import (
 	"testing"
 
 	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/geom/geos"
 )
 
 func TestFilters_require(t *testing.T) {
@@ -565,3 +567,375 @@ func filterTest(t *testing.T, mapping string, accept []osm.Tags, reject []osm.Ta
 	}
 
 }
+
+func TestFilters_members(t *testing.T) {
+	const mapping = `
+tables:
+  route_stops:
+    type: relation_member
+    columns:
+    - name: id
+      type: id
+    - name: member
+      type: member_id
+    filters:
+      member_types: [node, way]
+      exclude_member_roles: [platform]
+      member_filter: 'role != "" or tags["public_transport"] == "stop_position"'
+    relation_types: [route]
+    mapping:
+      route: [bus]
+`
+
+	configTestMapping, err := New([]byte(mapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rel := osm.Relation{
+		Element: osm.Element{
+			Tags: osm.Tags{"type": "route", "route": "bus"},
+		},
+	}
+	matches := configTestMapping.RelationMemberMatcher.MatchRelation(&rel)
+	if len(matches) != 1 {
+		t.Fatal(matches)
+	}
+
+	stopPosition := osm.Element{Tags: osm.Tags{"public_transport": "stop_position"}}
+	for _, tc := range []struct {
+		member osm.Member
+		accept bool
+	}{
+		{osm.Member{Type: osm.NodeMember, Role: "stop"}, true},
+		{osm.Member{Type: osm.WayMember, Role: "platform"}, false},
+		{osm.Member{Type: osm.RelationMember, Role: "stop"}, false},
+		{osm.Member{Type: osm.WayMember, Role: ""}, false},
+		{osm.Member{Type: osm.NodeMember, Role: "", Element: &stopPosition}, true},
+	} {
+		if accept := matches[0].AcceptMember(&tc.member); accept != tc.accept {
+			t.Errorf("unexpected result %v for %#v", accept, tc.member)
+		}
+	}
+}
+
+func TestFilters_membersInvalid(t *testing.T) {
+	for _, mapping := range []string{`
+tables:
+  routes:
+    type: linestring
+    columns:
+    - name: id
+      type: id
+    filters:
+      member_roles: [stop]
+    mapping:
+      route: [bus]
+`, `
+tables:
+  route_members:
+    type: relation_member
+    columns:
+    - name: id
+      type: id
+    filters:
+      member_types: [area]
+    mapping:
+      route: [bus]
+`} {
+		if _, err := New([]byte(mapping)); err == nil {
+			t.Errorf("expected error for mapping %s", mapping)
+		}
+	}
+}
+
+func TestAddressInterpolationMatcher(t *testing.T) {
+	const mapping = `
+tables:
+  addresses:
+    type: address_interpolation
+    columns:
+    - name: id
+      type: id
+    - name: housenumber
+      key: addr:housenumber
+      type: string
+    - name: street
+      key: addr:street
+      type: string
+    mapping:
+      addr:interpolation: [odd, even, all, alphabetic]
+  roads:
+    type: linestring
+    columns:
+    - name: id
+      type: id
+    mapping:
+      highway: [__any__]
+`
+
+	configTestMapping, err := New([]byte(mapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	way := osm.Way{Element: osm.Element{Tags: osm.Tags{"addr:interpolation": "odd"}}}
+	if matches := configTestMapping.AddressInterpolationMatcher.MatchWay(&way); len(matches) != 1 {
+		t.Error("interpolation way should match", matches)
+	}
+	if matches := configTestMapping.LineStringMatcher.MatchWay(&way); len(matches) != 0 {
+		t.Error("interpolation way should not match linestring table", matches)
+	}
+	way = osm.Way{Element: osm.Element{Tags: osm.Tags{"highway": "residential"}}}
+	if matches := configTestMapping.AddressInterpolationMatcher.MatchWay(&way); len(matches) != 0 {
+		t.Error("road should not match", matches)
+	}
+
+	// tags of the address nodes are required for the interpolation
+	tags := osm.Tags{"addr:housenumber": "12", "addr:street": "Main St", "shop": "bakery"}
+	configTestMapping.NodeTagFilter().Filter(&tags)
+	if len(tags) != 2 || tags["addr:housenumber"] != "12" || tags["addr:street"] != "Main St" {
+		t.Error("unexpected node tags", tags)
+	}
+}
+
+func TestSubdivide(t *testing.T) {
+	const mapping = `
+tables:
+  landuse:
+    type: polygon
+    subdivide:
+      max_vertices: 256
+    columns:
+    - name: id
+      type: id
+    - name: geometry
+      type: geometry
+    mapping:
+      landuse: [forest]
+`
+	m, err := New([]byte(mapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := m.Conf.Tables["landuse"].Columns
+	if last := columns[len(columns)-1]; last.Name != "part" || last.Type != "part" {
+		t.Errorf("missing part column: %#v", last)
+	}
+
+	elem := osm.Element{Tags: osm.Tags{"landuse": "forest"}}
+	matches := m.PolygonMatcher.MatchWay(&osm.Way{Element: elem, Refs: []int64{1, 2, 3, 1}})
+	if len(matches) != 1 || matches[0].Subdivide() != 256 {
+		t.Fatalf("unexpected matches %v", matches)
+	}
+	row := matches[0].Row(&elem, &geom.Geometry{Part: 3})
+	if row[len(row)-1] != 3 {
+		t.Errorf("unexpected part in row %v", row)
+	}
+
+	for _, invalid := range []string{`
+tables:
+  roads:
+    type: linestring
+    subdivide:
+      max_vertices: 256
+    mapping:
+      highway: [__any__]
+`, `
+tables:
+  landuse:
+    type: polygon
+    subdivide:
+      max_vertices: 2
+    mapping:
+      landuse: [__any__]
+`} {
+		if _, err := New([]byte(invalid)); err == nil {
+			t.Errorf("expected error for mapping %s", invalid)
+		}
+	}
+}
+
+func TestFilters_geometry(t *testing.T) {
+	const mapping = `
+tables:
+  landuse:
+    type: polygon
+    columns:
+    - name: id
+      type: id
+    filters:
+      min_area: 100
+      max_vertices: 10
+      geometry_filter: geometry_type == "Polygon" && length < 1000
+    mapping:
+      landuse: [__any__]
+  landuse_all:
+    type: polygon
+    columns:
+    - name: id
+      type: id
+    mapping:
+      landuse: [__any__]
+`
+	m, err := New([]byte(mapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := geos.NewGeos()
+	defer g.Finish()
+
+	elem := osm.Element{Tags: osm.Tags{"landuse": "forest"}}
+	matches := m.PolygonMatcher.MatchWay(&osm.Way{Element: elem, Refs: []int64{1, 2, 3, 1}})
+	if len(matches) != 2 {
+		t.Fatalf("unexpected matches %v", matches)
+	}
+
+	for _, tc := range []struct {
+		wkt    string
+		accept bool
+	}{
+		{"POLYGON((0 0, 20 0, 20 20, 0 20, 0 0))", true},
+		{"POLYGON((0 0, 5 0, 5 5, 0 5, 0 0))", false},                                          // min_area
+		{"POLYGON((0 0, 300 0, 300 300, 0 300, 0 0))", false},                                  // length
+		{"POLYGON((0 0, 10 0, 20 0, 20 10, 20 20, 10 20, 0 20, 0 15, 0 10, 0 5, 0 0))", false}, // max_vertices
+	} {
+		geom := g.FromWkt(tc.wkt)
+		for _, match := range matches {
+			accept := match.AcceptGeometry(g, &elem, geom)
+			if match.Table.Name == "landuse_all" && !accept {
+				t.Errorf("geometry %s rejected without filters", tc.wkt)
+			}
+			if match.Table.Name == "landuse" && accept != tc.accept {
+				t.Errorf("unexpected result %v for %s", accept, tc.wkt)
+			}
+		}
+		g.Destroy(geom)
+	}
+}
+
+func TestFilters_geometryInvalid(t *testing.T) {
+	for _, mapping := range []string{`
+tables:
+  pois:
+    type: point
+    filters:
+      min_area: 100
+    mapping:
+      amenity: [__any__]
+`, `
+tables:
+  landuse:
+    type: polygon
+    filters:
+      geometry_filter: area >
+    mapping:
+      landuse: [__any__]
+`, `
+tables:
+  landuse:
+    type: polygon
+    filters:
+      min_length: -1
+    mapping:
+      landuse: [__any__]
+`} {
+		if _, err := New([]byte(mapping)); err == nil {
+			t.Errorf("expected error for mapping %s", mapping)
+		}
+	}
+}
+
+func TestFilters_lateExpression(t *testing.T) {
+	const mapping = `
+tables:
+  buildings:
+    type: polygon
+    columns:
+    - name: id
+      type: id
+    filters:
+      filter: 'area > 100 and tags["building"] != "roof"'
+    mapping:
+      building: [__any__]
+`
+	m, err := New([]byte(mapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := m.filterExprs["buildings"]; f == nil || !f.late {
+		t.Fatalf("expected late filter expression, got %v", f)
+	}
+
+	// filter expressions with geometry are not checked during tag matching
+	elem := osm.Element{Tags: osm.Tags{"building": "yes"}}
+	matches := m.PolygonMatcher.MatchWay(&osm.Way{Element: elem, Refs: []int64{1, 2, 3, 1}})
+	if len(matches) != 1 || matches[0].builder.geometryFilter == nil {
+		t.Fatalf("unexpected matches %v", matches)
+	}
+
+	const relationMapping = `
+tables:
+  routes:
+    type: relation
+    filters:
+      filter: 'num_points > 100'
+    mapping:
+      route: [__any__]
+`
+	if _, err := New([]byte(relationMapping)); err == nil {
+		t.Error("expected error for geometry filter expression in relation table")
+	}
+
+	const metadataMapping = `
+tables:
+  buildings:
+    type: polygon
+    filters:
+      filter: 'version > 1'
+    mapping:
+      building: [__any__]
+`
+	if _, err := New([]byte(metadataMapping)); err == nil {
+		t.Error("expected error for metadata in filter expression")
+	}
+}
+
+func TestMergedTablesInvalid(t *testing.T) {
+	for _, mapping := range []string{`
+tables:
+  roads:
+    type: linestring
+    columns:
+    - name: id
+      type: id
+    - name: geometry
+      type: geometry
+    mapping:
+      highway: [__any__]
+merged_tables:
+  roads_merged:
+    source: roads
+`, `
+tables:
+  roads:
+    type: linestring
+    columns:
+    - name: name
+      type: string
+      key: name
+    - name: geometry
+      type: geometry
+    mapping:
+      highway: [__any__]
+merged_tables:
+  roads_merged:
+    source: roads
+    group_by: [name]
+`} {
+		if _, err := New([]byte(mapping)); err == nil {
+			t.Errorf("expected error for mapping %s", mapping)
+		}
+	}
+}
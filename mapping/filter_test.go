@@ -236,6 +236,114 @@ func TestTagFilterIncludeRegexInvalidPattern(t *testing.T) {
 	}
 }
 
+const patternMapping = `
+    tables:
+      disused:
+        type: point
+        mapping:
+          disused:*: [__any__]
+      links:
+        type: linestring
+        mapping:
+          highway: ['*_link']
+      paths:
+        type: linestring
+        multi_values: [bicycle]
+        mapping:
+          bicycle: ['~^(yes|designated)$']
+`
+
+func TestTagFilterPatterns(t *testing.T) {
+	mapping, err := New([]byte(patternMapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		tags     osm.Tags
+		expected osm.Tags
+	}{
+		{
+			tags:     osm.Tags{"highway": "primary_link", "bicycle": "designated", "foo": "x"},
+			expected: osm.Tags{"highway": "primary_link", "bicycle": "designated"},
+		},
+		{
+			tags:     osm.Tags{"highway": "primary", "bicycle": "no"},
+			expected: osm.Tags{},
+		},
+		{
+			tags:     osm.Tags{"bicycle": "no;yes"},
+			expected: osm.Tags{"bicycle": "no;yes"},
+		},
+	}
+
+	ways := mapping.WayTagFilter()
+	for i, test := range tests {
+		ways.Filter(&test.tags)
+		if !stringMapEqual(test.tags, test.expected) {
+			t.Errorf("unexpected result for case %d: %v != %v", i+1, test.tags, test.expected)
+		}
+	}
+
+	nodes := mapping.NodeTagFilter()
+	tags := osm.Tags{"disused:shop": "bakery", "shop": "bakery"}
+	nodes.Filter(&tags)
+	if !stringMapEqual(tags, osm.Tags{"disused:shop": "bakery"}) {
+		t.Errorf("unexpected result for nodes: %v", tags)
+	}
+}
+
+func TestPatternMatcher(t *testing.T) {
+	mapping, err := New([]byte(patternMapping))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		tags    osm.Tags
+		matches []Match
+	}{
+		{osm.Tags{"highway": "primary"}, []Match{}},
+		{osm.Tags{"highway": "primary_link"}, []Match{{Key: "highway", Value: "primary_link", Table: DestTable{Name: "links"}}}},
+		{osm.Tags{"bicycle": "yes"}, []Match{{Key: "bicycle", Value: "yes", Table: DestTable{Name: "paths"}}}},
+		{osm.Tags{"bicycle": "yes_but"}, []Match{}},
+		{osm.Tags{"bicycle": "no;yes"}, []Match{{Key: "bicycle", Value: "yes", Table: DestTable{Name: "paths"}}}},
+		{osm.Tags{"highway": "trunk_link", "bicycle": "designated"}, []Match{
+			{Key: "highway", Value: "trunk_link", Table: DestTable{Name: "links"}},
+			{Key: "bicycle", Value: "designated", Table: DestTable{Name: "paths"}},
+		}},
+	}
+
+	elem := osm.Way{}
+	m := mapping.LineStringMatcher
+	for i, test := range tests {
+		elem.Tags = test.tags
+		actual := m.MatchWay(&elem)
+		if !matchesEqual(actual, test.matches) {
+			t.Errorf("unexpected result for case %d: %v != %v", i+1, actual, test.matches)
+		}
+	}
+
+	node := osm.Node{}
+	node.Tags = osm.Tags{"disused:amenity": "pub"}
+	actual := mapping.PointMatcher.MatchNode(&node)
+	expected := []Match{{Key: "disused:amenity", Value: "pub", Table: DestTable{Name: "disused"}}}
+	if !matchesEqual(actual, expected) {
+		t.Errorf("unexpected result for node: %v != %v", actual, expected)
+	}
+}
+
+func TestPatternInvalid(t *testing.T) {
+	_, err := New([]byte(`
+    tables:
+      paths:
+        type: linestring
+        mapping:
+          bicycle: ['~^(yes']
+    `))
+	if err == nil {
+		t.Fatal("expected invalid pattern error")
+	}
+}
+
 func TestPointMatcher(t *testing.T) {
 	mapping, err := New([]byte(`
     tables:
@@ -281,15 +389,15 @@ func TestPointMatcher(t *testing.T) {
 	}{
 		{osm.Tags{"unknown": "baz"}, []Match{}},
 		{osm.Tags{"place": "unknown"}, []Match{}},
-		{osm.Tags{"place": "city"}, []Match{{"place", "city", DestTable{Name: "places"}, nil}}},
+		{osm.Tags{"place": "city"}, []Match{{Key: "place", Value: "city", Table: DestTable{Name: "places"}}}},
 		{osm.Tags{"place": "city;town"}, []Match{
-			{"place", "city", DestTable{Name: "places"}, nil},
-			{"place", "town", DestTable{Name: "places"}, nil},
+			{Key: "place", Value: "city", Table: DestTable{Name: "places"}},
+			{Key: "place", Value: "town", Table: DestTable{Name: "places"}},
 		}},
-		{osm.Tags{"place": "city", "highway": "residential"}, []Match{{"place", "city", DestTable{Name: "places"}, nil}}},
+		{osm.Tags{"place": "city", "highway": "residential"}, []Match{{Key: "place", Value: "city", Table: DestTable{Name: "places"}}}},
 		{osm.Tags{"place": "city", "highway": "bus_stop"}, []Match{
-			{"place", "city", DestTable{Name: "places"}, nil},
-			{"highway", "bus_stop", DestTable{Name: "transport_points"}, nil}},
+			{Key: "place", Value: "city", Table: DestTable{Name: "places"}},
+			{Key: "highway", Value: "bus_stop", Table: DestTable{Name: "transport_points"}}},
 		},
 	}
 
@@ -323,7 +431,7 @@ func TestPointMatcherSplitValuesDisabled(t *testing.T) {
 		matches []Match
 	}{
 		{osm.Tags{"place": "city;town"}, []Match{}},
-		{osm.Tags{"place": "city"}, []Match{{"place", "city", DestTable{Name: "places"}, nil}}},
+		{osm.Tags{"place": "city"}, []Match{{Key: "place", Value: "city", Table: DestTable{Name: "places"}}}},
 	}
 
 	elem := osm.Node{}
@@ -357,12 +465,12 @@ func TestPointMatcherMultiValuesDisabled(t *testing.T) {
 		matches []Match
 	}{
 		{osm.Tags{"place": "city;town"}, []Match{
-			{"place", "city", DestTable{Name: "places"}, nil},
-			{"place", "town", DestTable{Name: "places"}, nil},
+			{Key: "place", Value: "city", Table: DestTable{Name: "places"}},
+			{Key: "place", Value: "town", Table: DestTable{Name: "places"}},
 		}},
 		{osm.Tags{"place": "town;city"}, []Match{
-			{"place", "town", DestTable{Name: "places"}, nil},
-			{"place", "city", DestTable{Name: "places"}, nil},
+			{Key: "place", Value: "town", Table: DestTable{Name: "places"}},
+			{Key: "place", Value: "city", Table: DestTable{Name: "places"}},
 		}},
 	}
 
@@ -397,7 +505,7 @@ func TestPointMatcherFiltersSplitValuesEnabled(t *testing.T) {
 		tags    osm.Tags
 		matches []Match
 	}{
-		{osm.Tags{"place": "city", "amenity": "school;cafe"}, []Match{{"place", "city", DestTable{Name: "places"}, nil}}},
+		{osm.Tags{"place": "city", "amenity": "school;cafe"}, []Match{{Key: "place", Value: "city", Table: DestTable{Name: "places"}}}},
 		{osm.Tags{"place": "city", "amenity": "cafe"}, []Match{}},
 	}
 
@@ -432,7 +540,7 @@ func TestPointMatcherFiltersSplitValuesDisabled(t *testing.T) {
 		matches []Match
 	}{
 		{osm.Tags{"place": "city", "amenity": "school;cafe"}, []Match{}},
-		{osm.Tags{"place": "city", "amenity": "school"}, []Match{{"place", "city", DestTable{Name: "places"}, nil}}},
+		{osm.Tags{"place": "city", "amenity": "school"}, []Match{{Key: "place", Value: "city", Table: DestTable{Name: "places"}}}},
 	}
 
 	elem := osm.Node{}
@@ -467,7 +575,7 @@ func TestPointMatcherRejectFiltersSplitValuesEnabled(t *testing.T) {
 		matches []Match
 	}{
 		{osm.Tags{"place": "city", "amenity": "school;cafe"}, []Match{}},
-		{osm.Tags{"place": "city", "amenity": "cafe"}, []Match{{"place", "city", DestTable{Name: "places"}, nil}}},
+		{osm.Tags{"place": "city", "amenity": "cafe"}, []Match{{Key: "place", Value: "city", Table: DestTable{Name: "places"}}}},
 	}
 
 	elem := osm.Node{}
@@ -532,29 +640,29 @@ func TestLineStringMatcher(t *testing.T) {
 		{osm.Tags{"highway": "unknown"}, []Match{}},
 		{osm.Tags{"place": "city"}, []Match{}},
 		{osm.Tags{"highway": "pedestrian"},
-			[]Match{{"highway", "pedestrian", DestTable{Name: "roads", SubMapping: "roads"}, nil}}},
+			[]Match{{Key: "highway", Value: "pedestrian", Table: DestTable{Name: "roads", SubMapping: "roads"}}}},
 
 		// exclude_tags area=yes
 		{osm.Tags{"highway": "pedestrian", "area": "yes"}, []Match{}},
 
 		{osm.Tags{"barrier": "hedge"},
-			[]Match{{"barrier", "hedge", DestTable{Name: "barrierways"}, nil}}},
+			[]Match{{Key: "barrier", Value: "hedge", Table: DestTable{Name: "barrierways"}}}},
 		{osm.Tags{"barrier": "hedge", "area": "yes"}, []Match{}},
 
 		{osm.Tags{"aeroway": "runway"}, []Match{}},
 		{osm.Tags{"aeroway": "runway", "area": "no"},
-			[]Match{{"aeroway", "runway", DestTable{Name: "aeroways"}, nil}}},
+			[]Match{{Key: "aeroway", Value: "runway", Table: DestTable{Name: "aeroways"}}}},
 
 		{osm.Tags{"highway": "secondary", "railway": "tram"},
 			[]Match{
-				{"highway", "secondary", DestTable{Name: "roads", SubMapping: "roads"}, nil},
-				{"railway", "tram", DestTable{Name: "roads", SubMapping: "railway"}, nil}},
+				{Key: "highway", Value: "secondary", Table: DestTable{Name: "roads", SubMapping: "roads"}},
+				{Key: "railway", Value: "tram", Table: DestTable{Name: "roads", SubMapping: "railway"}}},
 		},
 		{osm.Tags{"highway": "footway", "landuse": "park", "barrier": "hedge"},
 			// landusages not a linestring table
 			[]Match{
-				{"highway", "footway", DestTable{Name: "roads", SubMapping: "roads"}, nil},
-				{"barrier", "hedge", DestTable{Name: "barrierways"}, nil}},
+				{Key: "highway", Value: "footway", Table: DestTable{Name: "roads", SubMapping: "roads"}},
+				{Key: "barrier", Value: "hedge", Table: DestTable{Name: "barrierways"}}},
 		},
 	}
 
@@ -626,32 +734,32 @@ func TestPolygonMatcher_MatchWay(t *testing.T) {
 		{osm.Tags{"unknown": "baz"}, []Match{}},
 		{osm.Tags{"landuse": "unknown"}, []Match{}},
 		{osm.Tags{"landuse": "unknown", "type": "multipolygon"}, []Match{}},
-		{osm.Tags{"building": "yes"}, []Match{{"building", "yes", DestTable{Name: "buildings"}, nil}}},
-		{osm.Tags{"building": "residential"}, []Match{{"building", "residential", DestTable{Name: "buildings"}, nil}}},
+		{osm.Tags{"building": "yes"}, []Match{{Key: "building", Value: "yes", Table: DestTable{Name: "buildings"}}}},
+		{osm.Tags{"building": "residential"}, []Match{{Key: "building", Value: "residential", Table: DestTable{Name: "buildings"}}}},
 		// line type requires area=yes
 		{osm.Tags{"barrier": "hedge"}, []Match{}},
-		{osm.Tags{"barrier": "hedge", "area": "yes"}, []Match{{"barrier", "hedge", DestTable{Name: "landusages"}, nil}}},
+		{osm.Tags{"barrier": "hedge", "area": "yes"}, []Match{{Key: "barrier", Value: "hedge", Table: DestTable{Name: "landusages"}}}},
 
 		{osm.Tags{"building": "shop"}, []Match{
-			{"building", "shop", DestTable{Name: "buildings"}, nil},
-			{"building", "shop", DestTable{Name: "amenity_areas"}, nil},
+			{Key: "building", Value: "shop", Table: DestTable{Name: "buildings"}},
+			{Key: "building", Value: "shop", Table: DestTable{Name: "amenity_areas"}},
 		}},
 
 		{osm.Tags{"aeroway": "apron", "landuse": "farm"}, []Match{
-			{"aeroway", "apron", DestTable{Name: "transport_areas"}, nil},
-			{"landuse", "farm", DestTable{Name: "landusages"}, nil},
+			{Key: "aeroway", Value: "apron", Table: DestTable{Name: "transport_areas"}},
+			{Key: "landuse", Value: "farm", Table: DestTable{Name: "landusages"}},
 		}},
 
 		{osm.Tags{"landuse": "farm", "highway": "secondary"}, []Match{
-			{"landuse", "farm", DestTable{Name: "landusages"}, nil},
+			{Key: "landuse", Value: "farm", Table: DestTable{Name: "landusages"}},
 		}},
 
 		{osm.Tags{"highway": "footway"}, []Match{}},
 		{osm.Tags{"highway": "footway", "area": "yes"}, []Match{
-			{"highway", "footway", DestTable{Name: "landusages"}, nil},
+			{Key: "highway", Value: "footway", Table: DestTable{Name: "landusages"}},
 		}},
 
-		{osm.Tags{"boundary": "administrative", "admin_level": "8"}, []Match{{"boundary", "administrative", DestTable{Name: "admin"}, nil}}},
+		{osm.Tags{"boundary": "administrative", "admin_level": "8"}, []Match{{Key: "boundary", Value: "administrative", Table: DestTable{Name: "admin"}}}},
 
 		/*
 			landusages mapping has the following order,
@@ -667,9 +775,9 @@ func TestPolygonMatcher_MatchWay(t *testing.T) {
 			- park
 		*/
 
-		{osm.Tags{"landuse": "forest", "leisure": "park"}, []Match{{"landuse", "forest", DestTable{Name: "landusages"}, nil}}},
-		{osm.Tags{"landuse": "park", "leisure": "park"}, []Match{{"leisure", "park", DestTable{Name: "landusages"}, nil}}},
-		{osm.Tags{"landuse": "park", "leisure": "park", "amenity": "university"}, []Match{{"amenity", "university", DestTable{Name: "landusages"}, nil}}},
+		{osm.Tags{"landuse": "forest", "leisure": "park"}, []Match{{Key: "landuse", Value: "forest", Table: DestTable{Name: "landusages"}}}},
+		{osm.Tags{"landuse": "park", "leisure": "park"}, []Match{{Key: "leisure", Value: "park", Table: DestTable{Name: "landusages"}}}},
+		{osm.Tags{"landuse": "park", "leisure": "park", "amenity": "university"}, []Match{{Key: "amenity", Value: "university", Table: DestTable{Name: "landusages"}}}},
 	}
 
 	elem := osm.Way{}
@@ -751,33 +859,33 @@ func TestPolygonMatcher_MatchRelation(t *testing.T) {
 		{osm.Tags{"landuse": "unknown"}, []Match{}},
 		{osm.Tags{"landuse": "unknown", "type": "multipolygon"}, []Match{}},
 		{osm.Tags{"building": "yes"}, []Match{}},
-		{osm.Tags{"building": "yes", "type": "multipolygon"}, []Match{{"building", "yes", DestTable{Name: "buildings"}, nil}}},
-		{osm.Tags{"building": "residential", "type": "multipolygon"}, []Match{{"building", "residential", DestTable{Name: "buildings"}, nil}}},
+		{osm.Tags{"building": "yes", "type": "multipolygon"}, []Match{{Key: "building", Value: "yes", Table: DestTable{Name: "buildings"}}}},
+		{osm.Tags{"building": "residential", "type": "multipolygon"}, []Match{{Key: "building", Value: "residential", Table: DestTable{Name: "buildings"}}}},
 		// line type requires area=yes
 		{osm.Tags{"barrier": "hedge", "type": "multipolygon"}, []Match{}},
-		{osm.Tags{"barrier": "hedge", "area": "yes", "type": "multipolygon"}, []Match{{"barrier", "hedge", DestTable{Name: "landusages"}, nil}}},
+		{osm.Tags{"barrier": "hedge", "area": "yes", "type": "multipolygon"}, []Match{{Key: "barrier", Value: "hedge", Table: DestTable{Name: "landusages"}}}},
 
 		{osm.Tags{"building": "shop", "type": "multipolygon"}, []Match{
-			{"building", "shop", DestTable{Name: "buildings"}, nil},
-			{"building", "shop", DestTable{Name: "amenity_areas"}, nil},
+			{Key: "building", Value: "shop", Table: DestTable{Name: "buildings"}},
+			{Key: "building", Value: "shop", Table: DestTable{Name: "amenity_areas"}},
 		}},
 
 		{osm.Tags{"aeroway": "apron", "landuse": "farm", "type": "multipolygon"}, []Match{
-			{"aeroway", "apron", DestTable{Name: "transport_areas"}, nil},
-			{"landuse", "farm", DestTable{Name: "landusages"}, nil},
+			{Key: "aeroway", Value: "apron", Table: DestTable{Name: "transport_areas"}},
+			{Key: "landuse", Value: "farm", Table: DestTable{Name: "landusages"}},
 		}},
 
 		{osm.Tags{"landuse": "farm", "highway": "secondary", "type": "multipolygon"}, []Match{
-			{"landuse", "farm", DestTable{Name: "landusages"}, nil},
+			{Key: "landuse", Value: "farm", Table: DestTable{Name: "landusages"}},
 		}},
 
 		{osm.Tags{"highway": "footway", "type": "multipolygon"}, []Match{}},
 		{osm.Tags{"highway": "footway", "area": "yes", "type": "multipolygon"}, []Match{
-			{"highway", "footway", DestTable{Name: "landusages"}, nil},
+			{Key: "highway", Value: "footway", Table: DestTable{Name: "landusages"}},
 		}},
 
 		{osm.Tags{"boundary": "administrative", "admin_level": "8"}, []Match{}},
-		{osm.Tags{"boundary": "administrative", "admin_level": "8", "type": "boundary"}, []Match{{"boundary", "administrative", DestTable{Name: "admin"}, nil}}},
+		{osm.Tags{"boundary": "administrative", "admin_level": "8", "type": "boundary"}, []Match{{Key: "boundary", Value: "administrative", Table: DestTable{Name: "admin"}}}},
 	}
 
 	elem := osm.Relation{}
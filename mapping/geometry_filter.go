@@ -0,0 +1,101 @@
+package mapping
+
+import (
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/geom/geos"
+	"github.com/omniscale/imposm3/mapping/config"
+	"github.com/pkg/errors"
+)
+
+// geometryFilter returns true if the geometry of elem should be inserted.
+type geometryFilter func(g *geos.Geos, elem *osm.Element, geom *geos.Geom, match *Match) bool
+
+// hasGeometryFilters returns whether any geometry filter is configured.
+func hasGeometryFilters(f *config.Filters) bool {
+	return f.MinArea != 0 || f.MaxArea != 0 || f.MinLength != 0 ||
+		f.MaxVertices != 0 || f.GeometryFilter != ""
+}
+
+// makeGeometryFilter combines all geometry filters of a table, including
+// the filter expression if it requires the geometry.
+// Returns nil if no geometry filters are configured.
+func makeGeometryFilter(f *config.Filters, filter *filterExpr) (geometryFilter, error) {
+	var filters []geometryFilter
+
+	if f.MinArea < 0 || f.MaxArea < 0 || f.MinLength < 0 || f.MaxVertices < 0 {
+		return nil, errors.New("geometry filters require positive values")
+	}
+
+	if f.MinArea > 0 {
+		minArea := f.MinArea
+		filters = append(filters, func(g *geos.Geos, elem *osm.Element, geom *geos.Geom, match *Match) bool {
+			return geom.Area() >= minArea
+		})
+	}
+
+	if f.MaxArea > 0 {
+		maxArea := f.MaxArea
+		filters = append(filters, func(g *geos.Geos, elem *osm.Element, geom *geos.Geom, match *Match) bool {
+			return geom.Area() <= maxArea
+		})
+	}
+
+	if f.MinLength > 0 {
+		minLength := f.MinLength
+		filters = append(filters, func(g *geos.Geos, elem *osm.Element, geom *geos.Geom, match *Match) bool {
+			return geom.Length() >= minLength
+		})
+	}
+
+	if f.MaxVertices > 0 {
+		maxVertices := f.MaxVertices
+		filters = append(filters, func(g *geos.Geos, elem *osm.Element, geom *geos.Geom, match *Match) bool {
+			return int(g.NumCoordinates(geom)) <= maxVertices
+		})
+	}
+
+	if f.GeometryFilter != "" {
+		program, err := expr.Compile(
+			f.GeometryFilter,
+			expr.Env(filterExprEnv{}),
+			expr.AsBool(),
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid geometry_filter expression")
+		}
+		filters = append(filters, makeGeometryExprFilter(program))
+	}
+
+	if filter != nil && filter.late {
+		filters = append(filters, makeGeometryExprFilter(filter.program))
+	}
+
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	return func(g *geos.Geos, elem *osm.Element, geom *geos.Geom, match *Match) bool {
+		for _, f := range filters {
+			if !f(g, elem, geom, match) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func makeGeometryExprFilter(program *vm.Program) geometryFilter {
+	return func(g *geos.Geos, elem *osm.Element, geom *geos.Geom, match *Match) bool {
+		env := filterExprEnv{Tags: elem.Tags}
+		env.Type = match.elementType
+		env.Closed = match.closed
+		env.setGeometry(g, geom)
+		result, err := expr.Run(program, env)
+		if err != nil {
+			return false
+		}
+		accepted, ok := result.(bool)
+		return ok && accepted
+	}
+}
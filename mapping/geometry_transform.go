@@ -33,6 +33,19 @@ var geometryTransformPool = sync.Pool{
 	},
 }
 
+// geosGeom returns the GEOS geometry of geom, see geom.Geometry.GeosGeom.
+func geosGeom(geom *geom.Geometry) *geos.Geom {
+	if geom == nil {
+		return nil
+	}
+	if geom.Geom != nil {
+		return geom.Geom
+	}
+	g := geometryTransformPool.Get().(*geos.Geos)
+	defer geometryTransformPool.Put(g)
+	return geom.GeosGeom(g)
+}
+
 func normalizeGeometryTransform(value string) (string, error) {
 	trimmed := strings.TrimSpace(value)
 	if trimmed == "" || strings.EqualFold(trimmed, "none") {
@@ -48,7 +61,7 @@ func normalizeGeometryTransform(value string) (string, error) {
 
 func makeGeometryTransformFunc(transform string) MakeValue {
 	return func(val string, elem *osm.Element, geomValue *geom.Geometry, match Match) interface{} {
-		if geomValue == nil || geomValue.Geom == nil {
+		if geomValue == nil || (geomValue.Geom == nil && len(geomValue.Wkb) == 0) {
 			return nil
 		}
 		wkb, err := transformGeometry(geomValue, transform)
@@ -67,15 +80,19 @@ func transformGeometry(geomValue *geom.Geometry, transform string) ([]byte, erro
 	geosHandle := geometryTransformPool.Get().(*geos.Geos)
 	defer geometryTransformPool.Put(geosHandle)
 
-	srid := geosHandle.SRID(geomValue.Geom)
+	geosGeom := geomValue.GeosGeom(geosHandle)
+	if geosGeom == nil {
+		return nil, errors.New("invalid geometry")
+	}
+	srid := geosHandle.SRID(geosGeom)
 	geosHandle.SetHandleSrid(srid)
 
 	var result *geos.Geom
 	switch transform {
 	case geometryTransformCentroid:
-		result = geosHandle.Centroid(geomValue.Geom)
+		result = geosHandle.Centroid(geosGeom)
 	case geometryTransformCenter:
-		bounds := geomValue.Geom.Bounds()
+		bounds := geosGeom.Bounds()
 		if bounds.MinX > bounds.MaxX || bounds.MinY > bounds.MaxY {
 			return nil, errors.New("invalid geometry bounds")
 		}
@@ -83,9 +100,9 @@ func transformGeometry(geomValue *geom.Geometry, transform string) ([]byte, erro
 		centerY := bounds.MinY + (bounds.MaxY-bounds.MinY)/2
 		result = geosHandle.Point(centerX, centerY)
 	case geometryTransformPointOnSurface:
-		result = geosHandle.PointOnSurface(geomValue.Geom)
+		result = geosHandle.PointOnSurface(geosGeom)
 	case geometryTransformPoleOfInaccessibility:
-		circle := geosHandle.MaximumInscribedCircle(geomValue.Geom, 0)
+		circle := geosHandle.MaximumInscribedCircle(geosGeom, 0)
 		if circle == nil {
 			return nil, errors.New("maximum inscribed circle failed")
 		}
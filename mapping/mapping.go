@@ -1,7 +1,6 @@
 package mapping
 
 import (
-	"fmt"
 	"io/ioutil"
 	"regexp"
 
@@ -73,6 +72,8 @@ func (tt *TableType) UnmarshalJSON(data []byte) error {
 		*tt = RelationTable
 	case `"relation_member"`:
 		*tt = RelationMemberTable
+	case `"address_interpolation"`:
+		*tt = AddressInterpolationTable
 	}
 	return errors.New("unknown type " + string(data))
 }
@@ -85,8 +86,14 @@ const (
 	PointOrPolygonTable TableType = "point_or_polygon"
 	RelationTable       TableType = "relation"
 	RelationMemberTable TableType = "relation_member"
+	// AddressInterpolationTable inserts a point for each house number of
+	// addr:interpolation ways.
+	AddressInterpolationTable TableType = "address_interpolation"
 )
 
+// MaxZoom is the highest zoom level of tables for vector tile outputs.
+const MaxZoom = 20
+
 type Mapping struct {
 	Conf                  config.Mapping
 	PointMatcher          NodeMatcher
@@ -94,6 +101,24 @@ type Mapping struct {
 	PolygonMatcher        RelWayMatcher
 	RelationMatcher       RelationMatcher
 	RelationMemberMatcher RelationMatcher
+	// AddressInterpolationMatcher matches ways for address_interpolation
+	// tables.
+	AddressInterpolationMatcher WayMatcher
+
+	// filterExprs contains the compiled filter expression of each table.
+	filterExprs map[string]*filterExpr
+	// rowBuilders contains the row builder of each table, shared by all
+	// matchers.
+	rowBuilders map[string]*rowBuilder
+	// tagRewriter is nil if no tag_rewrites are configured.
+	tagRewriter *TagRewriter
+}
+
+// filterExpr is a compiled filter expression. Expressions that use
+// geometry are evaluated after the geometry was built.
+type filterExpr struct {
+	program *vm.Program
+	late    bool
 }
 
 func FromFile(filename string) (*Mapping, error) {
@@ -139,17 +164,114 @@ func (m *Mapping) prepare() error {
 				return errors.Errorf("table with type:geometry requires type_mappings for table %s", name)
 			}
 		}
+
+		if t.FlattenMembers && TableType(t.Type) != RelationMemberTable {
+			return errors.Errorf("flatten_members requires type:relation_member for table %s", name)
+		}
+
+		if t.ParallelCopy < 0 {
+			return errors.Errorf("parallel_copy needs to be positive for table %s", name)
+		}
+
+		if t.Zoom != nil && (t.Zoom.Min < 0 || t.Zoom.Min > t.Zoom.Max || t.Zoom.Max > MaxZoom) {
+			return errors.Errorf("zoom needs to be a range between 0 and %d for table %s", MaxZoom, name)
+		}
+
+		if t.Subdivide != nil {
+			if err := prepareSubdivide(t); err != nil {
+				return err
+			}
+		}
+
+		if t.Filters != nil && t.Filters.Filter != "" {
+			if err := m.prepareFilterExpr(t); err != nil {
+				return err
+			}
+		}
+
+		if t.Filters != nil && hasGeometryFilters(t.Filters) {
+			switch TableType(t.Type) {
+			case LineStringTable, PolygonTable, GeometryTable, PointOrPolygonTable:
+			default:
+				return errors.Errorf("geometry filters are only supported for linestring and polygon tables, not for table %s", name)
+			}
+		}
+
+		if t.Filters != nil && TableType(t.Type) != RelationMemberTable {
+			f := t.Filters
+			if f.MemberRoles != nil || f.ExcludeMemberRoles != nil || f.MemberTypes != nil || f.MemberFilter != "" {
+				return errors.Errorf("member filters require type:relation_member for table %s", name)
+			}
+		}
 	}
 
 	for name, t := range m.Conf.GeneralizedTables {
 		t.Name = name
 	}
 
+	for name, t := range m.Conf.MergedTables {
+		t.Name = name
+		if len(t.GroupBy) == 0 {
+			return errors.Errorf("missing group_by for merged table %s", name)
+		}
+		// groups of modified rows are queried by the OSM ID
+		if source, ok := m.Conf.Tables[t.SourceTableName]; ok && !hasIDColumn(source) {
+			return errors.Errorf("source %s of merged table %s has no id column", t.SourceTableName, name)
+		}
+	}
+
+	rewriter, err := newTagRewriter(m.Conf.TagRewrites)
+	if err != nil {
+		return err
+	}
+	m.tagRewriter = rewriter
+
+	patterns := make(TagTableMapping)
+	for _, tableType := range []TableType{PointTable, LineStringTable, PolygonTable, RelationTable, RelationMemberTable, AddressInterpolationTable} {
+		m.mappings(tableType, patterns)
+	}
+	if err := validatePatterns(patterns); err != nil {
+		return errors.Wrap(err, "invalid mapping")
+	}
+
 	for _, includeRegex := range m.Conf.Tags.IncludeRegex {
 		if _, err := regexp.Compile(includeRegex); err != nil {
 			return errors.Wrapf(err, "invalid tags.include_regex pattern %q", includeRegex)
 		}
 	}
+
+	m.rowBuilders = make(map[string]*rowBuilder)
+	for name, t := range m.Conf.Tables {
+		builder, err := makeRowBuilder(t, m.filterExprs[name])
+		if err != nil {
+			return errors.Wrapf(err, "creating row builder for %s", name)
+		}
+		m.rowBuilders[name] = builder
+	}
+	return nil
+}
+
+// prepareFilterExpr compiles the filter expression of the table.
+func (m *Mapping) prepareFilterExpr(t *config.Table) error {
+	program, err := expr.Compile(
+		t.Filters.Filter,
+		expr.Env(filterExprEnv{}),
+		expr.AsBool(),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "invalid filter expression for table %s", t.Name)
+	}
+	late := usesIdentifiers(program, geometryExprIdentifiers)
+	if late {
+		switch TableType(t.Type) {
+		case RelationTable, RelationMemberTable, AddressInterpolationTable:
+			return errors.Errorf("filter expression with geometry is not supported for table %s", t.Name)
+		}
+	}
+	if m.filterExprs == nil {
+		m.filterExprs = make(map[string]*filterExpr)
+	}
+	m.filterExprs[t.Name] = &filterExpr{program: program, late: late}
 	return nil
 }
 
@@ -175,6 +297,10 @@ func (m *Mapping) createMatcher() error {
 	if err != nil {
 		return err
 	}
+	m.AddressInterpolationMatcher, err = m.addressInterpolationMatcher()
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -275,22 +401,59 @@ func (m *Mapping) mappings(tableType TableType, mappings TagTableMapping) {
 }
 
 func (m *Mapping) tables(tableType TableType) (map[string]*rowBuilder, error) {
-	var err error
 	result := make(map[string]*rowBuilder)
 	for name, t := range m.Conf.Tables {
 		if tableMatchesType(t, tableType) {
-			result[name], err = makeRowBuilder(t)
-			if err != nil {
-				return nil, errors.Wrapf(err, "creating row builder for %s", name)
-			}
-
+			result[name] = m.rowBuilders[name]
 		}
 	}
 	return result, nil
 }
 
-func makeRowBuilder(tbl *config.Table) (*rowBuilder, error) {
-	result := rowBuilder{}
+// prepareSubdivide checks the subdivide option and adds the part column
+// if the table has no column of type part.
+func prepareSubdivide(t *config.Table) error {
+	switch TableType(t.Type) {
+	case PolygonTable, GeometryTable, PointOrPolygonTable:
+	default:
+		return errors.Errorf("subdivide is only supported for polygon tables, not for table %s", t.Name)
+	}
+	if t.Subdivide.MaxVertices < 8 {
+		return errors.Errorf("subdivide requires max_vertices of at least 8 for table %s", t.Name)
+	}
+	for _, c := range t.Columns {
+		if c.Type == "part" {
+			return nil
+		}
+	}
+	t.Columns = append(t.Columns, &config.Column{Name: "part", Type: "part"})
+	return nil
+}
+
+func makeRowBuilder(tbl *config.Table, tableFilter *filterExpr) (*rowBuilder, error) {
+	result := rowBuilder{
+		flattenMembers: tbl.FlattenMembers,
+	}
+	if tbl.Subdivide != nil {
+		result.subdivide = tbl.Subdivide.MaxVertices
+		result.needsGeometry = true
+	}
+	if tbl.Filters != nil {
+		filter, err := makeMemberFilter(tbl.Filters)
+		if err != nil {
+			return nil, err
+		}
+		result.memberFilter = filter
+
+		geomFilter, err := makeGeometryFilter(tbl.Filters, tableFilter)
+		if err != nil {
+			return nil, err
+		}
+		result.geometryFilter = geomFilter
+		if geomFilter != nil {
+			result.needsGeometry = true
+		}
+	}
 
 	for _, mappingColumn := range tbl.Columns {
 		column := valueBuilder{}
@@ -308,11 +471,43 @@ func makeRowBuilder(tbl *config.Table) (*rowBuilder, error) {
 			columnType.Func = makeGeometryTransformFunc(normalized)
 		}
 		column.colType = *columnType
+		if columnType.Name == "parent_way_tags" {
+			result.parentWays = true
+		}
+		if columnNeedsGeometry(mappingColumn) {
+			result.needsGeometry = true
+		}
 		result.columns = append(result.columns, column)
 	}
 	return &result, nil
 }
 
+// geometryColumnTypes are column types that require the GEOS geometry.
+var geometryColumnTypes = map[string]struct{}{
+	"area":                       {},
+	"pseudoarea":                 {},
+	"webmerc_area":               {},
+	"geojson_intersects":         {},
+	"geojson_intersects_feature": {},
+}
+
+// columnNeedsGeometry returns whether the column requires the GEOS geometry
+// and not only the (E)WKB.
+func columnNeedsGeometry(c *config.Column) bool {
+	if c.GeometryTransform != "" {
+		return true
+	}
+	if _, ok := geometryColumnTypes[c.Type]; ok {
+		return true
+	}
+	if c.Type == "expression" {
+		expression, _ := c.Args["expression"].(string)
+		program, err := expr.Compile(expression, expr.Env(columnExprEnv{}))
+		return err != nil || usesIdentifiers(program, geometryExprIdentifiers)
+	}
+	return false
+}
+
 func MakeColumnType(c *config.Column) (*ColumnType, error) {
 	columnType, ok := AvailableColumnTypes[c.Type]
 	if !ok {
@@ -330,6 +525,60 @@ func MakeColumnType(c *config.Column) (*ColumnType, error) {
 	return &columnType, nil
 }
 
+func hasIDColumn(t *config.Table) bool {
+	for _, col := range t.Columns {
+		if col.Type == "id" {
+			return true
+		}
+	}
+	return false
+}
+
+// HasParentWayTags returns whether any point table has parent_way_tags
+// columns. The import requires the node to way references of the diff cache
+// for these columns.
+func (m *Mapping) HasParentWayTags() bool {
+	for _, t := range m.Conf.Tables {
+		if !tableMatchesType(t, PointTable) {
+			continue
+		}
+		for _, col := range t.Columns {
+			if col.Type == "parent_way_tags" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parentWayTags adds the keys of all parent_way_tags columns. These tags are
+// required for the ways.
+func (m *Mapping) parentWayTags(tags map[Key]bool) {
+	for _, key := range m.ParentWayTagKeys() {
+		tags[Key(key)] = true
+	}
+}
+
+// ParentWayTagKeys returns the keys of all parent_way_tags columns. Ways
+// with any of these keys are parent ways, even if they are not inserted
+// into a table.
+func (m *Mapping) ParentWayTagKeys() ParentWayKeys {
+	var keys ParentWayKeys
+	seen := make(map[string]bool)
+	for _, t := range m.Conf.Tables {
+		if !tableMatchesType(t, PointTable) {
+			continue
+		}
+		for _, col := range t.Columns {
+			if col.Type == "parent_way_tags" && col.Key != "" && !seen[string(col.Key)] {
+				seen[string(col.Key)] = true
+				keys = append(keys, string(col.Key))
+			}
+		}
+	}
+	return keys
+}
+
 func (m *Mapping) extraTags(tableType TableType, tags map[Key]bool) {
 	for _, t := range m.Conf.Tables {
 		if !tableMatchesType(t, tableType) {
@@ -356,6 +605,11 @@ func (m *Mapping) extraTags(tableType TableType, tags map[Key]bool) {
 				tags["type"] = true
 			}
 		}
+
+		if tableType == AddressInterpolationTable {
+			// required for the address nodes of the interpolation
+			tags["addr:housenumber"] = true
+		}
 	}
 	for _, k := range m.Conf.Tags.Include {
 		tags[Key(k)] = true
@@ -456,7 +710,10 @@ func (m *Mapping) addRelationFilters(tableType TableType, filters tableElementFi
 
 func tableMatchesType(t *config.Table, tableType TableType) bool {
 	ttype := TableType(t.Type)
-	if ttype == GeometryTable || ttype == tableType {
+	if ttype == tableType {
+		return true
+	}
+	if ttype == GeometryTable && tableType != AddressInterpolationTable {
 		return true
 	}
 	if ttype == PointOrPolygonTable && (tableType == PointTable || tableType == PolygonTable) {
@@ -510,16 +767,8 @@ func (m *Mapping) addFilters(filters tableElementFilters) {
 			}
 		}
 
-		if t.Filters.Filter != "" {
-			program, err := expr.Compile(
-				t.Filters.Filter,
-				expr.Env(filterExprEnv{}),
-				expr.AsBool(),
-			)
-			if err != nil {
-				panic(fmt.Sprintf("invalid filter expression for table %s: %v", name, err))
-			}
-			filters[name] = append(filters[name], makeExprFilterFunction(program))
+		if f, ok := m.filterExprs[name]; ok && !f.late {
+			filters[name] = append(filters[name], makeExprFilterFunction(f.program))
 		}
 
 	}
@@ -609,14 +858,16 @@ func makeFiltersFunction(tablename string, virtualTrue bool, virtualFalse bool,
 }
 
 type filterExprEnv struct {
-	Tags   map[string]string `expr:"tags"`
-	Type   string            `expr:"type"`
-	Closed bool              `expr:"closed"`
+	Tags map[string]string `expr:"tags"`
+	elementExprEnv
 }
 
 func makeExprFilterFunction(program *vm.Program) func(tags osm.Tags, key Key, elemType string, closed bool) bool {
 	return func(tags osm.Tags, key Key, elemType string, closed bool) bool {
-		result, err := expr.Run(program, filterExprEnv{Tags: tags, Type: elemType, Closed: closed})
+		env := filterExprEnv{Tags: tags}
+		env.Type = elemType
+		env.Closed = closed
+		result, err := expr.Run(program, env)
 		if err != nil {
 			return false
 		}
@@ -627,3 +878,108 @@ func makeExprFilterFunction(program *vm.Program) func(tags osm.Tags, key Key, el
 		return accepted
 	}
 }
+
+// memberFilter returns true if a relation member should be inserted.
+type memberFilter func(member *osm.Member) bool
+
+var memberTypeNames = map[string]osm.MemberType{
+	"node":     osm.NodeMember,
+	"way":      osm.WayMember,
+	"relation": osm.RelationMember,
+}
+
+type memberFilterExprEnv struct {
+	Role string            `expr:"role"`
+	Type string            `expr:"type"`
+	Tags map[string]string `expr:"tags"`
+}
+
+// makeMemberFilter combines all member filters of a relation_member table.
+// Returns nil if no member filters are configured.
+func makeMemberFilter(f *config.Filters) (memberFilter, error) {
+	var filters []memberFilter
+
+	if f.MemberTypes != nil {
+		types := make(map[osm.MemberType]struct{})
+		for _, t := range f.MemberTypes {
+			memberType, ok := memberTypeNames[t]
+			if !ok {
+				return nil, errors.Errorf("unknown member type %q in member_types, expected node, way or relation", t)
+			}
+			types[memberType] = struct{}{}
+		}
+		filters = append(filters, func(member *osm.Member) bool {
+			_, ok := types[member.Type]
+			return ok
+		})
+	}
+
+	if f.MemberRoles != nil {
+		roles := make(map[string]struct{})
+		for _, r := range f.MemberRoles {
+			roles[r] = struct{}{}
+		}
+		filters = append(filters, func(member *osm.Member) bool {
+			_, ok := roles[member.Role]
+			return ok
+		})
+	}
+
+	if f.ExcludeMemberRoles != nil {
+		roles := make(map[string]struct{})
+		for _, r := range f.ExcludeMemberRoles {
+			roles[r] = struct{}{}
+		}
+		filters = append(filters, func(member *osm.Member) bool {
+			_, ok := roles[member.Role]
+			return !ok
+		})
+	}
+
+	if f.MemberFilter != "" {
+		program, err := expr.Compile(
+			f.MemberFilter,
+			expr.Env(memberFilterExprEnv{}),
+			expr.AsBool(),
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid member_filter expression")
+		}
+		filters = append(filters, func(member *osm.Member) bool {
+			env := memberFilterExprEnv{Role: member.Role, Type: memberTypeName(member.Type)}
+			if member.Element != nil {
+				env.Tags = member.Element.Tags
+			}
+			result, err := expr.Run(program, env)
+			if err != nil {
+				return false
+			}
+			accepted, ok := result.(bool)
+			return ok && accepted
+		})
+	}
+
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	return func(member *osm.Member) bool {
+		for _, f := range filters {
+			if !f(member) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func memberTypeName(t osm.MemberType) string {
+	switch t {
+	case osm.NodeMember:
+		return "node"
+	case osm.WayMember:
+		return "way"
+	case osm.RelationMember:
+		return "relation"
+	}
+	return ""
+}
@@ -3,9 +3,11 @@ package mapping
 import (
 	"sort"
 	"strings"
+	"sync"
 
 	osm "github.com/omniscale/go-osm"
 	"github.com/omniscale/imposm3/geom"
+	"github.com/omniscale/imposm3/geom/geos"
 )
 
 func (m *Mapping) pointMatcher() (NodeMatcher, error) {
@@ -15,13 +17,16 @@ func (m *Mapping) pointMatcher() (NodeMatcher, error) {
 	m.addFilters(filters)
 	m.addTypedFilters(PointTable, filters)
 	tables, err := m.tables(PointTable)
-	return &tagMatcher{
+	tm := &tagMatcher{
 		mappings:    mappings,
+		patterns:    mappings.patterns(),
 		filters:     filters,
 		tables:      tables,
 		multiValues: m.multiValues(PointTable),
 		matchAreas:  false,
-	}, err
+	}
+	tm.compile()
+	return tm, err
 }
 
 func (m *Mapping) lineStringMatcher() (WayMatcher, error) {
@@ -31,13 +36,16 @@ func (m *Mapping) lineStringMatcher() (WayMatcher, error) {
 	m.addFilters(filters)
 	m.addTypedFilters(LineStringTable, filters)
 	tables, err := m.tables(LineStringTable)
-	return &tagMatcher{
+	tm := &tagMatcher{
 		mappings:    mappings,
+		patterns:    mappings.patterns(),
 		filters:     filters,
 		tables:      tables,
 		multiValues: m.multiValues(LineStringTable),
 		matchAreas:  false,
-	}, err
+	}
+	tm.compile()
+	return tm, err
 }
 
 func (m *Mapping) polygonMatcher() (RelWayMatcher, error) {
@@ -49,14 +57,17 @@ func (m *Mapping) polygonMatcher() (RelWayMatcher, error) {
 	relFilters := make(tableElementFilters)
 	m.addRelationFilters(PolygonTable, relFilters)
 	tables, err := m.tables(PolygonTable)
-	return &tagMatcher{
+	tm := &tagMatcher{
 		mappings:    mappings,
+		patterns:    mappings.patterns(),
 		filters:     filters,
 		tables:      tables,
 		relFilters:  relFilters,
 		multiValues: m.multiValues(PolygonTable),
 		matchAreas:  true,
-	}, err
+	}
+	tm.compile()
+	return tm, err
 }
 
 func (m *Mapping) relationMatcher() (RelationMatcher, error) {
@@ -69,14 +80,17 @@ func (m *Mapping) relationMatcher() (RelationMatcher, error) {
 	relFilters := make(tableElementFilters)
 	m.addRelationFilters(RelationTable, relFilters)
 	tables, err := m.tables(RelationTable)
-	return &tagMatcher{
+	tm := &tagMatcher{
 		mappings:    mappings,
+		patterns:    mappings.patterns(),
 		filters:     filters,
 		tables:      tables,
 		relFilters:  relFilters,
 		multiValues: m.multiValues(RelationTable),
 		matchAreas:  true,
-	}, err
+	}
+	tm.compile()
+	return tm, err
 }
 
 func (m *Mapping) relationMemberMatcher() (RelationMatcher, error) {
@@ -88,14 +102,35 @@ func (m *Mapping) relationMemberMatcher() (RelationMatcher, error) {
 	relFilters := make(tableElementFilters)
 	m.addRelationFilters(RelationMemberTable, relFilters)
 	tables, err := m.tables(RelationMemberTable)
-	return &tagMatcher{
+	tm := &tagMatcher{
 		mappings:    mappings,
+		patterns:    mappings.patterns(),
 		filters:     filters,
 		tables:      tables,
 		relFilters:  relFilters,
 		multiValues: m.multiValues(RelationMemberTable),
 		matchAreas:  true,
-	}, err
+	}
+	tm.compile()
+	return tm, err
+}
+
+func (m *Mapping) addressInterpolationMatcher() (WayMatcher, error) {
+	mappings := make(TagTableMapping)
+	m.mappings(AddressInterpolationTable, mappings)
+	filters := make(tableElementFilters)
+	m.addFilters(filters)
+	tables, err := m.tables(AddressInterpolationTable)
+	tm := &tagMatcher{
+		mappings:    mappings,
+		patterns:    mappings.patterns(),
+		filters:     filters,
+		tables:      tables,
+		multiValues: m.multiValues(AddressInterpolationTable),
+		matchAreas:  false,
+	}
+	tm.compile()
+	return tm, err
 }
 
 type NodeMatcher interface {
@@ -120,23 +155,216 @@ type Match struct {
 	Value   string
 	Table   DestTable
 	builder *rowBuilder
+
+	// context for expressions
+	elementType string
+	closed      bool
+	member      *osm.Member
+	memberIndex int
+	// parentWays are all ways that reference the matched node, see
+	// SetParentWays.
+	parentWays []*osm.Way
 }
 
 func (m *Match) Row(elem *osm.Element, geom *geom.Geometry) []interface{} {
 	return m.builder.MakeRow(elem, geom, *m)
 }
 
-func (m *Match) MemberRow(rel *osm.Relation, member *osm.Member, memberIndex int, geom *geom.Geometry) []interface{} {
-	return m.builder.MakeMemberRow(rel, member, memberIndex, geom, *m)
+// MemberRow returns the row for a member of a relation_member table.
+// parents contains the IDs of all relations from rel down to the relation
+// that contains the member directly.
+func (m *Match) MemberRow(rel *osm.Relation, member *osm.Member, memberIndex int, parents []int64, geom *geom.Geometry) []interface{} {
+	return m.builder.MakeMemberRow(rel, member, memberIndex, parents, geom, *m)
+}
+
+// FlattenMembers returns whether the relation members should be expanded
+// recursively for the table of this match.
+func (m *Match) FlattenMembers() bool {
+	return m.builder != nil && m.builder.flattenMembers
+}
+
+// Subdivide returns the max. number of vertices for each part of
+// subdivided polygons, or 0 if the table of this match is not subdivided.
+func (m *Match) Subdivide() int {
+	if m.builder == nil {
+		return 0
+	}
+	return m.builder.subdivide
+}
+
+// NeedsGeometry returns whether the table of this match requires the GEOS
+// geometry for columns, geometry filters or subdivide. The (E)WKB of points
+// and linestrings can be created without GEOS if no match needs the
+// geometry.
+func (m *Match) NeedsGeometry() bool {
+	return m.builder == nil || m.builder.needsGeometry
+}
+
+// NeedsParentWays returns whether the table of this match has
+// parent_way_tags columns that require the parent ways.
+func (m *Match) NeedsParentWays() bool {
+	return m.builder != nil && m.builder.parentWays
+}
+
+// SetParentWays sets all ways that reference the matched node, for the
+// parent_way_tags columns of the row.
+func (m *Match) SetParentWays(ways []*osm.Way) {
+	m.parentWays = ways
+}
+
+// ParentWayKeys are the keys of all parent_way_tags columns.
+type ParentWayKeys []string
+
+// Match returns whether tags contain any of the keys.
+func (k ParentWayKeys) Match(tags osm.Tags) bool {
+	for _, key := range k {
+		if _, ok := tags[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptMember returns whether the member should be inserted into the
+// relation_member table of this match.
+func (m *Match) AcceptMember(member *osm.Member) bool {
+	if m.builder == nil || m.builder.memberFilter == nil {
+		return true
+	}
+	return m.builder.memberFilter(member)
+}
+
+// AcceptGeometry returns whether the geometry of elem passes all geometry
+// filters of the table of this match.
+func (m *Match) AcceptGeometry(g *geos.Geos, elem *osm.Element, geom *geos.Geom) bool {
+	if m.builder == nil || m.builder.geometryFilter == nil {
+		return true
+	}
+	return m.builder.geometryFilter(g, elem, geom, m)
 }
 
 type tagMatcher struct {
 	mappings    TagTableMapping
+	patterns    []tagPattern
 	tables      map[string]*rowBuilder
 	filters     tableElementFilters
 	relFilters  tableElementFilters
 	multiValues tableElementMultiValues
 	matchAreas  bool
+
+	// compiled lookup structures, see compile
+	destTables    []matchTable
+	keys          map[Key]*keyMapping
+	anyTables     []tableRef
+	patternTables [][]tableRef
+	hitsPool      sync.Pool
+}
+
+// matchTable contains everything that is needed to create the Match for
+// a destination table.
+type matchTable struct {
+	DestTable
+	builder    *rowBuilder
+	filters    []elementFilter
+	relFilters []elementFilter
+}
+
+// tableRef references a destination table from a mapping.
+type tableRef struct {
+	table       int // index into tagMatcher.destTables
+	order       int
+	multiValues bool
+}
+
+// keyMapping contains all destination tables for a single mapping key.
+type keyMapping struct {
+	any    []tableRef
+	values map[Value][]tableRef
+	// hasMultiValues is set if any table splits values of this key.
+	hasMultiValues bool
+}
+
+// compile creates the lookup structures for match from the mappings.
+// Destination tables are numbered in a fixed order, so that matches are
+// always returned in the same order.
+func (tm *tagMatcher) compile() {
+	tableIndex := make(map[DestTable]int)
+	addTable := func(t DestTable) {
+		if _, ok := tableIndex[t]; !ok {
+			tableIndex[t] = -1
+			tm.destTables = append(tm.destTables, matchTable{DestTable: t})
+		}
+	}
+	for _, values := range tm.mappings {
+		for _, tables := range values {
+			for _, t := range tables {
+				addTable(t.DestTable)
+			}
+		}
+	}
+	sort.Slice(tm.destTables, func(i, j int) bool {
+		a, b := tm.destTables[i], tm.destTables[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.SubMapping < b.SubMapping
+	})
+	for i := range tm.destTables {
+		t := &tm.destTables[i]
+		tableIndex[t.DestTable] = i
+		t.builder = tm.tables[t.Name]
+		t.filters = tm.filters[t.Name]
+		t.relFilters = tm.relFilters[t.Name]
+	}
+
+	refs := func(key Key, tables []orderedDestTable) []tableRef {
+		result := make([]tableRef, 0, len(tables))
+		for _, t := range tables {
+			result = append(result, tableRef{
+				table:       tableIndex[t.DestTable],
+				order:       t.order,
+				multiValues: tm.multiValuesForTableKey(t.Name, key),
+			})
+		}
+		return result
+	}
+
+	tm.keys = make(map[Key]*keyMapping, len(tm.mappings))
+	for k, values := range tm.mappings {
+		km := &keyMapping{values: make(map[Value][]tableRef, len(values))}
+		for v, tables := range values {
+			r := refs(k, tables)
+			if v == "__any__" {
+				km.any = r
+			} else {
+				km.values[v] = r
+			}
+			for _, ref := range r {
+				if ref.multiValues {
+					km.hasMultiValues = true
+				}
+			}
+		}
+		tm.keys[k] = km
+	}
+	if km, ok := tm.keys["__any__"]; ok {
+		tm.anyTables = km.any
+	}
+
+	// multiValues of pattern refs depends on the matched key, see matchPatterns
+	tm.patternTables = make([][]tableRef, len(tm.patterns))
+	for i, p := range tm.patterns {
+		for _, t := range p.tables {
+			tm.patternTables[i] = append(tm.patternTables[i], tableRef{
+				table: tableIndex[t.DestTable],
+				order: t.order,
+			})
+		}
+	}
+
+	tm.hitsPool.New = func() interface{} {
+		return &matchHits{}
+	}
 }
 
 func (tm *tagMatcher) MatchNode(node *osm.Node) []Match {
@@ -168,137 +396,197 @@ func (tm *tagMatcher) MatchRelation(rel *osm.Relation) []Match {
 	return matches
 }
 
-type orderedMatch struct {
-	Match
-	order int
+// matchHit is a single tag that matched a destination table.
+type matchHit struct {
+	table       int
+	key         string
+	value       string
+	order       int
+	multiValues bool
 }
 
-func (tm *tagMatcher) match(tags osm.Tags, elemType string, closed bool) []Match {
-	type tableKeyMatches struct {
-		order   int
-		matches []orderedMatch
-	}
-
-	tables := make(map[DestTable]map[Key]*tableKeyMatches)
-
-	addTableMatch := func(k, v string, t orderedDestTable) {
-		keyMatches, ok := tables[t.DestTable]
-
-		if !ok {
-			keyMatches = make(map[Key]*tableKeyMatches)
-			tables[t.DestTable] = keyMatches
-		}
-
-		entry, ok := keyMatches[Key(k)]
-
-		if !ok {
-			entry = &tableKeyMatches{order: t.order}
-			keyMatches[Key(k)] = entry
-		} else if t.order < entry.order {
-			entry.order = t.order
+// matchHits collects all hits of a single element. matchHits are reused
+// for multiple elements to avoid allocations.
+type matchHits []matchHit
+
+func (h *matchHits) add(ref tableRef, key, value string) {
+	hits := *h
+	for i := range hits {
+		// same tag matched by exact mapping and pattern
+		if hits[i].table == ref.table && hits[i].key == key && hits[i].value == value {
+			if ref.order < hits[i].order {
+				hits[i].order = ref.order
+			}
+			return
 		}
-
-		entry.matches = append(entry.matches, orderedMatch{
-			Match: Match{
-				Key:     k,
-				Value:   v,
-				Table:   t.DestTable,
-				builder: tm.tables[t.Name],
-			},
-			order: t.order,
-		})
 	}
+	*h = append(hits, matchHit{
+		table:       ref.table,
+		key:         key,
+		value:       value,
+		order:       ref.order,
+		multiValues: ref.multiValues,
+	})
+}
 
-	if values, ok := tm.mappings[Key("__any__")]; ok {
-		for _, t := range values["__any__"] {
-			addTableMatch("__any__", "__any__", t)
+// sort orders hits by table, key and order. Uses a stable insertion sort,
+// as elements only have a few hits.
+func (h matchHits) sort() {
+	for i := 1; i < len(h); i++ {
+		for j := i; j > 0 && h[j].less(&h[j-1]); j-- {
+			h[j], h[j-1] = h[j-1], h[j]
 		}
 	}
+}
 
-	for k, v := range tags {
-		values, ok := tm.mappings[Key(k)]
+func (a *matchHit) less(b *matchHit) bool {
+	if a.table != b.table {
+		return a.table < b.table
+	}
+	if a.key != b.key {
+		return a.key < b.key
+	}
+	return a.order < b.order
+}
 
-		if ok {
-			if tbls, ok := values["__any__"]; ok {
-				for _, t := range tbls {
-					addTableMatch(k, v, t)
-				}
+// matchPatterns adds hits for all patterns that match the tag.
+func (tm *tagMatcher) matchPatterns(k, v string, hits *matchHits) {
+	for i := range tm.patterns {
+		p := &tm.patterns[i]
+		if !p.matchesKey(k) {
+			continue
+		}
+		if p.matchesValue(v) {
+			for _, ref := range tm.patternTables[i] {
+				ref.multiValues = tm.multiValuesForTableKey(tm.destTables[ref.table].Name, Key(k))
+				hits.add(ref, k, v)
 			}
-
-			if tbls, ok := values[Value(v)]; ok {
-				for _, t := range tbls {
-					addTableMatch(k, v, t)
+			continue
+		}
+		if strings.Contains(v, ";") {
+			for _, val := range splitTagValues(v) {
+				if !p.matchesValue(val) {
+					continue
+				}
+				for _, ref := range tm.patternTables[i] {
+					ref.multiValues = tm.multiValuesForTableKey(tm.destTables[ref.table].Name, Key(k))
+					if ref.multiValues {
+						hits.add(ref, k, val)
+					}
 				}
 			}
+		}
+	}
+}
 
-			if strings.Contains(v, ";") {
-				for _, val := range splitTagValues(v) {
-					if tbls, ok := values[Value(val)]; ok {
-						for _, t := range tbls {
-							if tm.multiValuesForTableKey(t.Name, Key(k)) {
-								addTableMatch(k, val, t)
-							}
-						}
+// match returns all matches for tags. Each table is matched by a single key,
+// the key with the lowest mapping order. Tables with multi_values for this
+// key return a match for each value, other tables only the value with the
+// lowest mapping order.
+func (tm *tagMatcher) match(tags osm.Tags, elemType string, closed bool) []Match {
+	hits := tm.hitsPool.Get().(*matchHits)
+	*hits = (*hits)[:0]
+	defer tm.hitsPool.Put(hits)
+
+	for _, ref := range tm.anyTables {
+		hits.add(ref, "__any__", "__any__")
+	}
+
+	for k, v := range tags {
+		km, ok := tm.keys[Key(k)]
+		if !ok {
+			continue
+		}
+		for _, ref := range km.any {
+			hits.add(ref, k, v)
+		}
+		for _, ref := range km.values[Value(v)] {
+			hits.add(ref, k, v)
+		}
+		if km.hasMultiValues && strings.Contains(v, ";") {
+			for _, val := range splitTagValues(v) {
+				for _, ref := range km.values[Value(val)] {
+					if ref.multiValues {
+						hits.add(ref, k, val)
 					}
 				}
 			}
 		}
 	}
+	if len(tm.patterns) > 0 {
+		for k, v := range tags {
+			tm.matchPatterns(k, v, hits)
+		}
+	}
+
+	h := *hits
+	if len(h) == 0 {
+		return nil
+	}
+	h.sort()
+
 	var matches []Match
-	for t, keyMatches := range tables {
-		var selected *tableKeyMatches
-		for key, entry := range keyMatches {
-			if !tm.multiValuesForTableKey(t.Name, key) {
-				entry.matches = reduceMatches(entry.matches)
-				if len(entry.matches) == 0 {
-					continue
-				}
-				entry.order = entry.matches[0].order
+	for start := 0; start < len(h); {
+		table := h[start].table
+		end := start
+		for end < len(h) && h[end].table == table {
+			end++
+		}
+
+		// select the key with the lowest order, hits of each key are
+		// already ordered
+		selStart, selEnd := -1, -1
+		for i := start; i < end; {
+			j := i
+			for j < end && h[j].key == h[i].key {
+				j++
 			}
-			if selected == nil || entry.order < selected.order {
-				selected = entry
+			if selStart == -1 || h[i].order < h[selStart].order {
+				selStart, selEnd = i, j
+				if !h[i].multiValues {
+					selEnd = i + 1
+				}
 			}
+			i = j
 		}
-		if selected == nil || len(selected.matches) == 0 {
+		start = end
+
+		t := &tm.destTables[table]
+		key := Key(h[selStart].key)
+		if !acceptElement(t.filters, tags, key, elemType, closed) {
 			continue
 		}
-
-		sort.SliceStable(selected.matches, func(i, j int) bool {
-			return selected.matches[i].order < selected.matches[j].order
-		})
-
-		match := selected.matches[0].Match
-		filters, ok := tm.filters[t.Name]
-		filteredOut := false
-		if ok {
-			for _, filter := range filters {
-				if !filter(tags, Key(match.Key), elemType, closed) {
-					filteredOut = true
-					break
-				}
-			}
+		if elemType == "relation" && !acceptElement(t.relFilters, tags, key, elemType, closed) {
+			continue
 		}
-		if elemType == "relation" && !filteredOut {
-			filters, ok := tm.relFilters[t.Name]
-			if ok {
-				for _, filter := range filters {
-					if !filter(tags, Key(match.Key), elemType, closed) {
-						filteredOut = true
-						break
-					}
-				}
-			}
+
+		if matches == nil {
+			matches = make([]Match, 0, len(h))
 		}
+		for i := selStart; i < selEnd; i++ {
+			matches = append(matches, Match{
+				Key:     h[i].key,
+				Value:   h[i].value,
+				Table:   t.DestTable,
+				builder: t.builder,
 
-		if !filteredOut {
-			for _, selectedMatch := range selected.matches {
-				matches = append(matches, selectedMatch.Match)
-			}
+				elementType: elemType,
+				closed:      closed,
+			})
 		}
 	}
 	return matches
 }
 
+func acceptElement(filters []elementFilter, tags osm.Tags, key Key, elemType string, closed bool) bool {
+	for _, filter := range filters {
+		if !filter(tags, key, elemType, closed) {
+			return false
+		}
+	}
+	return true
+}
+
 func (tm *tagMatcher) multiValuesForTableKey(tableName string, key Key) bool {
 	if multiValues, ok := tm.multiValues[tableName]; ok {
 		if _, ok := multiValues["__any__"]; ok {
@@ -311,19 +599,6 @@ func (tm *tagMatcher) multiValuesForTableKey(tableName string, key Key) bool {
 	return false
 }
 
-func reduceMatches(matches []orderedMatch) []orderedMatch {
-	if len(matches) == 0 {
-		return matches
-	}
-	best := matches[0]
-	for i := 1; i < len(matches); i++ {
-		if matches[i].order < best.order {
-			best = matches[i]
-		}
-	}
-	return []orderedMatch{best}
-}
-
 type valueBuilder struct {
 	key     Key
 	colType ColumnType
@@ -336,7 +611,7 @@ func (v *valueBuilder) Value(elem *osm.Element, geom *geom.Geometry, match Match
 	return nil
 }
 
-func (v *valueBuilder) MemberValue(rel *osm.Relation, member *osm.Member, memberIndex int, geom *geom.Geometry, match Match) interface{} {
+func (v *valueBuilder) MemberValue(rel *osm.Relation, member *osm.Member, memberIndex int, parents []int64, geom *geom.Geometry, match Match) interface{} {
 	if v.colType.Func != nil {
 		if v.colType.FromMember {
 			if member.Element == nil {
@@ -347,27 +622,37 @@ func (v *valueBuilder) MemberValue(rel *osm.Relation, member *osm.Member, member
 		return v.colType.Func(rel.Tags[string(v.key)], &rel.Element, geom, match)
 	}
 	if v.colType.MemberFunc != nil {
-		return v.colType.MemberFunc(rel, member, memberIndex, match)
+		return v.colType.MemberFunc(rel, member, memberIndex, parents, match)
 	}
 	return nil
 }
 
 type rowBuilder struct {
-	columns []valueBuilder
+	columns        []valueBuilder
+	flattenMembers bool
+	memberFilter   memberFilter
+	parentWays     bool
+	subdivide      int
+	geometryFilter geometryFilter
+	// needsGeometry is set if any column, filter or option of the table
+	// requires the GEOS geometry.
+	needsGeometry bool
 }
 
 func (r *rowBuilder) MakeRow(elem *osm.Element, geom *geom.Geometry, match Match) []interface{} {
-	var row []interface{}
-	for _, column := range r.columns {
-		row = append(row, column.Value(elem, geom, match))
+	row := make([]interface{}, len(r.columns))
+	for i := range r.columns {
+		row[i] = r.columns[i].Value(elem, geom, match)
 	}
 	return row
 }
 
-func (r *rowBuilder) MakeMemberRow(rel *osm.Relation, member *osm.Member, memberIndex int, geom *geom.Geometry, match Match) []interface{} {
-	var row []interface{}
-	for _, column := range r.columns {
-		row = append(row, column.MemberValue(rel, member, memberIndex, geom, match))
+func (r *rowBuilder) MakeMemberRow(rel *osm.Relation, member *osm.Member, memberIndex int, parents []int64, geom *geom.Geometry, match Match) []interface{} {
+	match.member = member
+	match.memberIndex = memberIndex
+	row := make([]interface{}, len(r.columns))
+	for i := range r.columns {
+		row[i] = r.columns[i].MemberValue(rel, member, memberIndex, parents, geom, match)
 	}
 	return row
 }
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/geom"
 )
 
 func BenchmarkTagMatch(b *testing.B) {
@@ -14,9 +15,187 @@ func BenchmarkTagMatch(b *testing.B) {
 	matcher := m.PolygonMatcher
 	for i := 0; i < b.N; i++ {
 		e := osm.Relation{}
-		e.Tags = osm.Tags{"landuse": "forest", "name": "Forest", "source": "bling", "tourism": "zoo"}
+		e.Tags = osm.Tags{"type": "multipolygon", "landuse": "forest", "name": "Forest", "source": "bling", "tourism": "zoo"}
 		if m := matcher.MatchRelation(&e); len(m) != 1 {
 			b.Fatal(m)
 		}
 	}
 }
+
+func TestMatchOrder(t *testing.T) {
+	m, err := FromFile("../example-mapping.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	way := osm.Way{Refs: []int64{1, 2, 3, 1}}
+	way.Tags = osm.Tags{
+		"landuse": "residential", "building": "yes", "amenity": "school",
+	}
+	// matches are ordered by table name for repeatable imports
+	expected := []string{"buildings", "landusages"}
+	for i := 0; i < 20; i++ {
+		matches := m.PolygonMatcher.MatchWay(&way)
+		if len(matches) != len(expected) {
+			t.Fatal(matches)
+		}
+		for j, match := range matches {
+			if match.Table.Name != expected[j] {
+				t.Fatalf("unexpected table order: %v", matches)
+			}
+		}
+	}
+}
+
+func TestMatchNeedsGeometry(t *testing.T) {
+	m, err := New([]byte(`
+    tables:
+      roads:
+        type: linestring
+        columns:
+        - {name: geometry, type: geometry}
+        - {name: name, type: string, key: name}
+        - {name: type, type: mapping_value}
+        mapping:
+          highway: [__any__]
+      long_roads:
+        type: linestring
+        filters:
+          min_length: 1000
+        mapping:
+          highway: [motorway]
+      rivers:
+        type: linestring
+        columns:
+        - {name: length, type: expression, args: {expression: 'string(length)'}}
+        mapping:
+          waterway: [river]
+      canals:
+        type: linestring
+        columns:
+        - {name: kind, type: expression, args: {expression: 'tags["waterway"]'}}
+        mapping:
+          waterway: [canal]
+      centroids:
+        type: linestring
+        columns:
+        - {name: geometry, type: geometry, geometry_transform: centroid}
+        mapping:
+          railway: [rail]
+    `))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		tags     osm.Tags
+		expected map[string]bool
+	}{
+		{osm.Tags{"highway": "primary"}, map[string]bool{"roads": false}},
+		{osm.Tags{"highway": "motorway"}, map[string]bool{"roads": false, "long_roads": true}},
+		{osm.Tags{"waterway": "river"}, map[string]bool{"rivers": true}},
+		{osm.Tags{"waterway": "canal"}, map[string]bool{"canals": false}},
+		{osm.Tags{"railway": "rail"}, map[string]bool{"centroids": true}},
+	} {
+		way := osm.Way{Refs: []int64{1, 2}}
+		way.Tags = tc.tags
+		matches := m.LineStringMatcher.MatchWay(&way)
+		if len(matches) != len(tc.expected) {
+			t.Fatalf("unexpected matches for %v: %v", tc.tags, matches)
+		}
+		for _, match := range matches {
+			if match.NeedsGeometry() != tc.expected[match.Table.Name] {
+				t.Errorf("unexpected NeedsGeometry for %s", match.Table.Name)
+			}
+		}
+	}
+}
+
+func loadExampleMapping(b *testing.B) *Mapping {
+	m, err := FromFile("../example-mapping.yml")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return m
+}
+
+func BenchmarkMatchNode(b *testing.B) {
+	m := loadExampleMapping(b)
+	node := osm.Node{}
+	node.Tags = osm.Tags{
+		"amenity": "library", "name": "Stadtbibliothek", "wheelchair": "yes",
+		"addr:street": "Hauptstraße", "addr:housenumber": "1", "opening_hours": "Mo-Fr 10:00-18:00",
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if matches := m.PointMatcher.MatchNode(&node); len(matches) != 2 {
+			b.Fatal(matches)
+		}
+	}
+}
+
+func BenchmarkMatchNodeNoMatch(b *testing.B) {
+	m := loadExampleMapping(b)
+	node := osm.Node{}
+	node.Tags = osm.Tags{"created_by": "JOSM", "source": "survey"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if matches := m.PointMatcher.MatchNode(&node); len(matches) != 0 {
+			b.Fatal(matches)
+		}
+	}
+}
+
+func BenchmarkMatchWayLineString(b *testing.B) {
+	m := loadExampleMapping(b)
+	way := osm.Way{Refs: []int64{1, 2, 3}}
+	way.Tags = osm.Tags{
+		"highway": "residential", "name": "Hauptstraße", "oneway": "yes",
+		"surface": "asphalt", "maxspeed": "30", "lit": "yes",
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if matches := m.LineStringMatcher.MatchWay(&way); len(matches) != 1 {
+			b.Fatal(matches)
+		}
+	}
+}
+
+func BenchmarkMatchWayPolygon(b *testing.B) {
+	m := loadExampleMapping(b)
+	way := osm.Way{Refs: []int64{1, 2, 3, 1}}
+	way.Tags = osm.Tags{
+		"building": "yes", "addr:street": "Hauptstraße", "addr:housenumber": "1",
+		"amenity": "school", "name": "Grundschule",
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if matches := m.PolygonMatcher.MatchWay(&way); len(matches) != 2 {
+			b.Fatal(matches)
+		}
+	}
+}
+
+func BenchmarkMakeRow(b *testing.B) {
+	m := loadExampleMapping(b)
+	way := osm.Way{Refs: []int64{1, 2, 3}}
+	way.ID = 42
+	way.Tags = osm.Tags{
+		"highway": "residential", "name": "Hauptstraße", "oneway": "yes",
+		"bridge": "yes", "layer": "1", "ref": "B 1",
+	}
+	matches := m.LineStringMatcher.MatchWay(&way)
+	if len(matches) != 1 {
+		b.Fatal(matches)
+	}
+	g := &geom.Geometry{Wkb: []byte{0}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if row := matches[0].Row(&way.Element, g); len(row) != 12 {
+			b.Fatal(row)
+		}
+	}
+}
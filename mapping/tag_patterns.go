@@ -0,0 +1,121 @@
+package mapping
+
+import (
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Mapping keys and values can be patterns. Values starting with ~ are
+// regular expressions, values with *, ? or [ are glob patterns
+// (see path.Match).
+
+// isPattern returns whether the mapping key or value is a pattern.
+func isPattern(s string) bool {
+	return strings.HasPrefix(s, "~") || strings.ContainsAny(s, "*?[")
+}
+
+// stringPattern is a compiled glob or regular expression pattern.
+type stringPattern struct {
+	raw    string
+	regexp *regexp.Regexp
+}
+
+func compilePattern(s string) (*stringPattern, error) {
+	if strings.HasPrefix(s, "~") {
+		r, err := regexp.Compile(s[1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid regular expression %q", s)
+		}
+		return &stringPattern{raw: s, regexp: r}, nil
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return nil, errors.Wrapf(err, "invalid pattern %q", s)
+	}
+	return &stringPattern{raw: s}, nil
+}
+
+func (p *stringPattern) matches(s string) bool {
+	if p.regexp != nil {
+		return p.regexp.MatchString(s)
+	}
+	ok, _ := path.Match(p.raw, s)
+	return ok
+}
+
+// tagPattern is a mapping with a pattern for the key and/or the value.
+type tagPattern struct {
+	// key is nil for exact keys
+	key      *stringPattern
+	exactKey Key
+	// value is nil for __any__ and exact values
+	value      *stringPattern
+	exactValue Value
+	tables     []orderedDestTable
+}
+
+func (p *tagPattern) matchesKey(k string) bool {
+	if p.key != nil {
+		return p.key.matches(k)
+	}
+	return Key(k) == p.exactKey
+}
+
+func (p *tagPattern) matchesValue(v string) bool {
+	if p.value != nil {
+		return p.value.matches(v)
+	}
+	return p.exactValue == "__any__" || Value(v) == p.exactValue
+}
+
+// patterns returns all mappings with patterns, sorted by key and value.
+// Patterns are already validated by validatePatterns.
+func (tt TagTableMapping) patterns() []tagPattern {
+	var result []tagPattern
+	for k, values := range tt {
+		keyIsPattern := k != "__any__" && isPattern(string(k))
+		for v, tables := range values {
+			valueIsPattern := v != "__any__" && isPattern(string(v))
+			if !keyIsPattern && !valueIsPattern {
+				continue
+			}
+			p := tagPattern{exactKey: k, exactValue: v, tables: tables}
+			if keyIsPattern {
+				p.key, _ = compilePattern(string(k))
+			}
+			if valueIsPattern {
+				p.value, _ = compilePattern(string(v))
+			}
+			result = append(result, p)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].exactKey != result[j].exactKey {
+			return result[i].exactKey < result[j].exactKey
+		}
+		return result[i].exactValue < result[j].exactValue
+	})
+	return result
+}
+
+// validatePatterns checks all patterns of the mapping.
+func validatePatterns(tt TagTableMapping) error {
+	for k, values := range tt {
+		if k != "__any__" && isPattern(string(k)) {
+			if _, err := compilePattern(string(k)); err != nil {
+				return err
+			}
+		}
+		for v := range values {
+			if v != "__any__" && isPattern(string(v)) {
+				if _, err := compilePattern(string(v)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
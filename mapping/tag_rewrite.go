@@ -0,0 +1,194 @@
+package mapping
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	osm "github.com/omniscale/go-osm"
+	"github.com/omniscale/imposm3/mapping/config"
+	"github.com/pkg/errors"
+)
+
+// TagRewriter normalizes tags of elements before they are filtered and
+// matched. A TagRewriter is safe for concurrent use.
+type TagRewriter struct {
+	rules []tagRewriteRule
+}
+
+// tagRewriteRule modifies tags in place. elemType is point, way or
+// relation.
+type tagRewriteRule func(tags osm.Tags, elemType string)
+
+// Rewrite applies all rewrite rules to tags. Elements without tags are
+// not modified.
+func (r *TagRewriter) Rewrite(elemType string, tags *osm.Tags) {
+	if r == nil || len(*tags) == 0 {
+		return
+	}
+	for _, rule := range r.rules {
+		rule(*tags, elemType)
+	}
+}
+
+// TagRewriter returns the rewriter for the configured tag_rewrites, or nil
+// if no rewrites are configured. Rewrite is a no-op for a nil rewriter.
+func (m *Mapping) TagRewriter() *TagRewriter {
+	return m.tagRewriter
+}
+
+// rewriteExprIdentifiers are not available for set_tag conditions, as the
+// rules are applied before the geometry is built.
+var rewriteExprIdentifiers = map[string]struct{}{
+	"closed": {},
+}
+
+func newTagRewriter(rewrites []*config.TagRewrite) (*TagRewriter, error) {
+	if len(rewrites) == 0 {
+		return nil, nil
+	}
+	r := &TagRewriter{}
+	for i, rw := range rewrites {
+		rule, err := makeTagRewriteRule(rw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "tag_rewrites rule %d", i+1)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+func makeTagRewriteRule(rw *config.TagRewrite) (tagRewriteRule, error) {
+	if rw == nil {
+		return nil, errors.New("empty rule")
+	}
+	options := 0
+	for _, set := range []bool{
+		rw.RenameKey != nil, rw.MapValues != nil, rw.Lowercase != nil,
+		rw.Trim != nil, rw.Replace != nil, rw.SetTag != nil,
+	} {
+		if set {
+			options++
+		}
+	}
+	if options != 1 {
+		return nil, errors.New("requires exactly one of rename_key, map_values, lowercase, trim, replace or set_tag")
+	}
+
+	switch {
+	case rw.RenameKey != nil:
+		return makeRenameKeyRule(rw.RenameKey), nil
+	case rw.MapValues != nil:
+		return makeMapValuesRule(rw.MapValues), nil
+	case rw.Lowercase != nil:
+		return makeValueFuncRule(rw.Lowercase, strings.ToLower), nil
+	case rw.Trim != nil:
+		return makeValueFuncRule(rw.Trim, strings.TrimSpace), nil
+	case rw.Replace != nil:
+		return makeReplaceRule(rw.Replace)
+	default:
+		return makeSetTagRule(rw.SetTag)
+	}
+}
+
+// makeRenameKeyRule renames keys. The value of the new key is not
+// overwritten if it is already set, but the old key is always removed.
+func makeRenameKeyRule(renames map[config.Key]config.Key) tagRewriteRule {
+	// sort for a deterministic result if keys are renamed multiple times
+	from := make([]string, 0, len(renames))
+	for k := range renames {
+		from = append(from, string(k))
+	}
+	sort.Strings(from)
+	return func(tags osm.Tags, elemType string) {
+		for _, k := range from {
+			v, ok := tags[k]
+			if !ok {
+				continue
+			}
+			delete(tags, k)
+			to := string(renames[config.Key(k)])
+			if _, ok := tags[to]; !ok {
+				tags[to] = v
+			}
+		}
+	}
+}
+
+func makeMapValuesRule(mappings map[config.Key]map[string]string) tagRewriteRule {
+	return func(tags osm.Tags, elemType string) {
+		for k, values := range mappings {
+			v, ok := tags[string(k)]
+			if !ok {
+				continue
+			}
+			if newValue, ok := values[v]; ok {
+				tags[string(k)] = newValue
+			}
+		}
+	}
+}
+
+func makeValueFuncRule(keys []config.Key, f func(string) string) tagRewriteRule {
+	return func(tags osm.Tags, elemType string) {
+		for _, k := range keys {
+			if v, ok := tags[string(k)]; ok {
+				tags[string(k)] = f(v)
+			}
+		}
+	}
+}
+
+func makeReplaceRule(replace *config.TagReplace) (tagRewriteRule, error) {
+	if replace.Key == "" {
+		return nil, errors.New("missing key for replace")
+	}
+	re, err := regexp.Compile(replace.Regexp)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid regexp for replace")
+	}
+	key := string(replace.Key)
+	replacement := replace.Replacement
+	return func(tags osm.Tags, elemType string) {
+		if v, ok := tags[key]; ok {
+			tags[key] = re.ReplaceAllString(v, replacement)
+		}
+	}, nil
+}
+
+func makeSetTagRule(set *config.SetTag) (tagRewriteRule, error) {
+	if set.Key == "" {
+		return nil, errors.New("missing key for set_tag")
+	}
+	key := string(set.Key)
+	value := set.Value
+	if set.If == "" {
+		return func(tags osm.Tags, elemType string) {
+			tags[key] = value
+		}, nil
+	}
+
+	program, err := expr.Compile(
+		set.If,
+		expr.Env(filterExprEnv{}),
+		expr.AsBool(),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid if expression for set_tag")
+	}
+	if usesIdentifiers(program, geometryExprIdentifiers, rewriteExprIdentifiers) {
+		return nil, errors.New("if expression for set_tag only supports tags and type")
+	}
+	return func(tags osm.Tags, elemType string) {
+		env := filterExprEnv{Tags: tags}
+		env.Type = elemType
+		result, err := expr.Run(program, env)
+		if err != nil {
+			return
+		}
+		if ok, _ := result.(bool); ok {
+			tags[key] = value
+		}
+	}, nil
+}
@@ -0,0 +1,102 @@
+package mapping
+
+import (
+	"testing"
+
+	osm "github.com/omniscale/go-osm"
+)
+
+func TestTagRewriter(t *testing.T) {
+	mapping, err := New([]byte(`
+    tag_rewrites:
+      - rename_key: {Highway: highway}
+      - lowercase: [highway]
+      - trim: [name]
+      - map_values:
+          landuse: {farm: farmland}
+      - replace:
+          key: surface
+          regexp: '^([^;]*);.*$'
+          replacement: '$1'
+      - set_tag:
+          key: area
+          value: 'yes'
+          if: 'type == "way" && tags["leisure"] == "park"'
+    tables:
+      roads:
+        type: linestring
+        mapping:
+          highway: [residential]
+    `))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		elemType string
+		tags     osm.Tags
+		expected osm.Tags
+	}{
+		{"way", osm.Tags{"Highway": "Residential"}, osm.Tags{"highway": "residential"}},
+		{"way", osm.Tags{"Highway": "Primary", "highway": "Secondary"}, osm.Tags{"highway": "secondary"}},
+		{"way", osm.Tags{"name": " Main Street  "}, osm.Tags{"name": "Main Street"}},
+		{"way", osm.Tags{"landuse": "farm"}, osm.Tags{"landuse": "farmland"}},
+		{"way", osm.Tags{"landuse": "forest"}, osm.Tags{"landuse": "forest"}},
+		{"way", osm.Tags{"surface": "asphalt;paved"}, osm.Tags{"surface": "asphalt"}},
+		{"way", osm.Tags{"leisure": "park"}, osm.Tags{"leisure": "park", "area": "yes"}},
+		{"point", osm.Tags{"leisure": "park"}, osm.Tags{"leisure": "park"}},
+		{"way", osm.Tags{}, osm.Tags{}},
+	}
+
+	rw := mapping.TagRewriter()
+	for i, test := range tests {
+		rw.Rewrite(test.elemType, &test.tags)
+		if !stringMapEqual(test.tags, test.expected) {
+			t.Errorf("unexpected result for case %d: %v != %v", i+1, test.tags, test.expected)
+		}
+	}
+}
+
+func TestTagRewriterNil(t *testing.T) {
+	mapping, err := New([]byte(`
+    tables:
+      roads:
+        type: linestring
+        mapping:
+          highway: [residential]
+    `))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := mapping.TagRewriter()
+	if rw != nil {
+		t.Fatal("expected nil rewriter without tag_rewrites")
+	}
+	tags := osm.Tags{"Highway": "Residential"}
+	rw.Rewrite("way", &tags)
+	if !stringMapEqual(tags, osm.Tags{"Highway": "Residential"}) {
+		t.Errorf("unexpected result: %v", tags)
+	}
+}
+
+func TestTagRewriterInvalid(t *testing.T) {
+	for _, rewrites := range []string{
+		`[{}]`,
+		`[{lowercase: [name], trim: [name]}]`,
+		`[{replace: {key: name, regexp: '[a'}}]`,
+		`[{set_tag: {key: area, value: 'yes', if: 'tags["foo"] =='}}]`,
+		`[{set_tag: {key: area, value: 'yes', if: 'area > 100'}}]`,
+		`[{set_tag: {value: 'yes'}}]`,
+	} {
+		_, err := New([]byte(`
+    tag_rewrites: ` + rewrites + `
+    tables:
+      roads:
+        type: linestring
+        mapping:
+          highway: [residential]
+    `))
+		if err == nil {
+			t.Errorf("expected error for %s", rewrites)
+		}
+	}
+}
@@ -122,6 +122,7 @@ func ReadPbf(
 			var skip, hit int
 
 			m := tagmapping.WayTagFilter()
+			rw := tagmapping.TagRewriter()
 			for ws := range ways {
 				if ws == nil {
 					waysSync.Done()
@@ -132,6 +133,7 @@ func ReadPbf(
 					continue
 				}
 				for i := range ws {
+					rw.Rewrite("way", &ws[i].Tags)
 					m.Filter(&ws[i].Tags)
 					if withLimiter {
 						cached, err := cache.Coords.FirstRefIsCached(ws[i].Refs)
@@ -164,9 +166,11 @@ func ReadPbf(
 			var skip, hit int
 
 			m := tagmapping.RelationTagFilter()
+			rw := tagmapping.TagRewriter()
 			for rels := range relations {
 				numWithTags := 0
 				for i := range rels {
+					rw.Rewrite("relation", &rels[i].Tags)
 					m.Filter(&rels[i].Tags)
 					if len(rels[i].Tags) > 0 {
 						numWithTags++
@@ -236,6 +240,7 @@ func ReadPbf(
 			g := geos.NewGeos()
 			defer g.Finish()
 			m := tagmapping.NodeTagFilter()
+			rw := tagmapping.TagRewriter()
 			for nds := range nodes {
 				if nds == nil {
 					coordsSync.Done()
@@ -247,6 +252,7 @@ func ReadPbf(
 				}
 				numWithTags := 0
 				for i := range nds {
+					rw.Rewrite("point", &nds[i].Tags)
 					m.Filter(&nds[i].Tags)
 					if len(nds[i].Tags) > 0 {
 						numWithTags++
@@ -1,7 +1,6 @@
 package test
 
 import (
-	"database/sql"
 	"io/ioutil"
 	"os"
 
@@ -28,18 +27,13 @@ func TestAnyAny(t *testing.T) {
 			t.Fatal(err)
 		}
 		ts.config = importConfig{
-			connection:      "postgis://",
 			cacheDir:        ts.dir,
 			osmFileName:     "build/any_any.pbf",
 			mappingFileName: "any_any_mapping.json",
 		}
 		ts.g = geos.NewGeos()
 
-		ts.db, err = sql.Open("postgres", "sslmode=disable")
-		if err != nil {
-			t.Fatal(err)
-		}
-		ts.dropSchemas()
+		ts.connect(t)
 	})
 
 	t.Run("Import", func(t *testing.T) {
@@ -1,10 +1,9 @@
 package test
 
 import (
-	"database/sql"
-	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	osm "github.com/omniscale/go-osm"
@@ -32,18 +31,13 @@ func TestComplete(t *testing.T) {
 			t.Fatal(err)
 		}
 		ts.config = importConfig{
-			connection:      "postgis://",
 			cacheDir:        ts.dir,
 			osmFileName:     "build/complete_db.pbf",
 			mappingFileName: "complete_db_mapping.json",
 		}
 		ts.g = geos.NewGeos()
 
-		ts.db, err = sql.Open("postgres", "sslmode=disable")
-		if err != nil {
-			t.Fatal(err)
-		}
-		ts.dropSchemas()
+		ts.connect(t)
 	})
 
 	t.Run("Import", func(t *testing.T) {
@@ -425,6 +419,21 @@ func TestComplete(t *testing.T) {
 		})
 	})
 
+	t.Run("MergedRoads", func(t *testing.T) {
+		// Connected ways with same type and name are merged.
+
+		rows := ts.queryDynamic(t, "osm_roads_merged", "name = 'merged road'")
+		if len(rows) != 1 {
+			t.Fatalf("unexpected merged roads: %v", rows)
+		}
+		if rows[0]["type"] != "secondary" || !strings.HasPrefix(rows[0]["wkt"], "LINESTRING") {
+			t.Errorf("unexpected merged road: %v", rows[0])
+		}
+		if !ts.indexExists(t, ts.dbschemaProduction(), "osm_roads_merged", "osm_roads_merged_geom") {
+			t.Fatal("geom idx missing for osm_roads_merged")
+		}
+	})
+
 	// #######################################################################
 
 	t.Run("Update", func(t *testing.T) {
@@ -437,17 +446,7 @@ func TestComplete(t *testing.T) {
 		// Relations/ways are only inserted once Checks #66
 
 		for _, table := range []string{"osm_roads", "osm_landusages"} {
-			rows, err := ts.db.Query(
-				fmt.Sprintf(`SELECT osm_id, count(osm_id) FROM "%s"."%s" GROUP BY osm_id HAVING count(osm_id) > 1`,
-					ts.dbschemaProduction(), table))
-			if err != nil {
-				t.Fatal(err)
-			}
-			var osmID, count int64
-			for rows.Next() {
-				if err := rows.Scan(&osmID, &count); err != nil {
-					t.Fatal(err)
-				}
+			for osmID, count := range ts.duplicateIDs(t, table) {
 				if table == "osm_roads" && osmID == 18001 {
 					// # duplicate for TestNodeWayInsertedTwice is expected
 					if count != 2 {
@@ -729,6 +728,19 @@ func TestComplete(t *testing.T) {
 		})
 	})
 
+	t.Run("MergedRoads2", func(t *testing.T) {
+		// Merged roads are updated after the middle way was renamed.
+
+		rows := ts.queryDynamic(t, "osm_roads_merged", "name = 'merged road'")
+		if len(rows) != 2 {
+			t.Errorf("unexpected merged roads: %v", rows)
+		}
+		rows = ts.queryDynamic(t, "osm_roads_merged", "name = 'other road'")
+		if len(rows) != 1 {
+			t.Errorf("unexpected merged roads: %v", rows)
+		}
+	})
+
 	t.Run("UnsupportedRelation", func(t *testing.T) {
 		// Unsupported relation type is not inserted with update
 
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/omniscale/imposm3/config"
+	"github.com/omniscale/imposm3/import_"
+	"github.com/omniscale/imposm3/mapping"
+)
+
+const benchMappingFileName = "../example-mapping.yml"
+
+// BenchmarkCopyFormat compares the -write performance of COPY in text and
+// binary format and reports the inserted rows per second. Set
+// IMPOSM_BENCH_PBF to an extract, e.g. a country from Geofabrik:
+//
+//	IMPOSM_BENCH_PBF=/data/germany-latest.osm.pbf go test ./test -run - -bench CopyFormat -benchtime 1x
+func BenchmarkCopyFormat(b *testing.B) {
+	pbf := os.Getenv("IMPOSM_BENCH_PBF")
+	if pbf == "" {
+		b.Skip("IMPOSM_BENCH_PBF not set")
+	}
+	const schema = "imposm_bench_copy_import"
+
+	db, err := sql.Open("postgres", "sslmode=disable")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	defer db.Exec(`DROP SCHEMA IF EXISTS ` + schema + ` CASCADE`)
+
+	m, err := mapping.FromFile(benchMappingFileName)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	cacheDir := b.TempDir()
+	import_.Import(config.ParseImport([]string{
+		"-read", pbf,
+		"-cachedir", cacheDir,
+		"-overwritecache",
+		"-mapping", benchMappingFileName,
+		"-quiet",
+	}))
+
+	for _, format := range []string{"text", "binary"} {
+		b.Run(format, func(b *testing.B) {
+			var elapsed time.Duration
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				import_.Import(config.ParseImport([]string{
+					"-connection", "postgis://",
+					"-cachedir", cacheDir,
+					"-mapping", benchMappingFileName,
+					"-dbschema-import", schema,
+					"-write",
+					"-copy-format", format,
+					"-quiet",
+				}))
+				elapsed += time.Since(start)
+			}
+
+			var rows int64
+			for name := range m.Conf.Tables {
+				var n int64
+				err := db.QueryRow(fmt.Sprintf(`SELECT count(*) FROM "%s"."osm_%s"`, schema, name)).Scan(&n)
+				if err != nil {
+					b.Fatal(err)
+				}
+				rows += n
+			}
+			b.ReportMetric(float64(rows)*float64(b.N)/elapsed.Seconds(), "rows/s")
+		})
+	}
+}
@@ -2,7 +2,6 @@ package test
 
 import (
 	"bufio"
-	"database/sql"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -32,7 +31,6 @@ func TestExpireTiles(t *testing.T) {
 			t.Fatal(err)
 		}
 		ts.config = importConfig{
-			connection:      "postgis://",
 			cacheDir:        ts.dir,
 			osmFileName:     "build/expire_tiles.pbf",
 			mappingFileName: "expire_tiles_mapping.yml",
@@ -40,11 +38,7 @@ func TestExpireTiles(t *testing.T) {
 		}
 		ts.g = geos.NewGeos()
 
-		ts.db, err = sql.Open("postgres", "sslmode=disable")
-		if err != nil {
-			t.Fatal(err)
-		}
-		ts.dropSchemas()
+		ts.connect(t)
 	})
 
 	t.Run("Import", func(t *testing.T) {
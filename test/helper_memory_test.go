@@ -0,0 +1,180 @@
+package test
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/omniscale/imposm3/database/memory"
+	"github.com/omniscale/imposm3/geom"
+)
+
+// Helpers for the memory backend, they return the same results as the
+// SQL queries in helper_test.go.
+
+func (ts *importTestSuite) memTable(t *testing.T, table string) *memory.Table {
+	tbl := ts.mem.Table(ts.dbschemaProduction(), table)
+	if tbl == nil {
+		t.Fatalf("table %q does not exist in %q", table, ts.dbschemaProduction())
+	}
+	return tbl
+}
+
+func (ts *importTestSuite) memDropSchemas() {
+	memory.Remove(ts.memoryName())
+	ts.mem = memory.Lookup(ts.memoryName())
+}
+
+func (ts *importTestSuite) memIndexExists(schema, table, index string) bool {
+	tbl := ts.mem.Table(schema, table)
+	if tbl == nil {
+		return false
+	}
+	for _, idx := range tbl.Indices {
+		if idx == index {
+			return true
+		}
+	}
+	return false
+}
+
+func (ts *importTestSuite) memQuery(t *testing.T, table string, id int64, keys []string) record {
+	rows := ts.memTable(t, table).ByID(id)
+	if len(rows) == 0 {
+		return record{missing: true}
+	}
+	if len(rows) > 1 {
+		t.Errorf("duplicate row for %d in %q", id, table)
+	}
+	r := memRecord(rows[0])
+	for _, k := range keys {
+		if r.tags == nil {
+			r.tags = make(map[string]string)
+		}
+		if v, ok := rows[0].Text(k); ok {
+			r.tags[k] = v
+		} else {
+			r.tags[k] = "NULL"
+		}
+	}
+	return r
+}
+
+func (ts *importTestSuite) memQueryTags(t *testing.T, table string, id int64) record {
+	rows := ts.memTable(t, table).ByID(id)
+	if len(rows) == 0 {
+		return record{missing: true}
+	}
+	r := memRecord(rows[0])
+	r.tags = memTags(t, rows[0])
+	return r
+}
+
+func (ts *importTestSuite) memQueryRows(t *testing.T, table string, id int64) []record {
+	rows := ts.memTable(t, table).ByID(id)
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, col := range []string{"type", "name"} {
+			a, aok := rows[i].Text(col)
+			b, bok := rows[j].Text(col)
+			if aok != bok {
+				// NULL values are sorted last
+				return aok
+			}
+			if a != b {
+				return a < b
+			}
+		}
+		return memGeometryType(rows[i]) < memGeometryType(rows[j])
+	})
+	rs := []record{}
+	for _, row := range rows {
+		rs = append(rs, memRecord(row))
+	}
+	return rs
+}
+
+func (ts *importTestSuite) memQueryRowsTags(t *testing.T, table string, id int64) []record {
+	rows := ts.memTable(t, table).ByID(id)
+	sort.SliceStable(rows, func(i, j int) bool {
+		return memGeometryType(rows[i]) < memGeometryType(rows[j])
+	})
+	rs := []record{}
+	for _, row := range rows {
+		r := memRecord(row)
+		r.tags = memTags(t, row)
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+func (ts *importTestSuite) memQueryDynamic(t *testing.T, table, where string) []map[string]string {
+	tbl := ts.memTable(t, table)
+	rows, err := tbl.Where(where)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := []map[string]string{}
+	for _, row := range rows {
+		r := map[string]string{"wkt": row.WKT()}
+		for _, col := range tbl.Columns {
+			if v, ok := row.Text(col.Name); ok {
+				r[col.Name] = v
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func (ts *importTestSuite) memDuplicateIDs(t *testing.T, table string) map[int64]int64 {
+	counts := make(map[int64]int64)
+	for _, row := range ts.memTable(t, table).Rows() {
+		if id, ok := row.OSMID(); ok {
+			counts[id]++
+		}
+	}
+	for id, count := range counts {
+		if count < 2 {
+			delete(counts, id)
+		}
+	}
+	return counts
+}
+
+func memRecord(row *memory.Row) record {
+	r := record{wkt: row.WKT()}
+	id, _ := row.OSMID()
+	r.id = int(id)
+	r.name, _ = row.Text("name")
+	r.osmType, _ = row.Text("type")
+	return r
+}
+
+func memTags(t *testing.T, row *memory.Row) map[string]string {
+	tags, err := row.Tags("tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+var stGeometryTypes = map[int]string{
+	geom.WKBPoint:              "ST_Point",
+	geom.WKBLineString:         "ST_LineString",
+	geom.WKBPolygon:            "ST_Polygon",
+	geom.WKBMultiPoint:         "ST_MultiPoint",
+	geom.WKBMultiLineString:    "ST_MultiLineString",
+	geom.WKBMultiPolygon:       "ST_MultiPolygon",
+	geom.WKBGeometryCollection: "ST_GeometryCollection",
+}
+
+// memGeometryType returns the type like ST_GeometryType.
+func memGeometryType(row *memory.Row) string {
+	g, err := row.Geometry()
+	if err != nil || g == nil {
+		return ""
+	}
+	return stGeometryTypes[g.Type]
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"math"
+	"os"
 	"strings"
 	"testing"
 
@@ -12,6 +13,7 @@ import (
 	osm "github.com/omniscale/go-osm"
 	"github.com/omniscale/imposm3/cache"
 	"github.com/omniscale/imposm3/config"
+	"github.com/omniscale/imposm3/database/memory"
 	"github.com/omniscale/imposm3/geom/geos"
 	"github.com/omniscale/imposm3/import_"
 	"github.com/omniscale/imposm3/log"
@@ -32,7 +34,9 @@ type importTestSuite struct {
 	name   string
 	config importConfig
 	db     *sql.DB
-	g      *geos.Geos
+	// mem contains the tables if the tests run with the memory backend
+	mem *memory.Store
+	g   *geos.Geos
 }
 
 const Missing = ""
@@ -43,6 +47,25 @@ func (ts *importTestSuite) dbschemaProduction() string {
 }
 func (ts *importTestSuite) dbschemaBackup() string { return "imposm_test_" + ts.name + "_backup" }
 
+func (ts *importTestSuite) memoryName() string { return "imposm_test_" + ts.name }
+
+// connect sets the connection for all imports and removes the tables of
+// previous runs. The tests use PostGIS, or the memory backend if
+// IMPOSM_TEST_BACKEND is memory.
+func (ts *importTestSuite) connect(t *testing.T) {
+	if os.Getenv("IMPOSM_TEST_BACKEND") == "memory" {
+		ts.config.connection = "memory:" + ts.memoryName()
+	} else {
+		ts.config.connection = "postgis://"
+		var err error
+		ts.db, err = sql.Open("postgres", "sslmode=disable")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts.dropSchemas()
+}
+
 func (ts *importTestSuite) importOsm(t *testing.T) {
 	importArgs := []string{
 		"-connection", ts.config.connection,
@@ -161,6 +184,10 @@ func (ts *importTestSuite) updateOsm(t *testing.T, diffFile string) {
 }
 
 func (ts *importTestSuite) dropSchemas() {
+	if ts.db == nil {
+		ts.memDropSchemas()
+		return
+	}
 	var err error
 	_, err = ts.db.Exec(fmt.Sprintf(`DROP SCHEMA IF EXISTS %s CASCADE`, ts.dbschemaImport()))
 	if err != nil {
@@ -177,6 +204,9 @@ func (ts *importTestSuite) dropSchemas() {
 }
 
 func (ts *importTestSuite) tableExists(t *testing.T, schema, table string) bool {
+	if ts.mem != nil {
+		return ts.mem.Table(schema, table) != nil
+	}
 	row := ts.db.QueryRow(
 		`SELECT EXISTS(SELECT * FROM information_schema.tables WHERE table_name=$1 AND table_schema=$2)`,
 		table, schema,
@@ -190,6 +220,9 @@ func (ts *importTestSuite) tableExists(t *testing.T, schema, table string) bool
 }
 
 func (ts *importTestSuite) indexExists(t *testing.T, schema, table, index string) bool {
+	if ts.mem != nil {
+		return ts.memIndexExists(schema, table, index)
+	}
 	row := ts.db.QueryRow(
 		`SELECT EXISTS(SELECT * FROM pg_indexes WHERE tablename=$1 AND schemaname=$2 AND indexname like $3)`,
 		table, schema, index,
@@ -212,6 +245,9 @@ type record struct {
 }
 
 func (ts *importTestSuite) query(t *testing.T, table string, id int64, keys []string) record {
+	if ts.mem != nil {
+		return ts.memQuery(t, table, id, keys)
+	}
 	kv := make([]string, len(keys))
 	for i, k := range keys {
 		kv[i] = "'" + k + "', " + k + "::varchar"
@@ -257,6 +293,9 @@ func (ts *importTestSuite) query(t *testing.T, table string, id int64, keys []st
 }
 
 func (ts *importTestSuite) queryTags(t *testing.T, table string, id int64) record {
+	if ts.mem != nil {
+		return ts.memQueryTags(t, table, id)
+	}
 	stmt := fmt.Sprintf(`SELECT osm_id, tags FROM "%s"."%s" WHERE osm_id=$1`, ts.dbschemaProduction(), table)
 	row := ts.db.QueryRow(stmt, id)
 	r := record{}
@@ -280,6 +319,9 @@ func (ts *importTestSuite) queryTags(t *testing.T, table string, id int64) recor
 }
 
 func (ts *importTestSuite) queryRows(t *testing.T, table string, id int64) []record {
+	if ts.mem != nil {
+		return ts.memQueryRows(t, table, id)
+	}
 	rows, err := ts.db.Query(fmt.Sprintf(`SELECT osm_id, name, type, ST_AsText(geometry) FROM "%s"."%s" WHERE osm_id=$1 ORDER BY type, name, ST_GeometryType(geometry)`, ts.dbschemaProduction(), table), id)
 	if err != nil {
 		t.Fatal(err)
@@ -296,6 +338,9 @@ func (ts *importTestSuite) queryRows(t *testing.T, table string, id int64) []rec
 }
 
 func (ts *importTestSuite) queryRowsTags(t *testing.T, table string, id int64) []record {
+	if ts.mem != nil {
+		return ts.memQueryRowsTags(t, table, id)
+	}
 	rows, err := ts.db.Query(fmt.Sprintf(`SELECT osm_id, ST_AsText(geometry), tags FROM "%s"."%s" WHERE osm_id=$1 ORDER BY ST_GeometryType(geometry)`, ts.dbschemaProduction(), table), id)
 	if err != nil {
 		t.Fatal(err)
@@ -321,14 +366,20 @@ func (ts *importTestSuite) queryRowsTags(t *testing.T, table string, id int64) [
 }
 
 func (ts *importTestSuite) queryGeom(t *testing.T, table string, id int64) *geos.Geom {
-	stmt := fmt.Sprintf(`SELECT osm_id, ST_AsText(geometry) FROM "%s"."%s" WHERE osm_id=$1`, ts.dbschemaProduction(), table)
-	row := ts.db.QueryRow(stmt, id)
 	r := record{}
-	if err := row.Scan(&r.id, &r.wkt); err != nil {
-		if err == sql.ErrNoRows {
-			r.missing = true
-		} else {
-			t.Fatal(err)
+	if ts.mem != nil {
+		if rows := ts.memTable(t, table).ByID(id); len(rows) > 0 {
+			r = memRecord(rows[0])
+		}
+	} else {
+		stmt := fmt.Sprintf(`SELECT osm_id, ST_AsText(geometry) FROM "%s"."%s" WHERE osm_id=$1`, ts.dbschemaProduction(), table)
+		row := ts.db.QueryRow(stmt, id)
+		if err := row.Scan(&r.id, &r.wkt); err != nil {
+			if err == sql.ErrNoRows {
+				r.missing = true
+			} else {
+				t.Fatal(err)
+			}
 		}
 	}
 	g := geos.NewGeos()
@@ -341,6 +392,9 @@ func (ts *importTestSuite) queryGeom(t *testing.T, table string, id int64) *geos
 }
 
 func (ts *importTestSuite) queryDynamic(t *testing.T, table, where string) []map[string]string {
+	if ts.mem != nil {
+		return ts.memQueryDynamic(t, table, where)
+	}
 	stmt := fmt.Sprintf(`SELECT hstore(r) FROM (SELECT ST_AsText(geometry) AS wkt, * FROM "%s"."%s" WHERE %s) AS r`, ts.dbschemaProduction(), table, where)
 	rows, err := ts.db.Query(stmt)
 	if err != nil {
@@ -363,6 +417,30 @@ func (ts *importTestSuite) queryDynamic(t *testing.T, table, where string) []map
 	return results
 }
 
+// duplicateIDs returns the number of rows for all OSM IDs that were
+// inserted more than once.
+func (ts *importTestSuite) duplicateIDs(t *testing.T, table string) map[int64]int64 {
+	if ts.mem != nil {
+		return ts.memDuplicateIDs(t, table)
+	}
+	rows, err := ts.db.Query(
+		fmt.Sprintf(`SELECT osm_id, count(osm_id) FROM "%s"."%s" GROUP BY osm_id HAVING count(osm_id) > 1`,
+			ts.dbschemaProduction(), table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	counts := make(map[int64]int64)
+	for rows.Next() {
+		var osmID, count int64
+		if err := rows.Scan(&osmID, &count); err != nil {
+			t.Fatal(err)
+		}
+		counts[osmID] = count
+	}
+	return counts
+}
+
 type checkElem struct {
 	table   string
 	id      int64
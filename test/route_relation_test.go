@@ -1,7 +1,6 @@
 package test
 
 import (
-	"database/sql"
 	"io/ioutil"
 	"math"
 	"os"
@@ -28,18 +27,13 @@ func TestRouteRelation(t *testing.T) {
 			t.Fatal(err)
 		}
 		ts.config = importConfig{
-			connection:      "postgis://",
 			cacheDir:        ts.dir,
 			osmFileName:     "build/route_relation.pbf",
 			mappingFileName: "route_relation_mapping.yml",
 		}
 		ts.g = geos.NewGeos()
 
-		ts.db, err = sql.Open("postgres", "sslmode=disable")
-		if err != nil {
-			t.Fatal(err)
-		}
-		ts.dropSchemas()
+		ts.connect(t)
 	})
 
 	t.Run("Import", func(t *testing.T) {
@@ -106,6 +100,26 @@ func TestRouteRelation(t *testing.T) {
 		}
 	})
 
+	t.Run("FlattenedMembers1", func(t *testing.T) {
+		// ways of both routes are part of the flattened route master
+		rows := ts.queryDynamic(t, "osm_master_route_members", "osm_id = -100911 AND member = 100503")
+		if len(rows) != 2 {
+			t.Fatal(rows)
+		}
+		rows = ts.queryDynamic(t, "osm_master_route_members", "osm_id = -100911 AND member = 100512 AND parent = 100902")
+		if len(rows) != 1 {
+			t.Fatal(rows)
+		}
+		if rows[0]["path"] != "100911/100902" {
+			t.Error(rows[0])
+		}
+		// no rows for the nested relations themselves
+		rows = ts.queryDynamic(t, "osm_master_route_members", "osm_id = -100911 AND member = 100901")
+		if len(rows) != 0 {
+			t.Fatal(rows)
+		}
+	})
+
 	t.Run("NoRouteWithMissingMember", func(t *testing.T) {
 		// current implementation: route members are all or nothing.
 		// if one member is missing, no member is imported
@@ -114,6 +128,20 @@ func TestRouteRelation(t *testing.T) {
 		}
 	})
 
+	t.Run("NestedMemberWay1", func(t *testing.T) {
+		rows := ts.queryDynamic(t, "osm_master_route_members", "osm_id = -140911")
+		if len(rows) != 2 {
+			t.Fatal(rows)
+		}
+		rows = ts.queryDynamic(t, "osm_master_route_members", "osm_id = -140911 AND member = 140501")
+		if len(rows) != 1 {
+			t.Fatal(rows)
+		}
+		if rows[0]["name"] != "old name" {
+			t.Error(rows[0])
+		}
+	})
+
 	// #######################################################################
 
 	t.Run("Update", func(t *testing.T) {
@@ -158,6 +186,26 @@ func TestRouteRelation(t *testing.T) {
 
 	})
 
+	t.Run("FlattenedMembers2", func(t *testing.T) {
+		// member removed from nested route, but still part of the other route
+		rows := ts.queryDynamic(t, "osm_master_route_members", "osm_id = -100911 AND member = 100512")
+		if len(rows) != 1 {
+			t.Fatal(rows)
+		}
+		if rows[0]["parent"] != "100901" {
+			t.Error(rows[0])
+		}
+
+		// tag from nested member is updated
+		rows = ts.queryDynamic(t, "osm_master_route_members", "osm_id = -100911 AND member = 100503 AND parent = 100902")
+		if len(rows) != 1 {
+			t.Fatal(rows)
+		}
+		if rows[0]["name"] != "new name" {
+			t.Error(rows[0])
+		}
+	})
+
 	t.Run("MemberUpdatedByNode2", func(t *testing.T) {
 		// check that member is updated after node was modified
 		rows := ts.queryDynamic(t, "osm_route_members", "osm_id = -110901 AND member = 110101")
@@ -169,6 +217,28 @@ func TestRouteRelation(t *testing.T) {
 		}
 	})
 
+	t.Run("NestedMemberWay2", func(t *testing.T) {
+		// only the member way of the nested route was modified, the route
+		// master is updated without duplicate rows
+		rows := ts.queryDynamic(t, "osm_master_route_members", "osm_id = -140911")
+		if len(rows) != 2 {
+			t.Fatal(rows)
+		}
+		rows = ts.queryDynamic(t, "osm_master_route_members", "osm_id = -140911 AND member = 140501")
+		if len(rows) != 1 {
+			t.Fatal(rows)
+		}
+		if rows[0]["name"] != "new name" {
+			t.Error(rows[0])
+		}
+		if rows := ts.queryDynamic(t, "osm_master_routes", "osm_id = -140911"); len(rows) != 1 {
+			t.Error(rows)
+		}
+		if rows := ts.queryDynamic(t, "osm_routes", "osm_id = -140911"); len(rows) != 1 {
+			t.Error(rows)
+		}
+	})
+
 	t.Run("Cleanup", func(t *testing.T) {
 		ts.dropSchemas()
 		if err := os.RemoveAll(ts.dir); err != nil {
@@ -1,7 +1,6 @@
 package test
 
 import (
-	"database/sql"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -31,18 +30,13 @@ func TestSingleTable(t *testing.T) {
 			t.Fatal(err)
 		}
 		ts.config = importConfig{
-			connection:      "postgis://",
 			cacheDir:        ts.dir,
 			osmFileName:     "build/single_table.pbf",
 			mappingFileName: "single_table_mapping.json",
 		}
 		ts.g = geos.NewGeos()
 
-		ts.db, err = sql.Open("postgres", "sslmode=disable")
-		if err != nil {
-			t.Fatal(err)
-		}
-		ts.dropSchemas()
+		ts.connect(t)
 	})
 
 	t.Run("Import", func(t *testing.T) {
@@ -31,16 +31,24 @@ func Diff(baseOpts config.Base, files []string) {
 		log.SetMinLevel(log.LInfo)
 	}
 
+	lastState, err := readLastState(baseOpts)
+	if err != nil && !baseOpts.ForceDiffImport {
+		log.Printf("[info] Unable to read last state, will not check if already imported: %v", err)
+	}
 	nextSeq, err := sequenceFromFiles(
 		files,
-		filepath.Join(baseOpts.DiffDir, LastStateFilename),
+		lastState,
 		baseOpts.ForceDiffImport,
 	)
 	if err != nil {
 		log.Fatalf("[error] Checking diff files: %v", err)
 	}
 
-	if err := diffImportLoop(baseOpts, nextSeq); err != nil {
+	var replicationURL string
+	if lastState != nil {
+		replicationURL = lastState.URL
+	}
+	if err := diffImportLoop(baseOpts, nextSeq, replicationURL); err != nil {
 		log.Fatalf("[error] Importing diffs: %v", err)
 	}
 }
@@ -50,9 +58,9 @@ func Run(baseOpts config.Base) {
 		log.SetMinLevel(log.LInfo)
 	}
 
-	s, err := state.ParseFile(filepath.Join(baseOpts.DiffDir, LastStateFilename))
+	s, err := readLastState(baseOpts)
 	if err != nil {
-		log.Fatal("[fatal] Unable to read last.state.txt:", err)
+		log.Fatal("[fatal] Unable to read last state:", err)
 	}
 	replicationURL := baseOpts.ReplicationURL
 	if replicationURL == "" {
@@ -73,12 +81,59 @@ func Run(baseOpts config.Base) {
 	nextSeq := downloader.Sequences()
 	defer downloader.Stop()
 
-	if err := diffImportLoop(baseOpts, nextSeq); err != nil {
+	if err := diffImportLoop(baseOpts, nextSeq, replicationURL); err != nil {
 		log.Fatalf("[error] Importing diffs: %v", err)
 	}
 }
 
-func diffImportLoop(baseOpts config.Base, nextSeq <-chan replication.Sequence) error {
+// readLastState returns the state of the last imported diff. The state is
+// read from the database with -diff-state-db, or from last.state.txt if
+// the database contains no state yet.
+func readLastState(baseOpts config.Base) (*state.DiffState, error) {
+	lastStateFile := filepath.Join(baseOpts.DiffDir, LastStateFilename)
+	if !baseOpts.DiffStateDB {
+		return state.ParseFile(lastStateFile)
+	}
+
+	tagmapping, err := mapping.FromFile(baseOpts.MappingFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading tagmapping")
+	}
+	db, err := database.Open(diffDBConfig(baseOpts), &tagmapping.Conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening database")
+	}
+	defer db.Close()
+	store, ok := db.(database.StateStore)
+	if !ok {
+		return nil, errors.New("database does not support -diff-state-db")
+	}
+	s, err := store.ReadState()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading state from database")
+	}
+	if s == nil {
+		return state.ParseFile(lastStateFile)
+	}
+	return s, nil
+}
+
+// diffDBConfig returns the database configuration for diff imports.
+func diffDBConfig(baseOpts config.Base) database.Config {
+	return database.Config{
+		ConnectionParams: baseOpts.Connection,
+		Srid:             baseOpts.Srid,
+		// we apply diff imports on the Production schema
+		ImportSchema:     baseOpts.Schemas.Production,
+		ProductionSchema: baseOpts.Schemas.Production,
+		BackupSchema:     baseOpts.Schemas.Backup,
+		Upsert:           baseOpts.DiffUpsert,
+		Changes:          baseOpts.DiffChanges,
+		ChangesRetention: baseOpts.DiffChangesRetention,
+	}
+}
+
+func diffImportLoop(baseOpts config.Base, nextSeq <-chan replication.Sequence, replicationURL string) error {
 	var geometryLimiter *limit.Limiter
 	if baseOpts.LimitTo != "" {
 		var err error
@@ -113,26 +168,34 @@ func diffImportLoop(baseOpts config.Base, nextSeq <-chan replication.Sequence) e
 	if baseOpts.ExpireTilesDir != "" {
 		tilelist = expire.NewTileList(baseOpts.ExpireTilesZoom, baseOpts.ExpireTilesDir)
 	}
+	var bbox *expire.BBox
+	if baseOpts.DiffNotify {
+		bbox = expire.NewBBox()
+	}
 
 	tagmapping, err := mapping.FromFile(baseOpts.MappingFile)
 	if err != nil {
 		log.Fatalf("[fatal] reading tagmapping: %v", err)
 	}
 
-	dbConf := database.Config{
-		ConnectionParams: baseOpts.Connection,
-		Srid:             baseOpts.Srid,
-		// we apply diff imports on the Production schema
-		ImportSchema:     baseOpts.Schemas.Production,
-		ProductionSchema: baseOpts.Schemas.Production,
-		BackupSchema:     baseOpts.Schemas.Backup,
-	}
-	db, err := database.Open(dbConf, &tagmapping.Conf)
+	db, err := database.Open(diffDBConfig(baseOpts), &tagmapping.Conf)
 	if err != nil {
 		log.Fatalf("[fatal] unable to open database: %v", err)
 	}
 	defer db.Close()
 
+	fullDB, ok := db.(database.FullDB)
+	if !ok {
+		log.Fatal("[fatal] database does not support diff imports")
+	}
+	var stateStore database.StateStore
+	if baseOpts.DiffStateDB {
+		stateStore, ok = db.(database.StateStore)
+		if !ok {
+			log.Fatal("[fatal] database does not support -diff-state-db")
+		}
+	}
+
 	if err := db.Begin(); err != nil {
 		log.Fatalf("[fatal] unable to start transaction: %v", err)
 	}
@@ -141,12 +204,15 @@ func diffImportLoop(baseOpts config.Base, nextSeq <-chan replication.Sequence) e
 		baseOpts:       baseOpts,
 		commitEachDiff: baseOpts.CommitLatest == false,
 
-		db:              db.(database.FullDB),
+		db:              fullDB,
 		osmCache:        osmCache,
 		diffCache:       diffCache,
 		geometryLimiter: geometryLimiter,
 		tagmapping:      tagmapping,
 		tilelist:        tilelist,
+		bbox:            bbox,
+		stateStore:      stateStore,
+		replicationURL:  replicationURL,
 
 		sigc: sigc,
 	}
@@ -177,6 +243,11 @@ type updater struct {
 	geometryLimiter *limit.Limiter
 	tagmapping      *mapping.Mapping
 	tilelist        *expire.TileList
+	// bbox collects the changed area for notifications, nil if disabled
+	bbox *expire.BBox
+	// stateStore stores the state with each commit, nil if disabled
+	stateStore     database.StateStore
+	replicationURL string
 
 	sigc chan os.Signal
 }
@@ -197,9 +268,22 @@ func (u *updater) flush() error {
 			log.Println("[error] Writing tile expire list", err)
 		}
 	}
+	if u.stateStore != nil {
+		err := u.stateStore.WriteState(&diffstate.DiffState{
+			Time:     u.lastDiff.Time,
+			Sequence: u.lastDiff.Sequence,
+			URL:      u.replicationURL,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "unable to write state")
+		}
+	}
 	if err := u.db.End(); err != nil {
 		return errors.Wrapf(err, "unable to commit transaction")
 	}
+	if u.bbox != nil {
+		u.notify()
+	}
 	if err := u.db.Begin(); err != nil {
 		return errors.Wrapf(err, "unable to start transaction")
 	}
@@ -208,6 +292,7 @@ func (u *updater) flush() error {
 	}
 	u.diffCache.Flush()
 
+	// last.state.txt is also written with -diff-state-db for compatibility
 	var lastStateFile = filepath.Join(u.baseOpts.DiffDir, LastStateFilename)
 	if err := markImported(u.lastDiff, lastStateFile); err != nil {
 		log.Println("[error] Unable to write last state:", err)
@@ -216,6 +301,25 @@ func (u *updater) flush() error {
 	return nil
 }
 
+// notify announces the last commit, if the database supports this.
+func (u *updater) notify() {
+	defer u.bbox.Reset()
+	notifier, ok := u.db.(database.Notifier)
+	if !ok {
+		return
+	}
+	n := database.Notification{
+		Sequence:  u.lastDiff.Sequence,
+		Timestamp: u.lastDiff.Time,
+	}
+	if b, ok := u.bbox.Bounds(); ok {
+		n.BBox = b[:]
+	}
+	if err := notifier.Notify(n); err != nil {
+		log.Println("[warn] Unable to send notification:", err)
+	}
+}
+
 func (u *updater) shutdown() error {
 	u.osmCache.Close()
 	u.diffCache.Close()
@@ -273,8 +377,12 @@ func (u *updater) importDiff(seq replication.Sequence) error {
 	exp := newExpBackoff(2*time.Second, 5*time.Minute)
 
 	var exptiles expire.Expireor
-	if u.tilelist != nil {
+	if u.tilelist != nil && u.bbox != nil {
+		exptiles = expire.Multi{u.tilelist, u.bbox}
+	} else if u.tilelist != nil {
 		exptiles = u.tilelist
+	} else if u.bbox != nil {
+		exptiles = u.bbox
 	}
 
 	var err error
@@ -282,9 +390,19 @@ func (u *updater) importDiff(seq replication.Sequence) error {
 		if err != nil {
 			// previous loop failed, reconnect DB
 			u.db.Abort()
+			if u.bbox != nil {
+				// changes of the aborted transaction are not notified
+				u.bbox.Reset()
+			}
 			err = u.db.Begin()
 		}
 
+		if cr, ok := u.db.(database.ChangeRecorder); ok && err == nil {
+			err = cr.SetChangeSequence(seq.Sequence)
+		}
+		if hr, ok := u.db.(database.HistoryRecorder); ok && err == nil {
+			err = hr.SetVersionTime(seq.Time)
+		}
 		if err == nil {
 			err = importDiffFile(seq.Filename, u.db,
 				u.tagmapping, u.baseOpts.Srid, u.geometryLimiter, exptiles,
@@ -319,12 +437,7 @@ func (u *updater) importDiff(seq replication.Sequence) error {
 	}
 }
 
-func sequenceFromFiles(files []string, lastStateFile string, force bool) (<-chan replication.Sequence, error) {
-	lastState, err := diffstate.ParseFile(lastStateFile)
-	if err != nil && !force {
-		log.Printf("[info] Unable to read last state, will not check if already imported: %v", err)
-	}
-
+func sequenceFromFiles(files []string, lastState *diffstate.DiffState, force bool) (<-chan replication.Sequence, error) {
 	c := make(chan replication.Sequence, len(files))
 
 	for i, oscFile := range files {
@@ -18,6 +18,7 @@ type Deleter struct {
 	tmPolygons       mapping.RelWayMatcher
 	tmRelation       mapping.RelationMatcher
 	tmRelationMember mapping.RelationMatcher
+	tmAddresses      mapping.WayMatcher
 	expireor         expire.Expireor
 	singleIDSpace    bool
 
@@ -30,6 +31,11 @@ type Deleter struct {
 	// Cache deleted elements to avoid processing them multiple times.
 	deletedRelations map[int64]struct{}
 	deletedMembers   map[int64]struct{}
+
+	// Nodes of modified ways that need to be re-inserted, as they depend
+	// on the tags of the way (parent_way_tags columns).
+	parentWayKeys  mapping.ParentWayKeys
+	dependingNodes map[int64]struct{}
 }
 
 func NewDeleter(db database.Deleter, osmCache *cache.OSMCache, diffCache *cache.DiffCache,
@@ -39,6 +45,7 @@ func NewDeleter(db database.Deleter, osmCache *cache.OSMCache, diffCache *cache.
 	tmPolygons mapping.RelWayMatcher,
 	tmRelation mapping.RelationMatcher,
 	tmRelationMember mapping.RelationMatcher,
+	tmAddresses mapping.WayMatcher,
 ) *Deleter {
 	return &Deleter{
 		delDb:            db,
@@ -49,11 +56,13 @@ func NewDeleter(db database.Deleter, osmCache *cache.OSMCache, diffCache *cache.
 		tmPolygons:       tmPolygons,
 		tmRelation:       tmRelation,
 		tmRelationMember: tmRelationMember,
+		tmAddresses:      tmAddresses,
 		singleIDSpace:    singleIDSpace,
 		deletedNodes:     make(map[int64]osm.Node),
 		deletedRelations: make(map[int64]struct{}),
 		deletedWays:      make(map[int64][]int64),
 		deletedMembers:   make(map[int64]struct{}),
+		dependingNodes:   make(map[int64]struct{}),
 	}
 }
 
@@ -65,6 +74,20 @@ func (d *Deleter) DeletedMemberWays() map[int64]struct{} {
 	return d.deletedMembers
 }
 
+// SetParentWayKeys enables the deletion of nodes when one of their ways
+// changes. Required for parent_way_tags columns. Ways with one of the keys
+// are removed from the node to way references, even if they are not
+// inserted into a table.
+func (d *Deleter) SetParentWayKeys(keys mapping.ParentWayKeys) {
+	d.parentWayKeys = keys
+}
+
+// DependingNodes returns all nodes that were deleted because one of their
+// ways changed. These nodes need to be re-inserted.
+func (d *Deleter) DependingNodes() map[int64]struct{} {
+	return d.dependingNodes
+}
+
 func (d *Deleter) nodeID(id int64) int64 {
 	return id
 }
@@ -129,6 +152,10 @@ func (d *Deleter) deleteRelation(id int64, deleteRefs bool, deleteMembers bool)
 				if err := d.diffCache.CoordsRel.DeleteRef(m.ID, id); err != nil {
 					return err
 				}
+			} else if m.Type == osm.RelationMember {
+				if err := d.diffCache.Relations.DeleteRef(m.ID, id); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -186,7 +213,13 @@ func (d *Deleter) deleteWay(id int64, deleteRefs bool) error {
 		}
 		deleted = true
 	}
-	if deleted && deleteRefs {
+	if matches := d.tmAddresses.MatchWay(elem); len(matches) > 0 {
+		if err := d.delDb.Delete(d.WayID(elem.ID), matches); err != nil {
+			return err
+		}
+		deleted = true
+	}
+	if deleteRefs && (deleted || d.parentWayKeys.Match(elem.Tags)) {
 		for _, n := range elem.Refs {
 			if err := d.diffCache.Coords.DeleteRef(n, id); err != nil {
 				return err
@@ -248,10 +281,22 @@ func (d *Deleter) Delete(delElem osm.Diff) error {
 		if err := d.deleteRelation(delElem.Rel.ID, true, true); err != nil {
 			return err
 		}
+		if err := d.deleteParentRelations(delElem.Rel.ID); err != nil {
+			return err
+		}
 	} else if delElem.Way != nil {
 		if err := d.deleteWay(delElem.Way.ID, true); err != nil {
 			return err
 		}
+		if len(d.parentWayKeys) > 0 {
+			// old and new nodes of the way
+			if err := d.deleteDependingNodes(d.deletedWays[delElem.Way.ID]); err != nil {
+				return err
+			}
+			if err := d.deleteDependingNodes(delElem.Way.Refs); err != nil {
+				return err
+			}
+		}
 
 		if delElem.Modify || delElem.Create {
 			// Delete depending elements even if the element is new.
@@ -265,6 +310,9 @@ func (d *Deleter) Delete(delElem osm.Diff) error {
 				if err := d.deleteRelation(rel, false, false); err != nil {
 					return err
 				}
+				if err := d.deleteParentRelations(rel); err != nil {
+					return err
+				}
 			}
 		}
 	} else if delElem.Node != nil {
@@ -295,6 +343,9 @@ func (d *Deleter) Delete(delElem osm.Diff) error {
 					if err := d.deleteRelation(rel, false, false); err != nil {
 						return err
 					}
+					if err := d.deleteParentRelations(rel); err != nil {
+						return err
+					}
 				}
 			}
 			dependers = d.diffCache.CoordsRel.Get(delElem.Node.ID)
@@ -305,6 +356,9 @@ func (d *Deleter) Delete(delElem osm.Diff) error {
 				if err := d.deleteRelation(rel, false, false); err != nil {
 					return err
 				}
+				if err := d.deleteParentRelations(rel); err != nil {
+					return err
+				}
 			}
 		}
 		if delElem.Delete {
@@ -316,6 +370,57 @@ func (d *Deleter) Delete(delElem osm.Diff) error {
 	return nil
 }
 
+// deleteParentRelations deletes all relations that contain the relation id,
+// directly or nested. Relation member tables with flatten_members depend on
+// the members of their child relations.
+func (d *Deleter) deleteParentRelations(id int64) error {
+	for _, parent := range d.diffCache.Relations.Get(id) {
+		if _, ok := d.deletedRelations[parent]; ok {
+			continue
+		}
+		if err := d.deleteRelation(parent, false, false); err != nil {
+			return err
+		}
+		if err := d.deleteParentRelations(parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteDependingNodes deletes all nodes that are inserted into tables
+// with parent_way_tags columns.
+func (d *Deleter) deleteDependingNodes(refs []int64) error {
+	for _, ref := range refs {
+		if _, ok := d.dependingNodes[ref]; ok {
+			continue
+		}
+		nd, err := d.osmCache.Nodes.GetNode(ref)
+		if err != nil {
+			if err == cache.NotFound {
+				continue
+			}
+			return err
+		}
+		matches := d.tmPoints.MatchNode(nd)
+		needsParentWays := false
+		for i := range matches {
+			if matches[i].NeedsParentWays() {
+				needsParentWays = true
+				break
+			}
+		}
+		if !needsParentWays {
+			continue
+		}
+		if err := d.delDb.Delete(d.nodeID(nd.ID), matches); err != nil {
+			return err
+		}
+		d.dependingNodes[ref] = struct{}{}
+	}
+	return nil
+}
+
 func (d *Deleter) fillWayFromDeleted(w *osm.Way) {
 	for i := range w.Nodes {
 		if w.Nodes[i].ID == 0 {
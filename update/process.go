@@ -10,6 +10,10 @@ import (
 	"github.com/omniscale/go-osm/parser/diff"
 	"github.com/omniscale/imposm3/cache"
 	"github.com/omniscale/imposm3/database"
+	_ "github.com/omniscale/imposm3/database/flatgeobuf"
+	_ "github.com/omniscale/imposm3/database/geojsonseq"
+	_ "github.com/omniscale/imposm3/database/memory"
+	_ "github.com/omniscale/imposm3/database/pmtiles"
 	_ "github.com/omniscale/imposm3/database/postgis"
 	"github.com/omniscale/imposm3/expire"
 	"github.com/omniscale/imposm3/geom/geos"
@@ -57,8 +61,10 @@ func importDiffFile(
 		tagmapping.PolygonMatcher,
 		tagmapping.RelationMatcher,
 		tagmapping.RelationMemberMatcher,
+		tagmapping.AddressInterpolationMatcher,
 	)
 	deleter.SetExpireor(expireor)
+	deleter.SetParentWayKeys(tagmapping.ParentWayTagKeys())
 
 	parseProgress := stats.NewStatsReporter()
 	defer parseProgress.Stop()
@@ -66,6 +72,7 @@ func importDiffFile(
 	relTagFilter := tagmapping.RelationTagFilter()
 	wayTagFilter := tagmapping.WayTagFilter()
 	nodeTagFilter := tagmapping.NodeTagFilter()
+	tagRewriter := tagmapping.TagRewriter()
 
 	relations := make(chan *osm.Relation)
 	ways := make(chan *osm.Way)
@@ -89,12 +96,14 @@ func importDiffFile(
 		parseProgress,
 		tagmapping.PolygonMatcher,
 		tagmapping.LineStringMatcher,
+		tagmapping.AddressInterpolationMatcher,
 		srid)
 	wayWriter.SetLimiter(geometryLimiter)
 	wayWriter.SetExpireor(expireor)
+	wayWriter.SetParentWayKeys(tagmapping.ParentWayTagKeys())
 	wayWriter.Start()
 
-	nodeWriter := writer.NewNodeWriter(osmCache, nodes, db,
+	nodeWriter := writer.NewNodeWriter(osmCache, diffCache, nodes, db,
 		parseProgress,
 		tagmapping.PointMatcher,
 		srid)
@@ -120,12 +129,15 @@ func importDiffFile(
 
 	for elem := range diffs {
 		if elem.Rel != nil {
+			tagRewriter.Rewrite("relation", &elem.Rel.Tags)
 			relTagFilter.Filter(&elem.Rel.Tags)
 			parseProgress.AddRelations(1)
 		} else if elem.Way != nil {
+			tagRewriter.Rewrite("way", &elem.Way.Tags)
 			wayTagFilter.Filter(&elem.Way.Tags)
 			parseProgress.AddWays(1)
 		} else if elem.Node != nil {
+			tagRewriter.Rewrite("point", &elem.Node.Tags)
 			nodeTagFilter.Filter(&elem.Node.Tags)
 			if len(elem.Node.Tags) > 0 {
 				parseProgress.AddNodes(1)
@@ -144,6 +156,13 @@ func importDiffFile(
 				if err := osmCache.Relations.DeleteRelation(elem.Rel.ID); err != nil && err != cache.NotFound {
 					return errors.Wrapf(err, "delete relation %v", elem.Rel)
 				}
+				// parent relations need to be re-inserted without this relation
+				for _, parent := range diffCache.Relations.Get(elem.Rel.ID) {
+					relIDs[parent] = struct{}{}
+				}
+				if err := diffCache.Relations.Delete(elem.Rel.ID); err != nil && err != cache.NotFound {
+					return errors.Wrapf(err, "delete relation references %v", elem.Rel)
+				}
 			} else if elem.Way != nil {
 				if err := osmCache.Ways.DeleteWay(elem.Way.ID); err != nil && err != cache.NotFound {
 					return errors.Wrapf(err, "delete way %v", elem.Way)
@@ -258,6 +277,23 @@ func importDiffFile(
 		}
 	}
 
+	// mark parent relations for (re)insert, required for relation_member
+	// tables with flatten_members
+	parentQueue := make([]int64, 0, len(relIDs))
+	for relID := range relIDs {
+		parentQueue = append(parentQueue, relID)
+	}
+	for len(parentQueue) > 0 {
+		relID := parentQueue[len(parentQueue)-1]
+		parentQueue = parentQueue[:len(parentQueue)-1]
+		for _, parent := range diffCache.Relations.Get(relID) {
+			if _, ok := relIDs[parent]; !ok {
+				relIDs[parent] = struct{}{}
+				parentQueue = append(parentQueue, parent)
+			}
+		}
+	}
+
 	for relID := range relIDs {
 		rel, err := osmCache.Relations.GetRelation(relID)
 		if err != nil {
@@ -284,6 +320,18 @@ func importDiffFile(
 		ways <- way
 	}
 
+	// ways need to be inserted before the nodes, as parent_way_tags
+	// columns require the updated node to way references
+	close(relations)
+	close(ways)
+	relWriter.Wait()
+	wayWriter.Wait()
+
+	// mark nodes of modified ways for re-insert (parent_way_tags)
+	for id := range deleter.DependingNodes() {
+		nodeIDs[id] = struct{}{}
+	}
+
 	for nodeID := range nodeIDs {
 		node, err := osmCache.Nodes.GetNode(nodeID)
 		if err != nil {
@@ -300,15 +348,12 @@ func importDiffFile(
 		}
 	}
 
-	close(relations)
-	close(ways)
 	close(nodes)
-
 	nodeWriter.Wait()
-	relWriter.Wait()
-	wayWriter.Wait()
 
-	db.GeneralizeUpdates()
+	if err := db.GeneralizeUpdates(); err != nil {
+		return errors.Wrap(err, "updating generalized tables")
+	}
 
 	importProgress.Stop()
 	step()
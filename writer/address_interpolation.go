@@ -0,0 +1,203 @@
+package writer
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	osm "github.com/omniscale/go-osm"
+)
+
+// maxInterpolatedAddresses limits the number of house numbers between two
+// address nodes to protect against invalid house numbers (e.g. 1 to 99999).
+const maxInterpolatedAddresses = 1000
+
+// interpolatedAddress is a single house number along an addr:interpolation
+// way.
+type interpolatedAddress struct {
+	housenumber string
+	long, lat   float64
+	// index of the address node where the interpolation started
+	start int
+}
+
+// interpolateAddresses returns all house numbers between the address nodes
+// of an interpolation way. anchors contains the addr:housenumber for each
+// node index of an address node. kind is the value of the addr:interpolation
+// tag (odd, even, all or alphabetic).
+func interpolateAddresses(kind string, nodes []osm.Node, anchors map[int]string) []interpolatedAddress {
+	indices := make([]int, 0, len(anchors))
+	for i := range anchors {
+		if i >= 0 && i < len(nodes) {
+			indices = append(indices, i)
+		}
+	}
+	sort.Ints(indices)
+
+	var result []interpolatedAddress
+	for n := 1; n < len(indices); n++ {
+		start, end := indices[n-1], indices[n]
+		housenumbers, positions := housenumbersBetween(kind, anchors[start], anchors[end])
+		if len(housenumbers) == 0 {
+			continue
+		}
+		segment := nodes[start : end+1]
+		for i, hn := range housenumbers {
+			long, lat := pointAlong(segment, positions[i])
+			result = append(result, interpolatedAddress{
+				housenumber: hn,
+				long:        long,
+				lat:         lat,
+				start:       start,
+			})
+		}
+	}
+	return result
+}
+
+// housenumbersBetween returns all house numbers between from and to
+// (exclusive) and their relative position between both numbers (0.0-1.0).
+func housenumbersBetween(kind string, from, to string) ([]string, []float64) {
+	if kind == "alphabetic" {
+		return alphabeticHousenumbersBetween(from, to)
+	}
+
+	var step int
+	switch kind {
+	case "all":
+		step = 1
+	case "odd", "even":
+		step = 2
+	default:
+		return nil, nil
+	}
+
+	a, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return nil, nil
+	}
+	b, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return nil, nil
+	}
+	if a == b || abs(b-a)/step > maxInterpolatedAddresses {
+		return nil, nil
+	}
+
+	dir := 1
+	if b < a {
+		dir = -1
+	}
+
+	var housenumbers []string
+	var positions []float64
+	for n := a + dir; n != b; n += dir {
+		if kind == "odd" && n%2 == 0 {
+			continue
+		}
+		if kind == "even" && n%2 != 0 {
+			continue
+		}
+		housenumbers = append(housenumbers, strconv.Itoa(n))
+		positions = append(positions, float64(n-a)/float64(b-a))
+	}
+	return housenumbers, positions
+}
+
+// alphabeticHousenumbersBetween returns all house numbers between two house
+// numbers with the same number but different letters, e.g. 12b, 12c and 12d
+// for 12a and 12e. from can be without letter (12 to 12c).
+func alphabeticHousenumbersBetween(from, to string) ([]string, []float64) {
+	fromNum, fromLetter := splitHousenumber(from)
+	toNum, toLetter := splitHousenumber(to)
+	if fromNum == "" || fromNum != toNum || toLetter == 0 {
+		return nil, nil
+	}
+	upper := toLetter >= 'A' && toLetter <= 'Z'
+	if fromLetter == 0 {
+		// 12 to 12c starts with 12a
+		if upper {
+			fromLetter = 'A' - 1
+		} else {
+			fromLetter = 'a' - 1
+		}
+	} else if (fromLetter >= 'A' && fromLetter <= 'Z') != upper {
+		return nil, nil
+	}
+	if fromLetter == toLetter {
+		return nil, nil
+	}
+
+	dir := 1
+	if toLetter < fromLetter {
+		dir = -1
+	}
+
+	var housenumbers []string
+	var positions []float64
+	for l := int(fromLetter) + dir; l != int(toLetter); l += dir {
+		housenumbers = append(housenumbers, fromNum+string(rune(l)))
+		positions = append(positions, float64(l-int(fromLetter))/float64(int(toLetter)-int(fromLetter)))
+	}
+	return housenumbers, positions
+}
+
+// splitHousenumber splits house numbers like 12a into the number and the
+// letter. Returns 0 as letter if the house number has no letter, and an
+// empty number for all other house numbers.
+func splitHousenumber(hn string) (string, byte) {
+	hn = strings.TrimSpace(hn)
+	i := 0
+	for i < len(hn) && hn[i] >= '0' && hn[i] <= '9' {
+		i++
+	}
+	if i == 0 {
+		return "", 0
+	}
+	num := hn[:i]
+	rest := strings.TrimSpace(hn[i:])
+	if rest == "" {
+		return num, 0
+	}
+	if len(rest) == 1 && (rest[0] >= 'a' && rest[0] <= 'z' || rest[0] >= 'A' && rest[0] <= 'Z') {
+		return num, rest[0]
+	}
+	return "", 0
+}
+
+// pointAlong returns the coordinate at the relative position (0.0-1.0)
+// along the line of nodes.
+func pointAlong(nodes []osm.Node, position float64) (float64, float64) {
+	var total float64
+	for i := 1; i < len(nodes); i++ {
+		total += segmentLength(nodes[i-1], nodes[i])
+	}
+	if total == 0 {
+		return nodes[0].Long, nodes[0].Lat
+	}
+
+	target := total * position
+	for i := 1; i < len(nodes); i++ {
+		l := segmentLength(nodes[i-1], nodes[i])
+		if target <= l && l > 0 {
+			f := target / l
+			return nodes[i-1].Long + (nodes[i].Long-nodes[i-1].Long)*f,
+				nodes[i-1].Lat + (nodes[i].Lat-nodes[i-1].Lat)*f
+		}
+		target -= l
+	}
+	last := nodes[len(nodes)-1]
+	return last.Long, last.Lat
+}
+
+func segmentLength(a, b osm.Node) float64 {
+	return math.Hypot(b.Long-a.Long, b.Lat-a.Lat)
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
@@ -0,0 +1,69 @@
+package writer
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	osm "github.com/omniscale/go-osm"
+)
+
+func TestHousenumbersBetween(t *testing.T) {
+	for _, tc := range []struct {
+		kind      string
+		from, to  string
+		expected  []string
+		positions []float64
+	}{
+		{"all", "1", "5", []string{"2", "3", "4"}, []float64{0.25, 0.5, 0.75}},
+		{"odd", "1", "9", []string{"3", "5", "7"}, []float64{0.25, 0.5, 0.75}},
+		{"even", "10", "2", []string{"8", "6", "4"}, []float64{0.25, 0.5, 0.75}},
+		{"even", "2", "4", []string{}, nil},
+		{"odd", "1", "2", nil, nil},
+		{"all", "1", "1", nil, nil},
+		{"all", "1", "100000", nil, nil},
+		{"all", "1a", "5", nil, nil},
+		{"unknown", "1", "5", nil, nil},
+		{"alphabetic", "12a", "12e", []string{"12b", "12c", "12d"}, []float64{0.25, 0.5, 0.75}},
+		{"alphabetic", "12", "12c", []string{"12a", "12b"}, []float64{1.0 / 3, 2.0 / 3}},
+		{"alphabetic", "7D", "7A", []string{"7C", "7B"}, []float64{1.0 / 3, 2.0 / 3}},
+		{"alphabetic", "12a", "13c", nil, nil},
+		{"alphabetic", "12a", "12C", nil, nil},
+	} {
+		t.Run(tc.kind+" "+tc.from+"-"+tc.to, func(t *testing.T) {
+			housenumbers, positions := housenumbersBetween(tc.kind, tc.from, tc.to)
+			if len(housenumbers) != len(tc.expected) || (len(housenumbers) > 0 && !reflect.DeepEqual(housenumbers, tc.expected)) {
+				t.Fatalf("unexpected house numbers %v, expected %v", housenumbers, tc.expected)
+			}
+			for i := range tc.positions {
+				if math.Abs(positions[i]-tc.positions[i]) > 1e-9 {
+					t.Errorf("unexpected positions %v, expected %v", positions, tc.positions)
+				}
+			}
+		})
+	}
+}
+
+func TestInterpolateAddresses(t *testing.T) {
+	nodes := []osm.Node{
+		{Long: 0, Lat: 0},
+		{Long: 10, Lat: 0},
+		{Long: 10, Lat: 10},
+		{Long: 10, Lat: 20},
+	}
+	// address nodes at start, at the corner and at the end
+	anchors := map[int]string{0: "1", 2: "5", 3: "9"}
+
+	addrs := interpolateAddresses("odd", nodes, anchors)
+	expected := []interpolatedAddress{
+		{housenumber: "3", long: 10, lat: 0, start: 0},
+		{housenumber: "7", long: 10, lat: 15, start: 2},
+	}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("unexpected addresses %v, expected %v", addrs, expected)
+	}
+
+	if addrs := interpolateAddresses("all", nodes, map[int]string{1: "1"}); len(addrs) != 0 {
+		t.Errorf("expected no addresses with single address node, got %v", addrs)
+	}
+}
@@ -1,6 +1,7 @@
 package writer
 
 import (
+	"sort"
 	"sync"
 
 	osm "github.com/omniscale/go-osm"
@@ -22,6 +23,7 @@ type NodeWriter struct {
 
 func NewNodeWriter(
 	osmCache *cache.OSMCache,
+	diffCache *cache.DiffCache,
 	nodes chan *osm.Node,
 	inserter database.Inserter,
 	progress *stats.Statistics,
@@ -30,11 +32,12 @@ func NewNodeWriter(
 ) *OsmElemWriter {
 	nw := NodeWriter{
 		OsmElemWriter: OsmElemWriter{
-			osmCache: osmCache,
-			progress: progress,
-			wg:       &sync.WaitGroup{},
-			inserter: inserter,
-			srid:     srid,
+			osmCache:  osmCache,
+			diffCache: diffCache,
+			progress:  progress,
+			wg:        &sync.WaitGroup{},
+			inserter:  inserter,
+			srid:      srid,
 		},
 		pointMatcher: matcher,
 		nodes:        nodes,
@@ -51,7 +54,25 @@ func (nw *NodeWriter) loop() {
 	for n := range nw.nodes {
 		nw.progress.AddNodes(1)
 		if matches := nw.pointMatcher.MatchNode(n); len(matches) > 0 {
+			if err := nw.fillParentWays(n, matches); err != nil {
+				log.Println("[warn]: ", err)
+				continue
+			}
 			nw.NodeToSrid(n)
+
+			if nw.limiter == nil && !needsGeometry(matches) {
+				// fast path without GEOS
+				geom := geomp.Geometry{Wkb: geomp.NodeAsEWKBHexPoint(*n, nw.srid)}
+				if err := nw.inserter.InsertPoint(n.Element, geom, matches); err != nil {
+					log.Println("[warn]: ", err)
+					continue
+				}
+				if nw.expireor != nil {
+					expire.ExpireProjectedNode(nw.expireor, *n, nw.srid)
+				}
+				continue
+			}
+
 			point, err := geomp.Point(geos, *n)
 			if err != nil {
 				if errl, ok := err.(ErrorLevel); !ok || errl.Level() > 0 {
@@ -60,6 +81,11 @@ func (nw *NodeWriter) loop() {
 				continue
 			}
 
+			matches = acceptedGeometryMatches(geos, &n.Element, point, matches)
+			if len(matches) == 0 {
+				continue
+			}
+
 			geom, err := geomp.AsGeomElement(geos, point)
 			if err != nil {
 				log.Println("[warn]: ", err)
@@ -68,7 +94,7 @@ func (nw *NodeWriter) loop() {
 
 			inserted := false
 			if nw.limiter != nil {
-				parts, err := nw.limiter.Clip(geom.Geom)
+				parts, err := nw.limiter.Clip(geom.GeosGeom(geos))
 				if err != nil {
 					log.Println("[warn]: ", err)
 					continue
@@ -95,3 +121,38 @@ func (nw *NodeWriter) loop() {
 	}
 	nw.wg.Done()
 }
+
+// fillParentWays sets the parent ways of all matches that require the ways
+// of the node (for parent_way_tags columns). Ways are ordered by ID.
+func (nw *NodeWriter) fillParentWays(n *osm.Node, matches []mapping.Match) error {
+	needed := false
+	for i := range matches {
+		if matches[i].NeedsParentWays() {
+			needed = true
+			break
+		}
+	}
+	if !needed || nw.diffCache == nil {
+		return nil
+	}
+
+	wayIDs := nw.diffCache.Coords.Get(n.ID)
+	sort.Slice(wayIDs, func(i, j int) bool { return wayIDs[i] < wayIDs[j] })
+	var ways []*osm.Way
+	for _, id := range wayIDs {
+		w, err := nw.osmCache.Ways.GetWay(id)
+		if err != nil {
+			if err == cache.NotFound {
+				continue
+			}
+			return err
+		}
+		ways = append(ways, w)
+	}
+	for i := range matches {
+		if matches[i].NeedsParentWays() {
+			matches[i].SetParentWays(ways)
+		}
+	}
+	return nil
+}
@@ -74,30 +74,14 @@ func (rw *RelationWriter) loop() {
 	geos.SetHandleSrid(rw.srid)
 	defer geos.Finish()
 
-NextRel:
 	for r := range rw.rel {
 		rw.progress.AddRelations(1)
-		err := rw.osmCache.Ways.FillMembers(r.Members)
-		if err != nil {
+		if err := rw.fillWayMembers(r); err != nil {
 			if err != cache.NotFound {
 				log.Println("[warn]: ", err)
 			}
 			continue
 		}
-		for i, m := range r.Members {
-			if m.Way == nil {
-				continue
-			}
-			err := rw.osmCache.Coords.FillWay(m.Way)
-			if err != nil {
-				if err != cache.NotFound {
-					log.Println("[warn]: ", err)
-				}
-				continue NextRel
-			}
-			rw.NodesToSrid(m.Way.Nodes)
-			r.Members[i].Element = &m.Way.Element
-		}
 
 		// handleRelation updates r.Members but we need all of them
 		// for the diffCache
@@ -162,9 +146,15 @@ func handleMultiPolygon(rw *RelationWriter, r *osm.Relation, geos *geosp.Geos) b
 		return false
 	}
 
+	matches = acceptedGeometryMatches(geos, &r.Element, geom.Geom, matches)
+	if len(matches) == 0 {
+		// register for diff updates, see WayWriter.buildAndInsert
+		return true
+	}
+
 	if rw.limiter != nil {
 		start := time.Now()
-		parts, err := rw.limiter.Clip(geom.Geom)
+		parts, err := rw.limiter.Clip(geom.GeosGeom(geos))
 		if err != nil {
 			log.Println("[warn]: ", err)
 			return false
@@ -213,44 +203,197 @@ func handleRelation(rw *RelationWriter, r *osm.Relation, geos *geosp.Geos) bool
 	return true
 }
 
-func handleRelationMembers(rw *RelationWriter, r *osm.Relation, geos *geosp.Geos) bool {
-	relMemberMatches := rw.relationMemberMatcher.MatchRelation(r)
-	if relMemberMatches == nil {
-		return false
+// maxFlattenDepth limits the recursion of flatten_members to protect against
+// deeply nested relations. It is the number of relation levels, including
+// the matched relation.
+const maxFlattenDepth = 8
+
+// relationMember is a member of a relation_member row, with the index and
+// the parent relations (from the matched relation down to the direct
+// parent) of the member.
+type relationMember struct {
+	osm.Member
+	index   int
+	parents []int64
+}
+
+// fillWayMembers loads all way members of r, including their coordinates.
+func (rw *RelationWriter) fillWayMembers(r *osm.Relation) error {
+	if err := rw.osmCache.Ways.FillMembers(r.Members); err != nil {
+		return err
+	}
+	for i, m := range r.Members {
+		if m.Way == nil {
+			continue
+		}
+		if err := rw.osmCache.Coords.FillWay(m.Way); err != nil {
+			return err
+		}
+		rw.NodesToSrid(m.Way.Nodes)
+		r.Members[i].Element = &m.Way.Element
 	}
+	return nil
+}
+
+// fillNodeAndRelationMembers loads all node and relation members of r.
+func (rw *RelationWriter) fillNodeAndRelationMembers(r *osm.Relation) error {
 	for i, m := range r.Members {
 		if m.Type == osm.RelationMember {
 			mrel, err := rw.osmCache.Relations.GetRelation(m.ID)
 			if err != nil {
-				if err != cache.NotFound {
-					log.Println("[warn]: ", err)
-				}
-				return false
+				return err
 			}
 			r.Members[i].Element = &mrel.Element
 		} else if m.Type == osm.NodeMember {
 			nd, err := rw.osmCache.Nodes.GetNode(m.ID)
+			if err == cache.NotFound {
+				nd, err = rw.osmCache.Coords.GetCoord(m.ID)
+			}
 			if err != nil {
-				if err == cache.NotFound {
-					nd, err = rw.osmCache.Coords.GetCoord(m.ID)
-					if err != nil {
-						if err != cache.NotFound {
-							log.Println("[warn]: ", err)
-						}
-						return false
-					}
-				} else {
-					log.Println("[warn]: ", err)
-					return false
-				}
+				return err
 			}
 			rw.NodeToSrid(nd)
 			r.Members[i].Node = nd
 			r.Members[i].Element = &nd.Element
 		}
 	}
+	return nil
+}
+
+// flattenMembers appends all node and way members of r to members. Relation
+// members are replaced by their own members, recursively. Cyclic references
+// and relations below maxFlattenDepth levels are skipped.
+func (rw *RelationWriter) flattenMembers(r *osm.Relation, parents []int64, members []relationMember) ([]relationMember, error) {
+	for _, m := range r.Members {
+		if m.Type != osm.RelationMember {
+			members = append(members, relationMember{Member: m, index: len(members), parents: parents})
+			continue
+		}
+		if len(parents) >= maxFlattenDepth || containsID(parents, m.ID) {
+			continue
+		}
+		child, err := rw.osmCache.Relations.GetRelation(m.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := rw.fillWayMembers(child); err != nil {
+			return nil, err
+		}
+		if err := rw.fillNodeAndRelationMembers(child); err != nil {
+			return nil, err
+		}
+		if rw.diffCache != nil {
+			rw.diffCache.Relations.AddFromMembers(child.ID, child.Members)
+		}
+		childParents := make([]int64, len(parents), len(parents)+1)
+		copy(childParents, parents)
+		childParents = append(childParents, child.ID)
+		members, err = rw.flattenMembers(child, childParents, members)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return members, nil
+}
+
+func containsID(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func handleRelationMembers(rw *RelationWriter, r *osm.Relation, geos *geosp.Geos) bool {
+	relMemberMatches := rw.relationMemberMatcher.MatchRelation(r)
+	if relMemberMatches == nil {
+		return false
+	}
+	if err := rw.fillNodeAndRelationMembers(r); err != nil {
+		if err != cache.NotFound {
+			log.Println("[warn]: ", err)
+		}
+		return false
+	}
+
+	var matches, flattenMatches []mapping.Match
+	for _, m := range relMemberMatches {
+		if m.FlattenMembers() {
+			flattenMatches = append(flattenMatches, m)
+		} else {
+			matches = append(matches, m)
+		}
+	}
+
+	parents := []int64{r.ID}
+	if len(matches) > 0 {
+		members := make([]relationMember, len(r.Members))
+		for i, m := range r.Members {
+			members[i] = relationMember{Member: m, index: i, parents: parents}
+		}
+		if !insertRelationMembers(rw, r, members, matches, geos) {
+			return false
+		}
+	}
+
+	if len(flattenMatches) > 0 {
+		if rw.diffCache != nil {
+			rw.diffCache.Relations.AddFromMembers(r.ID, r.Members)
+		}
+		members, err := rw.flattenMembers(r, parents, nil)
+		if err != nil {
+			if err != cache.NotFound {
+				log.Println("[warn]: ", err)
+			}
+			return false
+		}
+		if !insertRelationMembers(rw, r, members, flattenMatches, geos) {
+			return false
+		}
+		rw.addFlattenedMembers(r, members)
+	}
+	return true
+}
+
+// addFlattenedMembers registers the nested members of r in the diff cache
+// and expires them, so that changes of nested members update r.
+func (rw *RelationWriter) addFlattenedMembers(r *osm.Relation, members []relationMember) {
+	var nested []osm.Member
+	for _, m := range members {
+		if len(m.parents) > 1 {
+			nested = append(nested, m.Member)
+		}
+	}
+	if len(nested) == 0 {
+		return
+	}
+	if rw.diffCache != nil {
+		rw.diffCache.Ways.AddFromMembers(r.ID, nested)
+		rw.diffCache.CoordsRel.AddFromMembers(r.ID, nested)
+		for _, m := range nested {
+			if m.Way != nil {
+				rw.diffCache.Coords.AddFromWay(m.Way)
+			}
+		}
+	}
+	if rw.expireor != nil {
+		for _, m := range nested {
+			if m.Way != nil {
+				expire.ExpireProjectedNodes(rw.expireor, m.Way.Nodes, rw.srid, true)
+			}
+		}
+	}
+}
+
+func insertRelationMembers(rw *RelationWriter, r *osm.Relation, members []relationMember, matches []mapping.Match, geos *geosp.Geos) bool {
+	for _, m := range members {
+		// filter before building the geometry
+		memberMatches := acceptedMemberMatches(matches, &m.Member)
+		if len(memberMatches) == 0 {
+			continue
+		}
 
-	for mi, m := range r.Members {
 		var g *geosp.Geom
 		var err error
 		if m.Node != nil {
@@ -277,7 +420,14 @@ func handleRelationMembers(rw *RelationWriter, r *osm.Relation, geos *geosp.Geos
 		}
 		rel := osm.Relation(*r)
 		rel.ID = rw.relID(r.ID)
-		rw.inserter.InsertRelationMember(rel, m, mi, gelem, relMemberMatches)
+		rw.inserter.InsertRelationMember(rel, m.Member, m.index, m.parents, gelem, memberMatches)
 	}
 	return true
 }
+
+// acceptedMemberMatches returns all matches that accept the member.
+func acceptedMemberMatches(matches []mapping.Match, member *osm.Member) []mapping.Match {
+	return acceptedMatches(matches, func(m *mapping.Match) bool {
+		return m.AcceptMember(member)
+	})
+}
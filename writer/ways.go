@@ -20,6 +20,7 @@ type WayWriter struct {
 	ways           chan *osm.Way
 	lineMatcher    mapping.WayMatcher
 	polygonMatcher mapping.WayMatcher
+	addrMatcher    mapping.WayMatcher
 	maxGap         float64
 }
 
@@ -32,6 +33,7 @@ func NewWayWriter(
 	progress *stats.Statistics,
 	polygonMatcher mapping.WayMatcher,
 	lineMatcher mapping.WayMatcher,
+	addrMatcher mapping.WayMatcher,
 	srid int,
 ) *OsmElemWriter {
 	maxGap := 1e-1 // 0.1m
@@ -50,6 +52,7 @@ func NewWayWriter(
 		singleIDSpace:  singleIDSpace,
 		lineMatcher:    lineMatcher,
 		polygonMatcher: polygonMatcher,
+		addrMatcher:    addrMatcher,
 		ways:           ways,
 		maxGap:         maxGap,
 	}
@@ -119,10 +122,33 @@ func (ww *WayWriter) loop() {
 			}
 		}
 
-		if (inserted || insertedPolygon) && ww.expireor != nil {
+		insertedAddresses := false
+		matchedAddresses := false
+		if matches := ww.addrMatcher.MatchWay(w); len(matches) > 0 {
+			if !fill(w) {
+				continue
+			}
+			// register for diff updates even without interpolated
+			// addresses, address nodes can be added later
+			matchedAddresses = true
+			err, insertedAddresses = ww.insertInterpolatedAddresses(geos, w, matches)
+			if err != nil {
+				if errl, ok := err.(ErrorLevel); !ok || errl.Level() > 0 {
+					log.Println("[warn]: ", err)
+				}
+				continue
+			}
+		}
+
+		if (inserted || insertedPolygon || insertedAddresses) && ww.expireor != nil {
 			expire.ExpireProjectedNodes(ww.expireor, w.Nodes, ww.srid, insertedPolygon)
 		}
-		if (inserted || insertedPolygon) && ww.diffCache != nil {
+		registered := inserted || insertedPolygon || matchedAddresses
+		if !registered && ww.diffCache != nil && ww.parentWayKeys.Match(w.Tags) {
+			// parent way of nodes with parent_way_tags columns
+			registered = fill(w)
+		}
+		if registered && ww.diffCache != nil {
 			ww.diffCache.Coords.AddFromWay(w)
 		}
 	}
@@ -140,6 +166,18 @@ func (ww *WayWriter) buildAndInsert(
 	way := osm.Way(*w)
 	way.ID = ww.wayID(way.ID)
 
+	if !isPolygon && ww.limiter == nil && !needsGeometry(matches) {
+		// fast path without GEOS
+		wkb, err := geomp.NodesAsEWKBHexLineString(way.Nodes, ww.srid)
+		if err != nil {
+			return err, false
+		}
+		if err := ww.inserter.InsertLineString(way.Element, geomp.Geometry{Wkb: wkb}, matches); err != nil {
+			return err, false
+		}
+		return nil, true
+	}
+
 	var err error
 	var geosgeom *geos.Geom
 
@@ -155,6 +193,13 @@ func (ww *WayWriter) buildAndInsert(
 		return err, false
 	}
 
+	matches = acceptedGeometryMatches(g, &way.Element, geosgeom, matches)
+	if len(matches) == 0 {
+		// still report as inserted to register the way for diff updates,
+		// modified nodes can change the result of the geometry filters
+		return nil, true
+	}
+
 	geom, err := geomp.AsGeomElement(g, geosgeom)
 	if err != nil {
 		return err, false
@@ -162,7 +207,7 @@ func (ww *WayWriter) buildAndInsert(
 
 	inserted := true
 	if ww.limiter != nil {
-		parts, err := ww.limiter.Clip(geom.Geom)
+		parts, err := ww.limiter.Clip(geom.GeosGeom(g))
 		if err != nil {
 			return err, false
 		}
@@ -195,3 +240,66 @@ func (ww *WayWriter) buildAndInsert(
 	}
 	return nil, inserted
 }
+
+// insertInterpolatedAddresses inserts a point for each house number between
+// the address nodes of an addr:interpolation way.
+func (ww *WayWriter) insertInterpolatedAddresses(
+	g *geos.Geos,
+	w *osm.Way,
+	matches []mapping.Match,
+) (error, bool) {
+	anchors := make(map[int]string)
+	anchorTags := make(map[int]osm.Tags)
+	for i, ref := range w.Refs {
+		nd, err := ww.osmCache.Nodes.GetNode(ref)
+		if err == cache.NotFound {
+			continue
+		}
+		if err != nil {
+			return err, false
+		}
+		if hn, ok := nd.Tags["addr:housenumber"]; ok {
+			anchors[i] = hn
+			anchorTags[i] = nd.Tags
+		}
+	}
+
+	inserted := false
+	for _, addr := range interpolateAddresses(w.Tags["addr:interpolation"], w.Nodes, anchors) {
+		// tags of the way (e.g. addr:street) take precedence over the tags
+		// of the address node
+		tags := make(osm.Tags, len(w.Tags)+len(anchorTags[addr.start]))
+		for k, v := range anchorTags[addr.start] {
+			tags[k] = v
+		}
+		for k, v := range w.Tags {
+			tags[k] = v
+		}
+		tags["addr:housenumber"] = addr.housenumber
+
+		point, err := geomp.Point(g, osm.Node{Long: addr.long, Lat: addr.lat})
+		if err != nil {
+			return err, inserted
+		}
+		geom, err := geomp.AsGeomElement(g, point)
+		if err != nil {
+			return err, inserted
+		}
+		if ww.limiter != nil {
+			parts, err := ww.limiter.Clip(geom.GeosGeom(g))
+			if err != nil {
+				return err, inserted
+			}
+			if len(parts) == 0 {
+				continue
+			}
+		}
+
+		elem := osm.Element{ID: ww.wayID(w.ID), Tags: tags}
+		if err := ww.inserter.InsertPoint(elem, geom, matches); err != nil {
+			return err, inserted
+		}
+		inserted = true
+	}
+	return nil, inserted
+}
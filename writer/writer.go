@@ -8,7 +8,9 @@ import (
 	"github.com/omniscale/imposm3/cache"
 	"github.com/omniscale/imposm3/database"
 	"github.com/omniscale/imposm3/expire"
+	"github.com/omniscale/imposm3/geom/geos"
 	"github.com/omniscale/imposm3/geom/limit"
+	"github.com/omniscale/imposm3/mapping"
 	"github.com/omniscale/imposm3/proj"
 	"github.com/omniscale/imposm3/stats"
 )
@@ -32,6 +34,9 @@ type OsmElemWriter struct {
 	srid       int
 	expireor   expire.Expireor
 	concurrent bool
+	// parentWayKeys of ways that are registered as parent ways of their
+	// nodes, only used by the WayWriter.
+	parentWayKeys mapping.ParentWayKeys
 }
 
 func (writer *OsmElemWriter) SetLimiter(limiter *limit.Limiter) {
@@ -57,6 +62,12 @@ func (writer *OsmElemWriter) SetExpireor(exp expire.Expireor) {
 	writer.expireor = exp
 }
 
+// SetParentWayKeys registers all ways with one of the keys in the node to
+// way references of the diff cache, for parent_way_tags columns.
+func (writer *OsmElemWriter) SetParentWayKeys(keys mapping.ParentWayKeys) {
+	writer.parentWayKeys = keys
+}
+
 func (writer *OsmElemWriter) Wait() {
 	writer.wg.Wait()
 }
@@ -83,3 +94,41 @@ func (writer *OsmElemWriter) NodeToSrid(node *osm.Node) {
 	}
 	node.Long, node.Lat = proj.WgsToMerc(node.Long, node.Lat)
 }
+
+// acceptedMatches returns all matches for which accept returns true.
+// Returns matches unchanged if all matches are accepted.
+func acceptedMatches(matches []mapping.Match, accept func(m *mapping.Match) bool) []mapping.Match {
+	for i := range matches {
+		if accept(&matches[i]) {
+			continue
+		}
+		// at least one match is rejected, collect the remaining
+		accepted := make([]mapping.Match, 0, len(matches)-1)
+		accepted = append(accepted, matches[:i]...)
+		for j := i + 1; j < len(matches); j++ {
+			if accept(&matches[j]) {
+				accepted = append(accepted, matches[j])
+			}
+		}
+		return accepted
+	}
+	return matches
+}
+
+// acceptedGeometryMatches returns all matches that accept the geometry of
+// elem.
+func acceptedGeometryMatches(g *geos.Geos, elem *osm.Element, geom *geos.Geom, matches []mapping.Match) []mapping.Match {
+	return acceptedMatches(matches, func(m *mapping.Match) bool {
+		return m.AcceptGeometry(g, elem, geom)
+	})
+}
+
+// needsGeometry returns whether any match requires the GEOS geometry.
+func needsGeometry(matches []mapping.Match) bool {
+	for i := range matches {
+		if matches[i].NeedsGeometry() {
+			return true
+		}
+	}
+	return false
+}